@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
@@ -13,11 +15,20 @@ import (
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/qcom/qcom/internal/apierror"
 	"github.com/qcom/qcom/internal/config"
+	"github.com/qcom/qcom/internal/delivery"
+	"github.com/qcom/qcom/internal/email"
+	"github.com/qcom/qcom/internal/events"
+	"github.com/qcom/qcom/internal/fieldcrypt"
 	"github.com/qcom/qcom/internal/handlers"
+	"github.com/qcom/qcom/internal/identifier"
 	"github.com/qcom/qcom/internal/middleware"
 	"github.com/qcom/qcom/internal/repository"
 	"github.com/qcom/qcom/internal/service"
+	"github.com/qcom/qcom/internal/tracing"
+	"github.com/qcom/qcom/internal/version"
 	"github.com/sirupsen/logrus"
 )
 
@@ -31,15 +42,36 @@ func main() {
 		logger.WithError(err).Fatal("Failed to load configuration")
 	}
 
+	apierror.UseProblemDetails(cfg.Server.ProblemDetails)
+	if err := apierror.LoadMessages(cfg.Server.ErrorMessagesDir); err != nil {
+		logger.WithError(err).Fatal("Failed to load error messages")
+	}
+
+	shutdownTracing, err := tracing.Init(context.Background(), &cfg.Tracing, logger)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to initialize tracing")
+	}
+
 	dynamoClient, err := initDynamoDB(cfg, logger)
 	if err != nil {
 		logger.WithError(err).Fatal("Failed to initialize DynamoDB")
 	}
 
 	// Initialize repositories
-	userRepo := repository.NewUserRepository(dynamoClient, cfg.DynamoDB.TableName, logger)
-	otpRepo := repository.NewOTPRepository(dynamoClient, cfg.DynamoDB.TableName, logger)
-	refreshTokenRepo := repository.NewRefreshTokenRepository(dynamoClient, cfg.DynamoDB.TableName, logger)
+	keys := repository.KeySchema{PK: cfg.DynamoDB.PKName, SK: cfg.DynamoDB.SKName}
+	fieldCipher, err := fieldcrypt.New(cfg.Encryption.Keys, cfg.Encryption.CurrentKeyID)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to initialize field encryption")
+	}
+
+	userRepo := repository.NewUserRepository(dynamoClient, cfg.DynamoDB.UsersTable, keys, cfg.DynamoDB.StronglyConsistentReads, cfg.DynamoDB.CreateRetries, fieldCipher, logger)
+	otpRepo := repository.NewOTPRepository(dynamoClient, cfg.DynamoDB.OTPTable, cfg.DynamoDB.TableName, keys, logger)
+	refreshTokenRepo := repository.NewRefreshTokenRepository(dynamoClient, cfg.DynamoDB.TokensTable, keys, logger)
+	auditRepo := repository.NewAuditRepository(dynamoClient, cfg.DynamoDB.TableName, keys, logger)
+	diagnosticsRepo := repository.NewDiagnosticsRepository(dynamoClient, cfg.DynamoDB.UsersTable, cfg.DynamoDB.TokensTable, cfg.DynamoDB.OTPTable, keys, logger)
+	tokenRevocationRepo := repository.NewTokenRevocationRepository(dynamoClient, cfg.DynamoDB.TokensTable, keys, logger)
+	rateLimitRepo := repository.NewRateLimitRepository(dynamoClient, cfg.DynamoDB.TableName, keys, logger)
+	accountLockRepo := repository.NewAccountLockRepository(dynamoClient, cfg.DynamoDB.TableName, keys, logger)
 
 	// Initialize services
 	jwtService, err := service.NewJWTService(&cfg.JWT, logger)
@@ -47,19 +79,103 @@ func main() {
 		logger.WithError(err).Fatal("Failed to initialize JWT service")
 	}
 
-	otpService := service.NewOTPService(otpRepo, &cfg.OTP, logger)
-	refreshTokenService := service.NewRefreshTokenService(refreshTokenRepo, logger)
+	otpSender, err := delivery.NewSender(&cfg.Delivery, cfg.OTP.Expiry, logger)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to initialize OTP delivery")
+	}
+
+	var asyncSender *delivery.AsyncSender
+	if cfg.Delivery.Workers > 0 {
+		asyncSender = delivery.NewAsyncSender(otpSender, cfg.Delivery.PrimaryChannel(), cfg.Delivery.Workers, cfg.Delivery.QueueSize, logger)
+		otpSender = asyncSender
+	}
+
+	otpService := service.NewOTPService(otpRepo, rateLimitRepo, otpSender, &cfg.OTP, logger)
+	refreshTokenService := service.NewRefreshTokenService(
+		refreshTokenRepo,
+		cfg.JWT.RefreshTokenStorage == config.TokenStorageLenient,
+		cfg.JWT.ReuseGraceWindow,
+		cfg.JWT.MaxRefreshChain,
+		logger,
+	)
+
+	if cfg.DynamoDB.BackfillFamilyIndex {
+		if err := refreshTokenService.BackfillFamilyIndex(context.Background()); err != nil {
+			logger.WithError(err).Fatal("Failed to backfill refresh token family index")
+		}
+	}
+
+	if cfg.Server.SelfTest != config.SelfTestOff {
+		runSelfTest(cfg, jwtService, otpService, userRepo, logger)
+	}
+
+	revocationService := service.NewTokenRevocationService(tokenRevocationRepo, logger)
+	accountLockService := service.NewAccountLockService(accountLockRepo, cfg.JWT.ReuseLockoutThreshold, cfg.JWT.ReuseLockoutWindow, cfg.JWT.ReuseLockoutDuration, logger)
+
+	var eventPublisher events.Publisher = events.Nop{}
+	var asyncPublisher *events.AsyncPublisher
+	if cfg.Events.Publisher != config.EventsPublisherNone {
+		awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO())
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to load AWS config for events")
+		}
+		publisher, err := events.NewPublisher(&cfg.Events, awsCfg)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to initialize events publisher")
+		}
+		asyncPublisher = events.NewAsyncPublisher(publisher, cfg.Events.QueueSize, logger)
+		eventPublisher = asyncPublisher
+	}
+
+	// Only phone numbers have a delivery channel; other kinds can be
+	// accepted but are refused until one exists.
+	identifierKinds := make([]identifier.Kind, 0, len(cfg.OTP.IdentifierKinds))
+	for _, kind := range cfg.OTP.IdentifierKinds {
+		identifierKinds = append(identifierKinds, identifier.Kind(kind))
+	}
+	identifierRouter := identifier.NewRouter(identifierKinds, map[identifier.Kind]string{
+		identifier.KindPhone: cfg.Delivery.PrimaryChannel(),
+	}, email.Policy{})
+
+	// Browser sessions are started by the OTP page, so only accepted with it.
+	var sessionCookies *handlers.SessionCookies
+	if cfg.Server.OTPPage {
+		sessionCookies = &handlers.SessionCookies{TrustedProxies: cfg.Server.TrustedProxies, ForceSecure: cfg.Server.ForceSecureCookies}
+	}
 
 	authHandlers := handlers.NewAuthHandlers(
 		otpService,
 		jwtService,
 		refreshTokenService,
+		revocationService,
+		accountLockService,
+		identifierRouter,
 		userRepo,
+		eventPublisher,
+		cfg.Delivery.LogsOTPs(),
+		sessionCookies,
 		logger,
 	)
 
-	authMiddleware := middleware.NewAuthMiddleware(jwtService, logger)
-	router := setupRouter(authHandlers, authMiddleware, logger)
+	var otpPageHandlers *handlers.OTPPageHandlers
+	if cfg.Server.OTPPage {
+		otpPageHandlers, err = handlers.NewOTPPageHandlers(authHandlers, cfg.Server.OTPPageTemplate, sessionCookies, logger)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to load OTP page template")
+		}
+	}
+
+	exportHandlers := handlers.NewExportHandlers(userRepo, refreshTokenService, auditRepo, cfg.Server.DataExportSections, logger)
+
+	authStateService := service.NewAuthStateService(userRepo, otpRepo, rateLimitRepo, refreshTokenService, revocationService, accountLockService, logger)
+	maintenanceRepo := repository.NewMaintenanceRepository(dynamoClient, cfg.DynamoDB.TableName, keys, logger)
+	maintenance := middleware.NewMaintenance(maintenanceRepo, cfg.Server.Maintenance, cfg.Server.MaintenanceRetryAfter, logger,
+		"/health", "/ready", "/.well-known/jwks.json", "/api/v1/admin/maintenance", "/debug/health")
+	adminHandlers := handlers.NewAdminHandlers(auditRepo, diagnosticsRepo, authStateService, revocationService, accountLockService, otpService, eventPublisher, maintenance, logger)
+
+	authMiddleware := middleware.NewAuthMiddleware(jwtService, revocationService, cfg.Server.OTPPage, logger)
+	readiness := &handlers.Readiness{}
+	router := setupRouter(cfg, authHandlers, adminHandlers, exportHandlers, otpPageHandlers, authMiddleware, maintenance, readiness, logger)
 
 	srv := &http.Server{
 		Addr:         ":" + cfg.Server.Port,
@@ -68,13 +184,42 @@ func main() {
 		WriteTimeout: cfg.Server.WriteTimeout,
 	}
 
+	if cfg.Server.TLSCertFile != "" {
+		srv.TLSConfig, err = newTLSConfig(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to load TLS certificate")
+		}
+	}
+
 	go func() {
-		logger.WithField("port", cfg.Server.Port).Info("Starting server")
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.WithFields(logrus.Fields{
+			"port":    cfg.Server.Port,
+			"tls":     srv.TLSConfig != nil,
+			"version": version.Version,
+			"commit":  version.Commit,
+		}).Info("Starting server")
+
+		var err error
+		if srv.TLSConfig != nil {
+			// The certificate is already in TLSConfig.
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.WithError(err).Fatal("Server failed to start")
 		}
 	}()
 
+	// The listener is up, so /health answers while warm-up runs; /ready
+	// only does once it has finished.
+	go func() {
+		if cfg.DynamoDB.WarmUp {
+			warmUpDynamoDB(cfg, dynamoClient, logger)
+		}
+		readiness.SetReady()
+	}()
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -87,9 +232,89 @@ func main() {
 		logger.WithError(err).Fatal("Server forced to shutdown")
 	}
 
+	if asyncSender != nil {
+		if err := asyncSender.Shutdown(ctx); err != nil {
+			logger.WithError(err).Error("Timed out delivering queued OTPs")
+		}
+	}
+
+	if asyncPublisher != nil {
+		if err := asyncPublisher.Shutdown(ctx); err != nil {
+			logger.WithError(err).Error("Timed out publishing queued events")
+		}
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		logger.WithError(err).Error("Failed to flush traces")
+	}
+
 	logger.Info("Server exited")
 }
 
+// newTLSConfig loads the certificate and key and returns a TLS config that
+// accepts TLS 1.2 and later only, with forward-secret AEAD cipher suites.
+// TLS 1.3 suites are not configurable and are all strong. HTTP/2 is still
+// negotiated, since its required suite is included.
+func newTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// runSelfTest exercises token signing, OTP hashing and the users table, and
+// exits if any check fails in strict mode.
+func runSelfTest(cfg *config.Config, jwtService *service.JWTService, otpService *service.OTPService, userRepo *repository.UserRepository, logger *logrus.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := service.RunStartupChecks(ctx, []service.StartupCheck{
+		{Name: "jwt", Run: jwtService.SelfTest},
+		{Name: "otp", Run: otpService.SelfTest},
+		{Name: "users_table", Run: userRepo.SelfTest},
+	}, logger)
+	if err == nil {
+		logger.Info("Startup self-test passed")
+		return
+	}
+	if cfg.Server.SelfTest == config.SelfTestStrict {
+		logger.WithError(err).Fatal("Startup self-test failed")
+	}
+	logger.WithError(err).Warn("Startup self-test failed, starting anyway")
+}
+
+// warmUpDynamoDB opens connections to every configured table. A failure is
+// logged but not fatal: warm-up only saves latency, and requests will retry
+// the connection themselves.
+func warmUpDynamoDB(cfg *config.Config, client *dynamodb.Client, logger *logrus.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DynamoDB.WarmUpTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := repository.WarmUp(ctx, client,
+		cfg.DynamoDB.TableName, cfg.DynamoDB.UsersTable, cfg.DynamoDB.TokensTable, cfg.DynamoDB.OTPTable)
+	entry := logger.WithField("duration_ms", time.Since(start).Milliseconds())
+	if err != nil {
+		entry.WithError(err).Warn("DynamoDB warm-up failed")
+		return
+	}
+	entry.Info("DynamoDB warm-up complete")
+}
+
 func initDynamoDB(cfg *config.Config, logger *logrus.Logger) (*dynamodb.Client, error) {
 	var awsCfg aws.Config
 	var err error
@@ -113,42 +338,126 @@ func initDynamoDB(cfg *config.Config, logger *logrus.Logger) (*dynamodb.Client,
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
-	client := dynamodb.NewFromConfig(awsCfg)
+	opts := []func(*dynamodb.Options){repository.WithLatencyMetrics()}
+	if cfg.DynamoDB.OpTimeout > 0 {
+		opts = append(opts, repository.WithDefaultTimeout(cfg.DynamoDB.OpTimeout))
+	}
+	client := dynamodb.NewFromConfig(awsCfg, opts...)
 	logger.Info("DynamoDB client initialized")
 	return client, nil
 }
 
 func setupRouter(
+	cfg *config.Config,
 	authHandlers *handlers.AuthHandlers,
+	adminHandlers *handlers.AdminHandlers,
+	exportHandlers *handlers.ExportHandlers,
+	otpPageHandlers *handlers.OTPPageHandlers,
 	authMiddleware *middleware.AuthMiddleware,
+	maintenance *middleware.Maintenance,
+	readiness *handlers.Readiness,
 	logger *logrus.Logger,
 ) *mux.Router {
 	router := mux.NewRouter()
 
-	router.Use(middleware.CORSMiddleware)
-	router.Use(middleware.LoggingMiddleware(logger))
+	cors := middleware.NewCORSMiddleware(cfg.Server.CORSMaxAge, cfg.Server.CORSExposeHeaders)
+
+	// Router middleware doesn't run when no route matches, so these need
+	// CORS applied directly.
+	router.NotFoundHandler = cors(handlers.UnmatchedRoute(router))
+	router.MethodNotAllowedHandler = cors(http.HandlerFunc(handlers.MethodNotAllowed))
+
+	router.Use(middleware.TracingMiddleware)
+	router.Use(cors)
+	router.Use(middleware.LoggingMiddleware(logger, cfg.Server.TrustedProxies))
+	router.Use(maintenance.Middleware)
+	if len(cfg.Server.RateLimitBypassKeys) > 0 || len(cfg.Server.RateLimitBypassCIDRs) > 0 {
+		router.Use(middleware.RateLimitBypass(cfg.Server.RateLimitBypassKeys, cfg.Server.RateLimitBypassCIDRs, cfg.Server.TrustedProxies))
+	}
+	if len(cfg.Server.DeprecatedRoutes) > 0 {
+		router.Use(middleware.Deprecation(cfg.Server.DeprecatedRoutes))
+	}
+	if cfg.Server.Compression {
+		router.Use(middleware.CompressionMiddleware(cfg.Server.CompressionMinSize))
+	}
+	router.Use(middleware.JSONCase(cfg.Server.JSONFieldCase == config.JSONCaseCamel))
 
 	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	}).Methods("GET", "OPTIONS")
 
+	router.Handle("/ready", readiness).Methods("GET", "OPTIONS")
+
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	router.HandleFunc("/.well-known/jwks.json", authHandlers.JWKS).Methods("GET")
+
+	router.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(version.Get())
+	}).Methods("GET")
+
+	// The OTP page is HTML, outside the JSON API.
+	if otpPageHandlers != nil {
+		router.HandleFunc("/auth/otp", otpPageHandlers.Show).Methods("GET")
+		router.HandleFunc("/auth/otp", otpPageHandlers.Submit).Methods("POST")
+	}
+
 	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/errors", authHandlers.ListErrorCodes).Methods("GET", "OPTIONS")
 
 	auth := api.PathPrefix("/auth").Subrouter()
 	auth.HandleFunc("/initiate-otp", authHandlers.InitiateOTP).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/initiate-otp/batch", authHandlers.InitiateOTPBatch).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/otp/status", authHandlers.OTPStatus).Methods("GET", "OPTIONS")
 	auth.HandleFunc("/verify-otp", authHandlers.VerifyOTP).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/verify-and-set-name", authHandlers.VerifyAndSetName).Methods("POST", "OPTIONS")
 	auth.HandleFunc("/refresh", authHandlers.RefreshToken).Methods("POST", "OPTIONS")
-	auth.HandleFunc("/logout", authHandlers.Logout).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/token-exchange", authHandlers.TokenExchange).Methods("POST", "OPTIONS")
+	auth.Handle("/logout", authMiddleware.RequireLogoutAuth(http.HandlerFunc(authHandlers.Logout))).Methods("POST", "OPTIONS")
+	auth.Handle("/validate", authMiddleware.RequireAuth(http.HandlerFunc(authHandlers.ValidateToken))).Methods("GET")
+	if cfg.JWT.GuestSessions {
+		auth.HandleFunc("/guest", authHandlers.GuestLogin).Methods("POST", "OPTIONS")
+		auth.Handle("/upgrade", authMiddleware.RequireGuestAuth(http.HandlerFunc(authHandlers.UpgradeGuest))).Methods("POST")
+	}
+
+	if cfg.Server.AdminAPIKey != "" {
+		admin := api.PathPrefix("/admin").Subrouter()
+		useAdminMiddleware(admin, cfg)
+		admin.HandleFunc("/audit", adminHandlers.QueryAudit).Methods("GET")
+		admin.HandleFunc("/query", adminHandlers.RunQuery).Methods("GET")
+		admin.HandleFunc("/auth-state", adminHandlers.PurgeAuthState).Methods("DELETE")
+		admin.HandleFunc("/token-epoch/user", adminHandlers.RevokeUserTokens).Methods("PUT")
+		admin.HandleFunc("/token-epoch/global", adminHandlers.RevokeAllTokens).Methods("PUT")
+		admin.HandleFunc("/account-lock", adminHandlers.UnlockAccount).Methods("DELETE")
+		admin.HandleFunc("/otp-pepper", adminHandlers.RotateOTPPepper).Methods("PUT")
+		admin.HandleFunc("/maintenance", adminHandlers.GetMaintenance).Methods("GET")
+		admin.HandleFunc("/maintenance", adminHandlers.SetMaintenance).Methods("PUT")
+
+		debug := router.PathPrefix("/debug").Subrouter()
+		useAdminMiddleware(debug, cfg)
+		debug.HandleFunc("/health", adminHandlers.DebugHealth).Methods("GET")
+	}
 
 	protected := api.PathPrefix("/").Subrouter()
-	protected.Use(authMiddleware.RequireAuth)
-	protected.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
-		phone := r.Context().Value("phone").(string)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf(`{"phone":"%s"}`, phone)))
-	}).Methods("GET")
+	protected.Use(authMiddleware.RequireWebSocketAuth)
+	protected.Handle("/sessions/rotate", authMiddleware.RequireRecentAuth(cfg.JWT.ReauthMaxAge)(http.HandlerFunc(authHandlers.RotateSessions))).Methods("POST")
+	protected.HandleFunc("/me", authHandlers.Me).Methods("GET")
+	protected.HandleFunc("/me", authHandlers.UpdateMe).Methods("PATCH")
+	protected.Handle("/me/export", authMiddleware.RequireRecentAuth(cfg.JWT.ReauthMaxAge)(http.HandlerFunc(exportHandlers.Export))).Methods("GET")
 
 	return router
 }
+
+// useAdminMiddleware guards router like the admin API: network
+// restrictions, the admin key and, when configured, request signatures.
+func useAdminMiddleware(router *mux.Router, cfg *config.Config) {
+	if len(cfg.Server.AdminAllowedCIDRs) > 0 || len(cfg.Server.AdminBlockedCIDRs) > 0 {
+		router.Use(middleware.RestrictNetworks(cfg.Server.AdminAllowedCIDRs, cfg.Server.AdminBlockedCIDRs, cfg.Server.TrustedProxies))
+	}
+	router.Use(middleware.RequireAdminKey(cfg.Server.AdminAPIKey))
+	if cfg.Server.SigningSecret != "" {
+		router.Use(middleware.SignatureMiddleware(cfg.Server.SigningSecret, cfg.Server.SigningWindow))
+	}
+}
@@ -0,0 +1,138 @@
+package apierror
+
+import "net/http"
+
+// Code is a machine-readable error code returned in the "code" field of
+// every error response.
+type Code string
+
+const (
+	CodeNotFound                 Code = "NOT_FOUND"
+	CodeMethodNotAllowed         Code = "METHOD_NOT_ALLOWED"
+	CodeInvalidRequest           Code = "INVALID_REQUEST"
+	CodeInvalidPhone             Code = "INVALID_PHONE"
+	CodePhoneHasExtension        Code = "PHONE_HAS_EXTENSION"
+	CodeCountryNotSupported      Code = "COUNTRY_NOT_SUPPORTED"
+	CodeInvalidIdentifier        Code = "INVALID_IDENTIFIER"
+	CodeIdentifierNotSupported   Code = "IDENTIFIER_NOT_SUPPORTED"
+	CodeInvalidOTPFormat         Code = "INVALID_OTP_FORMAT"
+	CodeInvalidOTP               Code = "INVALID_OTP"
+	CodeInvalidOrExpiredOTP      Code = "INVALID_OR_EXPIRED_OTP"
+	CodeInvalidNonce             Code = "INVALID_NONCE"
+	CodeInvalidName              Code = "INVALID_NAME"
+	CodeInvalidPushToken         Code = "INVALID_PUSH_TOKEN"
+	CodeInvalidFields            Code = "INVALID_FIELDS"
+	CodeMissingToken             Code = "MISSING_TOKEN"
+	CodeInvalidToken             Code = "INVALID_TOKEN"
+	CodeInvalidTokenType         Code = "INVALID_TOKEN_TYPE"
+	CodeTokenRevoked             Code = "TOKEN_REVOKED"
+	CodeReauthRequired           Code = "REAUTH_REQUIRED"
+	CodeUnauthorized             Code = "UNAUTHORIZED"
+	CodeInvalidAudience          Code = "INVALID_AUDIENCE"
+	CodeInvalidScope             Code = "INVALID_SCOPE"
+	CodeForbidden                Code = "FORBIDDEN"
+	CodeInvalidCSRFToken         Code = "INVALID_CSRF_TOKEN"
+	CodeInvalidSignature         Code = "INVALID_SIGNATURE"
+	CodeInternalError            Code = "INTERNAL_ERROR"
+	CodeOTPGenerationFailed      Code = "OTP_GENERATION_FAILED"
+	CodeOTPAlreadySent           Code = "OTP_ALREADY_SENT"
+	CodeOTPAttemptsExhausted     Code = "OTP_ATTEMPTS_EXHAUSTED"
+	CodeGenerationInProgress     Code = "GENERATION_IN_PROGRESS"
+	CodePepperRotationInProgress Code = "PEPPER_ROTATION_IN_PROGRESS"
+	CodePreconditionFailed       Code = "PRECONDITION_FAILED"
+	CodeAccountLocked            Code = "ACCOUNT_LOCKED"
+	CodeItemTooLarge             Code = "ITEM_TOO_LARGE"
+	CodeRequestTooLarge          Code = "REQUEST_TOO_LARGE"
+	CodeServiceBusy              Code = "SERVICE_BUSY"
+	CodeServiceUnavailable       Code = "SERVICE_UNAVAILABLE"
+	CodeMaintenance              Code = "MAINTENANCE"
+	CodeRateLimited              Code = "RATE_LIMITED"
+	CodeUserCreationFailed       Code = "USER_CREATION_FAILED"
+	CodeTokenGenerationFailed    Code = "TOKEN_GENERATION_FAILED"
+	CodeTokenStorageFailed       Code = "TOKEN_STORAGE_FAILED"
+)
+
+// Entry describes a single error code in the catalog.
+type Entry struct {
+	Code        Code   `json:"code"`
+	Status      int    `json:"status"`
+	Description string `json:"description"`
+}
+
+var catalog = []Entry{
+	{CodeNotFound, http.StatusNotFound, "No route matches the request path"},
+	{CodeMethodNotAllowed, http.StatusMethodNotAllowed, "The route exists but does not accept the request method"},
+	{CodeInvalidRequest, http.StatusBadRequest, "Invalid request body or parameters"},
+	{CodeInvalidPhone, http.StatusBadRequest, "Invalid phone number format"},
+	{CodePhoneHasExtension, http.StatusBadRequest, "Phone number has an extension, which cannot receive SMS"},
+	{CodeCountryNotSupported, http.StatusBadRequest, "OTPs cannot be sent to the phone number's country"},
+	{CodeInvalidIdentifier, http.StatusBadRequest, "Invalid email address or username"},
+	{CodeIdentifierNotSupported, http.StatusBadRequest, "Signing in with this kind of identifier is not supported"},
+	{CodeInvalidOTPFormat, http.StatusBadRequest, "OTP does not match the expected format"},
+	{CodeInvalidOTP, http.StatusUnauthorized, "Invalid or expired OTP"},
+	{CodeInvalidOrExpiredOTP, http.StatusUnauthorized, "OTP verification failed"},
+	{CodeInvalidNonce, http.StatusUnauthorized, "Verification nonce is missing, invalid or already used"},
+	{CodeInvalidName, http.StatusBadRequest, "Name is too long or contains control characters"},
+	{CodeInvalidPushToken, http.StatusBadRequest, "Push token is too long or contains invalid characters"},
+	{CodeInvalidFields, http.StatusBadRequest, "The fields parameter names an unknown field"},
+	{CodeMissingToken, http.StatusBadRequest, "A required token was not provided"},
+	{CodeInvalidToken, http.StatusUnauthorized, "Token is malformed, expired, or has an invalid signature"},
+	{CodeInvalidTokenType, http.StatusUnauthorized, "Token is valid but of the wrong type for this endpoint"},
+	{CodeTokenRevoked, http.StatusUnauthorized, "Token has been revoked"},
+	{CodeReauthRequired, http.StatusUnauthorized, "The route requires a recent OTP verification; verify again and retry with the new token"},
+	{CodeUnauthorized, http.StatusUnauthorized, "Missing or invalid authentication token"},
+	{CodeInvalidAudience, http.StatusForbidden, "Requested audience is not permitted for token exchange"},
+	{CodeInvalidScope, http.StatusForbidden, "Requested scope is not held by the user"},
+	{CodeInvalidSignature, http.StatusUnauthorized, "Request signature is missing, invalid, or its timestamp is stale"},
+	{CodeForbidden, http.StatusForbidden, "Caller is not permitted to access this resource"},
+	{CodeInvalidCSRFToken, http.StatusForbidden, "A write authenticated by session cookie must echo the CSRF cookie in X-CSRF-Token"},
+	{CodeInternalError, http.StatusInternalServerError, "Unexpected server error"},
+	{CodeOTPGenerationFailed, http.StatusInternalServerError, "Failed to generate OTP"},
+	{CodeMaintenance, http.StatusServiceUnavailable, "The service is down for maintenance; retry after the Retry-After interval"},
+	{CodeServiceBusy, http.StatusServiceUnavailable, "Too many OTPs are being sent right now; try again shortly"},
+	{CodeServiceUnavailable, http.StatusServiceUnavailable, "A check the request depends on could not be completed; retry shortly"},
+	{CodeRateLimited, http.StatusTooManyRequests, "Too many requests for this phone number; slow down"},
+	{CodeOTPAlreadySent, http.StatusTooManyRequests, "An unexpired OTP was already sent; retry after the resend cooldown"},
+	{CodeOTPAttemptsExhausted, http.StatusTooManyRequests, "The OTP attempts for this phone number are used up; retry after the Retry-After interval"},
+	{CodeGenerationInProgress, http.StatusConflict, "Another request is already sending an OTP to this phone number"},
+	{CodePepperRotationInProgress, http.StatusConflict, "The previous OTP pepper is still accepted, so the pepper cannot be rotated yet"},
+	{CodePreconditionFailed, http.StatusPreconditionFailed, "The resource was modified since it was read; read it again and retry"},
+	{CodeAccountLocked, http.StatusLocked, "The account is locked after suspicious activity; retry after the Retry-After interval or contact support"},
+	{CodeItemTooLarge, http.StatusRequestEntityTooLarge, "The record would exceed the storage size limit"},
+	{CodeRequestTooLarge, http.StatusRequestEntityTooLarge, "The request body exceeds the size limit"},
+	{CodeUserCreationFailed, http.StatusInternalServerError, "Failed to create user"},
+	{CodeTokenGenerationFailed, http.StatusInternalServerError, "Failed to generate tokens"},
+	{CodeTokenStorageFailed, http.StatusInternalServerError, "Tokens were generated but could not be stored; nothing was issued"},
+}
+
+var entryByCode = func() map[Code]Entry {
+	m := make(map[Code]Entry, len(catalog))
+	for _, e := range catalog {
+		m[e.Code] = e
+	}
+	return m
+}()
+
+// Catalog returns every error code the API can return.
+func Catalog() []Entry {
+	entries := make([]Entry, len(catalog))
+	copy(entries, catalog)
+	return entries
+}
+
+// Status returns the HTTP status associated with the code, or 500 if the
+// code is not in the catalog.
+func (c Code) Status() int {
+	if e, ok := entryByCode[c]; ok {
+		return e.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// Description returns the catalog description of the code.
+func (c Code) Description() string {
+	if e, ok := entryByCode[c]; ok {
+		return e.Description
+	}
+	return http.StatusText(http.StatusInternalServerError)
+}
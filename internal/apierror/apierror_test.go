@@ -0,0 +1,96 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCatalogEntries(t *testing.T) {
+	seen := map[Code]bool{}
+	for _, e := range Catalog() {
+		if seen[e.Code] {
+			t.Errorf("%s is listed twice", e.Code)
+		}
+		seen[e.Code] = true
+		if e.Status < 400 || e.Status > 599 {
+			t.Errorf("%s has status %d, want an error status", e.Code, e.Status)
+		}
+		if e.Description == "" {
+			t.Errorf("%s has no description", e.Code)
+		}
+		if e.Code.Status() != e.Status || e.Code.Description() != e.Description {
+			t.Errorf("%s.Status(), Description() disagree with its catalog entry", e.Code)
+		}
+	}
+}
+
+func TestUnknownCode(t *testing.T) {
+	code := Code("NO_SUCH_CODE")
+	if got := code.Status(); got != http.StatusInternalServerError {
+		t.Errorf("Status of an unknown code = %d, want 500", got)
+	}
+	if got := code.Description(); got != http.StatusText(http.StatusInternalServerError) {
+		t.Errorf("Description of an unknown code = %q", got)
+	}
+}
+
+func TestCatalogReturnsCopy(t *testing.T) {
+	entries := Catalog()
+	entries[0].Status = http.StatusTeapot
+	if Catalog()[0].Status == http.StatusTeapot {
+		t.Error("changing the slice Catalog returned changed the catalog")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Write(rec, httptest.NewRequest(http.MethodGet, "/api/v1/me", nil), CodeTokenRevoked, "Token has been revoked")
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	var body Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	if body.Error.Code != CodeTokenRevoked || body.Error.Message != "Token has been revoked" {
+		t.Errorf("body = %+v", body)
+	}
+}
+
+// The same error written as Problem Details carries the code, status and
+// message in RFC 7807 members.
+func TestWriteProblemDetails(t *testing.T) {
+	UseProblemDetails(true)
+	t.Cleanup(func() { UseProblemDetails(false) })
+
+	rec := httptest.NewRecorder()
+	Write(rec, httptest.NewRequest(http.MethodGet, "/api/v1/me", nil), CodeTokenRevoked, "Token has been revoked")
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != ProblemContentType {
+		t.Errorf("Content-Type = %q, want %s", got, ProblemContentType)
+	}
+	var body Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	want := Problem{
+		Type:     "/api/v1/errors#TOKEN_REVOKED",
+		Title:    CodeTokenRevoked.Description(),
+		Status:   http.StatusUnauthorized,
+		Detail:   "Token has been revoked",
+		Instance: "/api/v1/me",
+		Code:     CodeTokenRevoked,
+	}
+	if body != want {
+		t.Errorf("body = %+v, want %+v", body, want)
+	}
+}
@@ -0,0 +1,144 @@
+package apierror
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// defaultLocale is the language of the messages passed to Write. Its
+// catalog must cover every code.
+const defaultLocale = "en"
+
+//go:embed messages/*.json
+var builtinMessages embed.FS
+
+// messages maps a lowercase locale, such as "es" or "pt-br", to the message
+// of each code in that locale. It is nil until LoadMessages succeeds, and
+// messages are then left as written.
+var messages atomic.Pointer[map[string]map[Code]string]
+
+// LoadMessages loads the built-in message catalogs, then those in dir, if
+// set, which add locales or replace built-in ones. Each catalog is a
+// <locale>.json file mapping codes to messages. It fails if the English
+// catalog misses a code or any catalog names an unknown one. It is called
+// once at startup.
+func LoadMessages(dir string) error {
+	catalogs := make(map[string]map[Code]string)
+	sub, err := fs.Sub(builtinMessages, "messages")
+	if err != nil {
+		return err
+	}
+	if err := readCatalogs(sub, catalogs); err != nil {
+		return err
+	}
+	if dir != "" {
+		if err := readCatalogs(os.DirFS(dir), catalogs); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range catalog {
+		if _, ok := catalogs[defaultLocale][e.Code]; !ok {
+			return fmt.Errorf("%s message catalog has no entry for %s", defaultLocale, e.Code)
+		}
+	}
+	for locale, msgs := range catalogs {
+		for code := range msgs {
+			if _, ok := entryByCode[code]; !ok {
+				return fmt.Errorf("%s message catalog has an entry for unknown code %s", locale, code)
+			}
+		}
+	}
+
+	messages.Store(&catalogs)
+	return nil
+}
+
+func readCatalogs(fsys fs.FS, catalogs map[string]map[Code]string) error {
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return fmt.Errorf("failed to read message catalog %s: %w", file, err)
+		}
+		var msgs map[Code]string
+		if err := json.Unmarshal(data, &msgs); err != nil {
+			return fmt.Errorf("invalid message catalog %s: %w", file, err)
+		}
+		catalogs[strings.ToLower(strings.TrimSuffix(path.Base(file), ".json"))] = msgs
+	}
+	return nil
+}
+
+// localize returns the message for code in the language r prefers, going by
+// its Accept-Language header, and that language. A language with no catalog,
+// or whose catalog lacks code, is skipped. When no preferred language has
+// the code, message is returned in English as written.
+func localize(r *http.Request, code Code, message string) (string, string) {
+	catalogs := messages.Load()
+	if catalogs == nil {
+		return message, defaultLocale
+	}
+
+	for _, tag := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		// Try the tag itself, then its primary language: pt-BR, then pt.
+		for _, locale := range []string{tag, strings.SplitN(tag, "-", 2)[0]} {
+			if locale == defaultLocale {
+				return message, defaultLocale
+			}
+			if localized, ok := (*catalogs)[locale][code]; ok {
+				return localized, locale
+			}
+		}
+	}
+	return message, defaultLocale
+}
+
+// acceptedLanguages returns the lowercase language tags of an
+// Accept-Language header, most preferred first. Tags with q=0 and the *
+// wildcard are dropped.
+func acceptedLanguages(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q <= 0 {
+			continue
+		}
+		tags = append(tags, weighted{tag, q})
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	result := make([]string, len(tags))
+	for i, t := range tags {
+		result[i] = t.tag
+	}
+	return result
+}
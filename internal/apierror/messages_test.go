@@ -0,0 +1,149 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// useMessages loads the built-in catalogs and those in dir, and goes back
+// to messages as written when the test ends.
+func useMessages(t *testing.T, dir string) {
+	t.Helper()
+	if err := LoadMessages(dir); err != nil {
+		t.Fatalf("LoadMessages: %v", err)
+	}
+	t.Cleanup(func() { messages.Store(nil) })
+}
+
+// writeCatalog writes msgs as the catalog of locale in dir.
+func writeCatalog(t *testing.T, dir, locale string, msgs map[Code]string) {
+	t.Helper()
+	data, err := json.Marshal(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, locale+".json"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteLocalized(t *testing.T) {
+	useMessages(t, "")
+	catalogs := *messages.Load()
+
+	tests := []struct {
+		acceptLanguage string
+		locale         string
+	}{
+		{"es", "es"},
+		{"fr-CA", "fr"},
+		{"de, fr;q=0.8, es;q=0.5", "fr"},
+		{"es;q=0, fr", "fr"},
+		{"en, es", "en"},
+		{"de", "en"},
+		{"", "en"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/me", nil)
+		req.Header.Set("Accept-Language", tt.acceptLanguage)
+		rec := httptest.NewRecorder()
+		Write(rec, req, CodeTokenRevoked, "Token has been revoked")
+
+		want := "Token has been revoked"
+		if tt.locale != defaultLocale {
+			want = catalogs[tt.locale][CodeTokenRevoked]
+		}
+		var body Response
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decoding %q: %v", rec.Body, err)
+		}
+		if body.Error.Code != CodeTokenRevoked || body.Error.Message != want || want == "" {
+			t.Errorf("Accept-Language %q: body = %+v, want the %s message %q", tt.acceptLanguage, body, tt.locale, want)
+		}
+		if got := rec.Header().Get("Content-Language"); got != tt.locale {
+			t.Errorf("Accept-Language %q: Content-Language = %q, want %s", tt.acceptLanguage, got, tt.locale)
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept-Language" {
+			t.Errorf("Accept-Language %q: Vary = %q", tt.acceptLanguage, got)
+		}
+	}
+}
+
+// Every built-in catalog translates every code.
+func TestBuiltinCatalogsComplete(t *testing.T) {
+	useMessages(t, "")
+	for locale, msgs := range *messages.Load() {
+		for _, e := range Catalog() {
+			if msgs[e.Code] == "" {
+				t.Errorf("%s catalog has no message for %s", locale, e.Code)
+			}
+		}
+	}
+}
+
+func TestLoadMessagesDir(t *testing.T) {
+	dir := t.TempDir()
+	writeCatalog(t, dir, "de", map[Code]string{CodeTokenRevoked: "Token wurde widerrufen"})
+	useMessages(t, dir)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/me", nil)
+	req.Header.Set("Accept-Language", "de-AT")
+	rec := httptest.NewRecorder()
+	Write(rec, req, CodeTokenRevoked, "Token has been revoked")
+	var body Response
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if body.Error.Message != "Token wurde widerrufen" {
+		t.Errorf("message = %q, want the one from the added catalog", body.Error.Message)
+	}
+
+	// A code the added catalog lacks falls back to English.
+	rec = httptest.NewRecorder()
+	Write(rec, req, CodeNotFound, "Not found")
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if body.Error.Message != "Not found" || rec.Header().Get("Content-Language") != "en" {
+		t.Errorf("message = %q in %s, want the English one", body.Error.Message, rec.Header().Get("Content-Language"))
+	}
+}
+
+func TestLoadMessagesInvalid(t *testing.T) {
+	tests := map[string]func(dir string){
+		"unknown code": func(dir string) {
+			writeCatalog(t, dir, "de", map[Code]string{"NO_SUCH_CODE": "?"})
+		},
+		"incomplete English catalog": func(dir string) {
+			writeCatalog(t, dir, "en", map[Code]string{CodeTokenRevoked: "Token has been revoked"})
+		},
+		"malformed catalog": func(dir string) {
+			os.WriteFile(filepath.Join(dir, "de.json"), []byte("not json"), 0o644)
+		},
+	}
+	for name, setup := range tests {
+		dir := t.TempDir()
+		setup(dir)
+		if err := LoadMessages(dir); err == nil {
+			messages.Store(nil)
+			t.Errorf("LoadMessages with %s succeeded", name)
+		}
+	}
+}
+
+func TestAcceptedLanguages(t *testing.T) {
+	tests := map[string][]string{
+		"":                         {},
+		"es":                       {"es"},
+		"fr-CA, fr;q=0.9, *;q=0.1": {"fr-ca", "fr"},
+		"de;q=0.2, es, it;q=0.5":   {"es", "it", "de"},
+		"es;q=0, pt-BR":            {"pt-br"},
+		"es;q=oops, fr":            {"fr"},
+	}
+	for header, want := range tests {
+		if got := acceptedLanguages(header); !slices.Equal(got, want) {
+			t.Errorf("acceptedLanguages(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// ProblemContentType is the media type of RFC 7807 error bodies.
+const ProblemContentType = "application/problem+json"
+
+// problemTypeBase prefixes codes to form Problem Details type URIs. It is a
+// reference to the code's entry in the /api/v1/errors catalog.
+const problemTypeBase = "/api/v1/errors#"
+
+var problemDetails atomic.Bool
+
+// UseProblemDetails makes Write emit RFC 7807 Problem Details instead of the
+// default body. It is set once at startup.
+func UseProblemDetails(enabled bool) {
+	problemDetails.Store(enabled)
+}
+
+// Response is the default error body, {"error": {"code": ..., "message": ...}}.
+type Response struct {
+	Error Detail `json:"error"`
+}
+
+type Detail struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+// Problem is an RFC 7807 error body. Code repeats the error code as an
+// extension member, so clients can switch on it in either format.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance,omitempty"`
+	Code     Code   `json:"code"`
+}
+
+// Write responds to r with the error code and message, in the format chosen
+// by UseProblemDetails. The message is replaced by the code's message in the
+// language r prefers, if there is one; see LoadMessages.
+func Write(w http.ResponseWriter, r *http.Request, code Code, message string) {
+	status := code.Status()
+	message, locale := localize(r, code, message)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", locale)
+
+	if !problemDetails.Load() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{Error: Detail{Code: code, Message: message}})
+		return
+	}
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:     problemTypeBase + string(code),
+		Title:    code.Description(),
+		Status:   status,
+		Detail:   message,
+		Instance: r.URL.Path,
+		Code:     code,
+	})
+}
@@ -1,78 +1,1054 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net/netip"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/qcom/qcom/internal/identifier"
+	"github.com/qcom/qcom/internal/phone"
 )
 
 type Config struct {
-	Server   ServerConfig
-	DynamoDB DynamoDBConfig
-	JWT      JWTConfig
-	OTP      OTPConfig
+	Server     ServerConfig
+	DynamoDB   DynamoDBConfig
+	JWT        JWTConfig
+	OTP        OTPConfig
+	Delivery   DeliveryConfig
+	Tracing    TracingConfig
+	Encryption EncryptionConfig
+	Events     EventsConfig
 }
 
 type ServerConfig struct {
 	Port         string
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+
+	// AdminAPIKey guards the /api/v1/admin routes. They are not registered
+	// when it is empty.
+	AdminAPIKey string
+
+	// SigningSecret, when set, additionally requires admin requests to be
+	// HMAC-signed with it. SigningWindow bounds the accepted clock skew.
+	SigningSecret string
+	SigningWindow time.Duration
+
+	// TrustedProxies are the CIDRs of proxies whose X-Forwarded-For entries
+	// are believed when determining the client IP.
+	TrustedProxies []netip.Prefix
+
+	// AdminAllowedCIDRs, when not empty, limits the admin routes to clients
+	// in these networks. Clients in AdminBlockedCIDRs are always refused.
+	AdminAllowedCIDRs []netip.Prefix
+	AdminBlockedCIDRs []netip.Prefix
+
+	// RateLimitBypassKeys and RateLimitBypassCIDRs allowlist internal
+	// services, by X-Service-Key or client IP, past the per-phone rate
+	// limits. The global OTP send budget still applies to them.
+	RateLimitBypassKeys  []string
+	RateLimitBypassCIDRs []netip.Prefix
+
+	// ForceSecureCookies marks cookies Secure even when the request did not
+	// arrive over HTTPS according to the connection or a trusted proxy's
+	// X-Forwarded-Proto.
+	ForceSecureCookies bool
+
+	// OTPPage serves a server-rendered sign-in form at /auth/otp that sets
+	// the tokens as cookies, and lets the API accept those cookies.
+	// OTPPageTemplate replaces its built-in html/template.
+	OTPPage         bool
+	OTPPageTemplate string
+
+	// TLSCertFile and TLSKeyFile, when both set, make the server terminate
+	// TLS itself instead of serving plain HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Maintenance starts the server in maintenance mode, rejecting requests
+	// with MaintenanceRetryAfter as their Retry-After. Once maintenance is
+	// toggled through the admin API, the flag it stores for every instance
+	// applies instead.
+	Maintenance           bool
+	MaintenanceRetryAfter time.Duration
+
+	// Compression gzips responses of at least CompressionMinSize bytes for
+	// clients that send Accept-Encoding: gzip.
+	Compression        bool
+	CompressionMinSize int
+
+	// CORSMaxAge is how long browsers may cache a preflight response.
+	// CORSExposeHeaders are the response headers browser clients may read.
+	CORSMaxAge        time.Duration
+	CORSExposeHeaders []string
+
+	// ProblemDetails emits errors as RFC 7807 application/problem+json
+	// instead of {"error": {"code", "message"}}.
+	ProblemDetails bool
+
+	// ErrorMessagesDir holds <locale>.json error message catalogs that add
+	// to or replace the built-in ones. Empty uses only the built-in ones.
+	ErrorMessagesDir string
+
+	// DeprecatedRoutes maps route path templates, such as
+	// /api/v1/auth/verify-and-set-name, to the deprecation advertised in
+	// their responses.
+	DeprecatedRoutes map[string]RouteDeprecation
+
+	// JSONFieldCase is how response field names are spelled by default:
+	// JSONCaseSnake (access_token) or JSONCaseCamel (accessToken). Requests
+	// are accepted in either.
+	JSONFieldCase string
+
+	// SelfTest runs startup checks of token signing, OTP hashing and the
+	// users table before serving: SelfTestOff skips them, SelfTestWarn logs
+	// failures and SelfTestStrict refuses to start.
+	SelfTest string
+
+	// DataExportSections are the parts of GET /api/v1/me/export: any of
+	// ExportProfile, ExportSessions and ExportAudit.
+	DataExportSections []string
+}
+
+// Sections of a user's data export.
+const (
+	ExportProfile  = "profile"
+	ExportSessions = "sessions"
+	ExportAudit    = "audit"
+)
+
+// Startup self-test modes.
+const (
+	SelfTestOff    = "off"
+	SelfTestWarn   = "warn"
+	SelfTestStrict = "strict"
+)
+
+// JSON field naming conventions.
+const (
+	JSONCaseSnake = "snake"
+	JSONCaseCamel = "camel"
+)
+
+// RouteDeprecation describes a deprecated route. Sunset and Link are
+// optional.
+type RouteDeprecation struct {
+	// DeprecatedAt is when the route was, or will be, deprecated.
+	DeprecatedAt time.Time
+	// Sunset is when the route is expected to stop responding.
+	Sunset time.Time
+	// Link points to documentation on migrating off the route.
+	Link string
 }
 
 type DynamoDBConfig struct {
 	Endpoint  string
 	Region    string
 	TableName string
+
+	// PKName and SKName are the partition and sort key attribute names,
+	// for reusing an existing table whose keys aren't called PK/SK.
+	PKName string
+	SKName string
+
+	// Optional per-entity tables. Each defaults to TableName; audit entries
+	// always live in TableName.
+	UsersTable  string
+	TokensTable string
+	OTPTable    string
+
+	// StronglyConsistentReads makes user lookups read-after-write consistent
+	// at twice the read capacity cost and slightly higher latency.
+	StronglyConsistentReads bool
+
+	// CreateRetries is how many more times a user is created after a
+	// conditional create fails and the user it collided with is already
+	// gone when read back.
+	CreateRetries int
+
+	// BackfillFamilyIndex indexes pre-existing refresh tokens by family at
+	// startup. It scans the whole table and only needs to run once.
+	BackfillFamilyIndex bool
+
+	// WarmUp describes every table at startup, before /ready reports ready,
+	// so the first requests don't pay for opening connections. It gives up
+	// after WarmUpTimeout.
+	WarmUp        bool
+	WarmUpTimeout time.Duration
+
+	// OpTimeout bounds each operation made without a deadline of its own,
+	// such as by background jobs. Zero leaves them unbounded.
+	OpTimeout time.Duration
 }
 
 type JWTConfig struct {
+	// Algorithm is JWTAlgorithmHS256, which signs with SecretKey, or
+	// JWTAlgorithmRS256, which signs with the RSA key in PrivateKeyFile or
+	// the signing entry of Keys. When unset it is inferred from which of
+	// them is configured.
+	Algorithm      string
+	PrivateKeyFile string
+
+	// Keys replaces PrivateKeyFile for RS256 key rotation. Every key is
+	// published in the JWKS and accepted for verification; exactly one
+	// signs.
+	Keys []JWTKeyConfig
+
 	SecretKey     string
 	AccessExpiry  time.Duration
 	RefreshExpiry time.Duration
+
+	// PreviousSecretKey is still accepted for verification while rotating
+	// secrets. Remove it once tokens signed with it have expired.
+	PreviousSecretKey string
+
+	// Token exchange: audiences a refresh token may be exchanged for, the
+	// scopes every user holds, which user tokens carry in their scope claim,
+	// and the lifetime of exchanged access tokens.
+	ExchangeAudiences []string
+	ExchangeScopes    []string
+	ExchangeExpiry    time.Duration
+
+	// RefreshTokenStorage decides what happens when a refresh token cannot
+	// be persisted: TokenStorageStrict fails the request, TokenStorageLenient
+	// logs and still returns the (then unrevocable) token.
+	RefreshTokenStorage string
+
+	// ReauthMaxAge is how recently the user must have verified an OTP to
+	// use sensitive routes such as rotating sessions.
+	ReauthMaxAge time.Duration
+
+	// ReuseGraceWindow is how long after a refresh token is rotated a
+	// retry presenting it again is issued new tokens in place of those it
+	// missed, rather than being rejected as revoked. Zero disables it.
+	ReuseGraceWindow time.Duration
+
+	// MaxRefreshChain is how many times a refresh token family can be
+	// rotated before the user must verify an OTP again. Zero means no limit.
+	MaxRefreshChain int
+
+	// ReuseLockoutThreshold enables reuse detection: a revoked refresh token
+	// presented again (outside ReuseGraceWindow) revokes its family, and
+	// more than this many such reuses within ReuseLockoutWindow lock the
+	// phone number out of signing in for ReuseLockoutDuration, or until an
+	// admin unlocks it when that is zero. Zero disables it.
+	ReuseLockoutThreshold int
+	ReuseLockoutWindow    time.Duration
+	ReuseLockoutDuration  time.Duration
+
+	// GuestSessions enables anonymous guest tokens, valid for GuestExpiry,
+	// which can later be upgraded to a phone-verified account.
+	GuestSessions bool
+	GuestExpiry   time.Duration
+
+	// IssuedAtSkew is how far in the future a token's iat may be, to allow
+	// for clock differences between the instance that issued it and the
+	// one verifying it. Tokens issued further ahead are rejected.
+	IssuedAtSkew time.Duration
+}
+
+const (
+	JWTAlgorithmHS256 = "HS256"
+	JWTAlgorithmRS256 = "RS256"
+)
+
+// JWTKeyConfig is an RSA key identified in token headers and the JWKS by
+// ID. File holds a PEM private key, or for JWTKeyRoleVerify keys
+// optionally just the public key.
+type JWTKeyConfig struct {
+	ID   string
+	Role string
+	File string
 }
 
+const (
+	JWTKeyRoleSign   = "sign"
+	JWTKeyRoleVerify = "verify"
+)
+
+const (
+	TokenStorageStrict  = "strict"
+	TokenStorageLenient = "lenient"
+)
+
+// OTP length bounds. Codes are numeric, so a 4-digit code has only 10^4
+// possible values; anything shorter is trivially guessable within the
+// attempt limit, and anything longer than 10 is impractical to type.
+const (
+	MinOTPLength = 4
+	MaxOTPLength = 10
+)
+
+// MaxOTPAttemptsLimit caps OTP_MAX_ATTEMPTS. Every extra attempt multiplies
+// an attacker's odds of guessing the code.
+const MaxOTPAttemptsLimit = 10
+
+// What GenerateOTP does when the number still has an unexpired OTP.
+const (
+	// OTPReinitiateOverwrite replaces the old code (it stops working).
+	OTPReinitiateOverwrite = "overwrite"
+	// OTPReinitiateReject keeps the old code until ResendCooldown has passed.
+	OTPReinitiateReject = "reject"
+)
+
+// How new OTPs are hashed. Stored hashes carry their algorithm, so OTPs
+// issued under a previous setting keep verifying after a change.
+const (
+	OTPHashBcrypt   = "bcrypt"
+	OTPHashArgon2id = "argon2id"
+	// OTPHashHMAC keys an HMAC-SHA256 with Pepper. It is cheap, and safe
+	// only as long as the pepper stays secret.
+	OTPHashHMAC = "hmac"
+)
+
 type OTPConfig struct {
-	Length      int
-	Expiry      time.Duration
+	Length int
+	Expiry time.Duration
+	// MaxAttempts is the total number of verification attempts, right or
+	// wrong, allowed per OTP. Attempt MaxAttempts is still checked; the one
+	// after it deletes the OTP.
 	MaxAttempts int
+
+	// ResetAttemptsOnResend starts a replacement OTP with a fresh attempt
+	// count. When false, a resend while the previous OTP is unexpired
+	// carries its Attempts over, and a locked-out OTP is kept rather than
+	// deleted, so requesting new codes cannot buy more guesses. Attempts
+	// reset Expiry after the first OTP of such a run of resends; until
+	// then, a number whose attempts are used up gets no new OTP.
+	ResetAttemptsOnResend bool
+
+	// RequireVerificationNonce makes initiate-otp return a single-use
+	// verification nonce that verify-otp must echo, so a captured verify
+	// request cannot be replayed to issue a second set of tokens.
+	RequireVerificationNonce bool
+
+	// Reinitiate is OTPReinitiateOverwrite or OTPReinitiateReject.
+	// ResendCooldown only applies to OTPReinitiateReject.
+	Reinitiate     string
+	ResendCooldown time.Duration
+
+	// AllowedCountryCodes limits OTPs to these calling codes (e.g. "254").
+	// Empty or "*" allows every country. BlockedCountryCodes always wins.
+	AllowedCountryCodes []string
+	BlockedCountryCodes []string
+
+	// IdentifierKinds are the identifier.Kind values users may sign in
+	// with. Other kinds are refused with IDENTIFIER_NOT_SUPPORTED, as are
+	// kinds no delivery channel can send an OTP to.
+	IdentifierKinds []string
+
+	// Pepper is a server-side secret HMAC-mixed into OTPs before hashing.
+	// Changing it invalidates every outstanding OTP unless the old value is
+	// kept in PreviousPepper, which only verifies OTPs hashed with it.
+	// NextPepper is one the admin API may rotate to; it verifies OTPs
+	// from the moment it is configured, so every instance must have it
+	// before the rotation.
+	Pepper         string
+	PreviousPepper string
+	NextPepper     string
+
+	// HashAlgorithm is OTPHashBcrypt, OTPHashArgon2id or OTPHashHMAC.
+	HashAlgorithm string
+
+	// ReturnDestination includes the masked phone number the OTP was sent
+	// to in the initiate response.
+	ReturnDestination bool
+
+	// GenericVerifyErrors reports every verify failure, including a bad
+	// format or nonce, as INVALID_OR_EXPIRED_OTP, so responses reveal
+	// nothing about the number beyond the failure itself.
+	GenericVerifyErrors bool
+
+	// GlobalRatePerMinute limits OTPs sent across all numbers and server
+	// instances, refilling a shared bucket of GlobalBurst. Zero disables it.
+	GlobalRatePerMinute int
+	GlobalBurst         int
+
+	// MaxConcurrentSends limits OTPs being generated and delivered at once
+	// by this process. A request that finds no free slot within
+	// SendSlotWait is refused as busy. Zero disables the limit.
+	MaxConcurrentSends int
+	SendSlotWait       time.Duration
+
+	// StatusRatePerMinute limits OTP status checks per phone number. Zero
+	// disables the limit.
+	StatusRatePerMinute int
+
+	// TestNumbers maps E.164 numbers, e.g. for app store review, to a fixed
+	// OTP. For them the code is stored as usual but never delivered.
+	TestNumbers map[string]string
+}
+
+// How OTPs are delivered when several providers are configured.
+const (
+	DeliveryPolicySingle    = "single"
+	DeliveryPolicyFailover  = "failover"
+	DeliveryPolicyBroadcast = "broadcast"
+)
+
+type DeliveryConfig struct {
+	// Providers deliver the OTP according to Policy: DeliveryPolicySingle
+	// uses only the first, DeliveryPolicyFailover tries them in order until
+	// one succeeds and DeliveryPolicyBroadcast sends the same OTP through
+	// all of them at once.
+	Providers []string
+	Policy    string
+
+	// Workers delivers OTPs in the background with this many workers and a
+	// queue of QueueSize. Zero delivers synchronously within the request.
+	Workers   int
+	QueueSize int
+
+	WhatsAppAccessToken   string
+	WhatsAppPhoneNumberID string
+
+	// WhatsAppTemplateName selects an approved template message instead of
+	// free text. Its body takes the OTP and its validity in minutes.
+	WhatsAppTemplateName     string
+	WhatsAppTemplateLanguage string
+
+	TwilioAccountSID string
+	TwilioAuthToken  string
+	TwilioFromNumber string
+
+	// The simulated provider, for load tests, sends nothing. It waits a
+	// random delay between SimulatedMinDelay and SimulatedMaxDelay and
+	// fails SimulatedFailurePercent of the time.
+	SimulatedMinDelay       time.Duration
+	SimulatedMaxDelay       time.Duration
+	SimulatedFailurePercent int
+}
+
+// LogsOTPs reports whether OTPs may be written to the server log, which is
+// only acceptable in development. Other development-only behaviour is
+// enabled along with it.
+func (c *DeliveryConfig) LogsOTPs() bool {
+	return slices.Contains(c.Providers, "log")
+}
+
+// PrimaryChannel is the channel reported for an OTP before it is delivered:
+// the first provider, or all of them when broadcasting.
+func (c *DeliveryConfig) PrimaryChannel() string {
+	if c.Policy == DeliveryPolicyBroadcast {
+		return strings.Join(c.Providers, ",")
+	}
+	return c.Providers[0]
+}
+
+// Where auth events are published.
+const (
+	EventsPublisherNone = "none"
+	EventsPublisherSNS  = "sns"
+	EventsPublisherSQS  = "sqs"
+)
+
+type EventsConfig struct {
+	// Publisher is EventsPublisherNone, EventsPublisherSNS (to
+	// SNSTopicARN) or EventsPublisherSQS (to SQSQueueURL).
+	Publisher   string
+	SNSTopicARN string
+	SQSQueueURL string
+
+	// QueueSize bounds the events waiting to be published; more are
+	// dropped rather than delaying requests.
+	QueueSize int
+}
+
+type TracingConfig struct {
+	OTLPEndpoint string
+	ServiceName  string
+	// PhoneHashKey keys the phone number HMAC recorded on spans. Spans
+	// carry no phone attribute when it is empty.
+	PhoneHashKey string
+}
+
+// EncryptionConfig holds the keys for encrypting sensitive user attributes
+// at rest. Encryption is disabled when Keys is empty.
+type EncryptionConfig struct {
+	// Keys maps key IDs to 32-byte AES-256 keys. Keys other than CurrentKeyID
+	// are kept only to decrypt values written before a rotation.
+	Keys         map[string][]byte
+	CurrentKeyID string
 }
 
 func Load() (*Config, error) {
+	tableName := getEnv("DYNAMODB_TABLE_NAME", "QComTable")
+
 	cfg := &Config{
 		Server: ServerConfig{
 			Port:         getEnv("PORT", "8080"),
 			ReadTimeout:  15 * time.Second,
 			WriteTimeout: 15 * time.Second,
+			AdminAPIKey:  getEnv("ADMIN_API_KEY", ""),
+
+			SigningSecret: getEnv("REQUEST_SIGNING_SECRET", ""),
+			SigningWindow: getEnvAsDuration("REQUEST_SIGNING_WINDOW", 5*time.Minute),
+
+			ForceSecureCookies: getEnvAsBool("FORCE_SECURE_COOKIES", false),
+			OTPPage:            getEnvAsBool("OTP_PAGE_ENABLED", false),
+			OTPPageTemplate:    getEnv("OTP_PAGE_TEMPLATE", ""),
+
+			TLSCertFile: getEnv("TLS_CERT_FILE", ""),
+			TLSKeyFile:  getEnv("TLS_KEY_FILE", ""),
+
+			Maintenance:           getEnvAsBool("MAINTENANCE_MODE", false),
+			MaintenanceRetryAfter: getEnvAsDuration("MAINTENANCE_RETRY_AFTER", 5*time.Minute),
+
+			Compression:        getEnvAsBool("COMPRESSION_ENABLED", false),
+			CompressionMinSize: getEnvAsInt("COMPRESSION_MIN_SIZE", 1024),
+
+			CORSMaxAge:        getEnvAsDuration("CORS_MAX_AGE", time.Hour),
+			CORSExposeHeaders: getEnvAsSlice("CORS_EXPOSE_HEADERS", []string{"X-Request-ID", "Retry-After", "Deprecation", "Sunset", "Link", "ETag"}),
+
+			JSONFieldCase:      getEnv("JSON_FIELD_CASE", JSONCaseSnake),
+			SelfTest:           getEnv("SELF_TEST", SelfTestOff),
+			DataExportSections: getEnvAsSlice("DATA_EXPORT_SECTIONS", []string{ExportProfile, ExportSessions, ExportAudit}),
+			ProblemDetails:     getEnvAsBool("PROBLEM_DETAILS", false),
+			ErrorMessagesDir:   getEnv("ERROR_MESSAGES_DIR", ""),
 		},
 		DynamoDB: DynamoDBConfig{
 			Endpoint:  getEnv("DYNAMODB_ENDPOINT", ""),
 			Region:    getEnv("DYNAMODB_REGION", "us-east-1"),
-			TableName: getEnv("DYNAMODB_TABLE_NAME", "QComTable"),
+			TableName: tableName,
+			PKName:    getEnv("DYNAMODB_PK_NAME", "PK"),
+			SKName:    getEnv("DYNAMODB_SK_NAME", "SK"),
+
+			UsersTable:  getEnv("DYNAMODB_USERS_TABLE", tableName),
+			TokensTable: getEnv("DYNAMODB_TOKENS_TABLE", tableName),
+			OTPTable:    getEnv("DYNAMODB_OTP_TABLE", tableName),
+
+			StronglyConsistentReads: getEnvAsBool("DYNAMODB_STRONGLY_CONSISTENT_READS", false),
+			BackfillFamilyIndex:     getEnvAsBool("DYNAMODB_BACKFILL_FAMILY_INDEX", false),
+			CreateRetries:           getEnvAsInt("DYNAMODB_CREATE_RETRIES", 2),
+
+			WarmUp:        getEnvAsBool("DYNAMODB_WARM_UP", false),
+			WarmUpTimeout: getEnvAsDuration("DYNAMODB_WARM_UP_TIMEOUT", 10*time.Second),
+			OpTimeout:     getEnvAsDuration("DYNAMODB_OP_TIMEOUT", 10*time.Second),
 		},
 		JWT: JWTConfig{
+			Algorithm:      getEnv("JWT_ALGORITHM", ""),
+			PrivateKeyFile: getEnv("JWT_PRIVATE_KEY_FILE", ""),
+
 			SecretKey:     getEnv("JWT_SECRET_KEY", ""),
 			AccessExpiry:  getEnvAsDuration("JWT_ACCESS_EXPIRY", 15*time.Minute),
 			RefreshExpiry: getEnvAsDuration("JWT_REFRESH_EXPIRY", 7*24*time.Hour),
+
+			PreviousSecretKey: getEnv("JWT_PREVIOUS_SECRET_KEY", ""),
+
+			ExchangeAudiences: getEnvAsSlice("JWT_EXCHANGE_AUDIENCES", nil),
+			ExchangeScopes:    getEnvAsSlice("JWT_EXCHANGE_SCOPES", nil),
+			ExchangeExpiry:    getEnvAsDuration("JWT_EXCHANGE_EXPIRY", 5*time.Minute),
+
+			RefreshTokenStorage: getEnv("JWT_REFRESH_TOKEN_STORAGE", TokenStorageStrict),
+
+			ReauthMaxAge: getEnvAsDuration("REAUTH_MAX_AGE", 10*time.Minute),
+
+			ReuseGraceWindow: getEnvAsDuration("REFRESH_REUSE_GRACE_WINDOW", 0),
+			MaxRefreshChain:  getEnvAsInt("JWT_MAX_REFRESH_CHAIN", 0),
+
+			ReuseLockoutThreshold: getEnvAsInt("REUSE_LOCKOUT_THRESHOLD", 0),
+			ReuseLockoutWindow:    getEnvAsDuration("REUSE_LOCKOUT_WINDOW", 24*time.Hour),
+			ReuseLockoutDuration:  getEnvAsDuration("REUSE_LOCKOUT_DURATION", time.Hour),
+
+			GuestSessions: getEnvAsBool("GUEST_SESSIONS", false),
+			GuestExpiry:   getEnvAsDuration("GUEST_TOKEN_EXPIRY", 24*time.Hour),
+
+			IssuedAtSkew: getEnvAsDuration("JWT_IAT_SKEW", 5*time.Second),
 		},
 		OTP: OTPConfig{
 			Length:      getEnvAsInt("OTP_LENGTH", 6),
 			Expiry:      getEnvAsDuration("OTP_EXPIRY", 10*time.Minute),
 			MaxAttempts: getEnvAsInt("OTP_MAX_ATTEMPTS", 5),
+
+			ResetAttemptsOnResend:    getEnvAsBool("OTP_RESET_ATTEMPTS_ON_RESEND", false),
+			RequireVerificationNonce: getEnvAsBool("OTP_REQUIRE_VERIFICATION_NONCE", false),
+			Pepper:                   getEnv("OTP_PEPPER", ""),
+			PreviousPepper:           getEnv("OTP_PREVIOUS_PEPPER", ""),
+			NextPepper:               getEnv("OTP_NEXT_PEPPER", ""),
+
+			HashAlgorithm: getEnv("OTP_HASH_ALGORITHM", OTPHashBcrypt),
+
+			Reinitiate:     getEnv("OTP_REINITIATE", OTPReinitiateOverwrite),
+			ResendCooldown: getEnvAsDuration("OTP_RESEND_COOLDOWN", time.Minute),
+
+			ReturnDestination:   getEnvAsBool("OTP_RETURN_DESTINATION", false),
+			GenericVerifyErrors: getEnvAsBool("OTP_GENERIC_VERIFY_ERRORS", false),
+
+			GlobalRatePerMinute: getEnvAsInt("OTP_GLOBAL_RATE_PER_MINUTE", 0),
+			GlobalBurst:         getEnvAsInt("OTP_GLOBAL_BURST", 0),
+			MaxConcurrentSends:  getEnvAsInt("OTP_MAX_CONCURRENT_SENDS", 0),
+			SendSlotWait:        getEnvAsDuration("OTP_SEND_SLOT_WAIT", 100*time.Millisecond),
+			StatusRatePerMinute: getEnvAsInt("OTP_STATUS_RATE_PER_MINUTE", 10),
+
+			AllowedCountryCodes: getEnvAsSlice("OTP_ALLOWED_COUNTRY_CODES", nil),
+			BlockedCountryCodes: getEnvAsSlice("OTP_BLOCKED_COUNTRY_CODES", nil),
+			IdentifierKinds:     getEnvAsSlice("IDENTIFIER_KINDS", []string{string(identifier.KindPhone)}),
+		},
+		Delivery: DeliveryConfig{
+			Providers: getEnvAsSlice("OTP_DELIVERY_PROVIDERS", []string{"log"}),
+			Policy:    getEnv("OTP_DELIVERY_POLICY", DeliveryPolicyFailover),
+			Workers:   getEnvAsInt("OTP_DELIVERY_WORKERS", 0),
+			QueueSize: getEnvAsInt("OTP_DELIVERY_QUEUE_SIZE", 100),
+
+			WhatsAppAccessToken:   getEnv("WHATSAPP_ACCESS_TOKEN", ""),
+			WhatsAppPhoneNumberID: getEnv("WHATSAPP_PHONE_NUMBER_ID", ""),
+
+			WhatsAppTemplateName:     getEnv("WHATSAPP_TEMPLATE_NAME", ""),
+			WhatsAppTemplateLanguage: getEnv("WHATSAPP_TEMPLATE_LANGUAGE", "en_US"),
+
+			TwilioAccountSID: getEnv("TWILIO_ACCOUNT_SID", ""),
+			TwilioAuthToken:  getEnv("TWILIO_AUTH_TOKEN", ""),
+			TwilioFromNumber: getEnv("TWILIO_FROM_NUMBER", ""),
+
+			SimulatedMinDelay:       getEnvAsDuration("OTP_SIMULATED_MIN_DELAY", 200*time.Millisecond),
+			SimulatedMaxDelay:       getEnvAsDuration("OTP_SIMULATED_MAX_DELAY", time.Second),
+			SimulatedFailurePercent: getEnvAsInt("OTP_SIMULATED_FAILURE_PERCENT", 0),
+		},
+		Tracing: TracingConfig{
+			OTLPEndpoint: getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+			ServiceName:  getEnv("OTEL_SERVICE_NAME", "qcom-server"),
+			PhoneHashKey: getEnv("TRACING_PHONE_HASH_KEY", ""),
+		},
+		Events: EventsConfig{
+			Publisher:   getEnv("EVENTS_PUBLISHER", EventsPublisherNone),
+			SNSTopicARN: getEnv("EVENTS_SNS_TOPIC_ARN", ""),
+			SQSQueueURL: getEnv("EVENTS_SQS_QUEUE_URL", ""),
+			QueueSize:   getEnvAsInt("EVENTS_QUEUE_SIZE", 1000),
 		},
 	}
 
-	if cfg.JWT.SecretKey == "" {
-		return nil, fmt.Errorf("JWT_SECRET_KEY environment variable is required")
+	if len(cfg.DynamoDB.PKName) > 255 || len(cfg.DynamoDB.SKName) > 255 {
+		return nil, fmt.Errorf("DYNAMODB_PK_NAME and DYNAMODB_SK_NAME must be at most 255 bytes")
 	}
 
-	if len(cfg.JWT.SecretKey) < 32 {
-		return nil, fmt.Errorf("JWT_SECRET_KEY must be at least 32 bytes (256 bits)")
+	if cfg.DynamoDB.PKName == cfg.DynamoDB.SKName {
+		return nil, fmt.Errorf("DYNAMODB_PK_NAME and DYNAMODB_SK_NAME must differ")
+	}
+
+	trustedProxies, err := parsePrefixes(getEnvAsSlice("TRUSTED_PROXIES", nil))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	cfg.Server.TrustedProxies = trustedProxies
+
+	cfg.Server.AdminAllowedCIDRs, err = parsePrefixes(getEnvAsSlice("ADMIN_ALLOWED_CIDRS", nil))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ADMIN_ALLOWED_CIDRS: %w", err)
+	}
+	cfg.Server.AdminBlockedCIDRs, err = parsePrefixes(getEnvAsSlice("ADMIN_BLOCKED_CIDRS", nil))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ADMIN_BLOCKED_CIDRS: %w", err)
+	}
+
+	cfg.Server.RateLimitBypassKeys = getEnvAsSlice("RATE_LIMIT_BYPASS_KEYS", nil)
+	cfg.Server.RateLimitBypassCIDRs, err = parsePrefixes(getEnvAsSlice("RATE_LIMIT_BYPASS_CIDRS", nil))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_BYPASS_CIDRS: %w", err)
+	}
+
+	cfg.Server.DeprecatedRoutes, err = parseDeprecatedRoutes(getEnvAsSlice("DEPRECATED_ROUTES", nil))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEPRECATED_ROUTES: %w", err)
+	}
+
+	cfg.Encryption, err = loadEncryption()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.JWT.Keys, err = loadJWTKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.OTP.TestNumbers, err = loadOTPTestNumbers(cfg.OTP.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateJWTKeys(&cfg.JWT); err != nil {
+		return nil, err
+	}
+
+	if cfg.JWT.RefreshTokenStorage != TokenStorageStrict && cfg.JWT.RefreshTokenStorage != TokenStorageLenient {
+		return nil, fmt.Errorf("JWT_REFRESH_TOKEN_STORAGE must be %q or %q", TokenStorageStrict, TokenStorageLenient)
+	}
+
+	if cfg.OTP.Reinitiate != OTPReinitiateOverwrite && cfg.OTP.Reinitiate != OTPReinitiateReject {
+		return nil, fmt.Errorf("OTP_REINITIATE must be %q or %q", OTPReinitiateOverwrite, OTPReinitiateReject)
+	}
+
+	if cfg.OTP.PreviousPepper != "" && cfg.OTP.PreviousPepper == cfg.OTP.Pepper {
+		return nil, fmt.Errorf("OTP_PREVIOUS_PEPPER must differ from OTP_PEPPER")
+	}
+	if cfg.OTP.NextPepper != "" && (cfg.OTP.NextPepper == cfg.OTP.Pepper || cfg.OTP.NextPepper == cfg.OTP.PreviousPepper) {
+		return nil, fmt.Errorf("OTP_NEXT_PEPPER must differ from OTP_PEPPER and OTP_PREVIOUS_PEPPER")
+	}
+
+	switch cfg.OTP.HashAlgorithm {
+	case OTPHashBcrypt, OTPHashArgon2id:
+	case OTPHashHMAC:
+		if cfg.OTP.Pepper == "" {
+			return nil, fmt.Errorf("OTP_PEPPER is required when OTP_HASH_ALGORITHM is %q", OTPHashHMAC)
+		}
+	default:
+		return nil, fmt.Errorf("OTP_HASH_ALGORITHM must be %q, %q or %q", OTPHashBcrypt, OTPHashArgon2id, OTPHashHMAC)
+	}
+
+	if cfg.OTP.MaxAttempts < 1 || cfg.OTP.MaxAttempts > MaxOTPAttemptsLimit {
+		return nil, fmt.Errorf("OTP_MAX_ATTEMPTS must be between 1 and %d", MaxOTPAttemptsLimit)
+	}
+
+	if len(cfg.OTP.IdentifierKinds) == 0 {
+		return nil, fmt.Errorf("IDENTIFIER_KINDS must list at least one kind")
+	}
+	for _, kind := range cfg.OTP.IdentifierKinds {
+		if !slices.Contains(identifier.Kinds, identifier.Kind(kind)) {
+			return nil, fmt.Errorf("IDENTIFIER_KINDS: unknown kind %q; must be %q, %q or %q", kind, identifier.KindPhone, identifier.KindEmail, identifier.KindUsername)
+		}
+	}
+
+	if !slices.Contains([]string{DeliveryPolicySingle, DeliveryPolicyFailover, DeliveryPolicyBroadcast}, cfg.Delivery.Policy) {
+		return nil, fmt.Errorf("OTP_DELIVERY_POLICY must be %q, %q or %q", DeliveryPolicySingle, DeliveryPolicyFailover, DeliveryPolicyBroadcast)
+	}
+
+	if cfg.Delivery.Workers < 0 || cfg.Delivery.QueueSize < 0 {
+		return nil, fmt.Errorf("OTP_DELIVERY_WORKERS and OTP_DELIVERY_QUEUE_SIZE must not be negative")
+	}
+
+	if cfg.Delivery.SimulatedMinDelay < 0 || cfg.Delivery.SimulatedMaxDelay < cfg.Delivery.SimulatedMinDelay {
+		return nil, fmt.Errorf("OTP_SIMULATED_MIN_DELAY must not be negative or exceed OTP_SIMULATED_MAX_DELAY")
+	}
+	if cfg.Delivery.SimulatedFailurePercent < 0 || cfg.Delivery.SimulatedFailurePercent > 100 {
+		return nil, fmt.Errorf("OTP_SIMULATED_FAILURE_PERCENT must be between 0 and 100")
+	}
+
+	if (cfg.Server.TLSCertFile == "") != (cfg.Server.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	if cfg.Server.CompressionMinSize < 0 {
+		return nil, fmt.Errorf("COMPRESSION_MIN_SIZE must not be negative")
+	}
+
+	if cfg.Server.CORSMaxAge < 0 {
+		return nil, fmt.Errorf("CORS_MAX_AGE must not be negative")
+	}
+
+	if cfg.DynamoDB.CreateRetries < 0 {
+		return nil, fmt.Errorf("DYNAMODB_CREATE_RETRIES must not be negative")
+	}
+
+	if cfg.JWT.ReauthMaxAge <= 0 {
+		return nil, fmt.Errorf("REAUTH_MAX_AGE must be positive")
+	}
+
+	if cfg.JWT.ReuseLockoutThreshold < 0 || cfg.JWT.ReuseLockoutDuration < 0 {
+		return nil, fmt.Errorf("REUSE_LOCKOUT_THRESHOLD and REUSE_LOCKOUT_DURATION must not be negative")
+	}
+	if cfg.JWT.ReuseLockoutThreshold > 0 && cfg.JWT.ReuseLockoutWindow <= 0 {
+		return nil, fmt.Errorf("REUSE_LOCKOUT_WINDOW must be positive")
+	}
+
+	if cfg.JWT.IssuedAtSkew < 0 {
+		return nil, fmt.Errorf("JWT_IAT_SKEW must not be negative")
+	}
+
+	if cfg.JWT.ReuseGraceWindow < 0 {
+		return nil, fmt.Errorf("REFRESH_REUSE_GRACE_WINDOW must not be negative")
+	}
+
+	if cfg.Server.JSONFieldCase != JSONCaseSnake && cfg.Server.JSONFieldCase != JSONCaseCamel {
+		return nil, fmt.Errorf("JSON_FIELD_CASE must be %q or %q", JSONCaseSnake, JSONCaseCamel)
+	}
+
+	if !slices.Contains([]string{SelfTestOff, SelfTestWarn, SelfTestStrict}, cfg.Server.SelfTest) {
+		return nil, fmt.Errorf("SELF_TEST must be %q, %q or %q", SelfTestOff, SelfTestWarn, SelfTestStrict)
+	}
+
+	for _, section := range cfg.Server.DataExportSections {
+		if !slices.Contains([]string{ExportProfile, ExportSessions, ExportAudit}, section) {
+			return nil, fmt.Errorf("DATA_EXPORT_SECTIONS may only list %q, %q and %q", ExportProfile, ExportSessions, ExportAudit)
+		}
+	}
+
+	if cfg.JWT.GuestSessions && cfg.JWT.GuestExpiry <= 0 {
+		return nil, fmt.Errorf("GUEST_TOKEN_EXPIRY must be positive")
+	}
+
+	if cfg.JWT.MaxRefreshChain < 0 {
+		return nil, fmt.Errorf("JWT_MAX_REFRESH_CHAIN must not be negative")
+	}
+
+	if cfg.DynamoDB.WarmUp && cfg.DynamoDB.WarmUpTimeout <= 0 {
+		return nil, fmt.Errorf("DYNAMODB_WARM_UP_TIMEOUT must be positive")
+	}
+
+	switch cfg.Events.Publisher {
+	case EventsPublisherNone:
+	case EventsPublisherSNS:
+		if cfg.Events.SNSTopicARN == "" {
+			return nil, fmt.Errorf("EVENTS_SNS_TOPIC_ARN is required when EVENTS_PUBLISHER is %q", EventsPublisherSNS)
+		}
+	case EventsPublisherSQS:
+		if cfg.Events.SQSQueueURL == "" {
+			return nil, fmt.Errorf("EVENTS_SQS_QUEUE_URL is required when EVENTS_PUBLISHER is %q", EventsPublisherSQS)
+		}
+	default:
+		return nil, fmt.Errorf("EVENTS_PUBLISHER must be %q, %q or %q", EventsPublisherNone, EventsPublisherSNS, EventsPublisherSQS)
+	}
+
+	if cfg.Events.QueueSize <= 0 {
+		return nil, fmt.Errorf("EVENTS_QUEUE_SIZE must be positive")
+	}
+
+	if cfg.DynamoDB.OpTimeout < 0 {
+		return nil, fmt.Errorf("DYNAMODB_OP_TIMEOUT must not be negative")
+	}
+
+	if cfg.OTP.GlobalRatePerMinute < 0 || cfg.OTP.GlobalBurst < 0 {
+		return nil, fmt.Errorf("OTP_GLOBAL_RATE_PER_MINUTE and OTP_GLOBAL_BURST must not be negative")
+	}
+	if cfg.OTP.MaxConcurrentSends < 0 || cfg.OTP.SendSlotWait < 0 {
+		return nil, fmt.Errorf("OTP_MAX_CONCURRENT_SENDS and OTP_SEND_SLOT_WAIT must not be negative")
+	}
+	if cfg.OTP.StatusRatePerMinute < 0 {
+		return nil, fmt.Errorf("OTP_STATUS_RATE_PER_MINUTE must not be negative")
+	}
+	if cfg.OTP.GlobalBurst == 0 {
+		cfg.OTP.GlobalBurst = cfg.OTP.GlobalRatePerMinute
+	}
+
+	if cfg.OTP.Length < MinOTPLength || cfg.OTP.Length > MaxOTPLength {
+		return nil, fmt.Errorf("OTP_LENGTH must be between %d and %d", MinOTPLength, MaxOTPLength)
 	}
 
 	return cfg, nil
 }
 
+// validateJWTKeys resolves JWT_ALGORITHM and checks that exactly the key
+// material it uses is configured. A key for the other algorithm is rejected
+// rather than ignored, since it usually means the operator expects it to be
+// in use.
+func validateJWTKeys(cfg *JWTConfig) error {
+	hasSecret := cfg.SecretKey != "" || cfg.PreviousSecretKey != ""
+	hasPrivateKey := cfg.PrivateKeyFile != "" || len(cfg.Keys) > 0
+
+	if cfg.PrivateKeyFile != "" && len(cfg.Keys) > 0 {
+		return fmt.Errorf("JWT_PRIVATE_KEY_FILE and JWT_KEYS are both set: move the key into JWT_KEYS and unset JWT_PRIVATE_KEY_FILE")
+	}
+
+	if cfg.Algorithm == "" {
+		switch {
+		case hasSecret && hasPrivateKey:
+			return fmt.Errorf("both JWT_SECRET_KEY and JWT_PRIVATE_KEY_FILE are set: set JWT_ALGORITHM to %q or %q and unset the other key", JWTAlgorithmHS256, JWTAlgorithmRS256)
+		case hasPrivateKey:
+			cfg.Algorithm = JWTAlgorithmRS256
+		default:
+			cfg.Algorithm = JWTAlgorithmHS256
+		}
+	}
+
+	switch cfg.Algorithm {
+	case JWTAlgorithmHS256:
+		if cfg.SecretKey == "" {
+			if hasPrivateKey {
+				return fmt.Errorf("JWT_ALGORITHM is %s but only JWT_PRIVATE_KEY_FILE is set: set JWT_ALGORITHM=%s, or set JWT_SECRET_KEY and unset JWT_PRIVATE_KEY_FILE", JWTAlgorithmHS256, JWTAlgorithmRS256)
+			}
+			return fmt.Errorf("JWT_SECRET_KEY environment variable is required")
+		}
+		if cfg.PrivateKeyFile != "" {
+			return fmt.Errorf("JWT_PRIVATE_KEY_FILE is not used with JWT_ALGORITHM=%s: unset it", JWTAlgorithmHS256)
+		}
+		if len(cfg.Keys) > 0 {
+			return fmt.Errorf("JWT_KEYS is not used with JWT_ALGORITHM=%s: unset it", JWTAlgorithmHS256)
+		}
+		if len(cfg.SecretKey) < 32 {
+			return fmt.Errorf("JWT_SECRET_KEY must be at least 32 bytes (256 bits)")
+		}
+		if cfg.PreviousSecretKey != "" && len(cfg.PreviousSecretKey) < 32 {
+			return fmt.Errorf("JWT_PREVIOUS_SECRET_KEY must be at least 32 bytes (256 bits)")
+		}
+
+	case JWTAlgorithmRS256:
+		if !hasPrivateKey {
+			if hasSecret {
+				return fmt.Errorf("JWT_ALGORITHM is %s but only JWT_SECRET_KEY is set: set JWT_PRIVATE_KEY_FILE or JWT_KEYS, or set JWT_ALGORITHM=%s", JWTAlgorithmRS256, JWTAlgorithmHS256)
+			}
+			return fmt.Errorf("JWT_PRIVATE_KEY_FILE or JWT_KEYS is required with JWT_ALGORITHM=%s", JWTAlgorithmRS256)
+		}
+		if cfg.SecretKey != "" {
+			return fmt.Errorf("JWT_SECRET_KEY is not used with JWT_ALGORITHM=%s: unset it", JWTAlgorithmRS256)
+		}
+		if cfg.PreviousSecretKey != "" {
+			return fmt.Errorf("JWT_PREVIOUS_SECRET_KEY is not used with JWT_ALGORITHM=%s: unset it", JWTAlgorithmRS256)
+		}
+
+	default:
+		return fmt.Errorf("JWT_ALGORITHM must be %q or %q", JWTAlgorithmHS256, JWTAlgorithmRS256)
+	}
+	return nil
+}
+
+// loadJWTKeys parses JWT_KEYS, a comma-separated list of id:role:file
+// entries such as "2026-10:sign:/keys/new.pem,2026-07:verify:/keys/old.pem".
+func loadJWTKeys() ([]JWTKeyConfig, error) {
+	entries := getEnvAsSlice("JWT_KEYS", nil)
+	keys := make([]JWTKeyConfig, 0, len(entries))
+	signers := 0
+
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("JWT_KEYS entries must be id:role:file")
+		}
+		key := JWTKeyConfig{ID: parts[0], Role: parts[1], File: parts[2]}
+
+		switch key.Role {
+		case JWTKeyRoleSign:
+			signers++
+		case JWTKeyRoleVerify:
+		default:
+			return nil, fmt.Errorf("JWT_KEYS key %q has role %q; must be %q or %q", key.ID, key.Role, JWTKeyRoleSign, JWTKeyRoleVerify)
+		}
+		for _, other := range keys {
+			if other.ID == key.ID {
+				return nil, fmt.Errorf("JWT_KEYS lists key %q twice", key.ID)
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) > 0 && signers != 1 {
+		return nil, fmt.Errorf("JWT_KEYS must have exactly one %q key, found %d", JWTKeyRoleSign, signers)
+	}
+	return keys, nil
+}
+
+// loadOTPTestNumbers parses OTP_TEST_NUMBERS, a comma-separated list of
+// phone:code entries such as "+15550000001:123456".
+func loadOTPTestNumbers(length int) (map[string]string, error) {
+	entries := getEnvAsSlice("OTP_TEST_NUMBERS", nil)
+	numbers := make(map[string]string, len(entries))
+
+	for _, entry := range entries {
+		number, code, ok := strings.Cut(entry, ":")
+		if !ok || !phone.IsValid(number) {
+			return nil, fmt.Errorf("OTP_TEST_NUMBERS entries must be +E164number:code")
+		}
+		if len(code) != length || strings.Trim(code, "0123456789") != "" {
+			return nil, fmt.Errorf("OTP_TEST_NUMBERS code for %s must be %d digits (OTP_LENGTH)", number, length)
+		}
+		if _, ok := numbers[number]; ok {
+			return nil, fmt.Errorf("OTP_TEST_NUMBERS lists %s twice", number)
+		}
+		numbers[number] = code
+	}
+	return numbers, nil
+}
+
+// loadEncryption parses FIELD_ENCRYPTION_KEYS, a comma-separated list of
+// id:base64key entries, and FIELD_ENCRYPTION_KEY_ID, which defaults to the
+// first listed key.
+func loadEncryption() (EncryptionConfig, error) {
+	entries := getEnvAsSlice("FIELD_ENCRYPTION_KEYS", nil)
+	cfg := EncryptionConfig{
+		Keys:         make(map[string][]byte, len(entries)),
+		CurrentKeyID: getEnv("FIELD_ENCRYPTION_KEY_ID", ""),
+	}
+
+	for _, entry := range entries {
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return cfg, fmt.Errorf("FIELD_ENCRYPTION_KEYS entries must be id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return cfg, fmt.Errorf("FIELD_ENCRYPTION_KEYS key %q must be 32 bytes, base64-encoded", id)
+		}
+		if _, dup := cfg.Keys[id]; dup {
+			return cfg, fmt.Errorf("FIELD_ENCRYPTION_KEYS lists key %q twice", id)
+		}
+		cfg.Keys[id] = key
+		if cfg.CurrentKeyID == "" {
+			cfg.CurrentKeyID = id
+		}
+	}
+
+	if cfg.CurrentKeyID != "" {
+		if _, ok := cfg.Keys[cfg.CurrentKeyID]; !ok {
+			return cfg, fmt.Errorf("FIELD_ENCRYPTION_KEY_ID %q is not in FIELD_ENCRYPTION_KEYS", cfg.CurrentKeyID)
+		}
+	}
+	return cfg, nil
+}
+
+// parsePrefixes parses CIDRs, accepting bare addresses as single-host
+// prefixes.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseDeprecatedRoutes parses path|deprecated[|sunset[|link]] entries, with
+// the dates as YYYY-MM-DD or RFC 3339 timestamps.
+func parseDeprecatedRoutes(values []string) (map[string]RouteDeprecation, error) {
+	routes := make(map[string]RouteDeprecation, len(values))
+	for _, value := range values {
+		fields := strings.Split(value, "|")
+		if len(fields) < 2 || len(fields) > 4 || !strings.HasPrefix(fields[0], "/") {
+			return nil, fmt.Errorf("%q is not path|deprecated[|sunset[|link]]", value)
+		}
+
+		var deprecation RouteDeprecation
+		var err error
+		if deprecation.DeprecatedAt, err = parseDate(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s: %w", fields[0], err)
+		}
+		if len(fields) > 2 && fields[2] != "" {
+			if deprecation.Sunset, err = parseDate(fields[2]); err != nil {
+				return nil, fmt.Errorf("%s: %w", fields[0], err)
+			}
+			if !deprecation.Sunset.After(deprecation.DeprecatedAt) {
+				return nil, fmt.Errorf("%s: sunset must be after deprecation", fields[0])
+			}
+		}
+		if len(fields) > 3 {
+			deprecation.Link = fields[3]
+		}
+		routes[fields[0]] = deprecation
+	}
+	return routes, nil
+}
+
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -89,6 +1065,15 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
 		if duration, err := time.ParseDuration(value); err == nil {
@@ -97,3 +1082,18 @@ func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
 	}
 	return defaultValue
 }
+
+func getEnvAsSlice(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var values []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			values = append(values, part)
+		}
+	}
+	return values
+}
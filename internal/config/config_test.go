@@ -0,0 +1,330 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadWith runs Load with a minimal valid environment plus env.
+func loadWith(t *testing.T, env map[string]string) (*Config, error) {
+	t.Helper()
+	t.Setenv("JWT_SECRET_KEY", "test-secret-key-of-at-least-32-bytes")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	return Load()
+}
+
+func TestLoadOTPTestNumbers(t *testing.T) {
+	cfg, err := loadWith(t, map[string]string{
+		"OTP_LENGTH":       "6",
+		"OTP_TEST_NUMBERS": "+15550000001:123456,+15550000002:000000",
+	})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := cfg.OTP.TestNumbers["+15550000001"]; got != "123456" {
+		t.Errorf("code of +15550000001 = %q, want 123456", got)
+	}
+	if len(cfg.OTP.TestNumbers) != 2 {
+		t.Errorf("loaded %d test numbers, want 2", len(cfg.OTP.TestNumbers))
+	}
+}
+
+func TestLoadRejectsOTPTestNumberCodesOfWrongLength(t *testing.T) {
+	for _, tc := range []struct {
+		length, entry, want string
+	}{
+		{"6", "+15550000001:12345", "must be 6 digits"},
+		{"6", "+15550000001:1234567", "must be 6 digits"},
+		{"6", "+15550000001:12345a", "must be 6 digits"},
+		{"4", "+15550000001:123456", "must be 4 digits"},
+		{"6", "+15550000001:", "must be 6 digits"},
+		{"6", "15550000001:123456", "must be +E164number:code"},
+		{"6", "+15550000001:123456,+15550000001:654321", "twice"},
+	} {
+		_, err := loadWith(t, map[string]string{"OTP_LENGTH": tc.length, "OTP_TEST_NUMBERS": tc.entry})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Load with OTP_LENGTH=%s OTP_TEST_NUMBERS=%s = %v, want an error containing %q", tc.length, tc.entry, err, tc.want)
+		}
+	}
+}
+
+func TestLoadOTPLength(t *testing.T) {
+	for _, length := range []string{"4", "6", "10"} {
+		cfg, err := loadWith(t, map[string]string{"OTP_LENGTH": length})
+		if err != nil {
+			t.Errorf("Load with OTP_LENGTH=%s: %v", length, err)
+			continue
+		}
+		if got := strconv.Itoa(cfg.OTP.Length); got != length {
+			t.Errorf("OTP length = %s, want %s", got, length)
+		}
+	}
+}
+
+func TestLoadRejectsOTPLengthOutOfRange(t *testing.T) {
+	for _, length := range []string{"3", "11", "0", "-6"} {
+		_, err := loadWith(t, map[string]string{"OTP_LENGTH": length})
+		if err == nil || !strings.Contains(err.Error(), "OTP_LENGTH must be between 4 and 10") {
+			t.Errorf("Load with OTP_LENGTH=%s = %v, want a range error", length, err)
+		}
+	}
+}
+
+func TestLoadTrustedProxies(t *testing.T) {
+	cfg, err := loadWith(t, map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8, 192.0.2.1"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	var got []string
+	for _, prefix := range cfg.Server.TrustedProxies {
+		got = append(got, prefix.String())
+	}
+	if strings.Join(got, ",") != "10.0.0.0/8,192.0.2.1/32" {
+		t.Errorf("TrustedProxies = %v, want 10.0.0.0/8 and 192.0.2.1/32", got)
+	}
+
+	if _, err := loadWith(t, map[string]string{"TRUSTED_PROXIES": "10.0.0.0/33"}); err == nil {
+		t.Error("Load accepted an invalid TRUSTED_PROXIES entry")
+	}
+}
+
+func TestLoadAdminCIDRs(t *testing.T) {
+	cfg, err := loadWith(t, map[string]string{
+		"ADMIN_ALLOWED_CIDRS": "10.0.0.0/8, 192.0.2.1",
+		"ADMIN_BLOCKED_CIDRS": "10.0.0.66",
+	})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(cfg.Server.AdminAllowedCIDRs) != 2 || cfg.Server.AdminAllowedCIDRs[1].String() != "192.0.2.1/32" {
+		t.Errorf("AdminAllowedCIDRs = %v, want 10.0.0.0/8 and 192.0.2.1/32", cfg.Server.AdminAllowedCIDRs)
+	}
+	if len(cfg.Server.AdminBlockedCIDRs) != 1 || cfg.Server.AdminBlockedCIDRs[0].String() != "10.0.0.66/32" {
+		t.Errorf("AdminBlockedCIDRs = %v, want 10.0.0.66/32", cfg.Server.AdminBlockedCIDRs)
+	}
+
+	for _, name := range []string{"ADMIN_ALLOWED_CIDRS", "ADMIN_BLOCKED_CIDRS"} {
+		if _, err := loadWith(t, map[string]string{name: "not-a-network"}); err == nil {
+			t.Errorf("Load accepted an invalid %s entry", name)
+		}
+	}
+}
+
+func TestLoadIdentifierKinds(t *testing.T) {
+	cfg, err := loadWith(t, nil)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !slices.Equal(cfg.OTP.IdentifierKinds, []string{"phone"}) {
+		t.Errorf("IdentifierKinds = %v, want phone only by default", cfg.OTP.IdentifierKinds)
+	}
+
+	cfg, err = loadWith(t, map[string]string{"IDENTIFIER_KINDS": "phone, email"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !slices.Equal(cfg.OTP.IdentifierKinds, []string{"phone", "email"}) {
+		t.Errorf("IdentifierKinds = %v, want phone and email", cfg.OTP.IdentifierKinds)
+	}
+
+	if _, err := loadWith(t, map[string]string{"IDENTIFIER_KINDS": "phone,fax"}); err == nil {
+		t.Error("Load accepted an unknown identifier kind")
+	}
+}
+
+func TestLoadDeprecatedRoutes(t *testing.T) {
+	cfg, err := loadWith(t, map[string]string{
+		"DEPRECATED_ROUTES": "/api/v1/users/{id}|2026-01-01|2026-07-01T00:00:00Z|https://example.com/migrate,/api/v1/legacy|2026-01-01",
+	})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	users := cfg.Server.DeprecatedRoutes["/api/v1/users/{id}"]
+	if !users.DeprecatedAt.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) || !users.Sunset.Equal(time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)) || users.Link != "https://example.com/migrate" {
+		t.Errorf("/api/v1/users/{id} = %+v", users)
+	}
+	if legacy, ok := cfg.Server.DeprecatedRoutes["/api/v1/legacy"]; !ok || !legacy.Sunset.IsZero() || legacy.Link != "" {
+		t.Errorf("/api/v1/legacy = %+v, %v, want only a deprecation date", legacy, ok)
+	}
+
+	for _, value := range []string{
+		"/api/v1/legacy",
+		"api/v1/legacy|2026-01-01",
+		"/api/v1/legacy|January",
+		"/api/v1/legacy|2026-01-01|2025-12-31",
+	} {
+		if _, err := loadWith(t, map[string]string{"DEPRECATED_ROUTES": value}); err == nil {
+			t.Errorf("Load accepted DEPRECATED_ROUTES=%s", value)
+		}
+	}
+}
+
+// Each entity table defaults to DYNAMODB_TABLE_NAME unless set itself.
+func TestLoadTables(t *testing.T) {
+	cfg, err := loadWith(t, map[string]string{
+		"DYNAMODB_TABLE_NAME":   "Main",
+		"DYNAMODB_TOKENS_TABLE": "Tokens",
+	})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	db := cfg.DynamoDB
+	if db.TableName != "Main" || db.UsersTable != "Main" || db.OTPTable != "Main" || db.TokensTable != "Tokens" {
+		t.Errorf("tables = main %s, users %s, OTPs %s, tokens %s, want Main for all but tokens", db.TableName, db.UsersTable, db.OTPTable, db.TokensTable)
+	}
+}
+
+func TestLoadRejectsOTPMaxAttemptsOutOfRange(t *testing.T) {
+	for _, attempts := range []string{"0", "11", "-1"} {
+		_, err := loadWith(t, map[string]string{"OTP_MAX_ATTEMPTS": attempts})
+		if err == nil || !strings.Contains(err.Error(), "OTP_MAX_ATTEMPTS must be between 1 and 10") {
+			t.Errorf("Load with OTP_MAX_ATTEMPTS=%s = %v, want a range error", attempts, err)
+		}
+	}
+	if _, err := loadWith(t, map[string]string{"OTP_MAX_ATTEMPTS": "10"}); err != nil {
+		t.Errorf("Load with OTP_MAX_ATTEMPTS=10: %v", err)
+	}
+}
+
+func TestLoadKeyNames(t *testing.T) {
+	cfg, err := loadWith(t, map[string]string{"DYNAMODB_PK_NAME": "id", "DYNAMODB_SK_NAME": "kind"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.DynamoDB.PKName != "id" || cfg.DynamoDB.SKName != "kind" {
+		t.Errorf("key names = %s, %s, want id, kind", cfg.DynamoDB.PKName, cfg.DynamoDB.SKName)
+	}
+
+	if _, err := loadWith(t, map[string]string{"DYNAMODB_PK_NAME": "key", "DYNAMODB_SK_NAME": "key"}); err == nil {
+		t.Error("Load accepted the same name for both keys")
+	}
+}
+
+func TestLoadRejectsTLSCertWithoutKey(t *testing.T) {
+	for _, name := range []string{"TLS_CERT_FILE", "TLS_KEY_FILE"} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadWith(t, map[string]string{name: "file.pem"}); err == nil || !strings.Contains(err.Error(), "must be set together") {
+				t.Errorf("Load with only %s = %v, want an error", name, err)
+			}
+		})
+	}
+}
+
+func TestLoadEncryptionKeys(t *testing.T) {
+	key1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	key2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+
+	t.Run("valid", func(t *testing.T) {
+		cfg, err := loadWith(t, map[string]string{"FIELD_ENCRYPTION_KEYS": "k1:" + key1 + ",k2:" + key2})
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		if len(cfg.Encryption.Keys) != 2 || cfg.Encryption.CurrentKeyID != "k1" {
+			t.Errorf("Encryption = %d keys, current %q, want 2 keys with k1 current", len(cfg.Encryption.Keys), cfg.Encryption.CurrentKeyID)
+		}
+	})
+
+	for name, env := range map[string]map[string]string{
+		"no ID":        {"FIELD_ENCRYPTION_KEYS": key1},
+		"short key":    {"FIELD_ENCRYPTION_KEYS": "k1:" + base64.StdEncoding.EncodeToString([]byte("short"))},
+		"duplicate ID": {"FIELD_ENCRYPTION_KEYS": "k1:" + key1 + ",k1:" + key2},
+		"unknown ID":   {"FIELD_ENCRYPTION_KEYS": "k1:" + key1, "FIELD_ENCRYPTION_KEY_ID": "k2"},
+		"ID, no keys":  {"FIELD_ENCRYPTION_KEY_ID": "k1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadWith(t, env); err == nil || !strings.Contains(err.Error(), "FIELD_ENCRYPTION") {
+				t.Errorf("Load = %v, want a FIELD_ENCRYPTION error", err)
+			}
+		})
+	}
+}
+
+func TestValidateJWTKeys(t *testing.T) {
+	secret := "test-secret-key-of-at-least-32-bytes"
+	keys := []JWTKeyConfig{{ID: "k1", Role: JWTKeyRoleSign, File: "k1.pem"}}
+
+	for _, tc := range []struct {
+		name string
+		cfg  JWTConfig
+		want string // algorithm, or a substring of the error
+	}{
+		{"secret only", JWTConfig{SecretKey: secret}, JWTAlgorithmHS256},
+		{"private key only", JWTConfig{PrivateKeyFile: "key.pem"}, JWTAlgorithmRS256},
+		{"keys only", JWTConfig{Keys: keys}, JWTAlgorithmRS256},
+		{"RS256 without keys", JWTConfig{Algorithm: JWTAlgorithmRS256, SecretKey: secret}, "set JWT_PRIVATE_KEY_FILE or JWT_KEYS"},
+		{"RS256 with nothing", JWTConfig{Algorithm: JWTAlgorithmRS256}, "JWT_PRIVATE_KEY_FILE or JWT_KEYS is required"},
+		{"RS256 with a leftover secret", JWTConfig{Algorithm: JWTAlgorithmRS256, PrivateKeyFile: "key.pem", SecretKey: secret}, "JWT_SECRET_KEY is not used"},
+		{"HS256 without secret", JWTConfig{Algorithm: JWTAlgorithmHS256, PrivateKeyFile: "key.pem"}, "set JWT_ALGORITHM=RS256"},
+		{"HS256 with a leftover key", JWTConfig{Algorithm: JWTAlgorithmHS256, SecretKey: secret, Keys: keys}, "JWT_KEYS is not used"},
+		{"both, no algorithm", JWTConfig{SecretKey: secret, PrivateKeyFile: "key.pem"}, "set JWT_ALGORITHM"},
+		{"file and keys", JWTConfig{PrivateKeyFile: "key.pem", Keys: keys}, "both set"},
+		{"unknown algorithm", JWTConfig{Algorithm: "ES256", SecretKey: secret}, "JWT_ALGORITHM must be"},
+	} {
+		err := validateJWTKeys(&tc.cfg)
+		switch tc.want {
+		case JWTAlgorithmHS256, JWTAlgorithmRS256:
+			if err != nil || tc.cfg.Algorithm != tc.want {
+				t.Errorf("%s: algorithm %q, %v, want %s", tc.name, tc.cfg.Algorithm, err, tc.want)
+			}
+		default:
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("%s: %v, want an error containing %q", tc.name, err, tc.want)
+			}
+		}
+	}
+}
+
+func TestLoadJWTKeys(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		cfg, err := loadWith(t, map[string]string{
+			"JWT_SECRET_KEY": "",
+			"JWT_KEYS":       "new:sign:/keys/new.pem,old:verify:/keys/old.pem",
+		})
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		want := []JWTKeyConfig{{"new", JWTKeyRoleSign, "/keys/new.pem"}, {"old", JWTKeyRoleVerify, "/keys/old.pem"}}
+		if !slices.Equal(cfg.JWT.Keys, want) || cfg.JWT.Algorithm != JWTAlgorithmRS256 {
+			t.Errorf("JWT keys %v with %s, want %v with RS256", cfg.JWT.Keys, cfg.JWT.Algorithm, want)
+		}
+	})
+
+	for name, keys := range map[string]string{
+		"no signer":    "old:verify:/keys/old.pem",
+		"two signers":  "a:sign:/keys/a.pem,b:sign:/keys/b.pem",
+		"unknown role": "a:encrypt:/keys/a.pem",
+		"no file":      "a:sign:",
+		"duplicate ID": "a:sign:/keys/a.pem,a:verify:/keys/b.pem",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadWith(t, map[string]string{"JWT_SECRET_KEY": "", "JWT_KEYS": keys}); err == nil || !strings.Contains(err.Error(), "JWT_KEYS") {
+				t.Errorf("Load with JWT_KEYS=%s = %v, want a JWT_KEYS error", keys, err)
+			}
+		})
+	}
+}
+
+func TestLoadCORS(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		cfg, err := loadWith(t, map[string]string{"CORS_MAX_AGE": "10m", "CORS_EXPOSE_HEADERS": "X-Request-ID,Retry-After"})
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		if cfg.Server.CORSMaxAge != 10*time.Minute || !slices.Equal(cfg.Server.CORSExposeHeaders, []string{"X-Request-ID", "Retry-After"}) {
+			t.Errorf("CORS max age %v exposing %v, want 10m exposing X-Request-ID and Retry-After", cfg.Server.CORSMaxAge, cfg.Server.CORSExposeHeaders)
+		}
+	})
+
+	t.Run("negative max age", func(t *testing.T) {
+		if _, err := loadWith(t, map[string]string{"CORS_MAX_AGE": "-1s"}); err == nil || !strings.Contains(err.Error(), "CORS_MAX_AGE") {
+			t.Errorf("Load with CORS_MAX_AGE=-1s = %v, want a CORS_MAX_AGE error", err)
+		}
+	})
+}
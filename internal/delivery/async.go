@@ -0,0 +1,118 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/qcom/qcom/internal/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrSenderClosed is returned by AsyncSender.Send after Shutdown.
+var ErrSenderClosed = errors.New("OTP sender is shut down")
+
+type deliveryJob struct {
+	phoneNumber string
+	otp         string
+}
+
+// AsyncSender queues OTPs for a fixed pool of workers that deliver them with
+// the wrapped sender, so requests don't wait on the provider. Since the
+// delivering channel isn't known yet, Send reports the primary channel. When
+// the queue is full, Send delivers synchronously instead.
+type AsyncSender struct {
+	next    Sender
+	channel string
+	queue   chan deliveryJob
+	logger  *logrus.Logger
+
+	mu     sync.RWMutex
+	closed bool
+
+	workers sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func NewAsyncSender(next Sender, primaryChannel string, workers, queueSize int, logger *logrus.Logger) *AsyncSender {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &AsyncSender{
+		next:    next,
+		channel: primaryChannel,
+		queue:   make(chan deliveryJob, queueSize),
+		logger:  logger,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	for i := 0; i < workers; i++ {
+		s.workers.Add(1)
+		go s.work()
+	}
+
+	return s
+}
+
+func (s *AsyncSender) Send(ctx context.Context, phoneNumber, otp string) (string, error) {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return "", ErrSenderClosed
+	}
+
+	select {
+	case s.queue <- deliveryJob{phoneNumber: phoneNumber, otp: otp}:
+		s.mu.RUnlock()
+		return s.channel, nil
+	default:
+		s.mu.RUnlock()
+	}
+
+	s.logger.WithField("phone", logging.LogPhone(phoneNumber)).Warn("OTP delivery queue full, sending synchronously")
+	return s.next.Send(ctx, phoneNumber, otp)
+}
+
+func (s *AsyncSender) work() {
+	defer s.workers.Done()
+
+	for job := range s.queue {
+		if s.ctx.Err() != nil {
+			s.logger.WithField("phone", logging.LogPhone(job.phoneNumber)).Error("OTP not delivered before shutdown")
+			continue
+		}
+
+		if _, err := s.next.Send(s.ctx, job.phoneNumber, job.otp); err != nil {
+			s.logger.WithError(err).WithField("phone", logging.LogPhone(job.phoneNumber)).Error("Failed to deliver queued OTP")
+		}
+	}
+}
+
+// Shutdown stops accepting OTPs and waits for queued ones to be delivered.
+// If ctx expires first, in-flight deliveries are canceled and every OTP
+// still queued is logged as undelivered.
+func (s *AsyncSender) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(drained)
+	}()
+
+	defer s.cancel()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		<-drained
+		return ctx.Err()
+	}
+}
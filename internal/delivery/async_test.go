@@ -0,0 +1,80 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// blockingSender blocks every Send until its context is done.
+type blockingSender struct {
+	started chan struct{}
+}
+
+func (s *blockingSender) Send(ctx context.Context, _, _ string) (string, error) {
+	s.started <- struct{}{}
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestAsyncSenderDrainsOnShutdown(t *testing.T) {
+	next := &fakeSender{channel: "whatsapp"}
+	sender := NewAsyncSender(next, "sms", 2, 10, testLogger())
+
+	for i := 0; i < 5; i++ {
+		channel, err := sender.Send(context.Background(), "+15551234567", "123456")
+		if err != nil || channel != "sms" {
+			t.Fatalf("Send = %q, %v, want the primary channel", channel, err)
+		}
+	}
+	if err := sender.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if next.count() != 5 {
+		t.Errorf("delivered %d OTPs before Shutdown returned, want 5", next.count())
+	}
+
+	if _, err := sender.Send(context.Background(), "+15551234567", "123456"); !errors.Is(err, ErrSenderClosed) {
+		t.Errorf("Send after Shutdown = %v, want ErrSenderClosed", err)
+	}
+	if err := sender.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+}
+
+// With the queue full, Send delivers before returning and reports the
+// channel that was used.
+func TestAsyncSenderSendsSynchronouslyWhenFull(t *testing.T) {
+	next := &fakeSender{channel: "whatsapp"}
+	sender := NewAsyncSender(next, "sms", 0, 0, testLogger())
+	defer sender.Shutdown(context.Background())
+
+	channel, err := sender.Send(context.Background(), "+15551234567", "123456")
+	if err != nil || channel != "whatsapp" {
+		t.Errorf("Send = %q, %v, want delivery by whatsapp", channel, err)
+	}
+	if next.count() != 1 {
+		t.Errorf("delivered %d OTPs, want 1", next.count())
+	}
+}
+
+// A Shutdown that runs out of time cancels the delivery in flight and
+// drops the rest of the queue.
+func TestAsyncSenderShutdownTimeout(t *testing.T) {
+	next := &blockingSender{started: make(chan struct{}, 3)}
+	sender := NewAsyncSender(next, "sms", 1, 10, testLogger())
+	for i := 0; i < 3; i++ {
+		sender.Send(context.Background(), "+15551234567", "123456")
+	}
+	<-next.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := sender.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown = %v, want context.DeadlineExceeded", err)
+	}
+	if n := len(next.started); n != 0 {
+		t.Errorf("%d queued OTPs were sent after the deadline", n)
+	}
+}
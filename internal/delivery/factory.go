@@ -0,0 +1,60 @@
+package delivery
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/qcom/qcom/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// NewSender builds the senders named by cfg.Providers, in order. A single
+// provider is returned as-is; several are wrapped in a FailoverSender or a
+// BroadcastSender as cfg.Policy says, or only the first is used.
+// otpExpiry is quoted in messages that mention how long the code is valid.
+func NewSender(cfg *config.DeliveryConfig, otpExpiry time.Duration, logger *logrus.Logger) (Sender, error) {
+	var senders []Sender
+	for _, name := range cfg.Providers {
+		switch name {
+		case "log":
+			senders = append(senders, NewLogSender(logger))
+		case "whatsapp":
+			if cfg.WhatsAppAccessToken == "" || cfg.WhatsAppPhoneNumberID == "" {
+				return nil, fmt.Errorf("whatsapp provider requires WHATSAPP_ACCESS_TOKEN and WHATSAPP_PHONE_NUMBER_ID")
+			}
+			var template *WhatsAppTemplate
+			if cfg.WhatsAppTemplateName != "" {
+				template = &WhatsAppTemplate{
+					Name:     cfg.WhatsAppTemplateName,
+					Language: cfg.WhatsAppTemplateLanguage,
+					Expiry:   otpExpiry,
+				}
+			}
+			senders = append(senders, NewWhatsAppSender(cfg.WhatsAppAccessToken, cfg.WhatsAppPhoneNumberID, template))
+		case "sms":
+			if cfg.TwilioAccountSID == "" || cfg.TwilioAuthToken == "" || cfg.TwilioFromNumber == "" {
+				return nil, fmt.Errorf("sms provider requires TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and TWILIO_FROM_NUMBER")
+			}
+			senders = append(senders, NewSMSSender(cfg.TwilioAccountSID, cfg.TwilioAuthToken, cfg.TwilioFromNumber))
+		case "simulated":
+			senders = append(senders, NewSimulatedSender(cfg.SimulatedMinDelay, cfg.SimulatedMaxDelay, cfg.SimulatedFailurePercent))
+		default:
+			return nil, fmt.Errorf("unknown OTP delivery provider: %s", name)
+		}
+	}
+
+	switch len(senders) {
+	case 0:
+		return nil, fmt.Errorf("at least one OTP delivery provider is required")
+	case 1:
+		return senders[0], nil
+	}
+	switch cfg.Policy {
+	case config.DeliveryPolicySingle:
+		return senders[0], nil
+	case config.DeliveryPolicyBroadcast:
+		return NewBroadcastSender(senders, logger), nil
+	default:
+		return NewFailoverSender(senders, logger), nil
+	}
+}
@@ -0,0 +1,124 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/qcom/qcom/internal/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// Sender delivers an OTP to a phone number.
+type Sender interface {
+	// Send delivers otp and returns the name of the channel that delivered it.
+	Send(ctx context.Context, phoneNumber, otp string) (string, error)
+}
+
+// LogSender writes OTPs to the log instead of delivering them. It is meant
+// for local development only.
+type LogSender struct {
+	logger *logrus.Logger
+}
+
+func NewLogSender(logger *logrus.Logger) *LogSender {
+	return &LogSender{logger: logger}
+}
+
+func (s *LogSender) Send(ctx context.Context, phoneNumber, otp string) (string, error) {
+	s.logger.WithFields(logrus.Fields{
+		"phone": logging.LogPhone(phoneNumber),
+		"otp":   otp,
+	}).Info("OTP generated (logged for development)")
+	return "log", nil
+}
+
+// FailoverSender tries each sender in order until one succeeds.
+type FailoverSender struct {
+	senders []Sender
+	logger  *logrus.Logger
+}
+
+func NewFailoverSender(senders []Sender, logger *logrus.Logger) *FailoverSender {
+	return &FailoverSender{
+		senders: senders,
+		logger:  logger,
+	}
+}
+
+func (s *FailoverSender) Send(ctx context.Context, phoneNumber, otp string) (string, error) {
+	var errs []error
+	for _, sender := range s.senders {
+		channel, err := sender.Send(ctx, phoneNumber, otp)
+		if err == nil {
+			if len(errs) > 0 {
+				s.logger.WithField("channel", channel).Warn("OTP delivered by fallback sender")
+			}
+			return channel, nil
+		}
+
+		s.logger.WithError(err).Warn("OTP sender failed, trying next")
+		errs = append(errs, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return "", fmt.Errorf("all OTP senders failed: %w", errors.Join(errs...))
+}
+
+// BroadcastSender sends the same OTP through every sender at once, for
+// deployments that would rather a code arrive twice than not at all.
+type BroadcastSender struct {
+	senders []Sender
+	logger  *logrus.Logger
+}
+
+func NewBroadcastSender(senders []Sender, logger *logrus.Logger) *BroadcastSender {
+	return &BroadcastSender{
+		senders: senders,
+		logger:  logger,
+	}
+}
+
+// Send succeeds if any sender does, and returns the channels that delivered
+// the OTP, comma-separated in configuration order. The result of each sender
+// is logged.
+func (s *BroadcastSender) Send(ctx context.Context, phoneNumber, otp string) (string, error) {
+	type result struct {
+		channel string
+		err     error
+	}
+	results := make([]result, len(s.senders))
+
+	var wg sync.WaitGroup
+	for i, sender := range s.senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			channel, err := sender.Send(ctx, phoneNumber, otp)
+			results[i] = result{channel, err}
+		}()
+	}
+	wg.Wait()
+
+	var delivered []string
+	var errs []error
+	for _, r := range results {
+		if r.err != nil {
+			logging.LoggerFromContext(ctx, s.logger).WithError(r.err).Warn("OTP broadcast sender failed")
+			errs = append(errs, r.err)
+			continue
+		}
+		logging.LoggerFromContext(ctx, s.logger).WithField("channel", r.channel).Info("OTP broadcast sender delivered")
+		delivered = append(delivered, r.channel)
+	}
+
+	if len(delivered) == 0 {
+		return "", fmt.Errorf("all OTP senders failed: %w", errors.Join(errs...))
+	}
+	return strings.Join(delivered, ","), nil
+}
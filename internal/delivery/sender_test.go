@@ -0,0 +1,213 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qcom/qcom/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// fakeSender delivers through channel, or fails with err if it is set, and
+// counts its sends.
+type fakeSender struct {
+	channel string
+	err     error
+
+	mu    sync.Mutex
+	sends int
+	otp   string
+}
+
+func (s *fakeSender) Send(_ context.Context, _, otp string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sends++
+	s.otp = otp
+	if s.err != nil {
+		return "", s.err
+	}
+	return s.channel, nil
+}
+
+func (s *fakeSender) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sends
+}
+
+func TestFailoverSenderFallsBack(t *testing.T) {
+	primary := &fakeSender{channel: "whatsapp", err: errors.New("whatsapp down")}
+	secondary := &fakeSender{channel: "sms"}
+	tertiary := &fakeSender{channel: "log"}
+	sender := NewFailoverSender([]Sender{primary, secondary, tertiary}, testLogger())
+
+	channel, err := sender.Send(context.Background(), "+15551234567", "123456")
+	if err != nil || channel != "sms" {
+		t.Fatalf("Send = %q, %v, want delivery by sms", channel, err)
+	}
+	if primary.count() != 1 || secondary.count() != 1 || secondary.otp != "123456" {
+		t.Errorf("primary sent %d, secondary %d times, want each tried once with the OTP", primary.count(), secondary.count())
+	}
+	if tertiary.count() != 0 {
+		t.Error("a sender after the one that delivered was tried")
+	}
+}
+
+func TestFailoverSenderAllFail(t *testing.T) {
+	sender := NewFailoverSender([]Sender{
+		&fakeSender{err: errors.New("whatsapp down")},
+		&fakeSender{err: errors.New("sms down")},
+	}, testLogger())
+
+	_, err := sender.Send(context.Background(), "+15551234567", "123456")
+	if err == nil {
+		t.Fatal("Send succeeded with every sender failing")
+	}
+	for _, cause := range []string{"whatsapp down", "sms down"} {
+		if !strings.Contains(err.Error(), cause) {
+			t.Errorf("error %q does not mention %q", err, cause)
+		}
+	}
+}
+
+// Once the request is cancelled, no further senders are tried.
+func TestFailoverSenderStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	next := &fakeSender{channel: "sms"}
+	sender := NewFailoverSender([]Sender{&fakeSender{err: context.Canceled}, next}, testLogger())
+
+	if _, err := sender.Send(ctx, "+15551234567", "123456"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Send = %v, want context.Canceled", err)
+	}
+	if next.count() != 0 {
+		t.Error("a sender was tried after the request was cancelled")
+	}
+}
+
+func TestBroadcastSenderPartialSuccess(t *testing.T) {
+	whatsapp := &fakeSender{channel: "whatsapp"}
+	sms := &fakeSender{channel: "sms", err: errors.New("sms down")}
+	email := &fakeSender{channel: "email"}
+	sender := NewBroadcastSender([]Sender{whatsapp, sms, email}, testLogger())
+
+	channel, err := sender.Send(context.Background(), "+15551234567", "123456")
+	if err != nil || channel != "whatsapp,email" {
+		t.Fatalf("Send = %q, %v, want delivery by whatsapp and email", channel, err)
+	}
+	for _, s := range []*fakeSender{whatsapp, sms, email} {
+		if s.count() != 1 || s.otp != "123456" {
+			t.Errorf("%s sent %d times with OTP %q, want once with the same OTP", s.channel, s.count(), s.otp)
+		}
+	}
+}
+
+func TestBroadcastSenderAllFail(t *testing.T) {
+	sender := NewBroadcastSender([]Sender{
+		&fakeSender{err: errors.New("whatsapp down")},
+		&fakeSender{err: errors.New("sms down")},
+	}, testLogger())
+
+	_, err := sender.Send(context.Background(), "+15551234567", "123456")
+	if err == nil {
+		t.Fatal("Send succeeded with every sender failing")
+	}
+	for _, cause := range []string{"whatsapp down", "sms down"} {
+		if !strings.Contains(err.Error(), cause) {
+			t.Errorf("error %q does not mention %q", err, cause)
+		}
+	}
+}
+
+// barrierSender only delivers once every sender sharing its barrier has
+// started, so a broadcast that sends one at a time would never finish.
+type barrierSender struct {
+	channel string
+	barrier *sync.WaitGroup
+}
+
+func (s barrierSender) Send(context.Context, string, string) (string, error) {
+	s.barrier.Done()
+	s.barrier.Wait()
+	return s.channel, nil
+}
+
+func TestBroadcastSenderSendsConcurrently(t *testing.T) {
+	var barrier sync.WaitGroup
+	barrier.Add(2)
+	sender := NewBroadcastSender([]Sender{barrierSender{"whatsapp", &barrier}, barrierSender{"sms", &barrier}}, testLogger())
+
+	done := make(chan string)
+	go func() {
+		channel, _ := sender.Send(context.Background(), "+15551234567", "123456")
+		done <- channel
+	}()
+	select {
+	case channel := <-done:
+		if channel != "whatsapp,sms" {
+			t.Errorf("Send = %q, want whatsapp,sms", channel)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast did not send to its senders at the same time")
+	}
+}
+
+func TestNewSender(t *testing.T) {
+	twilio := config.DeliveryConfig{TwilioAccountSID: "AC1", TwilioAuthToken: "token", TwilioFromNumber: "+15550000000"}
+
+	single := twilio
+	single.Providers = []string{"sms"}
+	if sender, err := NewSender(&single, 0, testLogger()); err != nil {
+		t.Errorf("NewSender(sms): %v", err)
+	} else if _, ok := sender.(*SMSSender); !ok {
+		t.Errorf("NewSender(sms) = %T, want the SMS sender itself", sender)
+	}
+
+	failover := twilio
+	failover.Providers = []string{"sms", "log"}
+	failover.Policy = config.DeliveryPolicyFailover
+	if sender, err := NewSender(&failover, 0, testLogger()); err != nil {
+		t.Errorf("NewSender(sms, log): %v", err)
+	} else if _, ok := sender.(*FailoverSender); !ok {
+		t.Errorf("NewSender(sms, log) = %T, want a FailoverSender", sender)
+	}
+
+	broadcast := failover
+	broadcast.Policy = config.DeliveryPolicyBroadcast
+	if sender, err := NewSender(&broadcast, 0, testLogger()); err != nil {
+		t.Errorf("NewSender(sms, log) broadcasting: %v", err)
+	} else if _, ok := sender.(*BroadcastSender); !ok {
+		t.Errorf("NewSender(sms, log) broadcasting = %T, want a BroadcastSender", sender)
+	}
+
+	first := failover
+	first.Policy = config.DeliveryPolicySingle
+	if sender, err := NewSender(&first, 0, testLogger()); err != nil {
+		t.Errorf("NewSender(sms, log) with the single policy: %v", err)
+	} else if _, ok := sender.(*SMSSender); !ok {
+		t.Errorf("NewSender(sms, log) with the single policy = %T, want the first provider's sender", sender)
+	}
+
+	for name, cfg := range map[string]config.DeliveryConfig{
+		"no providers":           {},
+		"unknown provider":       {Providers: []string{"carrier-pigeon"}},
+		"sms without Twilio":     {Providers: []string{"sms"}},
+		"whatsapp without token": {Providers: []string{"whatsapp"}},
+	} {
+		if _, err := NewSender(&cfg, 0, testLogger()); err == nil {
+			t.Errorf("NewSender with %s succeeded", name)
+		}
+	}
+}
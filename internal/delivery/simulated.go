@@ -0,0 +1,51 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// errSimulatedFailure is returned by SimulatedSender for the share of sends
+// it fails on purpose.
+var errSimulatedFailure = errors.New("simulated delivery failure")
+
+// SimulatedSender delivers nothing but takes as long as a provider would,
+// a uniformly random delay between minDelay and maxDelay, and fails
+// failurePercent of the sends. It is meant for load tests, to exercise
+// timeouts, the delivery workers and failover without sending real messages.
+// The OTPs are not logged.
+type SimulatedSender struct {
+	minDelay       time.Duration
+	maxDelay       time.Duration
+	failurePercent int
+}
+
+func NewSimulatedSender(minDelay, maxDelay time.Duration, failurePercent int) *SimulatedSender {
+	return &SimulatedSender{
+		minDelay:       minDelay,
+		maxDelay:       maxDelay,
+		failurePercent: failurePercent,
+	}
+}
+
+func (s *SimulatedSender) Send(ctx context.Context, phoneNumber, otp string) (string, error) {
+	delay := s.minDelay
+	if s.maxDelay > s.minDelay {
+		delay += rand.N(s.maxDelay - s.minDelay + 1)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	if rand.IntN(100) < s.failurePercent {
+		return "", errSimulatedFailure
+	}
+	return "simulated", nil
+}
@@ -0,0 +1,88 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qcom/qcom/internal/config"
+)
+
+func TestNewSenderSimulated(t *testing.T) {
+	cfg := config.DeliveryConfig{Providers: []string{"simulated"}, SimulatedFailurePercent: 100}
+	sender, err := NewSender(&cfg, 0, testLogger())
+	if err != nil {
+		t.Fatalf("NewSender(simulated): %v", err)
+	}
+	if _, err := sender.Send(context.Background(), "+15551234567", "123456"); !errors.Is(err, errSimulatedFailure) {
+		t.Errorf("Send = %v, want the configured simulated failure", err)
+	}
+}
+
+func TestSimulatedSenderFailureRate(t *testing.T) {
+	for _, tc := range []struct {
+		percent  int
+		min, max int
+	}{
+		{0, 0, 0},
+		{30, 220, 380},
+		{100, 1000, 1000},
+	} {
+		sender := NewSimulatedSender(0, 0, tc.percent)
+		failures := 0
+		for i := 0; i < 1000; i++ {
+			channel, err := sender.Send(context.Background(), "+15551234567", "123456")
+			if errors.Is(err, errSimulatedFailure) {
+				failures++
+			} else if err != nil || channel != "simulated" {
+				t.Fatalf("Send = %q, %v", channel, err)
+			}
+		}
+		if failures < tc.min || failures > tc.max {
+			t.Errorf("%d%% failure rate failed %d of 1000 sends, want %d to %d", tc.percent, failures, tc.min, tc.max)
+		}
+	}
+}
+
+func TestSimulatedSenderDelay(t *testing.T) {
+	const minDelay, maxDelay, sends = 10 * time.Millisecond, 30 * time.Millisecond, 50
+	sender := NewSimulatedSender(minDelay, maxDelay, 0)
+
+	delays := make([]time.Duration, sends)
+	var wg sync.WaitGroup
+	for i := range delays {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			sender.Send(context.Background(), "+15551234567", "123456")
+			delays[i] = time.Since(start)
+		}()
+	}
+	wg.Wait()
+
+	var total time.Duration
+	for _, delay := range delays {
+		if delay < minDelay {
+			t.Errorf("a send took %v, less than the minimum delay", delay)
+		}
+		total += delay
+	}
+	// Uniform between the bounds, so about 20ms on average, give or take
+	// timer overshoot.
+	if mean := total / sends; mean < 15*time.Millisecond || mean > 35*time.Millisecond {
+		t.Errorf("sends took %v on average, want about %v", mean, (minDelay+maxDelay)/2)
+	}
+}
+
+func TestSimulatedSenderCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	sender := NewSimulatedSender(time.Minute, time.Minute, 0)
+
+	if _, err := sender.Send(ctx, "+15551234567", "123456"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Send past the deadline = %v, want context.DeadlineExceeded", err)
+	}
+}
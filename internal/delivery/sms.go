@@ -0,0 +1,56 @@
+package delivery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const twilioAPIURL = "https://api.twilio.com/2010-04-01"
+
+// SMSSender delivers OTPs by SMS through the Twilio Messages API.
+type SMSSender struct {
+	accountSID string
+	authToken  string
+	fromNumber string
+	httpClient *http.Client
+}
+
+func NewSMSSender(accountSID, authToken, fromNumber string) *SMSSender {
+	return &SMSSender{
+		accountSID: accountSID,
+		authToken:  authToken,
+		fromNumber: fromNumber,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *SMSSender) Send(ctx context.Context, phoneNumber, otp string) (string, error) {
+	form := url.Values{}
+	form.Set("To", phoneNumber)
+	form.Set("From", s.fromNumber)
+	form.Set("Body", fmt.Sprintf("Your verification code is %s", otp))
+
+	endpoint := fmt.Sprintf("%s/Accounts/%s/Messages.json", twilioAPIURL, s.accountSID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to build SMS request: %w", err)
+	}
+	req.SetBasicAuth(s.accountSID, s.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("SMS request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("SMS API returned status %d", resp.StatusCode)
+	}
+
+	return "sms", nil
+}
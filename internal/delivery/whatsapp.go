@@ -0,0 +1,140 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const whatsAppAPIURL = "https://graph.facebook.com/v19.0"
+
+var (
+	// ErrInvalidTemplate means the WhatsApp template does not exist, is not
+	// approved for the language, or does not take the parameters sent.
+	ErrInvalidTemplate = errors.New("invalid WhatsApp template")
+	// ErrRateLimited means the provider is throttling this sender.
+	ErrRateLimited = errors.New("OTP provider rate limit reached")
+)
+
+// WhatsApp Cloud API error codes, see
+// https://developers.facebook.com/docs/whatsapp/cloud-api/support/error-codes
+var (
+	whatsAppTemplateErrorCodes  = []int{132000, 132001, 132005, 132007, 132012, 132015, 132016}
+	whatsAppRateLimitErrorCodes = []int{4, 80007, 130429, 131048, 131056}
+)
+
+// WhatsAppTemplate is an approved message template. Its body must take two
+// parameters: the OTP, then its validity in minutes.
+type WhatsAppTemplate struct {
+	Name     string
+	Language string
+	Expiry   time.Duration
+}
+
+// WhatsAppSender delivers OTPs through the WhatsApp Cloud API. Without a
+// template it sends a free-text message, which WhatsApp only delivers inside
+// a 24-hour customer service window.
+type WhatsAppSender struct {
+	accessToken   string
+	phoneNumberID string
+	template      *WhatsAppTemplate
+	httpClient    *http.Client
+}
+
+func NewWhatsAppSender(accessToken, phoneNumberID string, template *WhatsAppTemplate) *WhatsAppSender {
+	return &WhatsAppSender{
+		accessToken:   accessToken,
+		phoneNumberID: phoneNumberID,
+		template:      template,
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *WhatsAppSender) Send(ctx context.Context, phoneNumber, otp string) (string, error) {
+	body, err := json.Marshal(s.message(phoneNumber, otp))
+	if err != nil {
+		return "", fmt.Errorf("failed to encode WhatsApp message: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/%s/messages", whatsAppAPIURL, s.phoneNumberID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to build WhatsApp request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("WhatsApp request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", whatsAppError(resp)
+	}
+
+	return "whatsapp", nil
+}
+
+func (s *WhatsAppSender) message(phoneNumber, otp string) map[string]interface{} {
+	message := map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                strings.TrimPrefix(phoneNumber, "+"),
+	}
+
+	if s.template == nil {
+		message["type"] = "text"
+		message["text"] = map[string]string{
+			"body": fmt.Sprintf("Your verification code is %s", otp),
+		}
+		return message
+	}
+
+	message["type"] = "template"
+	message["template"] = map[string]interface{}{
+		"name":     s.template.Name,
+		"language": map[string]string{"code": s.template.Language},
+		"components": []map[string]interface{}{
+			{
+				"type": "body",
+				"parameters": []map[string]string{
+					{"type": "text", "text": otp},
+					{"type": "text", "text": strconv.Itoa(int(s.template.Expiry.Minutes()))},
+				},
+			},
+		},
+	}
+	return message
+}
+
+// whatsAppError turns an error response into an error wrapping
+// ErrInvalidTemplate or ErrRateLimited where the error code allows.
+func whatsAppError(resp *http.Response) error {
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Code    int    `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error.Code == 0 {
+		return fmt.Errorf("WhatsApp API returned status %d", resp.StatusCode)
+	}
+
+	code := body.Error.Code
+	switch {
+	case slices.Contains(whatsAppTemplateErrorCodes, code):
+		return fmt.Errorf("%w: %s (code %d)", ErrInvalidTemplate, body.Error.Message, code)
+	case slices.Contains(whatsAppRateLimitErrorCodes, code) || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s (code %d)", ErrRateLimited, body.Error.Message, code)
+	default:
+		return fmt.Errorf("WhatsApp API returned status %d: %s (code %d)", resp.StatusCode, body.Error.Message, code)
+	}
+}
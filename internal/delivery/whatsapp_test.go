@@ -0,0 +1,110 @@
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripFunc answers requests without a network.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// whatsAppReplying returns a sender whose API calls get status and body, and
+// a pointer to the last message it sent.
+func whatsAppReplying(template *WhatsAppTemplate, status int, body string) (*WhatsAppSender, *[]byte) {
+	sender := NewWhatsAppSender("token", "12345", template)
+	var sent []byte
+	sender.httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sent, _ = io.ReadAll(r.Body)
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Header: http.Header{}}, nil
+	})
+	return sender, &sent
+}
+
+func TestWhatsAppSenderTemplateParameters(t *testing.T) {
+	sender, sent := whatsAppReplying(&WhatsAppTemplate{Name: "otp", Language: "en_US", Expiry: 10 * time.Minute}, http.StatusOK, `{}`)
+
+	channel, err := sender.Send(context.Background(), "+15551234567", "123456")
+	if err != nil || channel != "whatsapp" {
+		t.Fatalf("Send = %q, %v, want delivery by whatsapp", channel, err)
+	}
+	var message struct {
+		To       string `json:"to"`
+		Type     string `json:"type"`
+		Template struct {
+			Name     string `json:"name"`
+			Language struct {
+				Code string `json:"code"`
+			} `json:"language"`
+			Components []struct {
+				Parameters []struct {
+					Text string `json:"text"`
+				} `json:"parameters"`
+			} `json:"components"`
+		} `json:"template"`
+	}
+	json.Unmarshal(*sent, &message)
+	if message.To != "15551234567" || message.Type != "template" || message.Template.Name != "otp" || message.Template.Language.Code != "en_US" {
+		t.Errorf("message = %s, want the otp template in en_US to 15551234567", *sent)
+	}
+	if len(message.Template.Components) != 1 {
+		t.Fatalf("message has %d components, want the body", len(message.Template.Components))
+	}
+	params := message.Template.Components[0].Parameters
+	if len(params) != 2 || params[0].Text != "123456" || params[1].Text != "10" {
+		t.Errorf("body parameters = %+v, want the OTP and 10 minutes", params)
+	}
+}
+
+func TestWhatsAppSenderFreeText(t *testing.T) {
+	sender, sent := whatsAppReplying(nil, http.StatusOK, `{}`)
+
+	if _, err := sender.Send(context.Background(), "+15551234567", "123456"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	var message struct {
+		Type string `json:"type"`
+		Text struct {
+			Body string `json:"body"`
+		} `json:"text"`
+	}
+	json.Unmarshal(*sent, &message)
+	if message.Type != "text" || !strings.Contains(message.Text.Body, "123456") {
+		t.Errorf("message = %s, want a text containing the OTP", *sent)
+	}
+}
+
+func TestWhatsAppSenderErrors(t *testing.T) {
+	template := &WhatsAppTemplate{Name: "otp", Language: "en_US", Expiry: time.Minute}
+	for _, tc := range []struct {
+		status int
+		body   string
+		want   error
+	}{
+		{http.StatusBadRequest, `{"error":{"message":"Template name does not exist","code":132001}}`, ErrInvalidTemplate},
+		{http.StatusBadRequest, `{"error":{"message":"Rate limit hit","code":130429}}`, ErrRateLimited},
+		{http.StatusTooManyRequests, `{"error":{"message":"Slow down","code":1}}`, ErrRateLimited},
+		{http.StatusInternalServerError, `{"error":{"message":"Oops","code":1}}`, nil},
+		{http.StatusBadGateway, `not json`, nil},
+	} {
+		sender, _ := whatsAppReplying(template, tc.status, tc.body)
+		_, err := sender.Send(context.Background(), "+15551234567", "123456")
+		if err == nil {
+			t.Errorf("Send with a %d %s response succeeded", tc.status, tc.body)
+			continue
+		}
+		if tc.want != nil && !errors.Is(err, tc.want) {
+			t.Errorf("Send with a %d %s response = %v, want %v", tc.status, tc.body, err, tc.want)
+		}
+		if tc.want == nil && (errors.Is(err, ErrInvalidTemplate) || errors.Is(err, ErrRateLimited)) {
+			t.Errorf("Send with a %d %s response = %v, want a plain error", tc.status, tc.body, err)
+		}
+	}
+}
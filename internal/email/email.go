@@ -0,0 +1,125 @@
+package email
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrInvalid is returned by NormalizeEmail for input that is not a plain
+// addr-spec such as "user@example.com".
+var ErrInvalid = errors.New("invalid email address")
+
+// Limits from RFC 5321.
+const (
+	maxLocalLength   = 64
+	maxAddressLength = 254
+)
+
+// Policy controls how far NormalizeEmail goes beyond trimming and
+// lowercasing the domain, which is always safe. Everything else depends on
+// the provider, so only rewrite local parts for providers known to treat
+// them the same way; otherwise two different inboxes could share a key.
+type Policy struct {
+	// LowercaseLocal lowercases the local part at every provider. RFC 5321
+	// lets providers treat it case-sensitively, though few do. Local parts
+	// at Gmail are lowercased regardless.
+	LowercaseLocal bool
+
+	// StripTags removes a "+tag" suffix from the local part at providers
+	// known to deliver such subaddresses to the untagged inbox.
+	StripTags bool
+
+	// IgnoreGmailDots removes dots from Gmail local parts, which Gmail
+	// ignores, and treats googlemail.com as gmail.com.
+	IgnoreGmailDots bool
+}
+
+// gmailDomains are the domains of Gmail inboxes.
+var gmailDomains = map[string]bool{"gmail.com": true, "googlemail.com": true}
+
+// subaddressingDomains deliver user+tag@domain to user@domain.
+var subaddressingDomains = map[string]bool{
+	"gmail.com":      true,
+	"googlemail.com": true,
+	"outlook.com":    true,
+	"hotmail.com":    true,
+	"live.com":       true,
+	"icloud.com":     true,
+	"me.com":         true,
+	"fastmail.com":   true,
+	"proton.me":      true,
+	"protonmail.com": true,
+}
+
+// NormalizeEmail validates raw and returns the form it should be stored
+// under: trimmed, with the domain lowercased and the local part rewritten
+// as the policy allows.
+func (p Policy) NormalizeEmail(raw string) (string, error) {
+	address := strings.TrimSpace(raw)
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 || len(address) > maxAddressLength {
+		return "", ErrInvalid
+	}
+	local, domain := address[:at], strings.ToLower(strings.TrimSuffix(address[at+1:], "."))
+	if !isValidLocal(local) || !isValidDomain(domain) {
+		return "", ErrInvalid
+	}
+
+	gmail := gmailDomains[domain]
+	if p.LowercaseLocal || gmail {
+		local = strings.ToLower(local)
+	}
+	if p.StripTags && subaddressingDomains[domain] {
+		if plus := strings.IndexByte(local, '+'); plus > 0 {
+			local = local[:plus]
+		}
+	}
+	if p.IgnoreGmailDots && gmail {
+		local = strings.ReplaceAll(local, ".", "")
+		domain = "gmail.com"
+		if local == "" {
+			return "", ErrInvalid
+		}
+	}
+
+	return local + "@" + domain, nil
+}
+
+// isValidLocal accepts dot-atom local parts. Quoted local parts are valid
+// but so rare in practice that they are refused rather than normalized.
+func isValidLocal(local string) bool {
+	if local == "" || len(local) > maxLocalLength || local[0] == '.' || local[len(local)-1] == '.' || strings.Contains(local, "..") {
+		return false
+	}
+	for i := 0; i < len(local); i++ {
+		c := local[i]
+		if !isAlnum(c) && !strings.ContainsRune(".!#$%&'*+/=?^_`{|}~-", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidDomain accepts hostnames of at least two labels. Address literals
+// such as user@[192.0.2.1] are refused.
+func isValidDomain(domain string) bool {
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			if !isAlnum(label[i]) && label[i] != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
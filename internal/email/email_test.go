@@ -0,0 +1,45 @@
+package email
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	all := Policy{LowercaseLocal: true, StripTags: true, IgnoreGmailDots: true}
+	tests := []struct {
+		name   string
+		policy Policy
+		input  string
+		want   string
+		err    error
+	}{
+		{"trimmed, domain lowercased", Policy{}, "  Jane.Doe@Example.COM. ", "Jane.Doe@example.com", nil},
+		{"local lowercased by policy", Policy{LowercaseLocal: true}, "Jane.Doe@Example.com", "jane.doe@example.com", nil},
+		{"Gmail local always lowercased", Policy{}, "Jane.Doe@Gmail.com", "jane.doe@gmail.com", nil},
+		{"tag stripped", all, "jane+news@outlook.com", "jane@outlook.com", nil},
+		{"tag kept without the policy", Policy{}, "jane+news@outlook.com", "jane+news@outlook.com", nil},
+		{"tag kept at other providers", all, "jane+news@example.com", "jane+news@example.com", nil},
+		{"leading plus kept", all, "+jane@outlook.com", "+jane@outlook.com", nil},
+		{"Gmail dots ignored", all, "J.a.n.e+x@googlemail.com", "jane@gmail.com", nil},
+		{"Gmail dots kept without the policy", Policy{StripTags: true}, "j.ane@gmail.com", "j.ane@gmail.com", nil},
+		{"dots kept at other providers", all, "j.ane@outlook.com", "j.ane@outlook.com", nil},
+		{"no at sign", all, "jane.example.com", "", ErrInvalid},
+		{"empty local part", all, "@example.com", "", ErrInvalid},
+		{"leading dot", all, ".jane@example.com", "", ErrInvalid},
+		{"double dot", all, "ja..ne@example.com", "", ErrInvalid},
+		{"quoted local part", all, `"jane doe"@example.com`, "", ErrInvalid},
+		{"single-label domain", all, "jane@localhost", "", ErrInvalid},
+		{"address literal", all, "jane@[192.0.2.1]", "", ErrInvalid},
+		{"hyphen-edged label", all, "jane@-example.com", "", ErrInvalid},
+		{"local part too long", all, strings.Repeat("a", 65) + "@example.com", "", ErrInvalid},
+		{"address too long", all, "jane@" + strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + strings.Repeat("c", 63) + "." + strings.Repeat("d", 63) + ".com", "", ErrInvalid},
+	}
+	for _, tt := range tests {
+		got, err := tt.policy.NormalizeEmail(tt.input)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("%s: NormalizeEmail(%q) = %q, %v, want %q, %v", tt.name, tt.input, got, err, tt.want, tt.err)
+		}
+	}
+}
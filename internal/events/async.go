@@ -0,0 +1,134 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Retry schedule for failed publishes: the delay doubles from
+// retryBaseDelay up to retryMaxDelay, for at most maxPublishAttempts tries.
+const (
+	maxPublishAttempts = 5
+	retryBaseDelay     = 200 * time.Millisecond
+	retryMaxDelay      = 5 * time.Second
+)
+
+// AsyncPublisher queues events for a background worker that publishes them
+// with the wrapped publisher, retrying failures with backoff, so requests
+// never wait on the bus. Events that cannot be queued or published are
+// logged and dropped.
+type AsyncPublisher struct {
+	next   Publisher
+	queue  chan Event
+	logger *logrus.Logger
+
+	mu     sync.RWMutex
+	closed bool
+
+	done   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewAsyncPublisher(next Publisher, queueSize int, logger *logrus.Logger) *AsyncPublisher {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &AsyncPublisher{
+		next:   next,
+		queue:  make(chan Event, queueSize),
+		logger: logger,
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go p.work()
+	return p
+}
+
+// Publish queues event and returns immediately. It never fails: a full queue
+// or a shut down publisher drops the event with a log entry.
+func (p *AsyncPublisher) Publish(_ context.Context, event Event) error {
+	if event.ID == "" {
+		event.ID = uuid.NewString()
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now().UTC()
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		p.logEvent(event).Error("Event dropped after shutdown")
+		return nil
+	}
+
+	select {
+	case p.queue <- event:
+	default:
+		p.logEvent(event).Error("Event queue full, dropping event")
+	}
+	return nil
+}
+
+func (p *AsyncPublisher) work() {
+	defer close(p.done)
+
+	for event := range p.queue {
+		p.publish(event)
+	}
+}
+
+// publish tries event until it is published, it runs out of attempts or the
+// publisher is shut down.
+func (p *AsyncPublisher) publish(event Event) {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := p.next.Publish(p.ctx, event)
+		if err == nil {
+			return
+		}
+		if attempt == maxPublishAttempts {
+			p.logEvent(event).WithError(err).Error("Failed to publish event, dropping it")
+			return
+		}
+		p.logEvent(event).WithError(err).WithField("attempt", attempt).Warn("Failed to publish event, retrying")
+
+		select {
+		case <-time.After(delay):
+		case <-p.ctx.Done():
+			p.logEvent(event).Error("Event not published before shutdown")
+			return
+		}
+		delay = min(delay*2, retryMaxDelay)
+	}
+}
+
+func (p *AsyncPublisher) logEvent(event Event) *logrus.Entry {
+	return p.logger.WithFields(logrus.Fields{"event_id": event.ID, "event_type": event.Type})
+}
+
+// Shutdown stops accepting events and waits for queued ones to be
+// published. If ctx expires first, retries are abandoned and the events
+// still queued are logged as unpublished.
+func (p *AsyncPublisher) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	defer p.cancel()
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		<-p.done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,107 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// recordingPublisher records published events, failing the first failures
+// attempts.
+type recordingPublisher struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	events   []Event
+}
+
+func (p *recordingPublisher) Publish(_ context.Context, event Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts++
+	if p.attempts <= p.failures {
+		return errors.New("bus unavailable")
+	}
+	p.events = append(p.events, event)
+	return nil
+}
+
+func (p *recordingPublisher) published() []Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Event(nil), p.events...)
+}
+
+func TestAsyncPublisherFillsInAndPublishes(t *testing.T) {
+	next := &recordingPublisher{}
+	p := NewAsyncPublisher(next, 10, testLogger())
+
+	p.Publish(context.Background(), Event{Type: TypeLogin})
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	events := next.published()
+	if len(events) != 1 {
+		t.Fatalf("published %d events, want 1", len(events))
+	}
+	if events[0].ID == "" || events[0].OccurredAt.IsZero() {
+		t.Errorf("published event = %+v, want its ID and time filled in", events[0])
+	}
+}
+
+func TestAsyncPublisherRetries(t *testing.T) {
+	next := &recordingPublisher{failures: 2}
+	p := NewAsyncPublisher(next, 10, testLogger())
+
+	p.Publish(context.Background(), Event{ID: "event-1", Type: TypeLogout})
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if events := next.published(); len(events) != 1 || events[0].ID != "event-1" {
+		t.Errorf("published %+v after two failures, want event-1", events)
+	}
+}
+
+func TestAsyncPublisherDropsAfterShutdown(t *testing.T) {
+	next := &recordingPublisher{}
+	p := NewAsyncPublisher(next, 10, testLogger())
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if err := p.Publish(context.Background(), Event{Type: TypeLogin}); err != nil {
+		t.Errorf("Publish after shutdown = %v, want nil", err)
+	}
+	if events := next.published(); len(events) != 0 {
+		t.Errorf("published %d events after shutdown, want 0", len(events))
+	}
+}
+
+func TestAsyncPublisherShutdownAbandonsRetries(t *testing.T) {
+	next := &recordingPublisher{failures: maxPublishAttempts}
+	p := NewAsyncPublisher(next, 10, testLogger())
+	p.Publish(context.Background(), Event{Type: TypeLogin})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown took %v, want it to stop retrying once ctx expires", elapsed)
+	}
+}
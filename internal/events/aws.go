@@ -0,0 +1,96 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// snsAPI is the part of the SNS client snsPublisher uses.
+type snsAPI interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// sqsAPI is the part of the SQS client sqsPublisher uses.
+type sqsAPI interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+type snsPublisher struct {
+	client   snsAPI
+	topicARN string
+}
+
+// NewSNSPublisher publishes each event as a message to the SNS topic with
+// topicARN, in the topic's region.
+func NewSNSPublisher(topicARN string, awsCfg aws.Config) (Publisher, error) {
+	// arn:partition:sns:region:account:topic
+	parts := strings.Split(topicARN, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" || parts[3] == "" {
+		return nil, fmt.Errorf("invalid SNS topic ARN %q", topicARN)
+	}
+
+	client := sns.NewFromConfig(awsCfg, func(o *sns.Options) { o.Region = parts[3] })
+	return &snsPublisher{client: client, topicARN: topicARN}, nil
+}
+
+func (p *snsPublisher) Publish(ctx context.Context, event Event) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	_, err = p.client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(p.topicARN),
+		Message:  aws.String(string(message)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish event to SNS: %w", err)
+	}
+	return nil
+}
+
+type sqsPublisher struct {
+	client   sqsAPI
+	queueURL string
+}
+
+// NewSQSPublisher sends each event as a message to the SQS queue at
+// queueURL, in the queue's region.
+func NewSQSPublisher(queueURL string, awsCfg aws.Config) (Publisher, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid SQS queue URL %q", queueURL)
+	}
+	// sqs.<region>.amazonaws.com, or the legacy <region>.queue.amazonaws.com
+	labels := strings.Split(u.Hostname(), ".")
+	region := labels[0]
+	if region == "sqs" && len(labels) > 1 {
+		region = labels[1]
+	}
+
+	client := sqs.NewFromConfig(awsCfg, func(o *sqs.Options) { o.Region = region })
+	return &sqsPublisher{client: client, queueURL: queueURL}, nil
+}
+
+func (p *sqsPublisher) Publish(ctx context.Context, event Event) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	_, err = p.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(p.queueURL),
+		MessageBody: aws.String(string(message)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send event to SQS: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+type fakeSNS struct {
+	input *sns.PublishInput
+	err   error
+}
+
+func (f *fakeSNS) Publish(_ context.Context, params *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	f.input = params
+	return &sns.PublishOutput{}, f.err
+}
+
+type fakeSQS struct {
+	input *sqs.SendMessageInput
+	err   error
+}
+
+func (f *fakeSQS) SendMessage(_ context.Context, params *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.input = params
+	return &sqs.SendMessageOutput{}, f.err
+}
+
+func TestNewSNSPublisherValidatesTopicARN(t *testing.T) {
+	for _, arn := range []string{"", "topic", "arn:aws:sqs:us-east-1:123456789012:events", "arn:aws:sns::123456789012:events"} {
+		if _, err := NewSNSPublisher(arn, aws.Config{}); err == nil {
+			t.Errorf("NewSNSPublisher(%q) succeeded, want an error", arn)
+		}
+	}
+	if _, err := NewSNSPublisher("arn:aws:sns:eu-west-1:123456789012:events", aws.Config{}); err != nil {
+		t.Errorf("NewSNSPublisher with a valid ARN: %v", err)
+	}
+}
+
+func TestNewSQSPublisherValidatesQueueURL(t *testing.T) {
+	for _, queueURL := range []string{"", "sqs.eu-west-1.amazonaws.com/123456789012/events", "http://sqs.eu-west-1.amazonaws.com/123456789012/events"} {
+		if _, err := NewSQSPublisher(queueURL, aws.Config{}); err == nil {
+			t.Errorf("NewSQSPublisher(%q) succeeded, want an error", queueURL)
+		}
+	}
+	if _, err := NewSQSPublisher("https://sqs.eu-west-1.amazonaws.com/123456789012/events", aws.Config{}); err != nil {
+		t.Errorf("NewSQSPublisher with a valid URL: %v", err)
+	}
+}
+
+func TestSNSPublisherPublishesEventAsJSON(t *testing.T) {
+	client := &fakeSNS{}
+	p := &snsPublisher{client: client, topicARN: "arn:aws:sns:eu-west-1:123456789012:events"}
+
+	if err := p.Publish(context.Background(), Event{ID: "event-1", Type: TypeLogin, UserID: "user-1"}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if got := aws.ToString(client.input.TopicArn); got != p.topicARN {
+		t.Errorf("TopicArn = %q, want %q", got, p.topicARN)
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(aws.ToString(client.input.Message)), &event); err != nil {
+		t.Fatalf("Message is not an event: %v", err)
+	}
+	if event.ID != "event-1" || event.Type != TypeLogin || event.UserID != "user-1" {
+		t.Errorf("published event = %+v", event)
+	}
+
+	client.err = errors.New("throttled")
+	if err := p.Publish(context.Background(), Event{ID: "event-2"}); !errors.Is(err, client.err) {
+		t.Errorf("Publish with SNS failing = %v, want its error", err)
+	}
+}
+
+func TestSQSPublisherSendsEventAsJSON(t *testing.T) {
+	client := &fakeSQS{}
+	p := &sqsPublisher{client: client, queueURL: "https://sqs.eu-west-1.amazonaws.com/123456789012/events"}
+
+	if err := p.Publish(context.Background(), Event{ID: "event-1", Type: TypeLogout}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if got := aws.ToString(client.input.QueueUrl); got != p.queueURL {
+		t.Errorf("QueueUrl = %q, want %q", got, p.queueURL)
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(aws.ToString(client.input.MessageBody)), &event); err != nil {
+		t.Fatalf("MessageBody is not an event: %v", err)
+	}
+	if event.ID != "event-1" || event.Type != TypeLogout {
+		t.Errorf("sent event = %+v", event)
+	}
+
+	client.err = errors.New("throttled")
+	if err := p.Publish(context.Background(), Event{ID: "event-2"}); !errors.Is(err, client.err) {
+		t.Errorf("Publish with SQS failing = %v, want its error", err)
+	}
+}
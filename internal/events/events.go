@@ -0,0 +1,55 @@
+// Package events publishes authentication events, such as logins and token
+// revocations, to a message bus for other systems to consume.
+package events
+
+import (
+	"context"
+	"time"
+)
+
+// Event types.
+const (
+	TypeLogin        = "login"
+	TypeLogout       = "logout"
+	TypeTokenRefresh = "token_refresh"
+	TypeRevoke       = "revoke"
+	TypeGuestLogin   = "guest_login"
+	// TypeGuestUpgrade links a guest to the account it upgraded to, so
+	// consumers can move data kept under GuestID to UserID.
+	TypeGuestUpgrade = "guest_upgrade"
+	// TypeAccountLocked is a security event: the phone number's refresh
+	// tokens were reused too often and it can no longer sign in.
+	TypeAccountLocked   = "account_locked"
+	TypeAccountUnlocked = "account_unlocked"
+)
+
+// Scopes of revoke events.
+const (
+	ScopeUser   = "user"
+	ScopeGlobal = "global"
+)
+
+// Event is published as JSON. ID and OccurredAt are filled in by
+// AsyncPublisher when left empty; the other fields are set as they apply.
+type Event struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	OccurredAt time.Time `json:"occurred_at"`
+	UserID     string    `json:"user_id,omitempty"`
+	Phone      string    `json:"phone,omitempty"`
+	// Scope is ScopeUser or ScopeGlobal for revoke events.
+	Scope string `json:"scope,omitempty"`
+	// GuestID is the guest's ID for guest events. UserID is the account's
+	// for upgrades.
+	GuestID string `json:"guest_id,omitempty"`
+}
+
+// Publisher delivers an event to the bus.
+type Publisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// Nop discards events. It is used when no bus is configured.
+type Nop struct{}
+
+func (Nop) Publish(context.Context, Event) error { return nil }
@@ -0,0 +1,23 @@
+package events
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/qcom/qcom/internal/config"
+)
+
+// NewPublisher builds the publisher named by cfg.Publisher, with AWS clients
+// configured from awsCfg.
+func NewPublisher(cfg *config.EventsConfig, awsCfg aws.Config) (Publisher, error) {
+	switch cfg.Publisher {
+	case config.EventsPublisherNone:
+		return Nop{}, nil
+	case config.EventsPublisherSNS:
+		return NewSNSPublisher(cfg.SNSTopicARN, awsCfg)
+	case config.EventsPublisherSQS:
+		return NewSQSPublisher(cfg.SQSQueueURL, awsCfg)
+	default:
+		return nil, fmt.Errorf("unknown events publisher: %s", cfg.Publisher)
+	}
+}
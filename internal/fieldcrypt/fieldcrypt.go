@@ -0,0 +1,114 @@
+// Package fieldcrypt encrypts individual attribute values for storage.
+package fieldcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// prefix marks an encrypted value. Encrypted values have the form
+// "enc:v1:<key id>:<base64 nonce+ciphertext>"; anything without the prefix is
+// a plaintext value written before encryption was enabled.
+const prefix = "enc:v1:"
+
+var (
+	// ErrUnknownKey means a value was encrypted with a key ID that is not
+	// configured.
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// ErrDecrypt means a value could not be decrypted, because it is
+	// corrupt, was encrypted with a different key under the same ID, or
+	// belongs to a different record.
+	ErrDecrypt = errors.New("failed to decrypt value")
+)
+
+// Cipher encrypts values with AES-256-GCM under its current key, and
+// decrypts values written under any of its keys. A nil *Cipher leaves new
+// values in plaintext.
+type Cipher struct {
+	currentKeyID string
+	aeads        map[string]cipher.AEAD
+}
+
+// New returns a Cipher that encrypts with keys[currentKeyID]. It returns nil
+// when keys is empty.
+func New(keys map[string][]byte, currentKeyID string) (*Cipher, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if _, ok := keys[currentKeyID]; !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, currentKeyID)
+	}
+
+	c := &Cipher{currentKeyID: currentKeyID, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("key ID %q must not contain ':'", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		c.aeads[id] = aead
+	}
+	return c, nil
+}
+
+// Encrypt encrypts plaintext, binding it to aad (e.g. the record key and
+// attribute name) so it cannot be moved to another record. Empty values are
+// stored as-is.
+func (c *Cipher) Encrypt(plaintext, aad string) (string, error) {
+	if c == nil || plaintext == "" {
+		return plaintext, nil
+	}
+
+	aead := c.aeads[c.currentKeyID]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(aad))
+
+	return prefix + c.currentKeyID + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the plaintext of value. Values without the encryption
+// prefix are returned unchanged.
+func (c *Cipher) Decrypt(value, aad string) (string, error) {
+	rest, ok := strings.CutPrefix(value, prefix)
+	if !ok {
+		return value, nil
+	}
+
+	keyID, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", fmt.Errorf("%w: malformed value", ErrDecrypt)
+	}
+	if c == nil {
+		return "", fmt.Errorf("%w: %q (encryption is not configured)", ErrUnknownKey, keyID)
+	}
+	aead, ok := c.aeads[keyID]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("%w: malformed value", ErrDecrypt)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("%w: key %q", ErrDecrypt, keyID)
+	}
+	return string(plaintext), nil
+}
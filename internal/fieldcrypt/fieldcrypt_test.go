@@ -0,0 +1,122 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var (
+	oldKey = bytes.Repeat([]byte{1}, 32)
+	newKey = bytes.Repeat([]byte{2}, 32)
+)
+
+func newCipher(t *testing.T, keys map[string][]byte, current string) *Cipher {
+	t.Helper()
+	c, err := New(keys, current)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return c
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	c := newCipher(t, map[string][]byte{"k1": oldKey}, "k1")
+
+	encrypted, err := c.Encrypt("Ada Lovelace", "USER#1/name")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if !strings.HasPrefix(encrypted, "enc:v1:k1:") || strings.Contains(encrypted, "Ada") {
+		t.Errorf("Encrypt = %q, want an enc:v1 value under k1", encrypted)
+	}
+	if again, _ := c.Encrypt("Ada Lovelace", "USER#1/name"); again == encrypted {
+		t.Error("encrypting twice gave the same value")
+	}
+	if got, err := c.Decrypt(encrypted, "USER#1/name"); err != nil || got != "Ada Lovelace" {
+		t.Errorf("Decrypt = %q, %v, want the plaintext", got, err)
+	}
+
+	// The value is bound to its record.
+	if _, err := c.Decrypt(encrypted, "USER#2/name"); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Decrypt with another AAD = %v, want ErrDecrypt", err)
+	}
+}
+
+func TestPlaintextValues(t *testing.T) {
+	c := newCipher(t, map[string][]byte{"k1": oldKey}, "k1")
+
+	if got, err := c.Encrypt("", "aad"); err != nil || got != "" {
+		t.Errorf("Encrypt of an empty value = %q, %v, want it unchanged", got, err)
+	}
+	if got, err := c.Decrypt("Ada", "aad"); err != nil || got != "Ada" {
+		t.Errorf("Decrypt of a value stored in plaintext = %q, %v, want it unchanged", got, err)
+	}
+
+	var disabled *Cipher
+	if got, err := disabled.Encrypt("Ada", "aad"); err != nil || got != "Ada" {
+		t.Errorf("nil Cipher Encrypt = %q, %v, want the plaintext", got, err)
+	}
+	encrypted, _ := c.Encrypt("Ada", "aad")
+	if _, err := disabled.Decrypt(encrypted, "aad"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("nil Cipher Decrypt of an encrypted value = %v, want ErrUnknownKey", err)
+	}
+}
+
+// After rotating to a new key, values written under the old one still
+// decrypt.
+func TestKeyRotation(t *testing.T) {
+	before := newCipher(t, map[string][]byte{"k1": oldKey}, "k1")
+	encrypted, _ := before.Encrypt("Ada", "aad")
+
+	after := newCipher(t, map[string][]byte{"k1": oldKey, "k2": newKey}, "k2")
+	if got, err := after.Decrypt(encrypted, "aad"); err != nil || got != "Ada" {
+		t.Errorf("Decrypt of an old value = %q, %v, want Ada", got, err)
+	}
+	if rotated, _ := after.Encrypt("Ada", "aad"); !strings.HasPrefix(rotated, "enc:v1:k2:") {
+		t.Errorf("Encrypt after rotation = %q, want the new key", rotated)
+	}
+
+	retired := newCipher(t, map[string][]byte{"k2": newKey}, "k2")
+	if _, err := retired.Decrypt(encrypted, "aad"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt under a retired key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestDecryptMalformed(t *testing.T) {
+	c := newCipher(t, map[string][]byte{"k1": oldKey}, "k1")
+	encrypted, _ := c.Encrypt("Ada", "aad")
+	tampered := encrypted[:len(encrypted)-2] + "AA"
+	if tampered == encrypted {
+		tampered = encrypted[:len(encrypted)-2] + "BB"
+	}
+
+	for _, value := range []string{"enc:v1:k1", "enc:v1:k1:!!!", "enc:v1:k1:AAAA", tampered} {
+		if _, err := c.Decrypt(value, "aad"); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("Decrypt(%q) = %v, want ErrDecrypt", value, err)
+		}
+	}
+	sameID := newCipher(t, map[string][]byte{"k1": newKey}, "k1")
+	if _, err := sameID.Decrypt(encrypted, "aad"); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Decrypt with another key under the same ID = %v, want ErrDecrypt", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if c, err := New(nil, ""); c != nil || err != nil {
+		t.Errorf("New without keys = %v, %v, want a nil Cipher", c, err)
+	}
+	for name, tc := range map[string]struct {
+		keys    map[string][]byte
+		current string
+	}{
+		"unknown current key": {map[string][]byte{"k1": oldKey}, "k2"},
+		"colon in key ID":     {map[string][]byte{"k:1": oldKey}, "k:1"},
+		"short key":           {map[string][]byte{"k1": oldKey[:7]}, "k1"},
+	} {
+		if _, err := New(tc.keys, tc.current); err == nil {
+			t.Errorf("New with %s succeeded", name)
+		}
+	}
+}
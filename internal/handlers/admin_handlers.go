@@ -0,0 +1,368 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qcom/qcom/internal/apierror"
+	"github.com/qcom/qcom/internal/events"
+	"github.com/qcom/qcom/internal/logging"
+	"github.com/qcom/qcom/internal/metrics"
+	"github.com/qcom/qcom/internal/middleware"
+	"github.com/qcom/qcom/internal/models"
+	"github.com/qcom/qcom/internal/repository"
+	"github.com/qcom/qcom/internal/service"
+	"github.com/sirupsen/logrus"
+)
+
+type AdminHandlers struct {
+	auditRepo         *repository.AuditRepository
+	diagnosticsRepo   *repository.DiagnosticsRepository
+	authStateService  *service.AuthStateService
+	revocationService *service.TokenRevocationService
+	accountLocks      *service.AccountLockService
+	otpService        *service.OTPService
+	events            events.Publisher
+	maintenance       *middleware.Maintenance
+	logger            *logrus.Logger
+}
+
+func NewAdminHandlers(auditRepo *repository.AuditRepository, diagnosticsRepo *repository.DiagnosticsRepository, authStateService *service.AuthStateService, revocationService *service.TokenRevocationService, accountLocks *service.AccountLockService, otpService *service.OTPService, eventPublisher events.Publisher, maintenance *middleware.Maintenance, logger *logrus.Logger) *AdminHandlers {
+	return &AdminHandlers{
+		auditRepo:         auditRepo,
+		diagnosticsRepo:   diagnosticsRepo,
+		authStateService:  authStateService,
+		revocationService: revocationService,
+		accountLocks:      accountLocks,
+		otpService:        otpService,
+		events:            eventPublisher,
+		maintenance:       maintenance,
+		logger:            logger,
+	}
+}
+
+type MaintenanceRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type MaintenanceResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+// TokenEpochRequest is the optional body of the token epoch endpoints.
+// IssuedBefore defaults to now.
+type TokenEpochRequest struct {
+	IssuedBefore *time.Time `json:"issued_before"`
+}
+
+// TokenEpochResponse reports the epoch in effect, which is later than the
+// requested one if the epoch had already been advanced past it.
+type TokenEpochResponse struct {
+	Epoch time.Time `json:"epoch"`
+}
+
+// OTPPepperRequest carries the pepper to rotate to.
+type OTPPepperRequest struct {
+	Pepper string `json:"pepper"`
+}
+
+// OTPPepperResponse reports the version of the new pepper, as stored with
+// OTPs hashed with it, and until when the previous pepper still verifies.
+type OTPPepperResponse struct {
+	Version               string    `json:"version"`
+	PreviousAcceptedUntil time.Time `json:"previous_accepted_until"`
+}
+
+// QueryAudit lists audit events for a phone number. Supported query
+// parameters: phone (required), event, from and to (RFC 3339), limit and
+// cursor (from a previous response's next_cursor).
+func (h *AdminHandlers) QueryAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	phoneNumber, ok := parsePhone(w, r, query.Get("phone"))
+	if !ok {
+		return
+	}
+
+	filter := models.AuditFilter{
+		EventType: query.Get("event"),
+		Cursor:    query.Get("cursor"),
+	}
+
+	var err error
+	if v := query.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid 'from' timestamp")
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid 'to' timestamp")
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit <= 0 {
+			h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid 'limit'")
+			return
+		}
+	}
+
+	page, err := h.auditRepo.Query(r.Context(), phoneNumber, filter)
+	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) {
+			h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid cursor")
+			return
+		}
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to query audit events")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to query audit events")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, page)
+}
+
+// RunQuery runs a named diagnostic query. Supported query parameters: query
+// (required), the key parameter that query takes (phone, jti, family_id or
+// user_id), limit and cursor (from a previous response's next_cursor).
+func (h *AdminHandlers) RunQuery(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	name := query.Get("query")
+	param, ok := h.diagnosticsRepo.QueryParam(name)
+	if !ok {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Unknown query; supported queries are "+strings.Join(h.diagnosticsRepo.QueryNames(), ", "))
+		return
+	}
+
+	value := query.Get(param)
+	if param == "phone" {
+		if value, ok = parsePhone(w, r, value); !ok {
+			return
+		}
+	} else if value == "" {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Missing '"+param+"'")
+		return
+	}
+
+	var limit int
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid 'limit'")
+			return
+		}
+	}
+
+	page, err := h.diagnosticsRepo.Run(r.Context(), name, value, limit, query.Get("cursor"))
+	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) {
+			h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid cursor")
+			return
+		}
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to run diagnostic query")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to run query")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, page)
+}
+
+// PurgeAuthState revokes every token, deletes any pending OTP and clears the
+// account lock and status rate limit of the phone number given in the phone
+// query parameter.
+func (h *AdminHandlers) PurgeAuthState(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := parsePhone(w, r, r.URL.Query().Get("phone"))
+	if !ok {
+		return
+	}
+
+	if err := h.authStateService.PurgeUser(r.Context(), phoneNumber); err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to purge auth state")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to purge auth state")
+		return
+	}
+	h.events.Publish(r.Context(), events.Event{Type: events.TypeRevoke, Scope: events.ScopeUser, Phone: phoneNumber})
+
+	h.respondWithJSON(w, http.StatusOK, map[string]string{
+		"message": "Auth state purged",
+	})
+}
+
+// RevokeUserTokens revokes every access and refresh token issued to the
+// phone number in the phone query parameter at or before issued_before.
+func (h *AdminHandlers) RevokeUserTokens(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := parsePhone(w, r, r.URL.Query().Get("phone"))
+	if !ok {
+		return
+	}
+
+	issuedBefore, ok := h.decodeTokenEpoch(w, r)
+	if !ok {
+		return
+	}
+
+	epoch, err := h.revocationService.RevokeUserBefore(r.Context(), phoneNumber, issuedBefore)
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to advance user token epoch")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to revoke tokens")
+		return
+	}
+	h.events.Publish(r.Context(), events.Event{Type: events.TypeRevoke, Scope: events.ScopeUser, Phone: phoneNumber})
+
+	h.respondWithJSON(w, http.StatusOK, TokenEpochResponse{Epoch: epoch.UTC()})
+}
+
+// UnlockAccount lifts a lockout of the phone query parameter's account
+// after repeated refresh token reuse. Unlocking an account that is not
+// locked succeeds.
+func (h *AdminHandlers) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := parsePhone(w, r, r.URL.Query().Get("phone"))
+	if !ok {
+		return
+	}
+
+	if err := h.accountLocks.Unlock(r.Context(), phoneNumber); err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to unlock account")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to unlock account")
+		return
+	}
+	h.events.Publish(r.Context(), events.Event{Type: events.TypeAccountUnlocked, Phone: phoneNumber})
+
+	logging.LoggerFromContext(r.Context(), h.logger).WithField("phone", logging.LogPhone(phoneNumber)).Info("Account unlocked")
+	h.respondWithJSON(w, http.StatusOK, map[string]string{
+		"message": "Account unlocked",
+	})
+}
+
+// RevokeAllTokens revokes every token of every user issued at or before
+// issued_before, e.g. after a signing key has been compromised.
+func (h *AdminHandlers) RevokeAllTokens(w http.ResponseWriter, r *http.Request) {
+	issuedBefore, ok := h.decodeTokenEpoch(w, r)
+	if !ok {
+		return
+	}
+
+	epoch, err := h.revocationService.RevokeAllBefore(r.Context(), issuedBefore)
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to advance global token epoch")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to revoke tokens")
+		return
+	}
+	h.events.Publish(r.Context(), events.Event{Type: events.TypeRevoke, Scope: events.ScopeGlobal})
+
+	logging.LoggerFromContext(r.Context(), h.logger).WithField("epoch", epoch.UTC()).Warn("Global token epoch advanced")
+	h.respondWithJSON(w, http.StatusOK, TokenEpochResponse{Epoch: epoch.UTC()})
+}
+
+// decodeTokenEpoch reads the optional TokenEpochRequest body. An epoch in
+// the future is refused, since it would also reject tokens issued until then.
+func (h *AdminHandlers) decodeTokenEpoch(w http.ResponseWriter, r *http.Request) (time.Time, bool) {
+	var req TokenEpochRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid request body")
+		return time.Time{}, false
+	}
+
+	now := time.Now()
+	if req.IssuedBefore == nil {
+		return now, true
+	}
+	if req.IssuedBefore.After(now) {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "'issued_before' must not be in the future")
+		return time.Time{}, false
+	}
+	return *req.IssuedBefore, true
+}
+
+// RotateOTPPepper switches every instance to a new OTP pepper, which must
+// already be configured as OTP_NEXT_PEPPER. OTPs sent before the switch keep
+// verifying with the old pepper until they expire; another rotation is
+// refused until then.
+func (h *AdminHandlers) RotateOTPPepper(w http.ResponseWriter, r *http.Request) {
+	var req OTPPepperRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	version, previousUntil, err := h.otpService.RotatePepper(r.Context(), req.Pepper)
+	if errors.Is(err, service.ErrInvalidPepper) {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "'pepper' must be a configured pepper other than the current one")
+		return
+	}
+	if errors.Is(err, service.ErrPepperRotationInProgress) {
+		h.respondWithError(w, r, apierror.CodePepperRotationInProgress, "OTPs hashed with an earlier pepper may still be outstanding; retry once they have expired")
+		return
+	}
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to rotate OTP pepper")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to rotate OTP pepper")
+		return
+	}
+
+	logging.LoggerFromContext(r.Context(), h.logger).WithFields(logrus.Fields{
+		"version":                 version,
+		"previous_accepted_until": previousUntil.UTC(),
+	}).Warn("OTP pepper rotated")
+	h.respondWithJSON(w, http.StatusOK, OTPPepperResponse{Version: version, PreviousAcceptedUntil: previousUntil.UTC()})
+}
+
+// GetMaintenance reports whether maintenance mode is enabled.
+func (h *AdminHandlers) GetMaintenance(w http.ResponseWriter, r *http.Request) {
+	enabled, err := h.maintenance.Enabled(r.Context(), true)
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to read maintenance flag")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to read maintenance mode")
+		return
+	}
+	h.respondWithJSON(w, http.StatusOK, MaintenanceResponse{Enabled: enabled})
+}
+
+// SetMaintenance turns maintenance mode on or off for every instance. Other
+// instances pick it up within a few seconds; requests already being served
+// are not affected.
+func (h *AdminHandlers) SetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req MaintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Body must be {\"enabled\": true|false}")
+		return
+	}
+
+	if err := h.maintenance.SetEnabled(r.Context(), *req.Enabled); err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to set maintenance flag")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to set maintenance mode")
+		return
+	}
+	logging.LoggerFromContext(r.Context(), h.logger).WithField("enabled", *req.Enabled).Warn("Maintenance mode changed")
+
+	h.respondWithJSON(w, http.StatusOK, MaintenanceResponse{Enabled: *req.Enabled})
+}
+
+// DebugHealthResponse reports recent backend latencies, keyed by backend.
+type DebugHealthResponse struct {
+	Latency map[string]metrics.LatencyPercentiles `json:"latency"`
+}
+
+// DebugHealth reports percentiles of recent DynamoDB and OTP verification
+// latencies on this instance, so degradation can be spotted without a
+// dashboard.
+func (h *AdminHandlers) DebugHealth(w http.ResponseWriter, r *http.Request) {
+	h.respondWithJSON(w, http.StatusOK, DebugHealthResponse{Latency: metrics.LatencySnapshot()})
+}
+
+func (h *AdminHandlers) respondWithJSON(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(payload)
+}
+
+func (h *AdminHandlers) respondWithError(w http.ResponseWriter, r *http.Request, code apierror.Code, message string) {
+	apierror.Write(w, r, code, message)
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/qcom/qcom/internal/config"
+)
+
+func TestRunQuery(t *testing.T) {
+	env := newTestEnv(t)
+	session := env.signIn(testPhone)
+
+	rec := env.do(http.MethodGet, "/api/v1/admin/query?query=user&phone="+testPhone, "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("user query status = %d: %s", rec.Code, rec.Body)
+	}
+	var page struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	decodeBody(t, rec, &page)
+	if len(page.Items) != 1 || page.Items[0]["user_id"] != session.User.UserID {
+		t.Errorf("user query returned %v, want the signed-in user", page.Items)
+	}
+
+	for _, tc := range []struct {
+		query, code string
+	}{
+		{"", "INVALID_REQUEST"},
+		{"query=scan", "INVALID_REQUEST"},
+		{"query=user&phone=not-a-phone", "INVALID_PHONE"},
+		{"query=token_family", "INVALID_REQUEST"},
+		{"query=token_family&family_id=f&limit=0", "INVALID_REQUEST"},
+		{"query=token_family&family_id=f&cursor=not-a-cursor", "INVALID_REQUEST"},
+	} {
+		rec := env.do(http.MethodGet, "/api/v1/admin/query?"+tc.query, "", nil)
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != tc.code {
+			t.Errorf("GET /admin/query?%s: %d %s, want %s", tc.query, rec.Code, rec.Body, tc.code)
+		}
+	}
+}
+
+func TestRevokeUserTokens(t *testing.T) {
+	env := newTestEnv(t)
+	session, other := env.signIn(testPhone), env.signIn("+15557654321")
+
+	rec := env.do(http.MethodPut, "/api/v1/admin/token-epoch/user?phone="+testPhone, "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /admin/token-epoch/user status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp TokenEpochResponse
+	decodeBody(t, rec, &resp)
+	if resp.Epoch.IsZero() || resp.Epoch.After(time.Now()) {
+		t.Errorf("epoch = %v, want the time of the request", resp.Epoch)
+	}
+
+	if status := env.meStatus(session.AccessToken); status != http.StatusUnauthorized {
+		t.Errorf("GET /me with a token issued before the user's epoch = %d, want 401", status)
+	}
+	if rec := env.refreshWith(session.RefreshToken); rec.Code == http.StatusOK {
+		t.Error("refresh with a token issued before the user's epoch succeeded")
+	}
+	if status := env.meStatus(other.AccessToken); status != http.StatusOK {
+		t.Errorf("GET /me as another user = %d, want 200", status)
+	}
+	if status := env.meStatus(env.signIn(testPhone).AccessToken); status != http.StatusOK {
+		t.Errorf("GET /me with a token issued after the epoch = %d, want 200", status)
+	}
+}
+
+func TestRevokeAllTokens(t *testing.T) {
+	env := newTestEnv(t)
+	session, other := env.signIn(testPhone), env.signIn("+15557654321")
+
+	rec := env.do(http.MethodPut, "/api/v1/admin/token-epoch/global", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /admin/token-epoch/global status = %d: %s", rec.Code, rec.Body)
+	}
+	for _, accessToken := range []string{session.AccessToken, other.AccessToken} {
+		if status := env.meStatus(accessToken); status != http.StatusUnauthorized {
+			t.Errorf("GET /me with a token issued before the global epoch = %d, want 401", status)
+		}
+	}
+	if status := env.meStatus(env.signIn(testPhone).AccessToken); status != http.StatusOK {
+		t.Errorf("GET /me with a token issued after the epoch = %d, want 200", status)
+	}
+}
+
+func TestTokenEpochRejectsFutureTime(t *testing.T) {
+	env := newTestEnv(t)
+	session := env.signIn(testPhone)
+
+	future := TokenEpochRequest{IssuedBefore: aws.Time(time.Now().Add(time.Hour))}
+	for _, path := range []string{"/api/v1/admin/token-epoch/user?phone=" + testPhone, "/api/v1/admin/token-epoch/global"} {
+		rec := env.do(http.MethodPut, path, "", future)
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != "INVALID_REQUEST" {
+			t.Errorf("PUT %s with issued_before in the future: %d %s, want INVALID_REQUEST", path, rec.Code, rec.Body)
+		}
+	}
+	if status := env.meStatus(session.AccessToken); status != http.StatusOK {
+		t.Errorf("GET /me after refused revocations = %d, want 200", status)
+	}
+}
+
+// An OTP sent before the pepper is rotated still verifies afterwards.
+func TestRotateOTPPepper(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) { cfg.OTP.NextPepper = "new pepper" })
+	if _, err := env.otp.GenerateOTP(context.Background(), testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+
+	for _, pepper := range []string{"pepper", "unconfigured"} {
+		rec := env.do(http.MethodPut, "/api/v1/admin/otp-pepper", "", OTPPepperRequest{Pepper: pepper})
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != "INVALID_REQUEST" {
+			t.Errorf("PUT /admin/otp-pepper to %q: %d %s, want INVALID_REQUEST", pepper, rec.Code, rec.Body)
+		}
+	}
+
+	rec := env.do(http.MethodPut, "/api/v1/admin/otp-pepper", "", OTPPepperRequest{Pepper: "new pepper"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /admin/otp-pepper status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp OTPPepperResponse
+	decodeBody(t, rec, &resp)
+	if resp.Version == "" || !resp.PreviousAcceptedUntil.After(time.Now()) {
+		t.Errorf("response = %+v, want the new version and a window that has not ended", resp)
+	}
+
+	rec = env.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{PhoneNumber: testPhone, OTP: env.sender.last(testPhone)})
+	if rec.Code != http.StatusOK {
+		t.Errorf("verify-otp with an OTP sent before the rotation: %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	rec = env.do(http.MethodPut, "/api/v1/admin/otp-pepper", "", OTPPepperRequest{Pepper: "pepper"})
+	if rec.Code != http.StatusConflict || errorCode(t, rec) != "PEPPER_ROTATION_IN_PROGRESS" {
+		t.Errorf("PUT /admin/otp-pepper during the window: %d %s, want PEPPER_ROTATION_IN_PROGRESS", rec.Code, rec.Body)
+	}
+}
@@ -1,11 +1,28 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
-	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/qcom/qcom/internal/apierror"
+	"github.com/qcom/qcom/internal/email"
+	"github.com/qcom/qcom/internal/events"
+	"github.com/qcom/qcom/internal/identifier"
+	"github.com/qcom/qcom/internal/logging"
+	"github.com/qcom/qcom/internal/middleware"
+	"github.com/qcom/qcom/internal/models"
+	"github.com/qcom/qcom/internal/phone"
 	"github.com/qcom/qcom/internal/repository"
 	"github.com/qcom/qcom/internal/service"
 	"github.com/sirupsen/logrus"
@@ -15,22 +32,41 @@ type AuthHandlers struct {
 	otpService          *service.OTPService
 	jwtService          *service.JWTService
 	refreshTokenService *service.RefreshTokenService
+	revocationService   *service.TokenRevocationService
+	accountLocks        *service.AccountLockService
+	identifiers         *identifier.Router
 	userRepo            *repository.UserRepository
-	logger              *logrus.Logger
+	events              events.Publisher
+	// devMode allows VerifyOTPRequest.IncludeClaims.
+	devMode        bool
+	sessionCookies *SessionCookies
+	logger         *logrus.Logger
 }
 
 func NewAuthHandlers(
 	otpService *service.OTPService,
 	jwtService *service.JWTService,
 	refreshTokenService *service.RefreshTokenService,
+	revocationService *service.TokenRevocationService,
+	accountLocks *service.AccountLockService,
+	identifiers *identifier.Router,
 	userRepo *repository.UserRepository,
+	eventPublisher events.Publisher,
+	devMode bool,
+	sessionCookies *SessionCookies,
 	logger *logrus.Logger,
 ) *AuthHandlers {
 	return &AuthHandlers{
 		otpService:          otpService,
 		jwtService:          jwtService,
 		refreshTokenService: refreshTokenService,
+		revocationService:   revocationService,
+		accountLocks:        accountLocks,
+		identifiers:         identifiers,
 		userRepo:            userRepo,
+		events:              eventPublisher,
+		devMode:             devMode,
+		sessionCookies:      sessionCookies,
 		logger:              logger,
 	}
 }
@@ -39,24 +75,71 @@ type InitiateOTPRequest struct {
 	PhoneNumber string `json:"phone_number"`
 }
 
+// InitiateOTPResponse carries a StatusToken for GET /auth/otp/status, valid
+// until the OTP expires.
 type InitiateOTPResponse struct {
-	Message string `json:"message"`
+	Message     string `json:"message"`
+	Channel     string `json:"channel"`
+	Destination string `json:"destination,omitempty"`
+	StatusToken string `json:"status_token,omitempty"`
+	// VerificationNonce must be sent back with verify-otp when nonces are
+	// required.
+	VerificationNonce string `json:"verification_nonce,omitempty"`
+	// TestNumber means nothing was sent: the number is configured with a
+	// fixed OTP.
+	TestNumber bool `json:"test_number,omitempty"`
 }
 
+type OTPStatusResponse struct {
+	Pending           bool  `json:"pending"`
+	ExpiresIn         int64 `json:"expires_in"`
+	AttemptsRemaining int   `json:"attempts_remaining"`
+}
+
+// OTPStatusTokenHeader carries the status token from the initiate response.
+const OTPStatusTokenHeader = "X-OTP-Status-Token"
+
 type VerifyOTPRequest struct {
 	PhoneNumber string `json:"phone_number"`
 	OTP         string `json:"otp"`
+	NoRefresh   bool   `json:"no_refresh,omitempty"`
+
+	VerificationNonce string `json:"verification_nonce,omitempty"`
+
+	// IncludeClaims returns the decoded access token claims, to help while
+	// integrating. It is ignored outside development.
+	IncludeClaims bool `json:"include_claims,omitempty"`
+
+	// PushToken binds the session to the device's push notification
+	// token, for alerts about the account. It is ignored with NoRefresh.
+	PushToken string `json:"push_token,omitempty"`
+}
+
+// VerifyAndSetNameRequest is a VerifyOTPRequest that also sets the user's
+// name. The name is only applied to an existing user when OverwriteName is
+// set.
+type VerifyAndSetNameRequest struct {
+	VerifyOTPRequest
+	Name          string `json:"name,omitempty"`
+	OverwriteName bool   `json:"overwrite_name,omitempty"`
 }
 
 type VerifyOTPResponse struct {
-	AccessToken  string       `json:"access_token"`
-	RefreshToken string       `json:"refresh_token"`
-	TokenType    string       `json:"token_type"`
-	ExpiresIn    int64        `json:"expires_in"`
-	User         UserResponse `json:"user"`
+	AccessToken      string       `json:"access_token"`
+	RefreshToken     string       `json:"refresh_token,omitempty"`
+	TokenType        string       `json:"token_type"`
+	ExpiresIn        int64        `json:"expires_in"`
+	RefreshExpiresIn int64        `json:"refresh_expires_in,omitempty"`
+	User             UserResponse `json:"user"`
+	// Claims are the access token's claims, only with IncludeClaims in
+	// development.
+	Claims *service.Claims `json:"claims,omitempty"`
+	// UpgradedFrom is the guest ID of an upgraded guest session.
+	UpgradedFrom string `json:"upgraded_from,omitempty"`
 }
 
 type UserResponse struct {
+	UserID      string `json:"user_id"`
 	PhoneNumber string `json:"phone_number"`
 	Name        string `json:"name,omitempty"`
 }
@@ -65,175 +148,600 @@ type RefreshTokenRequest struct {
 	RefreshToken string `json:"refresh_token"`
 }
 
+// RefreshTokenResponse omits the tokens for a browser session, whose tokens
+// are in its cookies.
 type RefreshTokenResponse struct {
-	AccessToken  string `json:"access_token"`
+	AccessToken      string `json:"access_token,omitempty"`
+	RefreshToken     string `json:"refresh_token,omitempty"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+}
+
+// TokenExchangeRequest asks for a token for one or more space-separated
+// audiences, like Scope.
+type TokenExchangeRequest struct {
 	RefreshToken string `json:"refresh_token"`
-	TokenType    string `json:"token_type"`
-	ExpiresIn    int64  `json:"expires_in"`
+	Audience     string `json:"audience"`
+	Scope        string `json:"scope,omitempty"`
 }
 
-type ErrorResponse struct {
-	Error ErrorDetail `json:"error"`
+type TokenExchangeResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Audience    string `json:"audience"`
+	Scope       string `json:"scope,omitempty"`
 }
 
-type ErrorDetail struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+type ValidateTokenResponse struct {
+	UserID    string `json:"user_id"`
+	Phone     string `json:"phone"`
+	JTI       string `json:"jti"`
+	ExpiresAt int64  `json:"expires_at"`
 }
 
 func (h *AuthHandlers) InitiateOTP(w http.ResponseWriter, r *http.Request) {
 	var req InitiateOTPRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.logger.WithError(err).Error("Failed to generate OTP")
-		h.respondWithError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to generate OTP")
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid request body")
 		return
 	}
 
-	// Validate phone number
-	phoneNumber := strings.TrimSpace(req.PhoneNumber)
-	if !isValidPhoneNumber(phoneNumber) {
-		h.respondWithError(w, http.StatusBadRequest, "INVALID_PHONE", "Invalid phone number format")
+	result := h.initiateOTP(r.Context(), req.PhoneNumber)
+	if result.resp == nil {
+		if result.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(result.retryAfter))
+		}
+		h.respondWithError(w, r, result.code, result.message)
 		return
 	}
 
-	// Normalize phone number (ensure it starts with +)
-	if !strings.HasPrefix(phoneNumber, "+") {
-		phoneNumber = "+" + phoneNumber
+	h.respondWithJSON(w, http.StatusOK, result.resp)
+}
+
+// maxInitiateOTPBatch caps the phone numbers in one batch initiate request.
+const maxInitiateOTPBatch = 5
+
+// Statuses of the items of a batch initiate response.
+const (
+	OTPBatchSent        = "sent"
+	OTPBatchRateLimited = "rate_limited"
+	OTPBatchInvalid     = "invalid"
+	OTPBatchFailed      = "failed"
+)
+
+type InitiateOTPBatchRequest struct {
+	PhoneNumbers []string `json:"phone_numbers"`
+}
+
+type InitiateOTPBatchResponse struct {
+	Results []InitiateOTPBatchResult `json:"results"`
+}
+
+// InitiateOTPBatchResult reports one phone number of a batch, as given in
+// the request. A sent OTP carries the same fields as a single initiate
+// response; any other status carries the error that request would have
+// returned.
+type InitiateOTPBatchResult struct {
+	PhoneNumber string `json:"phone_number"`
+	Status      string `json:"status"`
+	*InitiateOTPResponse
+	Error      *apierror.Detail `json:"error,omitempty"`
+	RetryAfter int              `json:"retry_after,omitempty"`
+}
+
+// InitiateOTPBatch initiates OTPs for several phone numbers at once, such as
+// when enrolling more than one. Each number is handled as by InitiateOTP,
+// with its own cooldown and rate limits, and the response is 200 with a
+// result per number even if only some were sent.
+func (h *AuthHandlers) InitiateOTPBatch(w http.ResponseWriter, r *http.Request) {
+	var req InitiateOTPBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+	if len(req.PhoneNumbers) == 0 || len(req.PhoneNumbers) > maxInitiateOTPBatch {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, fmt.Sprintf("'phone_numbers' must list 1 to %d phone numbers", maxInitiateOTPBatch))
+		return
+	}
+
+	results := make([]InitiateOTPBatchResult, 0, len(req.PhoneNumbers))
+	seen := make(map[string]bool, len(req.PhoneNumbers))
+	for _, input := range req.PhoneNumbers {
+		item := InitiateOTPBatchResult{PhoneNumber: input}
+
+		// A number listed twice, in any format, would be sent two OTPs.
+		var result otpInitiation
+		if id, err := h.identifiers.Parse(input); err == nil && seen[id.Normalized] {
+			result = otpInitiation{code: apierror.CodeInvalidRequest, message: "Phone number is listed more than once"}
+		} else {
+			if err == nil {
+				seen[id.Normalized] = true
+			}
+			result = h.initiateOTP(r.Context(), input)
+		}
+
+		switch result.code {
+		case "":
+			item.Status = OTPBatchSent
+			item.InitiateOTPResponse = result.resp
+		case apierror.CodeOTPAlreadySent, apierror.CodeOTPAttemptsExhausted, apierror.CodeGenerationInProgress, apierror.CodeServiceBusy:
+			item.Status = OTPBatchRateLimited
+			item.RetryAfter = result.retryAfter
+		case apierror.CodeInvalidRequest, apierror.CodeInvalidPhone, apierror.CodePhoneHasExtension, apierror.CodeCountryNotSupported,
+			apierror.CodeInvalidIdentifier, apierror.CodeIdentifierNotSupported:
+			item.Status = OTPBatchInvalid
+		default:
+			item.Status = OTPBatchFailed
+		}
+		if result.code != "" {
+			item.Error = &apierror.Detail{Code: result.code, Message: result.message}
+		}
+		results = append(results, item)
+	}
+
+	h.respondWithJSON(w, http.StatusOK, InitiateOTPBatchResponse{Results: results})
+}
+
+// otpInitiation is the outcome of initiating an OTP for one phone number:
+// either resp, or the error code and message to return.
+type otpInitiation struct {
+	resp    *InitiateOTPResponse
+	code    apierror.Code
+	message string
+	// retryAfter is set with CodeOTPAlreadySent, CodeOTPAttemptsExhausted
+	// and, for a lock that expires, CodeAccountLocked, in seconds.
+	retryAfter int
+}
+
+// initiateOTP validates input and generates and sends an OTP to it.
+func (h *AuthHandlers) initiateOTP(ctx context.Context, input string) otpInitiation {
+	id, err := h.identifiers.Parse(input)
+	if err != nil {
+		code, message := identifierError(id, err)
+		return otpInitiation{code: code, message: message}
+	}
+	phoneNumber := id.Normalized
+
+	if id.Kind == identifier.KindPhone && !h.otpService.CountryAllowed(phoneNumber) {
+		return otpInitiation{code: apierror.CodeCountryNotSupported, message: "OTPs cannot be sent to this country"}
+	}
+
+	if code, message, retryAfter := h.checkAccountLock(ctx, phoneNumber); code != "" {
+		return otpInitiation{code: code, message: message, retryAfter: retryAfter}
 	}
 
 	// Generate and store OTP
-	_, err := h.otpService.GenerateOTP(phoneNumber)
+	delivery, err := h.otpService.GenerateOTP(ctx, phoneNumber)
+	if errors.Is(err, service.ErrServiceBusy) {
+		return otpInitiation{code: apierror.CodeServiceBusy, message: "Too many OTP requests right now, please try again shortly"}
+	}
+	if errors.Is(err, service.ErrGenerationInProgress) {
+		return otpInitiation{code: apierror.CodeGenerationInProgress, message: "An OTP is already being sent to this phone number"}
+	}
+	var active *service.OTPActiveError
+	if errors.As(err, &active) {
+		retryAfter := int(math.Ceil(time.Until(active.RetryAt).Seconds()))
+		return otpInitiation{
+			code: apierror.CodeOTPAlreadySent,
+			message: fmt.Sprintf(
+				"An OTP was already sent and is valid for %d more seconds; a new one can be requested in %d seconds",
+				int(time.Until(active.ExpiresAt).Seconds()), retryAfter,
+			),
+			retryAfter: retryAfter,
+		}
+	}
+	var exhausted *service.OTPAttemptsExhaustedError
+	if errors.As(err, &exhausted) {
+		retryAfter := int(math.Ceil(time.Until(exhausted.RetryAt).Seconds()))
+		return otpInitiation{
+			code:       apierror.CodeOTPAttemptsExhausted,
+			message:    fmt.Sprintf("Too many wrong OTPs for this phone number; a new one can be requested in %d seconds", retryAfter),
+			retryAfter: retryAfter,
+		}
+	}
 	if err != nil {
-		h.logger.WithError(err).Error("Failed to generate OTP")
-		h.respondWithError(w, http.StatusInternalServerError, "OTP_GENERATION_FAILED", "Failed to generate OTP")
+		logging.LoggerFromContext(ctx, h.logger).WithError(err).Error("Failed to generate OTP")
+		return otpInitiation{code: apierror.CodeOTPGenerationFailed, message: "Failed to generate OTP"}
+	}
+
+	// The OTP was sent; a missing status token only disables status checks.
+	statusToken, err := h.jwtService.GenerateOTPStatusToken(phoneNumber, delivery.ExpiresAt)
+	if err != nil {
+		logging.LoggerFromContext(ctx, h.logger).WithError(err).Warn("Failed to generate OTP status token")
+	}
+
+	return otpInitiation{resp: &InitiateOTPResponse{
+		Message:     "OTP sent successfully",
+		Channel:     delivery.Channel,
+		Destination: delivery.Destination,
+		StatusToken: statusToken,
+
+		VerificationNonce: delivery.Nonce,
+		TestNumber:        delivery.TestNumber,
+	}}
+}
+
+// OTPStatus reports whether the OTP for the phone query parameter is still
+// pending, without consuming an attempt. The status token returned by
+// InitiateOTP for that number must be sent in OTPStatusTokenHeader, so the
+// endpoint can't be used to probe arbitrary numbers.
+func (h *AuthHandlers) OTPStatus(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.parseIdentifier(w, r, r.URL.Query().Get("phone"))
+	if !ok {
 		return
 	}
+	phoneNumber := id.Normalized
 
-	// OTP is logged in the service (for development)
-	// In production, send via WhatsApp here
+	tokenString := r.Header.Get(OTPStatusTokenHeader)
+	if tokenString == "" {
+		h.respondWithError(w, r, apierror.CodeMissingToken, "Status token is required")
+		return
+	}
 
-	h.respondWithJSON(w, http.StatusOK, InitiateOTPResponse{
-		Message: "OTP sent successfully",
+	claims, err := h.jwtService.VerifyToken(tokenString)
+	if err != nil {
+		h.respondWithError(w, r, apierror.CodeInvalidToken, "Invalid status token")
+		return
+	}
+	if claims.Type != "otp_status" {
+		h.respondWithError(w, r, apierror.CodeInvalidTokenType, "Token is not a status token")
+		return
+	}
+	if claims.Phone != phoneNumber {
+		h.respondWithError(w, r, apierror.CodeInvalidToken, "Status token was issued for a different phone number")
+		return
+	}
+
+	status, err := h.otpService.Status(r.Context(), phoneNumber)
+	if errors.Is(err, service.ErrStatusRateLimited) {
+		h.respondWithError(w, r, apierror.CodeRateLimited, "Too many status checks, please slow down")
+		return
+	}
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to get OTP status")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to get OTP status")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, OTPStatusResponse{
+		Pending:           status.Pending,
+		ExpiresIn:         int64(status.ExpiresIn.Seconds()),
+		AttemptsRemaining: status.AttemptsRemaining,
 	})
 }
 
 func (h *AuthHandlers) VerifyOTP(w http.ResponseWriter, r *http.Request) {
 	var req VerifyOTPRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid request body")
 		return
 	}
 
-	phoneNumber := strings.TrimSpace(req.PhoneNumber)
-	otp := strings.TrimSpace(req.OTP)
+	h.verifyOTP(w, r, VerifyAndSetNameRequest{VerifyOTPRequest: req}, nil)
+}
+
+// VerifyAndSetName verifies an OTP like VerifyOTP and sets the user's name in
+// the same call, saving new users a round-trip at signup.
+func (h *AuthHandlers) VerifyAndSetName(w http.ResponseWriter, r *http.Request) {
+	var req VerifyAndSetNameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name != "" && !isValidName(req.Name) {
+		h.respondWithError(w, r, apierror.CodeInvalidName, fmt.Sprintf("Name must be at most %d characters with no control characters", maxNameLength))
+		return
+	}
+
+	h.verifyOTP(w, r, req, nil)
+}
+
+// GuestLoginResponse carries an access token for a new anonymous guest.
+type GuestLoginResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	GuestID     string `json:"guest_id"`
+}
+
+// GuestLogin issues a token for a new anonymous guest. Guest tokens are
+// refused by every authenticated route except the guest ones, such as
+// UpgradeGuest.
+func (h *AuthHandlers) GuestLogin(w http.ResponseWriter, r *http.Request) {
+	tokenPair, guestID, err := h.jwtService.GenerateGuestToken()
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to generate guest token")
+		h.respondWithError(w, r, apierror.CodeTokenGenerationFailed, "Failed to generate tokens")
+		return
+	}
+
+	h.events.Publish(r.Context(), events.Event{Type: events.TypeGuestLogin, GuestID: guestID})
+	h.respondWithJSON(w, http.StatusOK, GuestLoginResponse{
+		AccessToken: tokenPair.AccessToken,
+		TokenType:   tokenPair.TokenType,
+		ExpiresIn:   tokenPair.ExpiresIn,
+		GuestID:     guestID,
+	})
+}
+
+// UpgradeGuest verifies an OTP like VerifyOTP for the guest whose token
+// authenticates the request, then ends the guest session. The guest ID is
+// returned and published with the account's user ID, so data kept under
+// the guest can be moved to the account.
+func (h *AuthHandlers) UpgradeGuest(w http.ResponseWriter, r *http.Request) {
+	guest, ok := r.Context().Value("claims").(*service.Claims)
+	if !ok || !guest.Guest {
+		h.respondWithError(w, r, apierror.CodeUnauthorized, "Invalid token")
+		return
+	}
 
-	// Normalize phone number
-	if !strings.HasPrefix(phoneNumber, "+") {
-		phoneNumber = "+" + phoneNumber
+	var req VerifyOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid request body")
+		return
 	}
 
+	h.verifyOTP(w, r, VerifyAndSetNameRequest{VerifyOTPRequest: req}, guest)
+}
+
+// verifyOTP verifies the OTP in req and signs the user in. guest, when not
+// nil, is the guest session being upgraded to the user's account.
+func (h *AuthHandlers) verifyOTP(w http.ResponseWriter, r *http.Request, req VerifyAndSetNameRequest, guest *service.Claims) {
+	otp := strings.TrimSpace(req.OTP)
+
 	// Validate inputs
-	if !isValidPhoneNumber(phoneNumber) {
-		h.respondWithError(w, http.StatusBadRequest, "INVALID_PHONE", "Invalid phone number format")
+	id, ok := h.parseIdentifier(w, r, req.PhoneNumber)
+	if !ok {
+		return
+	}
+	phoneNumber := id.Normalized
+
+	if !isValidOTP(otp, h.otpService.Length()) {
+		h.respondWithOTPError(w, r, apierror.CodeInvalidOTPFormat, "Invalid OTP format")
 		return
 	}
 
-	if len(otp) < 4 || len(otp) > 8 {
-		h.respondWithError(w, http.StatusBadRequest, "INVALID_OTP", "Invalid OTP format")
+	pushToken := strings.TrimSpace(req.PushToken)
+	if pushToken != "" && !isValidPushToken(pushToken) {
+		h.respondWithError(w, r, apierror.CodeInvalidPushToken, fmt.Sprintf("Push token must be at most %d printable ASCII characters", maxPushTokenLength))
+		return
+	}
+
+	if code, message, retryAfter := h.checkAccountLock(r.Context(), phoneNumber); code != "" {
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		}
+		h.respondWithError(w, r, code, message)
 		return
 	}
 
 	// Verify OTP
-	valid, err := h.otpService.VerifyOTP(phoneNumber, otp)
+	valid, err := h.otpService.VerifyOTP(r.Context(), phoneNumber, otp, req.VerificationNonce)
+	if errors.Is(err, service.ErrInvalidNonce) {
+		h.respondWithOTPError(w, r, apierror.CodeInvalidNonce, "Verification nonce is missing, invalid or already used")
+		return
+	}
 	if err != nil || !valid {
-		h.respondWithError(w, http.StatusUnauthorized, "INVALID_OTP", "Invalid or expired OTP")
+		h.respondWithOTPError(w, r, apierror.CodeInvalidOTP, "Invalid or expired OTP")
 		return
 	}
 
-	// Get or create user
-	user, err := h.userRepo.GetOrCreate(r.Context(), phoneNumber)
+	// Get or create user. A new user is created with the name directly.
+	user, created, err := h.userRepo.GetOrCreateWithName(r.Context(), phoneNumber, req.Name)
+	if errors.Is(err, repository.ErrItemTooLarge) {
+		h.respondWithError(w, r, apierror.CodeItemTooLarge, "User record would be too large to store")
+		return
+	}
 	if err != nil {
-		h.logger.WithError(err).Error("Failed to get or create user")
-		h.respondWithError(w, http.StatusInternalServerError, "USER_CREATION_FAILED", "Failed to create user")
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to get or create user")
+		h.respondWithError(w, r, apierror.CodeUserCreationFailed, "Failed to create user")
 		return
 	}
 
+	if !created && req.Name != "" && req.OverwriteName && req.Name != user.Name {
+		user.Name = req.Name
+		err := h.userRepo.Update(r.Context(), user)
+		if errors.Is(err, repository.ErrVersionConflict) {
+			h.respondWithError(w, r, apierror.CodePreconditionFailed, "User was modified concurrently; retry")
+			return
+		}
+		if errors.Is(err, repository.ErrItemTooLarge) {
+			h.respondWithError(w, r, apierror.CodeItemTooLarge, "User record would be too large to store")
+			return
+		}
+		if err != nil {
+			logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to update user name")
+			h.respondWithError(w, r, apierror.CodeInternalError, "Failed to update user")
+			return
+		}
+	}
+
 	// Generate JWT tokens
-	tokenPair, familyID, err := h.jwtService.GenerateAccessToken(phoneNumber)
+	var tokenPair *models.TokenPair
+	authTime := time.Now()
+	if req.NoRefresh {
+		tokenPair, err = h.jwtService.GenerateAccessTokenOnly(user.UserID, phoneNumber, authTime)
+	} else {
+		tokenPair, err = h.issueTokenPair(r.Context(), user.UserID, phoneNumber, authTime, pushToken)
+	}
+	if errors.Is(err, service.ErrTokenStorageFailed) {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to store refresh token")
+		h.respondWithError(w, r, apierror.CodeTokenStorageFailed, "Failed to store refresh token")
+		return
+	}
 	if err != nil {
-		h.logger.WithError(err).Error("Failed to generate tokens")
-		h.respondWithError(w, http.StatusInternalServerError, "TOKEN_GENERATION_FAILED", "Failed to generate tokens")
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to generate tokens")
+		h.respondWithError(w, r, apierror.CodeTokenGenerationFailed, "Failed to generate tokens")
+		return
+	}
+
+	resp := VerifyOTPResponse{
+		AccessToken:  tokenPair.AccessToken,
+		RefreshToken: tokenPair.RefreshToken,
+		TokenType:    tokenPair.TokenType,
+		ExpiresIn:    tokenPair.ExpiresIn,
+
+		RefreshExpiresIn: tokenPair.RefreshExpiresIn,
+		User: UserResponse{
+			UserID:      user.UserID,
+			PhoneNumber: user.PhoneNumber,
+			Name:        user.Name,
+		},
+	}
+	// Only the payload is returned, decoded from the token just issued;
+	// signing keys never leave the JWT service.
+	if req.IncludeClaims && h.devMode {
+		claims, err := h.jwtService.VerifyToken(tokenPair.AccessToken)
+		if err != nil {
+			logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Warn("Failed to decode issued access token")
+		}
+		resp.Claims = claims
+	}
+
+	if guest != nil {
+		// The guest token expires on its own if this fails.
+		if err := h.revocationService.Revoke(r.Context(), guest); err != nil {
+			logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Warn("Failed to revoke upgraded guest token")
+		}
+		resp.UpgradedFrom = guest.Subject
+		h.events.Publish(r.Context(), events.Event{Type: events.TypeGuestUpgrade, UserID: user.UserID, Phone: phoneNumber, GuestID: guest.Subject})
+	}
+
+	h.events.Publish(r.Context(), events.Event{Type: events.TypeLogin, UserID: user.UserID, Phone: phoneNumber})
+	h.respondWithJSON(w, http.StatusOK, resp)
+}
+
+// respondWithOTPError responds to a failed OTP verification with code, or
+// with INVALID_OR_EXPIRED_OTP when OTP_GENERIC_VERIFY_ERRORS hides why it
+// failed.
+func (h *AuthHandlers) respondWithOTPError(w http.ResponseWriter, r *http.Request, code apierror.Code, message string) {
+	if h.otpService.GenericVerifyErrors() {
+		h.respondWithError(w, r, apierror.CodeInvalidOrExpiredOTP, "OTP verification failed")
 		return
 	}
+	h.respondWithError(w, r, code, message)
+}
+
+// issueTokenPair generates an access and refresh token pair in a new family
+// and stores the refresh token, bound to pushToken if it is not empty.
+// authTime is when the user last verified an OTP.
+func (h *AuthHandlers) issueTokenPair(ctx context.Context, userID, phoneNumber string, authTime time.Time, pushToken string) (*models.TokenPair, error) {
+	tokenPair, familyID, err := h.jwtService.GenerateAccessToken(userID, phoneNumber, authTime)
+	if err != nil {
+		return nil, err
+	}
 
 	// Extract JTI from refresh token to store it
 	claims, err := h.jwtService.VerifyToken(tokenPair.RefreshToken)
 	if err != nil {
-		h.logger.WithError(err).Error("Failed to verify refresh token")
-		h.respondWithError(w, http.StatusInternalServerError, "TOKEN_GENERATION_FAILED", "Failed to generate tokens")
-		return
+		return nil, fmt.Errorf("failed to verify refresh token: %w", err)
 	}
 
-	// Store refresh token
+	// Store refresh token. Fails only in strict storage mode.
 	if err := h.refreshTokenService.Store(
-		r.Context(),
+		ctx,
 		claims.JTI,
-		phoneNumber,
+		userID,
 		phoneNumber,
 		familyID,
 		claims.RegisteredClaims.ExpiresAt.Time,
+		0,
+		pushToken,
 	); err != nil {
-		h.logger.WithError(err).Error("Failed to store refresh token")
-		// Continue anyway, token is still valid
+		return nil, err
 	}
 
-	h.respondWithJSON(w, http.StatusOK, VerifyOTPResponse{
-		AccessToken:  tokenPair.AccessToken,
-		RefreshToken: tokenPair.RefreshToken,
-		TokenType:    tokenPair.TokenType,
-		ExpiresIn:    tokenPair.ExpiresIn,
-		User: UserResponse{
-			PhoneNumber: user.PhoneNumber,
-			Name:        user.Name,
-		},
-	})
+	tokenPair.RefreshExpiresIn = secondsUntil(claims.RegisteredClaims.ExpiresAt.Time)
+	return tokenPair, nil
+}
+
+// resolveUserID returns the stable user ID for a token. Tokens issued before
+// stable IDs existed carry the phone number as their subject, so the ID is
+// looked up (and assigned if missing) from the user record instead.
+func (h *AuthHandlers) resolveUserID(ctx context.Context, claims *service.Claims) (string, error) {
+	if claims.Subject != "" && claims.Subject != claims.Phone {
+		return claims.Subject, nil
+	}
+
+	user, err := h.userRepo.GetOrCreate(ctx, claims.Phone)
+	if err != nil {
+		return "", err
+	}
+	return user.UserID, nil
 }
 
 func (h *AuthHandlers) RefreshToken(w http.ResponseWriter, r *http.Request) {
 	var req RefreshTokenRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+	cookieToken := h.sessionCookies.refreshToken(r)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !(errors.Is(err, io.EOF) && cookieToken != "") {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid request body")
 		return
 	}
 
+	// A browser session refreshes with its cookie, which the browser may
+	// also send on requests from other sites, so it must echo the CSRF
+	// cookie too.
+	fromCookie := req.RefreshToken == "" && cookieToken != ""
+	if fromCookie {
+		if !middleware.ValidCSRFToken(r, r.Header.Get(middleware.CSRFHeader)) {
+			h.respondWithError(w, r, apierror.CodeInvalidCSRFToken, "Missing or invalid CSRF token")
+			return
+		}
+		req.RefreshToken = cookieToken
+	}
+
 	if req.RefreshToken == "" {
-		h.respondWithError(w, http.StatusBadRequest, "MISSING_TOKEN", "Refresh token is required")
+		h.respondWithError(w, r, apierror.CodeMissingToken, "Refresh token is required")
 		return
 	}
 
 	// Verify refresh token
 	claims, err := h.jwtService.VerifyToken(req.RefreshToken)
 	if err != nil {
-		h.respondWithError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Invalid refresh token")
+		h.respondWithError(w, r, apierror.CodeInvalidToken, "Invalid refresh token")
 		return
 	}
 
 	if claims.Type != "refresh" {
-		h.respondWithError(w, http.StatusUnauthorized, "INVALID_TOKEN_TYPE", "Token is not a refresh token")
+		h.respondWithError(w, r, apierror.CodeInvalidTokenType, "Token is not a refresh token")
 		return
 	}
 
 	// Check if token is revoked
 	revoked, err := h.refreshTokenService.IsRevoked(r.Context(), claims.JTI)
 	if err == nil && revoked {
-		h.respondWithError(w, http.StatusUnauthorized, "TOKEN_REVOKED", "Refresh token has been revoked")
+		// A client that lost the response to a rotation retries with the
+		// token it just rotated; issue it tokens in place of those it missed.
+		if replacement := h.refreshReplacement(r.Context(), claims); replacement != nil {
+			h.reissueRefresh(w, r, claims, req.RefreshToken, fromCookie, replacement)
+			return
+		}
+		h.handleRefreshReuse(r.Context(), claims)
+		h.respondWithError(w, r, apierror.CodeTokenRevoked, "Refresh token has been revoked")
+		return
+	}
+	if h.isRevokedByEpoch(r.Context(), claims) {
+		h.respondWithError(w, r, apierror.CodeTokenRevoked, "Refresh token has been revoked")
 		return
 	}
 
 	// Get token data to get family ID
 	tokenData, err := h.refreshTokenService.Get(r.Context(), claims.JTI)
 	if err != nil {
-		h.logger.WithError(err).Warn("Failed to get refresh token data, will generate new family ID")
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Warn("Failed to get refresh token data, will generate new family ID")
+	}
+
+	// Families refreshed too many times must sign in again
+	if tokenData != nil {
+		if err := h.refreshTokenService.CheckRefreshChain(r.Context(), tokenData); err != nil {
+			h.respondWithError(w, r, apierror.CodeReauthRequired, "Refresh limit reached, please sign in again")
+			return
+		}
 	}
 
 	// Revoke old refresh token
@@ -243,23 +751,63 @@ func (h *AuthHandlers) RefreshToken(w http.ResponseWriter, r *http.Request) {
 
 	// Get family ID from existing token or use empty string (will generate new)
 	familyID := ""
+	refreshCount := 0
+	pushToken := ""
 	if tokenData != nil {
 		familyID = tokenData.FamilyID
+		refreshCount = tokenData.RefreshCount + 1
+		pushToken = tokenData.PushToken
+	}
+
+	h.issueRotatedTokens(w, r, claims, req.RefreshToken, fromCookie, familyID, refreshCount, pushToken, time.Now())
+}
+
+// reissueRefresh answers a retried rotation of the refresh token in claims.
+// The client never received replacement, so it is revoked and a new token
+// in the same family takes its place. The original rotation time is kept,
+// so retries cannot extend the grace window.
+func (h *AuthHandlers) reissueRefresh(w http.ResponseWriter, r *http.Request, claims *service.Claims, refreshToken string, fromCookie bool, replacement *models.RefreshTokenReplacement) {
+	logger := logging.LoggerFromContext(r.Context(), h.logger).WithField("jti", claims.JTI)
+
+	tokenData, err := h.refreshTokenService.Get(r.Context(), replacement.JTI)
+	if err == nil {
+		err = h.refreshTokenService.Revoke(r.Context(), replacement.JTI)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to revoke the replacement of a retried refresh")
+		h.respondWithError(w, r, apierror.CodeTokenGenerationFailed, "Failed to generate tokens")
+		return
 	}
 
+	logger.Info("Reissuing tokens for a retried refresh")
+	h.issueRotatedTokens(w, r, claims, refreshToken, fromCookie, replacement.FamilyID, tokenData.RefreshCount, tokenData.PushToken, replacement.RotatedAt)
+}
+
+// issueRotatedTokens issues and stores the tokens replacing the refresh
+// token in claims, rotated at rotatedAt, and responds with them. A refresh
+// token taken from the session cookie is replaced in the cookies instead,
+// and only the lifetimes are returned.
+func (h *AuthHandlers) issueRotatedTokens(w http.ResponseWriter, r *http.Request, claims *service.Claims, refreshToken string, fromCookie bool, familyID string, refreshCount int, pushToken string, rotatedAt time.Time) {
 	// Generate new tokens with same family ID
-	newTokenPair, newFamilyID, err := h.jwtService.RefreshTokens(req.RefreshToken, familyID)
+	userID, err := h.resolveUserID(r.Context(), claims)
 	if err != nil {
-		h.logger.WithError(err).Error("Failed to generate new tokens")
-		h.respondWithError(w, http.StatusInternalServerError, "TOKEN_GENERATION_FAILED", "Failed to generate tokens")
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to resolve user ID")
+		h.respondWithError(w, r, apierror.CodeTokenGenerationFailed, "Failed to generate tokens")
+		return
+	}
+
+	newTokenPair, newFamilyID, err := h.jwtService.RefreshTokens(refreshToken, userID, familyID)
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to generate new tokens")
+		h.respondWithError(w, r, apierror.CodeTokenGenerationFailed, "Failed to generate tokens")
 		return
 	}
 
 	// Extract JTI from new refresh token
 	newClaims, err := h.jwtService.VerifyToken(newTokenPair.RefreshToken)
 	if err != nil {
-		h.logger.WithError(err).Error("Failed to verify new refresh token")
-		h.respondWithError(w, http.StatusInternalServerError, "TOKEN_GENERATION_FAILED", "Failed to generate tokens")
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to verify new refresh token")
+		h.respondWithError(w, r, apierror.CodeTokenGenerationFailed, "Failed to generate tokens")
 		return
 	}
 
@@ -267,28 +815,282 @@ func (h *AuthHandlers) RefreshToken(w http.ResponseWriter, r *http.Request) {
 	if err := h.refreshTokenService.Store(
 		r.Context(),
 		newClaims.JTI,
-		claims.Phone,
+		userID,
 		claims.Phone,
 		newFamilyID,
 		newClaims.RegisteredClaims.ExpiresAt.Time,
+		refreshCount,
+		pushToken,
 	); err != nil {
-		h.logger.WithError(err).Error("Failed to store new refresh token")
-		// Continue anyway
+		// Strict storage mode: the new token could never be revoked, so
+		// don't hand it out.
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to store new refresh token")
+		h.respondWithError(w, r, apierror.CodeTokenStorageFailed, "Failed to store refresh token")
+		return
 	}
 
-	h.respondWithJSON(w, http.StatusOK, RefreshTokenResponse{
+	if err := h.refreshTokenService.RecordReplacement(r.Context(), claims.JTI, models.RefreshTokenReplacement{
+		JTI:       newClaims.JTI,
+		FamilyID:  newFamilyID,
+		RotatedAt: rotatedAt,
+	}); err != nil {
+		// Only a retry of this rotation is affected; it will be rejected.
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Warn("Failed to record refresh token replacement")
+	}
+
+	h.events.Publish(r.Context(), events.Event{Type: events.TypeTokenRefresh, UserID: userID, Phone: claims.Phone})
+
+	newTokenPair.RefreshExpiresIn = secondsUntil(newClaims.RegisteredClaims.ExpiresAt.Time)
+	resp := RefreshTokenResponse{
 		AccessToken:  newTokenPair.AccessToken,
 		RefreshToken: newTokenPair.RefreshToken,
 		TokenType:    newTokenPair.TokenType,
 		ExpiresIn:    newTokenPair.ExpiresIn,
+
+		RefreshExpiresIn: newTokenPair.RefreshExpiresIn,
+	}
+	if fromCookie {
+		h.sessionCookies.set(w, r, newTokenPair)
+		resp.AccessToken, resp.RefreshToken = "", ""
+	}
+	h.respondWithJSON(w, http.StatusOK, resp)
+}
+
+// refreshReplacement returns the refresh token issued when the revoked
+// refresh token in claims was rotated, if it was rotated within the reuse
+// grace window and neither a rotation nor an epoch revoked it since.
+func (h *AuthHandlers) refreshReplacement(ctx context.Context, claims *service.Claims) *models.RefreshTokenReplacement {
+	replacement, err := h.refreshTokenService.Replacement(ctx, claims.JTI)
+	if err != nil {
+		logging.LoggerFromContext(ctx, h.logger).WithError(err).Warn("Failed to look up refresh token replacement")
+		return nil
+	}
+	// The replacement was issued later, so an epoch that covers it also
+	// covers the token being retried.
+	if replacement == nil || h.isRevokedByEpoch(ctx, claims) {
+		return nil
+	}
+	return replacement
+}
+
+// handleRefreshReuse responds to a revoked refresh token being presented
+// again, which means it was copied, when reuse lockouts are enabled: the
+// token's whole family is revoked, since whoever holds the current one may
+// be the attacker, and the reuse counts towards locking the account.
+func (h *AuthHandlers) handleRefreshReuse(ctx context.Context, claims *service.Claims) {
+	if !h.accountLocks.Enabled() {
+		return
+	}
+	logger := logging.LoggerFromContext(ctx, h.logger).WithField("jti", claims.JTI)
+	logger.Warn("Revoked refresh token reused")
+
+	tokenData, err := h.refreshTokenService.Get(ctx, claims.JTI)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to get reused refresh token data")
+	} else if tokenData != nil {
+		if err := h.refreshTokenService.RevokeFamily(ctx, tokenData.FamilyID); err != nil {
+			logger.WithError(err).WithField("family_id", tokenData.FamilyID).Error("Failed to revoke family of reused refresh token")
+		}
+	}
+
+	locked, err := h.accountLocks.RecordReuse(ctx, claims.Phone)
+	if err != nil {
+		logger.WithError(err).Error("Failed to record refresh token reuse")
+		return
+	}
+	if locked {
+		h.events.Publish(ctx, events.Event{Type: events.TypeAccountLocked, UserID: claims.Subject, Phone: claims.Phone})
+	}
+}
+
+// checkAccountLock returns the error to respond with, and its Retry-After
+// in seconds if the lock expires, when phoneNumber's account is locked. The
+// account is treated as unlocked if the lock cannot be read.
+func (h *AuthHandlers) checkAccountLock(ctx context.Context, phoneNumber string) (apierror.Code, string, int) {
+	err := h.accountLocks.Check(ctx, phoneNumber)
+	var locked *service.AccountLockedError
+	if errors.As(err, &locked) {
+		if locked.Until.IsZero() {
+			return apierror.CodeAccountLocked, "Account is locked after suspicious activity; contact support", 0
+		}
+		return apierror.CodeAccountLocked, "Account is temporarily locked after suspicious activity", int(math.Ceil(time.Until(locked.Until).Seconds()))
+	}
+	if err != nil {
+		logging.LoggerFromContext(ctx, h.logger).WithError(err).Warn("Failed to check account lock")
+	}
+	return "", "", 0
+}
+
+// isRevokedByEpoch reports whether a token epoch covers claims. Like the
+// per-token revocation check, it lets the token through if the epochs
+// cannot be read.
+func (h *AuthHandlers) isRevokedByEpoch(ctx context.Context, claims *service.Claims) bool {
+	revoked, err := h.revocationService.IsRevokedByEpoch(ctx, claims)
+	if err != nil {
+		logging.LoggerFromContext(ctx, h.logger).WithError(err).Warn("Failed to check token epochs")
+		return false
+	}
+	return revoked
+}
+
+// parsePhone normalizes and validates a phone number from the request,
+// responding with an error and returning false if it cannot be used.
+func parsePhone(w http.ResponseWriter, r *http.Request, input string) (string, bool) {
+	phoneNumber, err := phone.Parse(input)
+	if err != nil {
+		code, message := phoneError(err)
+		apierror.Write(w, r, code, message)
+		return "", false
+	}
+	return phoneNumber, true
+}
+
+// parseIdentifier validates and normalizes an identifier from the request
+// for the OTP flow, responding with an error and returning false if it
+// cannot be used.
+func (h *AuthHandlers) parseIdentifier(w http.ResponseWriter, r *http.Request, input string) (identifier.Identifier, bool) {
+	id, err := h.identifiers.Parse(input)
+	if err != nil {
+		code, message := identifierError(id, err)
+		h.respondWithError(w, r, code, message)
+		return id, false
+	}
+	return id, true
+}
+
+// identifierError maps an identifier.Router.Parse error for id to the error
+// code and message to return.
+func identifierError(id identifier.Identifier, err error) (apierror.Code, string) {
+	switch {
+	case errors.Is(err, identifier.ErrUnsupportedKind), errors.Is(err, identifier.ErrNotDeliverable):
+		return apierror.CodeIdentifierNotSupported, fmt.Sprintf("Signing in with a %s is not supported", id.Kind)
+	case errors.Is(err, email.ErrInvalid):
+		return apierror.CodeInvalidIdentifier, "Invalid email address"
+	case errors.Is(err, identifier.ErrInvalidUsername):
+		return apierror.CodeInvalidIdentifier, "Invalid username"
+	}
+	return phoneError(err)
+}
+
+// phoneError maps a phone.Parse error to the error code and message to
+// return.
+func phoneError(err error) (apierror.Code, string) {
+	if errors.Is(err, phone.ErrHasExtension) {
+		return apierror.CodePhoneHasExtension, "Phone numbers with an extension cannot receive SMS"
+	}
+	return apierror.CodeInvalidPhone, "Invalid phone number format"
+}
+
+// secondsUntil returns the whole seconds left until t.
+func secondsUntil(t time.Time) int64 {
+	return int64(time.Until(t).Round(time.Second).Seconds())
+}
+
+// TokenExchange trades a valid refresh token for a short-lived access token
+// scoped to another audience. The refresh token is not rotated or revoked.
+func (h *AuthHandlers) TokenExchange(w http.ResponseWriter, r *http.Request) {
+	var req TokenExchangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	if req.RefreshToken == "" {
+		h.respondWithError(w, r, apierror.CodeMissingToken, "Refresh token is required")
+		return
+	}
+
+	audiences := strings.Fields(req.Audience)
+	if len(audiences) == 0 {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Audience is required")
+		return
+	}
+
+	claims, err := h.jwtService.VerifyToken(req.RefreshToken)
+	if err != nil {
+		h.respondWithError(w, r, apierror.CodeInvalidToken, "Invalid refresh token")
+		return
+	}
+
+	if claims.Type != "refresh" {
+		h.respondWithError(w, r, apierror.CodeInvalidTokenType, "Token is not a refresh token")
+		return
+	}
+
+	revoked, err := h.refreshTokenService.IsRevoked(r.Context(), claims.JTI)
+	if err == nil && revoked {
+		h.respondWithError(w, r, apierror.CodeTokenRevoked, "Refresh token has been revoked")
+		return
+	}
+	if h.isRevokedByEpoch(r.Context(), claims) {
+		h.respondWithError(w, r, apierror.CodeTokenRevoked, "Refresh token has been revoked")
+		return
+	}
+
+	scopes := strings.Fields(req.Scope)
+	userID, err := h.resolveUserID(r.Context(), claims)
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to resolve user ID")
+		h.respondWithError(w, r, apierror.CodeTokenGenerationFailed, "Failed to generate tokens")
+		return
+	}
+
+	accessToken, expiresIn, err := h.jwtService.GenerateExchangedToken(claims, userID, audiences, scopes)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrAudienceNotAllowed):
+			h.respondWithError(w, r, apierror.CodeInvalidAudience, "Audience is not permitted")
+		case errors.Is(err, service.ErrScopeNotAllowed):
+			h.respondWithError(w, r, apierror.CodeInvalidScope, "Requested scope is not permitted")
+		default:
+			logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to generate exchanged token")
+			h.respondWithError(w, r, apierror.CodeTokenGenerationFailed, "Failed to generate tokens")
+		}
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, TokenExchangeResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   expiresIn,
+		Audience:    strings.Join(audiences, " "),
+		Scope:       strings.Join(scopes, " "),
+	})
+}
+
+// ValidateToken reports the principal of an access token already verified by
+// the auth middleware. Beyond the middleware's single read of the token's
+// revocation state it performs no storage lookups, so gateways can call it
+// on every request.
+func (h *AuthHandlers) ValidateToken(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*service.Claims)
+	if !ok {
+		h.respondWithError(w, r, apierror.CodeUnauthorized, "Invalid token")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, ValidateTokenResponse{
+		UserID:    claims.Subject,
+		Phone:     claims.Phone,
+		JTI:       claims.JTI,
+		ExpiresAt: claims.ExpiresAt.Unix(),
 	})
 }
 
+// Logout revokes the caller's access token, so it is rejected from now on
+// rather than when it expires, and the refresh token in the body if there
+// is one. Logging out again with the same tokens succeeds.
 func (h *AuthHandlers) Logout(w http.ResponseWriter, r *http.Request) {
 	// Get token from context (set by auth middleware)
-	_, ok := r.Context().Value("claims").(*service.Claims)
+	claims, ok := r.Context().Value("claims").(*service.Claims)
 	if !ok {
-		h.respondWithError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		h.respondWithError(w, r, apierror.CodeUnauthorized, "Invalid token")
+		return
+	}
+
+	if err := h.revocationService.Revoke(r.Context(), claims); err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to revoke access token")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to log out")
 		return
 	}
 
@@ -297,6 +1099,9 @@ func (h *AuthHandlers) Logout(w http.ResponseWriter, r *http.Request) {
 		RefreshToken string `json:"refresh_token"`
 	}
 	json.NewDecoder(r.Body).Decode(&req)
+	if req.RefreshToken == "" {
+		req.RefreshToken = h.sessionCookies.refreshToken(r)
+	}
 
 	// If refresh token provided, revoke it
 	if req.RefreshToken != "" {
@@ -306,28 +1111,283 @@ func (h *AuthHandlers) Logout(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	h.events.Publish(r.Context(), events.Event{Type: events.TypeLogout, UserID: claims.Subject, Phone: claims.Phone})
+
+	if h.sessionCookies != nil {
+		h.sessionCookies.clear(w, r)
+	}
 	h.respondWithJSON(w, http.StatusOK, map[string]string{
 		"message": "Logged out successfully",
 	})
 }
 
+// RotateSessions revokes every token of the caller, including those of the
+// current session, and issues a fresh pair in a new family. Refresh tokens
+// are revoked individually and access tokens by advancing the caller's
+// epoch to now.
+func (h *AuthHandlers) RotateSessions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value("claims").(*service.Claims)
+	if !ok {
+		h.respondWithError(w, r, apierror.CodeUnauthorized, "Invalid token")
+		return
+	}
+
+	userID, err := h.resolveUserID(r.Context(), claims)
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to resolve user ID")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to rotate sessions")
+		return
+	}
+
+	now := time.Now()
+	if _, err := h.revocationService.RevokeUserBefore(r.Context(), claims.Phone, now); err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to revoke access tokens")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to rotate sessions")
+		return
+	}
+	if err := h.refreshTokenService.RevokeUser(r.Context(), userID); err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to revoke sessions")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to rotate sessions")
+		return
+	}
+	h.events.Publish(r.Context(), events.Event{Type: events.TypeRevoke, Scope: events.ScopeUser, UserID: userID, Phone: claims.Phone})
+
+	// Epochs have a resolution of one millisecond and revoke tokens issued
+	// in their millisecond, so the new pair is issued in the next one.
+	select {
+	case <-time.After(time.Until(now.Truncate(time.Millisecond).Add(time.Millisecond))):
+	case <-r.Context().Done():
+		h.respondWithError(w, r, apierror.CodeInternalError, "Sessions were revoked but new tokens could not be issued; sign in again")
+		return
+	}
+
+	// Rotating does not re-authenticate, so the caller's auth time carries
+	// over.
+	tokenPair, err := h.issueTokenPair(r.Context(), userID, claims.Phone, claims.AuthenticatedAt(), "")
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to issue tokens after rotating sessions")
+		if errors.Is(err, service.ErrTokenStorageFailed) {
+			h.respondWithError(w, r, apierror.CodeTokenStorageFailed, "Sessions were revoked but new tokens could not be stored; sign in again")
+			return
+		}
+		h.respondWithError(w, r, apierror.CodeInternalError, "Sessions were revoked but new tokens could not be issued; sign in again")
+		return
+	}
+
+	h.respondWithJSON(w, http.StatusOK, tokenPair)
+}
+
+// meFields are the user attributes Me returns, selectable with the fields
+// query parameter.
+var meFields = []string{"phone_number", "name", "created_at", "active_sessions"}
+
+// Me returns the caller's profile, limited to the comma-separated fields
+// query parameter when given. The user record is read only for name and
+// created_at, and the session index only for active_sessions; phone_number
+// comes from the token.
+func (h *AuthHandlers) Me(w http.ResponseWriter, r *http.Request) {
+	fields := meFields
+	if param := r.URL.Query().Get("fields"); param != "" {
+		fields = nil
+		for _, field := range strings.Split(param, ",") {
+			field = strings.TrimSpace(field)
+			if !slices.Contains(meFields, field) {
+				h.respondWithError(w, r, apierror.CodeInvalidFields, fmt.Sprintf("Unknown field %q; allowed fields are %s", field, strings.Join(meFields, ", ")))
+				return
+			}
+			if !slices.Contains(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+
+	phoneNumber, _ := r.Context().Value("phone").(string)
+	resp := make(map[string]interface{}, len(fields))
+
+	if slices.ContainsFunc(fields, func(f string) bool { return f == "name" || f == "created_at" }) {
+		user, err := h.userRepo.GetByPhoneNumber(r.Context(), phoneNumber)
+		if err != nil {
+			logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to get user")
+			h.respondWithError(w, r, apierror.CodeInternalError, "Failed to get user")
+			return
+		}
+		if user == nil {
+			h.respondWithError(w, r, apierror.CodeNotFound, "User not found")
+			return
+		}
+		w.Header().Set("ETag", userETag(user))
+		if slices.Contains(fields, "name") {
+			resp["name"] = user.Name
+		}
+		if slices.Contains(fields, "created_at") {
+			resp["created_at"] = user.CreatedAt
+		}
+	}
+	if slices.Contains(fields, "phone_number") {
+		resp["phone_number"] = phoneNumber
+	}
+	if slices.Contains(fields, "active_sessions") {
+		userID, _ := r.Context().Value("user_id").(string)
+		count, err := h.refreshTokenService.CountActiveSessions(r.Context(), userID)
+		if err != nil {
+			logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to count active sessions")
+			h.respondWithError(w, r, apierror.CodeInternalError, "Failed to count active sessions")
+			return
+		}
+		resp["active_sessions"] = count
+	}
+
+	h.respondWithJSON(w, http.StatusOK, resp)
+}
+
+// UpdateMeRequest carries the profile attributes to change.
+type UpdateMeRequest struct {
+	Name *string `json:"name"`
+}
+
+// UpdateMe changes the caller's profile. With an If-Match header holding the
+// ETag from GET /me, the update only applies if the user is unchanged since;
+// either way it fails with 412 if the user changes between this handler's
+// read and write.
+func (h *AuthHandlers) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	var req UpdateMeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == nil {
+		h.respondWithError(w, r, apierror.CodeInvalidRequest, "Request body must set name")
+		return
+	}
+	name := strings.TrimSpace(*req.Name)
+	if !isValidName(name) {
+		h.respondWithError(w, r, apierror.CodeInvalidName, fmt.Sprintf("Name must be at most %d characters with no control characters", maxNameLength))
+		return
+	}
+
+	phoneNumber, _ := r.Context().Value("phone").(string)
+	user, err := h.userRepo.GetByPhoneNumber(r.Context(), phoneNumber)
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to get user")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to get user")
+		return
+	}
+	if user == nil {
+		h.respondWithError(w, r, apierror.CodeNotFound, "User not found")
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagMatches(ifMatch, userETag(user)) {
+		h.respondWithError(w, r, apierror.CodePreconditionFailed, "User was modified since it was read")
+		return
+	}
+
+	user.Name = name
+	err = h.userRepo.Update(r.Context(), user)
+	if errors.Is(err, repository.ErrVersionConflict) {
+		h.respondWithError(w, r, apierror.CodePreconditionFailed, "User was modified concurrently; read it again")
+		return
+	}
+	if errors.Is(err, repository.ErrItemTooLarge) {
+		h.respondWithError(w, r, apierror.CodeItemTooLarge, "User record would be too large to store")
+		return
+	}
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to update user")
+		h.respondWithError(w, r, apierror.CodeInternalError, "Failed to update user")
+		return
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	h.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"phone_number": phoneNumber,
+		"name":         user.Name,
+		"created_at":   user.CreatedAt,
+	})
+}
+
+// userETag is a strong entity tag for the user's version.
+func userETag(user *models.User) string {
+	return fmt.Sprintf(`"%d"`, user.Version)
+}
+
+// etagMatches reports whether an If-Match header value, a comma-separated
+// list of entity tags or "*", includes etag. Weak tags never match, per the
+// strong comparison If-Match requires.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// JWKS publishes the token verification keys. Verifiers cache the set, so a
+// new key must be published here for longer than their cache lifetime
+// before it starts signing.
+func (h *AuthHandlers) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	h.respondWithJSON(w, http.StatusOK, h.jwtService.JWKS())
+}
+
+// ListErrorCodes returns the catalog of error codes and their HTTP statuses.
+func (h *AuthHandlers) ListErrorCodes(w http.ResponseWriter, r *http.Request) {
+	h.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"errors": apierror.Catalog(),
+	})
+}
+
 func (h *AuthHandlers) respondWithJSON(w http.ResponseWriter, status int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(payload)
 }
 
-func (h *AuthHandlers) respondWithError(w http.ResponseWriter, status int, code, message string) {
-	h.respondWithJSON(w, status, ErrorResponse{
-		Error: ErrorDetail{
-			Code:    code,
-			Message: message,
-		},
-	})
+func (h *AuthHandlers) respondWithError(w http.ResponseWriter, r *http.Request, code apierror.Code, message string) {
+	apierror.Write(w, r, code, message)
+}
+
+// maxNameLength is the longest user name accepted, in characters.
+const maxNameLength = 100
+
+// isValidName rejects invalid UTF-8, which DynamoDB refuses to store, and
+// control and bidi formatting characters, which can make a name render as
+// something other than what it contains.
+func isValidName(name string) bool {
+	if !utf8.ValidString(name) || utf8.RuneCountInString(name) > maxNameLength {
+		return false
+	}
+	for _, c := range name {
+		if unicode.IsControl(c) || unicode.Is(unicode.Bidi_Control, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// maxPushTokenLength comfortably fits FCM registration tokens and hex APNs
+// device tokens.
+const maxPushTokenLength = 512
+
+// isValidPushToken accepts printable ASCII without spaces, which covers the
+// token formats of the push services.
+func isValidPushToken(token string) bool {
+	if len(token) > maxPushTokenLength {
+		return false
+	}
+	for i := 0; i < len(token); i++ {
+		if token[i] <= ' ' || token[i] > '~' {
+			return false
+		}
+	}
+	return true
 }
 
-func isValidPhoneNumber(phone string) bool {
-	// E.164 format: +[country code][number] (max 15 digits after +)
-	matched, _ := regexp.MatchString(`^\+[1-9]\d{1,14}$`, phone)
-	return matched
+func isValidOTP(otp string, length int) bool {
+	if len(otp) != length {
+		return false
+	}
+	for _, c := range otp {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,1186 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/config"
+	"github.com/qcom/qcom/internal/service"
+)
+
+func TestRotateSessionsRevokesPriorSessions(t *testing.T) {
+	env := newTestEnv(t)
+	current := env.signIn(testPhone)
+	other := env.signIn(testPhone)
+
+	rec := env.do(http.MethodPost, "/api/v1/sessions/rotate", current.AccessToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rotate status = %d: %s", rec.Code, rec.Body)
+	}
+	var rotated RefreshTokenResponse
+	decodeBody(t, rec, &rotated)
+
+	for name, session := range map[string]VerifyOTPResponse{"current": current, "other": other} {
+		rec := env.do(http.MethodGet, "/api/v1/auth/validate", session.AccessToken, nil)
+		if rec.Code != http.StatusUnauthorized || errorCode(t, rec) != "TOKEN_REVOKED" {
+			t.Errorf("%s session's access token after rotation: %d %s, want TOKEN_REVOKED", name, rec.Code, rec.Body)
+		}
+		if rec := env.refreshWith(session.RefreshToken); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s session's refresh token after rotation: %d %s, want 401", name, rec.Code, rec.Body)
+		}
+	}
+
+	if rec := env.do(http.MethodGet, "/api/v1/auth/validate", rotated.AccessToken, nil); rec.Code != http.StatusOK {
+		t.Errorf("new access token: %d %s, want 200", rec.Code, rec.Body)
+	}
+	if rec := env.refreshWith(rotated.RefreshToken); rec.Code != http.StatusOK {
+		t.Errorf("new refresh token: %d %s, want 200", rec.Code, rec.Body)
+	}
+}
+
+func withReuseGraceWindow(window time.Duration) func(*config.Config) {
+	return func(cfg *config.Config) {
+		cfg.JWT.ReuseGraceWindow = window
+		cfg.JWT.ReuseLockoutThreshold = 5
+		cfg.JWT.ReuseLockoutWindow = time.Hour
+		cfg.JWT.ReuseLockoutDuration = time.Hour
+	}
+}
+
+// rotate rotates refreshToken, failing the test unless it succeeds.
+func (e *testEnv) rotate(refreshToken string) RefreshTokenResponse {
+	e.t.Helper()
+	rec := e.refreshWith(refreshToken)
+	if rec.Code != http.StatusOK {
+		e.t.Fatalf("refresh status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp RefreshTokenResponse
+	decodeBody(e.t, rec, &resp)
+	return resp
+}
+
+// assertNotStored fails the test if any attribute in the tokens table
+// contains one of tokens.
+func (e *testEnv) assertNotStored(tokens ...string) {
+	e.t.Helper()
+	out, err := e.db.Client().Scan(context.Background(), &dynamodb.ScanInput{TableName: aws.String(e.db.Table("tokens"))})
+	if err != nil {
+		e.t.Fatalf("Scan: %v", err)
+	}
+	for _, item := range out.Items {
+		for name, value := range item {
+			s, ok := value.(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			for _, token := range tokens {
+				if strings.Contains(s.Value, token) {
+					e.t.Errorf("attribute %s of %v stores a bearer token", name, item["PK"])
+				}
+			}
+		}
+	}
+}
+
+func TestRefreshRetryWithinGraceWindow(t *testing.T) {
+	env := newTestEnv(t, withReuseGraceWindow(time.Minute))
+	session := env.signIn(testPhone)
+
+	// The response to this rotation is lost.
+	lost := env.rotate(session.RefreshToken)
+	env.assertNotStored(lost.AccessToken, lost.RefreshToken)
+
+	retried := env.rotate(session.RefreshToken)
+	if retried.RefreshToken == lost.RefreshToken {
+		t.Fatal("retry returned the lost refresh token again")
+	}
+	env.assertNotStored(retried.AccessToken, retried.RefreshToken)
+
+	// A second retry is still benign.
+	again := env.rotate(session.RefreshToken)
+	if rec := env.do(http.MethodGet, "/api/v1/auth/validate", again.AccessToken, nil); rec.Code != http.StatusOK {
+		t.Errorf("reissued access token: %d %s, want 200", rec.Code, rec.Body)
+	}
+	next := env.rotate(again.RefreshToken)
+
+	// The tokens the retries replaced were revoked; presenting one now is
+	// reuse and revokes the family.
+	for name, token := range map[string]string{"lost": lost.RefreshToken, "first retry's": retried.RefreshToken} {
+		if rec := env.refreshWith(token); rec.Code != http.StatusUnauthorized || errorCode(t, rec) != "TOKEN_REVOKED" {
+			t.Errorf("%s refresh token: %d %s, want TOKEN_REVOKED", name, rec.Code, rec.Body)
+		}
+	}
+	if rec := env.refreshWith(next.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Errorf("current refresh token after reuse: %d %s, want 401", rec.Code, rec.Body)
+	}
+}
+
+func TestRefreshReuseAfterReplacementUsed(t *testing.T) {
+	env := newTestEnv(t, withReuseGraceWindow(time.Minute))
+	session := env.signIn(testPhone)
+
+	rotated := env.rotate(session.RefreshToken)
+	current := env.rotate(rotated.RefreshToken)
+
+	// The replacement has been used, so presenting the original token again
+	// is reuse: it is rejected and the family revoked.
+	if rec := env.refreshWith(session.RefreshToken); rec.Code != http.StatusUnauthorized || errorCode(t, rec) != "TOKEN_REVOKED" {
+		t.Fatalf("reused refresh token: %d %s, want TOKEN_REVOKED", rec.Code, rec.Body)
+	}
+	if rec := env.refreshWith(current.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Errorf("current refresh token after reuse: %d %s, want 401 as its family is revoked", rec.Code, rec.Body)
+	}
+}
+
+func TestRefreshRetryAfterGraceWindow(t *testing.T) {
+	env := newTestEnv(t, withReuseGraceWindow(50*time.Millisecond))
+	session := env.signIn(testPhone)
+
+	env.rotate(session.RefreshToken)
+	time.Sleep(100 * time.Millisecond)
+
+	if rec := env.refreshWith(session.RefreshToken); rec.Code != http.StatusUnauthorized || errorCode(t, rec) != "TOKEN_REVOKED" {
+		t.Errorf("retry after the grace window: %d %s, want TOKEN_REVOKED", rec.Code, rec.Body)
+	}
+}
+
+// reuse signs phoneNumber in and presents the first refresh token again
+// after rotating it, which counts as one reuse detection.
+func (e *testEnv) reuse(phoneNumber string) *httptest.ResponseRecorder {
+	e.t.Helper()
+	session := e.signIn(phoneNumber)
+	e.rotate(session.RefreshToken)
+	return e.refreshWith(session.RefreshToken)
+}
+
+func TestAccountLockoutAfterRepeatedReuse(t *testing.T) {
+	env := newTestEnv(t, withReuseGraceWindow(0), func(cfg *config.Config) {
+		cfg.JWT.ReuseLockoutThreshold = 1
+	})
+	env.router.HandleFunc("/api/v1/admin/account-lock", env.admin.UnlockAccount).Methods("DELETE")
+
+	// Reaching the threshold does not lock the account; exceeding it does.
+	if rec := env.reuse(testPhone); errorCode(t, rec) != "TOKEN_REVOKED" {
+		t.Fatalf("first reuse: %d %s, want TOKEN_REVOKED", rec.Code, rec.Body)
+	}
+	if rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: testPhone}); rec.Code != http.StatusOK {
+		t.Fatalf("initiate-otp after one reuse: %d %s, want 200", rec.Code, rec.Body)
+	}
+	env.reuse(testPhone)
+
+	rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: testPhone})
+	if rec.Code != http.StatusLocked || errorCode(t, rec) != "ACCOUNT_LOCKED" {
+		t.Fatalf("initiate-otp after exceeding the threshold: %d %s, want ACCOUNT_LOCKED", rec.Code, rec.Body)
+	}
+	if retryAfter, _ := strconv.Atoi(rec.Header().Get("Retry-After")); retryAfter <= 0 || retryAfter > 3600 {
+		t.Errorf("Retry-After = %q, want the rest of the hour-long lock", rec.Header().Get("Retry-After"))
+	}
+	rec = env.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{PhoneNumber: testPhone, OTP: env.sender.last(testPhone)})
+	if rec.Code != http.StatusLocked || errorCode(t, rec) != "ACCOUNT_LOCKED" {
+		t.Errorf("verify-otp while locked: %d %s, want ACCOUNT_LOCKED", rec.Code, rec.Body)
+	}
+	if rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: "+15557654321"}); rec.Code != http.StatusOK {
+		t.Errorf("initiate-otp for another number: %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	if rec := env.do(http.MethodDelete, "/api/v1/admin/account-lock?phone="+url.QueryEscape(testPhone), "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("unlock: %d %s, want 200", rec.Code, rec.Body)
+	}
+	env.signIn(testPhone)
+}
+
+func TestUpdateMeIfMatch(t *testing.T) {
+	env := newTestEnv(t)
+	session := env.signIn(testPhone)
+
+	rec := env.do(http.MethodGet, "/api/v1/me?fields=name", session.AccessToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /me status = %d: %s", rec.Code, rec.Body)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("GET /me ETag = %q, want %q", etag, `"1"`)
+	}
+
+	ifMatch := http.Header{"If-Match": {etag}}
+	rec = env.doWithHeader(http.MethodPatch, "/api/v1/me", session.AccessToken, UpdateMeRequest{Name: aws.String("Ada")}, ifMatch)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH /me with the current ETag: %d %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("ETag"); got != `"2"` {
+		t.Errorf("PATCH /me ETag = %q, want %q", got, `"2"`)
+	}
+
+	// Another client updated the user since etag was read.
+	rec = env.doWithHeader(http.MethodPatch, "/api/v1/me", session.AccessToken, UpdateMeRequest{Name: aws.String("Grace")}, ifMatch)
+	if rec.Code != http.StatusPreconditionFailed || errorCode(t, rec) != "PRECONDITION_FAILED" {
+		t.Errorf("PATCH /me with a stale ETag: %d %s, want PRECONDITION_FAILED", rec.Code, rec.Body)
+	}
+	rec = env.do(http.MethodGet, "/api/v1/me?fields=name", session.AccessToken, nil)
+	var me struct {
+		Name string `json:"name"`
+	}
+	decodeBody(t, rec, &me)
+	if me.Name != "Ada" {
+		t.Errorf("name after a rejected update = %q, want %q", me.Name, "Ada")
+	}
+
+	// Without If-Match the update applies to whatever version is current.
+	rec = env.do(http.MethodPatch, "/api/v1/me", session.AccessToken, UpdateMeRequest{Name: aws.String("Grace")})
+	if rec.Code != http.StatusOK {
+		t.Errorf("PATCH /me without If-Match: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// A failed verify-otp must not tell whether the number has an account or a
+// pending OTP, by its response or by how long it takes.
+func TestVerifyOTPFailureIndistinguishable(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.OTP.HashAlgorithm = config.OTPHashBcrypt
+		cfg.OTP.MaxAttempts = 100
+		cfg.OTP.GenericVerifyErrors = true
+	})
+	ctx := context.Background()
+
+	registered, unregistered, idle := testPhone, "+15557654321", "+15550001111"
+	env.signIn(registered)
+	for _, phoneNumber := range []string{registered, unregistered} {
+		if _, err := env.otp.GenerateOTP(ctx, phoneNumber); err != nil {
+			t.Fatalf("GenerateOTP: %v", err)
+		}
+	}
+
+	type outcome struct {
+		status int
+		body   string
+		median time.Duration
+	}
+	outcomes := map[string]outcome{}
+	for name, phoneNumber := range map[string]string{
+		"registered":           registered,
+		"unregistered":         unregistered,
+		"unregistered, no OTP": idle,
+	} {
+		wrong := "000000"
+		if env.sender.last(phoneNumber) == wrong {
+			wrong = "111111"
+		}
+		var o outcome
+		durations := make([]time.Duration, 5)
+		for i := range durations {
+			start := time.Now()
+			rec := env.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{PhoneNumber: phoneNumber, OTP: wrong})
+			durations[i] = time.Since(start)
+			o.status, o.body = rec.Code, rec.Body.String()
+		}
+		slices.Sort(durations)
+		o.median = durations[len(durations)/2]
+		outcomes[name] = o
+	}
+
+	want := outcomes["registered"]
+	if want.status != http.StatusUnauthorized {
+		t.Fatalf("wrong code for a registered number: %d %s, want 401", want.status, want.body)
+	}
+	for name, got := range outcomes {
+		if got.status != want.status || got.body != want.body {
+			t.Errorf("%s: %d %s, want the same response as a registered number: %d %s", name, got.status, got.body, want.status, want.body)
+		}
+		if ratio := float64(got.median) / float64(want.median); ratio < 0.5 || ratio > 2 {
+			t.Errorf("%s took %v, a registered number %v; want them within 2x", name, got.median, want.median)
+		}
+	}
+}
+
+func FuzzVerifyOTPInput(f *testing.F) {
+	seeds := []struct{ phone, otp string }{
+		{testPhone, "123456"},
+		{testPhone, "12345"},
+		{testPhone, "1234567"},
+		{testPhone, ""},
+		{testPhone, " 123456 "},
+		{testPhone, "12345\x00"},
+		{testPhone, "١٢٣٤٥٦"},
+		{testPhone, "１２３４５６"},
+		{testPhone, "12345６"},
+		{testPhone, "123​456"},
+		{testPhone, "-12345"},
+		{testPhone, "1e5000"},
+		{testPhone, "\xff\xfe\xfd\xfc\xfb\xfa"},
+		{"+1555\x001234567", "123456"},
+		{"‮+15551234567", "123456"},
+		{"+15551234567 ext. 89", "123456"},
+		{"", ""},
+	}
+	for _, seed := range seeds {
+		f.Add(seed.phone, seed.otp)
+	}
+
+	env := newTestEnv(f)
+	// A pending OTP, so well-formed input reaches verification.
+	if _, err := env.otp.GenerateOTP(context.Background(), testPhone); err != nil {
+		f.Fatalf("GenerateOTP: %v", err)
+	}
+
+	f.Fuzz(func(t *testing.T, phoneNumber, otp string) {
+		if isValidOTP(otp, 6) {
+			if len(otp) != 6 || strings.Trim(otp, "0123456789") != "" {
+				t.Fatalf("isValidOTP(%q) = true, want only 6 ASCII digits accepted", otp)
+			}
+		}
+
+		env.t = t
+		rec := env.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{PhoneNumber: phoneNumber, OTP: otp})
+		switch rec.Code {
+		case http.StatusOK:
+			if otp != env.sender.last(testPhone) {
+				t.Fatalf("verify-otp accepted %q for %q", otp, phoneNumber)
+			}
+			// Consumed; issue another so later inputs are still verified.
+			if _, err := env.otp.GenerateOTP(context.Background(), testPhone); err != nil {
+				t.Fatalf("GenerateOTP: %v", err)
+			}
+		case http.StatusBadRequest, http.StatusUnauthorized:
+			if errorCode(t, rec) == "" {
+				t.Fatalf("verify-otp error without a code: %s", rec.Body)
+			}
+		default:
+			t.Fatalf("verify-otp status = %d for %q, %q: %s", rec.Code, phoneNumber, otp, rec.Body)
+		}
+	})
+}
+
+func TestVerifyOTPNoRefresh(t *testing.T) {
+	env := newTestEnv(t)
+	if _, err := env.otp.GenerateOTP(context.Background(), testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+
+	rec := env.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{
+		PhoneNumber: testPhone,
+		OTP:         env.sender.last(testPhone),
+		NoRefresh:   true,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("verify-otp status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp map[string]interface{}
+	decodeBody(t, rec, &resp)
+	for _, field := range []string{"refresh_token", "refresh_expires_in"} {
+		if _, ok := resp[field]; ok {
+			t.Errorf("response has %s with no_refresh set", field)
+		}
+	}
+	if n := env.db.Len("tokens"); n != 0 {
+		t.Errorf("tokens table has %d items, want no refresh token stored", n)
+	}
+
+	accessToken, _ := resp["access_token"].(string)
+	if rec := env.do(http.MethodGet, "/api/v1/auth/validate", accessToken, nil); rec.Code != http.StatusOK {
+		t.Errorf("access token: %d %s, want 200", rec.Code, rec.Body)
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	env := newTestEnv(t)
+	session := env.signIn(testPhone)
+
+	rec := env.do(http.MethodGet, "/api/v1/auth/validate", session.AccessToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("validate status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp ValidateTokenResponse
+	decodeBody(t, rec, &resp)
+	if resp.UserID != session.User.UserID || resp.Phone != testPhone || resp.JTI == "" {
+		t.Errorf("validate = %+v, want the signed-in user", resp)
+	}
+	if expiresIn := time.Until(time.Unix(resp.ExpiresAt, 0)); expiresIn <= 0 || expiresIn > 15*time.Minute {
+		t.Errorf("expires_at is %v away, want within the access token lifetime", expiresIn)
+	}
+
+	for name, token := range map[string]string{
+		"refresh token": session.RefreshToken,
+		"garbage":       "not-a-token",
+	} {
+		if rec := env.do(http.MethodGet, "/api/v1/auth/validate", token, nil); rec.Code != http.StatusUnauthorized {
+			t.Errorf("validate with a %s: %d %s, want 401", name, rec.Code, rec.Body)
+		}
+	}
+	if rec := env.do(http.MethodGet, "/api/v1/auth/validate", "", nil); rec.Code == http.StatusOK {
+		t.Errorf("validate without a token: %d, want an error", rec.Code)
+	}
+}
+
+// Tokens name the user by a stable ID rather than their phone number.
+func TestTokenSubjectIsStableUserID(t *testing.T) {
+	env := newTestEnv(t)
+	first := env.signIn(testPhone)
+	second := env.signIn(testPhone)
+
+	if first.User.UserID == "" || first.User.UserID == testPhone {
+		t.Fatalf("user ID = %q, want a stable ID", first.User.UserID)
+	}
+	if second.User.UserID != first.User.UserID {
+		t.Errorf("user ID changed between sign-ins: %q, then %q", first.User.UserID, second.User.UserID)
+	}
+	for name, token := range map[string]string{"access": first.AccessToken, "refresh": first.RefreshToken} {
+		claims, err := env.jwt.VerifyToken(token)
+		if err != nil {
+			t.Fatalf("VerifyToken: %v", err)
+		}
+		if claims.Subject != first.User.UserID || claims.Phone != testPhone {
+			t.Errorf("%s token sub = %q, phone = %q, want the user ID and phone number", name, claims.Subject, claims.Phone)
+		}
+	}
+}
+
+// A refresh token issued when the subject was the phone number is rotated
+// into tokens naming the user ID.
+func TestRefreshLegacyTokenUsesUserID(t *testing.T) {
+	env := newTestEnv(t)
+	legacy, err := env.auth.issueTokenPair(context.Background(), testPhone, testPhone, time.Now(), "")
+	if err != nil {
+		t.Fatalf("issueTokenPair: %v", err)
+	}
+
+	rotated := env.rotate(legacy.RefreshToken)
+	claims, err := env.jwt.VerifyToken(rotated.AccessToken)
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+	if claims.Subject == "" || claims.Subject == testPhone {
+		t.Fatalf("rotated token sub = %q, want the user ID", claims.Subject)
+	}
+	if session := env.signIn(testPhone); session.User.UserID != claims.Subject {
+		t.Errorf("rotated token sub = %q, but the user's ID is %q", claims.Subject, session.User.UserID)
+	}
+}
+
+func TestInitiateOTPCountryLists(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.OTP.AllowedCountryCodes = []string{"1", "44"}
+		cfg.OTP.BlockedCountryCodes = []string{"44"}
+	})
+
+	for _, tc := range []struct {
+		phone string
+		want  int
+	}{
+		{testPhone, http.StatusOK},
+		{"+447700900123", http.StatusBadRequest},
+		{"+254712345678", http.StatusBadRequest},
+	} {
+		rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: tc.phone})
+		if rec.Code != tc.want {
+			t.Errorf("initiate-otp for %s: %d %s, want %d", tc.phone, rec.Code, rec.Body, tc.want)
+			continue
+		}
+		if tc.want != http.StatusOK {
+			if code := errorCode(t, rec); code != "COUNTRY_NOT_SUPPORTED" {
+				t.Errorf("initiate-otp for %s: code %s, want COUNTRY_NOT_SUPPORTED", tc.phone, code)
+			}
+			if env.sender.last(tc.phone) != "" {
+				t.Errorf("an OTP was sent to %s", tc.phone)
+			}
+		}
+	}
+}
+
+// dropTable deletes the test's table called name, so every write to it
+// fails.
+func (e *testEnv) dropTable(name string) {
+	e.t.Helper()
+	_, err := e.db.Client().DeleteTable(context.Background(), &dynamodb.DeleteTableInput{TableName: aws.String(e.db.Table(name))})
+	if err != nil {
+		e.t.Fatalf("DeleteTable: %v", err)
+	}
+}
+
+// In strict mode a refresh token that cannot be stored is never handed
+// out; in lenient mode the tokens are issued anyway.
+func TestVerifyOTPTokenStorageFailure(t *testing.T) {
+	for _, tc := range []struct {
+		storage string
+		want    int
+	}{
+		{config.TokenStorageStrict, http.StatusInternalServerError},
+		{config.TokenStorageLenient, http.StatusOK},
+	} {
+		env := newTestEnv(t, func(cfg *config.Config) { cfg.JWT.RefreshTokenStorage = tc.storage })
+		if _, err := env.otp.GenerateOTP(context.Background(), testPhone); err != nil {
+			t.Fatalf("GenerateOTP: %v", err)
+		}
+		env.dropTable("tokens")
+
+		rec := env.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{PhoneNumber: testPhone, OTP: env.sender.last(testPhone)})
+		if rec.Code != tc.want {
+			t.Fatalf("%s: verify-otp status = %d: %s, want %d", tc.storage, rec.Code, rec.Body, tc.want)
+		}
+		var resp VerifyOTPResponse
+		decodeBody(t, rec, &resp)
+		if tc.want == http.StatusOK {
+			if resp.AccessToken == "" || resp.RefreshToken == "" {
+				t.Errorf("%s: tokens missing from %s", tc.storage, rec.Body)
+			}
+			continue
+		}
+		if code := errorCode(t, rec); code != "TOKEN_STORAGE_FAILED" {
+			t.Errorf("%s: code %s, want TOKEN_STORAGE_FAILED", tc.storage, code)
+		}
+		if resp.AccessToken != "" || resp.RefreshToken != "" {
+			t.Errorf("%s: tokens issued although none could be stored: %s", tc.storage, rec.Body)
+		}
+	}
+}
+
+func TestInitiateOTPReportsChannel(t *testing.T) {
+	for _, returnDestination := range []bool{false, true} {
+		env := newTestEnv(t, func(cfg *config.Config) { cfg.OTP.ReturnDestination = returnDestination })
+
+		rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: testPhone})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("initiate-otp status = %d: %s", rec.Code, rec.Body)
+		}
+		var resp InitiateOTPResponse
+		decodeBody(t, rec, &resp)
+		if resp.Channel != "sms" {
+			t.Errorf("channel = %q, want the sender's sms", resp.Channel)
+		}
+		switch {
+		case !returnDestination && resp.Destination != "":
+			t.Errorf("destination %q returned although disabled", resp.Destination)
+		case returnDestination && (resp.Destination == "" || resp.Destination == testPhone):
+			t.Errorf("destination = %q, want the masked phone number", resp.Destination)
+		}
+	}
+}
+
+// verifyAndSetName sends a fresh OTP for testPhone to verify-and-set-name
+// with name and overwrite.
+func (e *testEnv) verifyAndSetName(name string, overwrite bool) *httptest.ResponseRecorder {
+	e.t.Helper()
+	if _, err := e.otp.GenerateOTP(context.Background(), testPhone); err != nil {
+		e.t.Fatalf("GenerateOTP: %v", err)
+	}
+	return e.do(http.MethodPost, "/api/v1/auth/verify-and-set-name", "", VerifyAndSetNameRequest{
+		VerifyOTPRequest: VerifyOTPRequest{PhoneNumber: testPhone, OTP: e.sender.last(testPhone)},
+		Name:             name,
+		OverwriteName:    overwrite,
+	})
+}
+
+func TestVerifyAndSetName(t *testing.T) {
+	env := newTestEnv(t)
+
+	for _, step := range []struct {
+		name      string
+		overwrite bool
+		want      string
+	}{
+		{"  Ada  ", false, "Ada"},
+		{"Grace", false, "Ada"},
+		{"Grace", true, "Grace"},
+		{"", true, "Grace"},
+	} {
+		rec := env.verifyAndSetName(step.name, step.overwrite)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("verify-and-set-name %q: status %d: %s", step.name, rec.Code, rec.Body)
+		}
+		var resp VerifyOTPResponse
+		decodeBody(t, rec, &resp)
+		if resp.AccessToken == "" || resp.User.Name != step.want {
+			t.Errorf("verify-and-set-name %q, overwrite %v: user name %q, want %q", step.name, step.overwrite, resp.User.Name, step.want)
+		}
+	}
+}
+
+// An invalid name is refused before the OTP is checked, so the code can
+// still be used.
+func TestVerifyAndSetNameInvalidName(t *testing.T) {
+	env := newTestEnv(t)
+
+	rec := env.verifyAndSetName("Ada\x00", false)
+	if rec.Code != http.StatusBadRequest || errorCode(t, rec) != "INVALID_NAME" {
+		t.Fatalf("verify-and-set-name with a control character: %d %s, want INVALID_NAME", rec.Code, rec.Body)
+	}
+	rec = env.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{PhoneNumber: testPhone, OTP: env.sender.last(testPhone)})
+	if rec.Code != http.StatusOK {
+		t.Errorf("verify-otp after the refused name: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// otpStatus asks for phoneNumber's OTP status with statusToken.
+func (e *testEnv) otpStatus(phoneNumber, statusToken string) *httptest.ResponseRecorder {
+	e.t.Helper()
+	header := http.Header{}
+	if statusToken != "" {
+		header.Set(OTPStatusTokenHeader, statusToken)
+	}
+	return e.doWithHeader(http.MethodGet, "/api/v1/auth/otp/status?phone="+url.QueryEscape(phoneNumber), "", nil, header)
+}
+
+func TestOTPStatus(t *testing.T) {
+	env := newTestEnv(t)
+	rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: testPhone})
+	var initiated InitiateOTPResponse
+	decodeBody(t, rec, &initiated)
+	if initiated.StatusToken == "" {
+		t.Fatalf("initiate-otp returned no status token: %s", rec.Body)
+	}
+
+	status := func() OTPStatusResponse {
+		t.Helper()
+		rec := env.otpStatus(testPhone, initiated.StatusToken)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("otp/status: %d %s", rec.Code, rec.Body)
+		}
+		var resp OTPStatusResponse
+		decodeBody(t, rec, &resp)
+		return resp
+	}
+
+	if got := status(); !got.Pending || got.AttemptsRemaining != 3 || got.ExpiresIn <= 0 || got.ExpiresIn > 300 {
+		t.Errorf("status after initiate = %+v, want pending with 3 attempts and at most 5 minutes left", got)
+	}
+	env.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{PhoneNumber: testPhone, OTP: "000000"})
+	if got := status(); !got.Pending || got.AttemptsRemaining != 2 {
+		t.Errorf("status after a wrong guess = %+v, want pending with 2 attempts", got)
+	}
+	env.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{PhoneNumber: testPhone, OTP: env.sender.last(testPhone)})
+	if got := status(); got.Pending {
+		t.Errorf("status after sign-in = %+v, want nothing pending", got)
+	}
+}
+
+func TestOTPStatusRejectsTokens(t *testing.T) {
+	env := newTestEnv(t)
+	rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: testPhone})
+	var initiated InitiateOTPResponse
+	decodeBody(t, rec, &initiated)
+	access := env.signIn("+15557654321").AccessToken
+
+	for _, tc := range []struct {
+		name, phone, token, code string
+	}{
+		{"no token", testPhone, "", "MISSING_TOKEN"},
+		{"garbage", testPhone, "not-a-token", "INVALID_TOKEN"},
+		{"another number's token", "+15557654321", initiated.StatusToken, "INVALID_TOKEN"},
+		{"access token", "+15557654321", access, "INVALID_TOKEN_TYPE"},
+	} {
+		rec := env.otpStatus(tc.phone, tc.token)
+		if code := errorCode(t, rec); code != tc.code {
+			t.Errorf("%s: %d %s, want %s", tc.name, rec.Code, rec.Body, tc.code)
+		}
+	}
+}
+
+func TestOTPStatusRateLimited(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) { cfg.OTP.StatusRatePerMinute = 2 })
+	rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: testPhone})
+	var initiated InitiateOTPResponse
+	decodeBody(t, rec, &initiated)
+
+	for i := 0; i < 2; i++ {
+		if rec := env.otpStatus(testPhone, initiated.StatusToken); rec.Code != http.StatusOK {
+			t.Fatalf("status check %d: %d %s", i+1, rec.Code, rec.Body)
+		}
+	}
+	if rec := env.otpStatus(testPhone, initiated.StatusToken); errorCode(t, rec) != "RATE_LIMITED" {
+		t.Errorf("third status check: %d %s, want RATE_LIMITED", rec.Code, rec.Body)
+	}
+}
+
+func TestMeFields(t *testing.T) {
+	env := newTestEnv(t)
+	session := env.signIn(testPhone)
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", slices.Sorted(slices.Values(meFields))},
+		{"?fields=phone_number", []string{"phone_number"}},
+		{"?fields=name,%20created_at,name", []string{"created_at", "name"}},
+	} {
+		rec := env.do(http.MethodGet, "/api/v1/me"+tc.query, session.AccessToken, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /me%s status = %d: %s", tc.query, rec.Code, rec.Body)
+		}
+		var me map[string]interface{}
+		decodeBody(t, rec, &me)
+		if got := slices.Sorted(maps.Keys(me)); !slices.Equal(got, tc.want) {
+			t.Errorf("GET /me%s returned %v, want %v", tc.query, got, tc.want)
+		}
+		if phone, ok := me["phone_number"]; ok && phone != testPhone {
+			t.Errorf("GET /me%s phone_number = %v, want %s", tc.query, phone, testPhone)
+		}
+	}
+
+	rec := env.do(http.MethodGet, "/api/v1/me?fields=name,password", session.AccessToken, nil)
+	if rec.Code != http.StatusBadRequest || errorCode(t, rec) != "INVALID_FIELDS" {
+		t.Errorf("GET /me with an unknown field: %d %s, want INVALID_FIELDS", rec.Code, rec.Body)
+	}
+}
+
+// active_sessions counts each sign-in and drops when one logs out.
+func TestMeActiveSessions(t *testing.T) {
+	env := newTestEnv(t)
+	sessions := []VerifyOTPResponse{env.signIn(testPhone), env.signIn(testPhone)}
+
+	activeSessions := func() float64 {
+		t.Helper()
+		rec := env.do(http.MethodGet, "/api/v1/me?fields=active_sessions", sessions[0].AccessToken, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /me status = %d: %s", rec.Code, rec.Body)
+		}
+		var me map[string]interface{}
+		decodeBody(t, rec, &me)
+		count, _ := me["active_sessions"].(float64)
+		return count
+	}
+	if got := activeSessions(); got != 2 {
+		t.Errorf("active_sessions after two sign-ins = %v, want 2", got)
+	}
+
+	rec := env.do(http.MethodPost, "/api/v1/auth/logout", sessions[1].AccessToken, map[string]string{"refresh_token": sessions[1].RefreshToken})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("logout status = %d: %s", rec.Code, rec.Body)
+	}
+	if got := activeSessions(); got != 1 {
+		t.Errorf("active_sessions after logging one out = %v, want 1", got)
+	}
+}
+
+// Logging out revokes the access token it was made with along with its
+// refresh token, and leaves the user's other sessions alone.
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	env := newTestEnv(t)
+	session := env.signIn(testPhone)
+	other := env.signIn(testPhone)
+
+	rec := env.do(http.MethodPost, "/api/v1/auth/logout", session.AccessToken, map[string]string{"refresh_token": session.RefreshToken})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("logout status = %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := env.do(http.MethodGet, "/api/v1/auth/validate", session.AccessToken, nil); rec.Code != http.StatusUnauthorized || errorCode(t, rec) != "TOKEN_REVOKED" {
+		t.Errorf("access token after logout: %d %s, want TOKEN_REVOKED", rec.Code, rec.Body)
+	}
+	if rec := env.refreshWith(session.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token after logout: %d %s, want 401", rec.Code, rec.Body)
+	}
+	if status := env.meStatus(other.AccessToken); status != http.StatusOK {
+		t.Errorf("other session after logout: %d, want 200", status)
+	}
+}
+
+// A family can be refreshed MaxRefreshChain times; the next refresh revokes
+// it and asks the user to sign in again.
+func TestRefreshChainLimit(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) { cfg.JWT.MaxRefreshChain = 2 })
+	session := env.signIn(testPhone)
+
+	refreshToken := session.RefreshToken
+	for i := 1; i <= 2; i++ {
+		rec := env.refreshWith(refreshToken)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("refresh %d status = %d: %s", i, rec.Code, rec.Body)
+		}
+		var resp RefreshTokenResponse
+		decodeBody(t, rec, &resp)
+		refreshToken = resp.RefreshToken
+	}
+
+	rec := env.refreshWith(refreshToken)
+	if rec.Code != http.StatusUnauthorized || errorCode(t, rec) != "REAUTH_REQUIRED" {
+		t.Fatalf("refresh past the limit: %d %s, want REAUTH_REQUIRED", rec.Code, rec.Body)
+	}
+	if rec := env.refreshWith(refreshToken); rec.Code == http.StatusOK {
+		t.Error("refresh succeeded after the family was revoked at the limit")
+	}
+	if n, err := env.refresh.CountActiveSessions(context.Background(), session.User.UserID); err != nil || n != 0 {
+		t.Errorf("CountActiveSessions after the limit = %d, %v, want 0", n, err)
+	}
+
+	if rec := env.refreshWith(env.signIn(testPhone).RefreshToken); rec.Code != http.StatusOK {
+		t.Errorf("refresh after signing in again: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// Refresh expiry slides, so each rotation issues a refresh token with the
+// full lifetime, and refresh_expires_in matches the token's expiry.
+func TestRefreshExpiresIn(t *testing.T) {
+	env := newTestEnv(t)
+	session := env.signIn(testPhone)
+	lifetime := int64((24 * time.Hour).Seconds())
+
+	checkLifetime := func(step, refreshToken string, got int64) {
+		t.Helper()
+		if got < lifetime-1 || got > lifetime {
+			t.Errorf("%s: refresh_expires_in = %d, want %d", step, got, lifetime)
+		}
+		claims, err := env.jwt.VerifyToken(refreshToken)
+		if err != nil {
+			t.Fatalf("%s: VerifyToken: %v", step, err)
+		}
+		if diff := time.Until(claims.ExpiresAt.Time).Seconds() - float64(got); diff < -1 || diff > 1 {
+			t.Errorf("%s: refresh_expires_in is %.0fs off the token's expiry", step, diff)
+		}
+	}
+	checkLifetime("verify-otp", session.RefreshToken, session.RefreshExpiresIn)
+
+	refreshToken := session.RefreshToken
+	for i := range 2 {
+		rec := env.refreshWith(refreshToken)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("refresh %d status = %d: %s", i, rec.Code, rec.Body)
+		}
+		var resp RefreshTokenResponse
+		decodeBody(t, rec, &resp)
+		checkLifetime("refresh", resp.RefreshToken, resp.RefreshExpiresIn)
+		refreshToken = resp.RefreshToken
+	}
+}
+
+func TestInitiateOTPFormattedNumbers(t *testing.T) {
+	env := newTestEnv(t)
+
+	rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: "+1 (555) 123-4567"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("initiate-otp with a formatted number: %d %s", rec.Code, rec.Body)
+	}
+	if env.sender.last(testPhone) == "" {
+		t.Error("no OTP was sent to the normalized number")
+	}
+
+	rec = env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: "+1-555-765-4321 ext. 89"})
+	if rec.Code != http.StatusBadRequest || errorCode(t, rec) != "PHONE_HAS_EXTENSION" {
+		t.Errorf("initiate-otp with an extension: %d %s, want PHONE_HAS_EXTENSION", rec.Code, rec.Body)
+	}
+}
+
+// A batch reports each number on its own and answers 200 even when only
+// some of them were sent an OTP.
+func TestInitiateOTPBatch(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.OTP.Reinitiate = config.OTPReinitiateReject
+		cfg.OTP.ResendCooldown = time.Minute
+	})
+	const limited, fresh = "+15557654321", "+15550001111"
+	if rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: limited}); rec.Code != http.StatusOK {
+		t.Fatalf("initiate-otp status = %d: %s", rec.Code, rec.Body)
+	}
+	limitedOTP := env.sender.last(limited)
+
+	rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp/batch", "", InitiateOTPBatchRequest{
+		PhoneNumbers: []string{fresh, "+0555123", limited, "+1 (555) 000-1111"},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("initiate-otp/batch status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp InitiateOTPBatchResponse
+	decodeBody(t, rec, &resp)
+	want := []struct{ status, code string }{
+		{OTPBatchSent, ""},
+		{OTPBatchInvalid, "INVALID_PHONE"},
+		{OTPBatchRateLimited, "OTP_ALREADY_SENT"},
+		{OTPBatchInvalid, "INVALID_REQUEST"},
+	}
+	if len(resp.Results) != len(want) {
+		t.Fatalf("got %d results, want %d: %s", len(resp.Results), len(want), rec.Body)
+	}
+	for i, result := range resp.Results {
+		code := ""
+		if result.Error != nil {
+			code = string(result.Error.Code)
+		}
+		if result.Status != want[i].status || code != want[i].code {
+			t.Errorf("result for %s = %s %s, want %s %s", result.PhoneNumber, result.Status, code, want[i].status, want[i].code)
+		}
+	}
+	if resp.Results[0].InitiateOTPResponse == nil || env.sender.last(fresh) == "" {
+		t.Error("the valid number was not sent an OTP")
+	}
+	if resp.Results[2].RetryAfter <= 0 {
+		t.Errorf("retry_after for the rate-limited number = %d, want the cooldown", resp.Results[2].RetryAfter)
+	}
+	if env.sender.last(limited) != limitedOTP {
+		t.Error("the rate-limited number was sent another OTP")
+	}
+
+	tooMany := make([]string, maxInitiateOTPBatch+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("+1555000%04d", i)
+	}
+	for _, numbers := range [][]string{nil, tooMany} {
+		rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp/batch", "", InitiateOTPBatchRequest{PhoneNumbers: numbers})
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != "INVALID_REQUEST" {
+			t.Errorf("initiate-otp/batch with %d numbers: %d %s, want INVALID_REQUEST", len(numbers), rec.Code, rec.Body)
+		}
+	}
+}
+
+// Only phone numbers have a delivery channel, so other kinds are refused
+// even when accepted, and malformed ones are reported as invalid.
+func TestInitiateOTPIdentifierKinds(t *testing.T) {
+	phoneOnly := newTestEnv(t)
+	all := newTestEnv(t, func(cfg *config.Config) {
+		cfg.OTP.IdentifierKinds = []string{"phone", "email", "username"}
+	})
+
+	tests := []struct {
+		env   *testEnv
+		input string
+		code  string
+	}{
+		{phoneOnly, "ada@example.com", "IDENTIFIER_NOT_SUPPORTED"},
+		{phoneOnly, "ada_l", "IDENTIFIER_NOT_SUPPORTED"},
+		{all, "ada@example.com", "IDENTIFIER_NOT_SUPPORTED"},
+		{all, "ada_l", "IDENTIFIER_NOT_SUPPORTED"},
+		{all, "ada@localhost", "INVALID_IDENTIFIER"},
+		{all, "a!", "INVALID_IDENTIFIER"},
+	}
+	for _, tt := range tests {
+		rec := tt.env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: tt.input})
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != tt.code {
+			t.Errorf("initiate-otp for %q: %d %s, want %s", tt.input, rec.Code, rec.Body, tt.code)
+		}
+	}
+
+	for _, env := range []*testEnv{phoneOnly, all} {
+		if rec := env.do(http.MethodPost, "/api/v1/auth/initiate-otp", "", InitiateOTPRequest{PhoneNumber: testPhone}); rec.Code != http.StatusOK || env.sender.last(testPhone) == "" {
+			t.Errorf("initiate-otp for a phone number: %d %s, want an OTP sent", rec.Code, rec.Body)
+		}
+	}
+
+	// In a batch, identifiers that cannot be sent an OTP are invalid
+	// entries, not failed sends.
+	rec := all.do(http.MethodPost, "/api/v1/auth/initiate-otp/batch", "", InitiateOTPBatchRequest{
+		PhoneNumbers: []string{"ada@example.com", "a!"},
+	})
+	var resp InitiateOTPBatchResponse
+	decodeBody(t, rec, &resp)
+	for _, result := range resp.Results {
+		if result.Status != OTPBatchInvalid {
+			t.Errorf("batch result for %s = %s, want %s", result.PhoneNumber, result.Status, OTPBatchInvalid)
+		}
+	}
+}
+
+// include_claims returns the access token's claims only when OTPs are
+// logged, as in development.
+func TestVerifyOTPIncludeClaims(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		providers []string
+		want      bool
+	}{
+		{"development", []string{"log"}, true},
+		{"production", []string{"sms"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t, func(cfg *config.Config) { cfg.Delivery.Providers = tc.providers })
+			if _, err := env.otp.GenerateOTP(context.Background(), testPhone); err != nil {
+				t.Fatalf("GenerateOTP: %v", err)
+			}
+			rec := env.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{
+				PhoneNumber:   testPhone,
+				OTP:           env.sender.last(testPhone),
+				IncludeClaims: true,
+			})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("verify-otp status = %d: %s", rec.Code, rec.Body)
+			}
+			if strings.Contains(rec.Body.String(), testConfig().JWT.SecretKey) {
+				t.Error("the response contains the signing secret")
+			}
+			var resp VerifyOTPResponse
+			decodeBody(t, rec, &resp)
+			if !tc.want {
+				if resp.Claims != nil {
+					t.Errorf("claims = %+v, want none", resp.Claims)
+				}
+				return
+			}
+			if resp.Claims == nil || resp.Claims.Phone != testPhone || resp.Claims.Type != "access" || resp.Claims.Subject != resp.User.UserID {
+				t.Errorf("claims = %+v, want the access token's", resp.Claims)
+			}
+		})
+	}
+}
+
+func TestVerifyOTPPushToken(t *testing.T) {
+	env := newTestEnv(t)
+	signIn := func(pushToken string) VerifyOTPResponse {
+		t.Helper()
+		if _, err := env.otp.GenerateOTP(context.Background(), testPhone); err != nil {
+			t.Fatalf("GenerateOTP: %v", err)
+		}
+		rec := env.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{
+			PhoneNumber: testPhone,
+			OTP:         env.sender.last(testPhone),
+			PushToken:   pushToken,
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("verify-otp with push token %q: %d %s", pushToken, rec.Code, rec.Body)
+		}
+		var resp VerifyOTPResponse
+		decodeBody(t, rec, &resp)
+		return resp
+	}
+	jti := func(refreshToken string) string {
+		t.Helper()
+		claims, err := env.jwt.VerifyToken(refreshToken)
+		if err != nil {
+			t.Fatalf("VerifyToken: %v", err)
+		}
+		return claims.JTI
+	}
+
+	first := signIn(" device-a ")
+	userID := first.User.UserID
+	if got := env.pushTokenSessions(userID); len(got) != 1 || got["device-a"] != jti(first.RefreshToken) {
+		t.Fatalf("push tokens after signing in = %v, want device-a bound to the new session", got)
+	}
+
+	// The same device signing in again moves its entry to the new session.
+	second := signIn("device-a")
+	if got := env.pushTokenSessions(userID); len(got) != 1 || got["device-a"] != jti(second.RefreshToken) {
+		t.Errorf("push tokens after signing in again = %v, want device-a bound to the latest session", got)
+	}
+
+	// Refreshing keeps the binding on the rotated token.
+	rec := env.refreshWith(second.RefreshToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh status = %d: %s", rec.Code, rec.Body)
+	}
+	var refreshed RefreshTokenResponse
+	decodeBody(t, rec, &refreshed)
+	if got := env.pushTokenSessions(userID); got["device-a"] != jti(refreshed.RefreshToken) {
+		t.Errorf("push tokens after refresh = %v, want device-a bound to the rotated token", got)
+	}
+
+	signIn("")
+	if got := env.pushTokenSessions(userID); len(got) != 1 {
+		t.Errorf("push tokens after signing in without one = %v, want only device-a", got)
+	}
+
+	for _, pushToken := range []string{"device a", "device-\x00", strings.Repeat("a", maxPushTokenLength+1)} {
+		if _, err := env.otp.GenerateOTP(context.Background(), testPhone); err != nil {
+			t.Fatalf("GenerateOTP: %v", err)
+		}
+		rec := env.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{
+			PhoneNumber: testPhone,
+			OTP:         env.sender.last(testPhone),
+			PushToken:   pushToken,
+		})
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != "INVALID_PUSH_TOKEN" {
+			t.Errorf("verify-otp with push token %.20q: %d %s, want INVALID_PUSH_TOKEN", pushToken, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestGuestSessions(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.JWT.GuestSessions = true
+		cfg.JWT.GuestExpiry = time.Hour
+	})
+
+	rec := env.do(http.MethodPost, "/api/v1/auth/guest", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("guest status = %d: %s", rec.Code, rec.Body)
+	}
+	var guest GuestLoginResponse
+	decodeBody(t, rec, &guest)
+	claims, err := env.jwt.VerifyToken(guest.AccessToken)
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+	if !claims.Guest || claims.Scope != service.ScopeGuest || claims.Subject != guest.GuestID || claims.Phone != "" || guest.ExpiresIn != 3600 {
+		t.Errorf("guest token claims = %+v, expires in %d, want a guest-scoped token for %s lasting an hour", claims, guest.ExpiresIn, guest.GuestID)
+	}
+
+	// Guest tokens only work on guest routes, and user tokens not on those.
+	if status := env.meStatus(guest.AccessToken); status != http.StatusForbidden {
+		t.Errorf("GET /me with a guest token = %d, want 403", status)
+	}
+	user := env.signIn("+15557654321")
+	if rec := env.do(http.MethodPost, "/api/v1/auth/upgrade", user.AccessToken, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("upgrade with a user token = %d, want 403", rec.Code)
+	}
+
+	if _, err := env.otp.GenerateOTP(context.Background(), testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	upgrade := VerifyOTPRequest{PhoneNumber: testPhone, OTP: env.sender.last(testPhone)}
+	rec = env.do(http.MethodPost, "/api/v1/auth/upgrade", guest.AccessToken, upgrade)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upgrade status = %d: %s", rec.Code, rec.Body)
+	}
+	var upgraded VerifyOTPResponse
+	decodeBody(t, rec, &upgraded)
+	if upgraded.UpgradedFrom != guest.GuestID || upgraded.User.PhoneNumber != testPhone || upgraded.RefreshToken == "" {
+		t.Errorf("upgrade = %+v, want tokens for %s upgraded from %s", upgraded, testPhone, guest.GuestID)
+	}
+	if status := env.meStatus(upgraded.AccessToken); status != http.StatusOK {
+		t.Errorf("GET /me after the upgrade = %d, want 200", status)
+	}
+	if rec := env.do(http.MethodPost, "/api/v1/auth/upgrade", guest.AccessToken, upgrade); rec.Code != http.StatusUnauthorized {
+		t.Errorf("upgrade with the upgraded guest's token = %d, want 401", rec.Code)
+	}
+}
+
+// Session rotation needs an OTP verification within ReauthMaxAge. A
+// refreshed token keeps the time of the verification it came from.
+func TestRotateSessionsRequiresRecentAuth(t *testing.T) {
+	env := newTestEnv(t)
+	session := env.signIn(testPhone)
+	claims, err := env.jwt.VerifyToken(session.AccessToken)
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+
+	rec := env.refreshWith(session.RefreshToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh status = %d: %s", rec.Code, rec.Body)
+	}
+	var refreshed RefreshTokenResponse
+	decodeBody(t, rec, &refreshed)
+	refreshedClaims, err := env.jwt.VerifyToken(refreshed.AccessToken)
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+	if !refreshedClaims.AuthenticatedAt().Equal(claims.AuthenticatedAt()) || claims.AuthenticatedAt().IsZero() {
+		t.Errorf("auth_time after refresh = %v, want %v", refreshedClaims.AuthenticatedAt(), claims.AuthenticatedAt())
+	}
+
+	for name, authTime := range map[string]time.Time{
+		"stale":   time.Now().Add(-time.Hour),
+		"missing": {},
+	} {
+		stale, _, err := env.jwt.GenerateAccessToken(claims.Subject, testPhone, authTime)
+		if err != nil {
+			t.Fatalf("GenerateAccessToken: %v", err)
+		}
+		rec := env.do(http.MethodPost, "/api/v1/sessions/rotate", stale.AccessToken, nil)
+		if rec.Code != http.StatusUnauthorized || errorCode(t, rec) != "REAUTH_REQUIRED" {
+			t.Errorf("rotate with %s auth_time: %d %s, want REAUTH_REQUIRED", name, rec.Code, rec.Body)
+		}
+	}
+
+	if rec := env.do(http.MethodPost, "/api/v1/sessions/rotate", refreshed.AccessToken, nil); rec.Code != http.StatusOK {
+		t.Errorf("rotate with a recent auth_time: %d %s, want 200", rec.Code, rec.Body)
+	}
+}
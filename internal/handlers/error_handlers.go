@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/qcom/qcom/internal/apierror"
+)
+
+// NotFound responds to requests that match no route with the standard JSON
+// error body instead of mux's plain-text 404.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	apierror.Write(w, r, apierror.CodeNotFound, "No route matches "+r.URL.Path)
+}
+
+// MethodNotAllowed responds to requests whose path exists but not for the
+// request method with the standard JSON error body.
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	apierror.Write(w, r, apierror.CodeMethodNotAllowed, "Method "+r.Method+" is not allowed for "+r.URL.Path)
+}
+
+// routeMethods are the methods UnmatchedRoute tries a path with.
+var routeMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// UnmatchedRoute is router's NotFoundHandler. It responds as
+// MethodNotAllowed when the path has a route for another method and as
+// NotFound otherwise. mux only reports a method mismatch found by the last
+// route it tries, so across subrouters most of them would be 404s.
+func UnmatchedRoute(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range routeMethods {
+			if method == r.Method {
+				continue
+			}
+			var match mux.RouteMatch
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			if router.Match(probe, &match) && match.MatchErr == nil {
+				MethodNotAllowed(w, r)
+				return
+			}
+		}
+		NotFound(w, r)
+	})
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUnmatchedRoutesReturnJSONErrors(t *testing.T) {
+	env := newTestEnv(t)
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{http.MethodGet, "/api/v1/nowhere", http.StatusNotFound, "NOT_FOUND"},
+		{http.MethodGet, "/api/v1/auth/verify-otp", http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED"},
+		{http.MethodDelete, "/api/v1/me", http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED"},
+	} {
+		rec := env.do(tc.method, tc.path, "", nil)
+		if rec.Code != tc.status {
+			t.Errorf("%s %s: status %d, want %d", tc.method, tc.path, rec.Code, tc.status)
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Content-Type %q, want application/json", tc.method, tc.path, ct)
+		}
+		if code := errorCode(t, rec); code != tc.code {
+			t.Errorf("%s %s: code %s, want %s", tc.method, tc.path, code, tc.code)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/qcom/qcom/internal/apierror"
+	"github.com/qcom/qcom/internal/config"
+	"github.com/qcom/qcom/internal/logging"
+	"github.com/qcom/qcom/internal/models"
+	"github.com/qcom/qcom/internal/repository"
+	"github.com/qcom/qcom/internal/service"
+	"github.com/sirupsen/logrus"
+)
+
+// ExportHandlers serves users a copy of the data held about them.
+type ExportHandlers struct {
+	userRepo            *repository.UserRepository
+	refreshTokenService *service.RefreshTokenService
+	auditRepo           *repository.AuditRepository
+	// sections are the config.Export* sections included in an export.
+	sections []string
+	logger   *logrus.Logger
+}
+
+func NewExportHandlers(userRepo *repository.UserRepository, refreshTokenService *service.RefreshTokenService, auditRepo *repository.AuditRepository, sections []string, logger *logrus.Logger) *ExportHandlers {
+	return &ExportHandlers{
+		userRepo:            userRepo,
+		refreshTokenService: refreshTokenService,
+		auditRepo:           auditRepo,
+		sections:            sections,
+		logger:              logger,
+	}
+}
+
+// ExportProfile is the user record as exported, without internal fields
+// such as its version.
+type ExportProfile struct {
+	UserID      string    `json:"user_id"`
+	PhoneNumber string    `json:"phone_number"`
+	Name        string    `json:"name,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ExportSession describes a signed-in session. Token values, JTIs and
+// push tokens are left out: they are credentials, not the user's data.
+type ExportSession struct {
+	SessionID string    `json:"session_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ExportAuditEvent is one entry of the user's audit history.
+type ExportAuditEvent struct {
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Export returns the caller's data as one JSON object with the configured
+// sections. The profile and sessions are read up front, so failing to read
+// them is still reported as an error; the audit history, which can be long,
+// is then streamed page by page. If reading it fails partway, the response
+// is cut off and is not valid JSON.
+func (h *ExportHandlers) Export(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	phoneNumber, _ := ctx.Value("phone").(string)
+	userID, _ := ctx.Value("user_id").(string)
+
+	export := make(map[string]interface{}, len(h.sections)+1)
+	export["exported_at"] = time.Now().UTC()
+
+	if slices.Contains(h.sections, config.ExportProfile) {
+		user, err := h.userRepo.GetByPhoneNumber(ctx, phoneNumber)
+		if err != nil {
+			logging.LoggerFromContext(ctx, h.logger).WithError(err).Error("Failed to get user for export")
+			apierror.Write(w, r, apierror.CodeInternalError, "Failed to get user")
+			return
+		}
+		if user == nil {
+			apierror.Write(w, r, apierror.CodeNotFound, "User not found")
+			return
+		}
+		export[config.ExportProfile] = ExportProfile{
+			UserID:      user.UserID,
+			PhoneNumber: user.PhoneNumber,
+			Name:        user.Name,
+			CreatedAt:   user.CreatedAt,
+			UpdatedAt:   user.UpdatedAt,
+		}
+	}
+
+	if slices.Contains(h.sections, config.ExportSessions) {
+		tokens, err := h.refreshTokenService.ActiveSessions(ctx, userID)
+		if err != nil {
+			logging.LoggerFromContext(ctx, h.logger).WithError(err).Error("Failed to list sessions for export")
+			apierror.Write(w, r, apierror.CodeInternalError, "Failed to list sessions")
+			return
+		}
+		sessions := make([]ExportSession, 0, len(tokens))
+		for _, token := range tokens {
+			sessions = append(sessions, ExportSession{SessionID: token.FamilyID, CreatedAt: token.CreatedAt, ExpiresAt: token.ExpiresAt})
+		}
+		export[config.ExportSessions] = sessions
+	}
+
+	head, err := json.Marshal(export)
+	if err != nil {
+		logging.LoggerFromContext(ctx, h.logger).WithError(err).Error("Failed to encode export")
+		apierror.Write(w, r, apierror.CodeInternalError, "Failed to encode export")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.json"`)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	// Flushing marks the response as streamed, so middleware passes it
+	// through unbuffered and its keys are the same with or without the
+	// audit history.
+	http.NewResponseController(w).Flush()
+
+	if !slices.Contains(h.sections, config.ExportAudit) {
+		w.Write(append(head, '\n'))
+		return
+	}
+
+	// Reopen the object to append the audit history to it.
+	w.Write(head[:len(head)-1])
+	w.Write([]byte(`,"` + config.ExportAudit + `":[`))
+	if err := h.streamAudit(w, r, phoneNumber); err != nil {
+		logging.LoggerFromContext(ctx, h.logger).WithError(err).Error("Failed to stream audit history for export")
+		return
+	}
+	w.Write([]byte("]}\n"))
+}
+
+// streamAudit writes the comma-separated audit events of phoneNumber,
+// newest first, flushing after each page.
+func (h *ExportHandlers) streamAudit(w http.ResponseWriter, r *http.Request, phoneNumber string) error {
+	flusher, _ := w.(http.Flusher)
+	filter := models.AuditFilter{Limit: repository.MaxAuditPageSize}
+	first := true
+	for {
+		page, err := h.auditRepo.Query(r.Context(), phoneNumber, filter)
+		if err != nil {
+			return err
+		}
+		for _, event := range page.Items {
+			encoded, err := json.Marshal(ExportAuditEvent{Event: event.Event, CreatedAt: event.CreatedAt})
+			if err != nil {
+				return err
+			}
+			if !first {
+				w.Write([]byte(","))
+			}
+			first = false
+			if _, err := w.Write(encoded); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if page.NextCursor == "" {
+			return nil
+		}
+		filter.Cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qcom/qcom/internal/config"
+)
+
+func TestExport(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Server.DataExportSections = []string{config.ExportProfile, config.ExportSessions, config.ExportAudit}
+	})
+	other := env.signIn(testPhone)
+	session := env.signIn(testPhone)
+
+	rec := env.do(http.MethodGet, "/api/v1/me/export", session.AccessToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export status = %d: %s", rec.Code, rec.Body)
+	}
+	var export struct {
+		ExportedAt time.Time          `json:"exported_at"`
+		Profile    ExportProfile      `json:"profile"`
+		Sessions   []ExportSession    `json:"sessions"`
+		Audit      []ExportAuditEvent `json:"audit"`
+	}
+	decodeBody(t, rec, &export)
+	if export.Profile.UserID != session.User.UserID || export.Profile.PhoneNumber != testPhone {
+		t.Errorf("profile = %+v, want the caller's", export.Profile)
+	}
+	if len(export.Sessions) != 2 {
+		t.Errorf("exported %d sessions, want 2", len(export.Sessions))
+	}
+	if len(export.Audit) == 0 || export.ExportedAt.IsZero() {
+		t.Errorf("export = %s, want the audit history and export time", rec.Body)
+	}
+
+	// No credentials, not even token IDs.
+	body := rec.Body.String()
+	for _, tokens := range []VerifyOTPResponse{session, other} {
+		for _, token := range []string{tokens.AccessToken, tokens.RefreshToken} {
+			claims, err := env.jwt.VerifyToken(token)
+			if err != nil {
+				t.Fatalf("VerifyToken: %v", err)
+			}
+			if strings.Contains(body, token) || strings.Contains(body, claims.JTI) {
+				t.Errorf("export contains a %s token or its ID", claims.Type)
+			}
+		}
+	}
+}
+
+func TestExportSections(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) { cfg.Server.DataExportSections = []string{config.ExportSessions} })
+	session := env.signIn(testPhone)
+
+	rec := env.do(http.MethodGet, "/api/v1/me/export", session.AccessToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export status = %d: %s", rec.Code, rec.Body)
+	}
+	var export map[string]interface{}
+	decodeBody(t, rec, &export)
+	if got := slices.Sorted(maps.Keys(export)); !slices.Equal(got, []string{"exported_at", "sessions"}) {
+		t.Errorf("export has %v, want only the sessions", got)
+	}
+}
+
+func TestExportRequiresRecentAuth(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) { cfg.Server.DataExportSections = []string{config.ExportProfile} })
+	session := env.signIn(testPhone)
+
+	stale, _, err := env.jwt.GenerateAccessToken(session.User.UserID, testPhone, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	rec := env.do(http.MethodGet, "/api/v1/me/export", stale.AccessToken, nil)
+	if rec.Code != http.StatusUnauthorized || errorCode(t, rec) != "REAUTH_REQUIRED" {
+		t.Errorf("export with a stale auth_time: %d %s, want REAUTH_REQUIRED", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/qcom/qcom/internal/config"
+	"github.com/qcom/qcom/internal/dynamotest"
+	"github.com/qcom/qcom/internal/email"
+	"github.com/qcom/qcom/internal/events"
+	"github.com/qcom/qcom/internal/identifier"
+	"github.com/qcom/qcom/internal/middleware"
+	"github.com/qcom/qcom/internal/repository"
+	"github.com/qcom/qcom/internal/service"
+	"github.com/sirupsen/logrus"
+)
+
+const testPhone = "+15551234567"
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// recordingSender remembers the last OTP sent to each number instead of
+// delivering it.
+type recordingSender struct {
+	mu   sync.Mutex
+	otps map[string]string
+}
+
+func (s *recordingSender) Send(_ context.Context, phoneNumber, otp string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.otps == nil {
+		s.otps = map[string]string{}
+	}
+	s.otps[phoneNumber] = otp
+	return "sms", nil
+}
+
+func (s *recordingSender) last(phoneNumber string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.otps[phoneNumber]
+}
+
+// testEnv is the API wired as in cmd/server, backed by an in-memory
+// DynamoDB.
+type testEnv struct {
+	t          testing.TB
+	db         *dynamotest.DB
+	sender     *recordingSender
+	jwt        *service.JWTService
+	otp        *service.OTPService
+	refresh    *service.RefreshTokenService
+	revocation *service.TokenRevocationService
+	auth       *AuthHandlers
+	admin      *AdminHandlers
+	middleware *middleware.AuthMiddleware
+	router     *mux.Router
+}
+
+func testConfig() *config.Config {
+	return &config.Config{
+		JWT: config.JWTConfig{
+			SecretKey:           "test-secret-key-of-at-least-32-bytes",
+			AccessExpiry:        15 * time.Minute,
+			RefreshExpiry:       24 * time.Hour,
+			RefreshTokenStorage: config.TokenStorageStrict,
+			ReauthMaxAge:        10 * time.Minute,
+			IssuedAtSkew:        5 * time.Second,
+		},
+		OTP: config.OTPConfig{
+			Length:        6,
+			Expiry:        5 * time.Minute,
+			MaxAttempts:   3,
+			Pepper:        "pepper",
+			HashAlgorithm: config.OTPHashHMAC,
+			Reinitiate:    config.OTPReinitiateOverwrite,
+
+			IdentifierKinds: []string{string(identifier.KindPhone)},
+		},
+	}
+}
+
+// newTestEnv builds the API from testConfig, after configure, if given,
+// has adjusted it.
+func newTestEnv(t testing.TB, configure ...func(*config.Config)) *testEnv {
+	t.Helper()
+	cfg := testConfig()
+	for _, fn := range configure {
+		fn(cfg)
+	}
+
+	db := dynamotest.New(t)
+	for _, table := range []string{"main", "users", "otps", "tokens"} {
+		db.CreateTable(table, "PK", "SK")
+	}
+	client := db.Client()
+	keys := repository.KeySchema{PK: "PK", SK: "SK"}
+	logger := testLogger()
+
+	userRepo := repository.NewUserRepository(client, db.Table("users"), keys, true, 3, nil, logger)
+	otpRepo := repository.NewOTPRepository(client, db.Table("otps"), db.Table("main"), keys, logger)
+	refreshTokenRepo := repository.NewRefreshTokenRepository(client, db.Table("tokens"), keys, logger)
+	revocationRepo := repository.NewTokenRevocationRepository(client, db.Table("tokens"), keys, logger)
+	rateLimitRepo := repository.NewRateLimitRepository(client, db.Table("main"), keys, logger)
+	accountLockRepo := repository.NewAccountLockRepository(client, db.Table("main"), keys, logger)
+
+	jwtService, err := service.NewJWTService(&cfg.JWT, logger)
+	if err != nil {
+		t.Fatalf("NewJWTService: %v", err)
+	}
+	sender := &recordingSender{}
+	otpService := service.NewOTPService(otpRepo, rateLimitRepo, sender, &cfg.OTP, logger)
+	refreshTokenService := service.NewRefreshTokenService(refreshTokenRepo, cfg.JWT.RefreshTokenStorage == config.TokenStorageLenient, cfg.JWT.ReuseGraceWindow, cfg.JWT.MaxRefreshChain, logger)
+	revocationService := service.NewTokenRevocationService(revocationRepo, logger)
+	accountLocks := service.NewAccountLockService(accountLockRepo, cfg.JWT.ReuseLockoutThreshold, cfg.JWT.ReuseLockoutWindow, cfg.JWT.ReuseLockoutDuration, logger)
+	authState := service.NewAuthStateService(userRepo, otpRepo, rateLimitRepo, refreshTokenService, revocationService, accountLocks, logger)
+	identifierKinds := make([]identifier.Kind, 0, len(cfg.OTP.IdentifierKinds))
+	for _, kind := range cfg.OTP.IdentifierKinds {
+		identifierKinds = append(identifierKinds, identifier.Kind(kind))
+	}
+	identifiers := identifier.NewRouter(identifierKinds, map[identifier.Kind]string{identifier.KindPhone: "sms"}, email.Policy{})
+
+	var sessionCookies *SessionCookies
+	if cfg.Server.OTPPage {
+		sessionCookies = &SessionCookies{TrustedProxies: cfg.Server.TrustedProxies, ForceSecure: cfg.Server.ForceSecureCookies}
+	}
+	auth := NewAuthHandlers(otpService, jwtService, refreshTokenService, revocationService, accountLocks, identifiers, userRepo, events.Nop{}, cfg.Delivery.LogsOTPs(), sessionCookies, logger)
+	authMiddleware := middleware.NewAuthMiddleware(jwtService, revocationService, cfg.Server.OTPPage, logger)
+	auditRepo := repository.NewAuditRepository(client, db.Table("main"), keys, logger)
+	diagnosticsRepo := repository.NewDiagnosticsRepository(client, db.Table("users"), db.Table("tokens"), db.Table("otps"), keys, logger)
+	admin := NewAdminHandlers(auditRepo, diagnosticsRepo, authState, revocationService, accountLocks, otpService, events.Nop{}, nil, logger)
+	export := NewExportHandlers(userRepo, refreshTokenService, auditRepo, cfg.Server.DataExportSections, logger)
+
+	router := mux.NewRouter()
+	router.NotFoundHandler = UnmatchedRoute(router)
+	router.MethodNotAllowedHandler = http.HandlerFunc(MethodNotAllowed)
+	if cfg.Server.OTPPage {
+		page, err := NewOTPPageHandlers(auth, cfg.Server.OTPPageTemplate, sessionCookies, logger)
+		if err != nil {
+			t.Fatalf("NewOTPPageHandlers: %v", err)
+		}
+		router.HandleFunc("/auth/otp", page.Show).Methods("GET")
+		router.HandleFunc("/auth/otp", page.Submit).Methods("POST")
+	}
+	api := router.PathPrefix("/api/v1").Subrouter()
+	authRoutes := api.PathPrefix("/auth").Subrouter()
+	authRoutes.HandleFunc("/initiate-otp", auth.InitiateOTP).Methods("POST")
+	authRoutes.HandleFunc("/initiate-otp/batch", auth.InitiateOTPBatch).Methods("POST")
+	authRoutes.HandleFunc("/otp/status", auth.OTPStatus).Methods("GET")
+	authRoutes.HandleFunc("/verify-otp", auth.VerifyOTP).Methods("POST")
+	authRoutes.HandleFunc("/verify-and-set-name", auth.VerifyAndSetName).Methods("POST")
+	authRoutes.HandleFunc("/refresh", auth.RefreshToken).Methods("POST")
+	authRoutes.Handle("/logout", authMiddleware.RequireLogoutAuth(http.HandlerFunc(auth.Logout))).Methods("POST")
+	authRoutes.Handle("/validate", authMiddleware.RequireAuth(http.HandlerFunc(auth.ValidateToken))).Methods("GET")
+	if cfg.JWT.GuestSessions {
+		authRoutes.HandleFunc("/guest", auth.GuestLogin).Methods("POST")
+		authRoutes.Handle("/upgrade", authMiddleware.RequireGuestAuth(http.HandlerFunc(auth.UpgradeGuest))).Methods("POST")
+	}
+	protected := api.PathPrefix("/").Subrouter()
+	protected.Use(authMiddleware.RequireAuth)
+	protected.Handle("/sessions/rotate", authMiddleware.RequireRecentAuth(cfg.JWT.ReauthMaxAge)(http.HandlerFunc(auth.RotateSessions))).Methods("POST")
+	protected.HandleFunc("/me", auth.Me).Methods("GET")
+	protected.HandleFunc("/me", auth.UpdateMe).Methods("PATCH")
+	protected.Handle("/me/export", authMiddleware.RequireRecentAuth(cfg.JWT.ReauthMaxAge)(http.HandlerFunc(export.Export))).Methods("GET")
+	// Admin routes are served without the admin key middleware.
+	adminRoutes := api.PathPrefix("/admin").Subrouter()
+	adminRoutes.HandleFunc("/query", admin.RunQuery).Methods("GET")
+	adminRoutes.HandleFunc("/token-epoch/user", admin.RevokeUserTokens).Methods("PUT")
+	adminRoutes.HandleFunc("/token-epoch/global", admin.RevokeAllTokens).Methods("PUT")
+	adminRoutes.HandleFunc("/otp-pepper", admin.RotateOTPPepper).Methods("PUT")
+
+	return &testEnv{
+		t:          t,
+		db:         db,
+		sender:     sender,
+		jwt:        jwtService,
+		otp:        otpService,
+		refresh:    refreshTokenService,
+		revocation: revocationService,
+		auth:       auth,
+		admin:      admin,
+		middleware: authMiddleware,
+		router:     router,
+	}
+}
+
+// do sends a request to the API, with token as its bearer token unless it
+// is empty and body encoded as JSON unless it is nil.
+func (e *testEnv) do(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	e.t.Helper()
+	return e.doWithHeader(method, path, token, body, nil)
+}
+
+// doWithHeader is do with extra request headers.
+func (e *testEnv) doWithHeader(method, path, token string, body interface{}, header http.Header) *httptest.ResponseRecorder {
+	e.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			e.t.Fatalf("encoding request body: %v", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	e.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// signIn verifies an OTP for phoneNumber and returns the issued tokens.
+func (e *testEnv) signIn(phoneNumber string) VerifyOTPResponse {
+	e.t.Helper()
+	if _, err := e.otp.GenerateOTP(context.Background(), phoneNumber); err != nil {
+		e.t.Fatalf("GenerateOTP: %v", err)
+	}
+	rec := e.do(http.MethodPost, "/api/v1/auth/verify-otp", "", VerifyOTPRequest{
+		PhoneNumber: phoneNumber,
+		OTP:         e.sender.last(phoneNumber),
+	})
+	if rec.Code != http.StatusOK {
+		e.t.Fatalf("verify-otp status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp VerifyOTPResponse
+	decodeBody(e.t, rec, &resp)
+	return resp
+}
+
+// refreshWith presents refreshToken to the refresh endpoint.
+func (e *testEnv) refreshWith(refreshToken string) *httptest.ResponseRecorder {
+	e.t.Helper()
+	return e.do(http.MethodPost, "/api/v1/auth/refresh", "", RefreshTokenRequest{RefreshToken: refreshToken})
+}
+
+// meStatus is the status of GET /me with accessToken.
+func (e *testEnv) meStatus(accessToken string) int {
+	e.t.Helper()
+	return e.do(http.MethodGet, "/api/v1/me?fields=phone_number", accessToken, nil).Code
+}
+
+// pushTokenSessions returns the refresh token JTI each of userID's push
+// tokens is bound to, from the user's push token index.
+func (e *testEnv) pushTokenSessions(userID string) map[string]string {
+	e.t.Helper()
+	rec := e.do(http.MethodGet, "/api/v1/admin/query?query=user_push_tokens&user_id="+userID, "", nil)
+	if rec.Code != http.StatusOK {
+		e.t.Fatalf("user_push_tokens query status = %d: %s", rec.Code, rec.Body)
+	}
+	var page struct {
+		Items []struct {
+			PushToken string
+			JTI       string
+		} `json:"items"`
+	}
+	decodeBody(e.t, rec, &page)
+	sessions := make(map[string]string, len(page.Items))
+	for _, item := range page.Items {
+		sessions[item.PushToken] = item.JTI
+	}
+	return sessions
+}
+
+func decodeBody(t testing.TB, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding response %q: %v", rec.Body, err)
+	}
+}
+
+// errorCode returns the code of an API error response.
+func errorCode(t testing.TB, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	decodeBody(t, rec, &body)
+	return body.Error.Code
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/qcom/qcom/internal/apierror"
+	"github.com/qcom/qcom/internal/events"
+	"github.com/qcom/qcom/internal/logging"
+	"github.com/qcom/qcom/internal/middleware"
+	"github.com/qcom/qcom/internal/service"
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed templates/otp_page.html
+var defaultOTPPage embed.FS
+
+// Steps of the OTP page, in OTPPageData.Step.
+const (
+	OTPPageStepPhone = "phone"
+	OTPPageStepOTP   = "otp"
+	OTPPageStepDone  = "done"
+)
+
+// OTPPageData is what the OTP page template is rendered with.
+type OTPPageData struct {
+	Step              string
+	Action            string
+	CSRFToken         string
+	PhoneNumber       string
+	VerificationNonce string
+	OTPLength         int
+	Error             string
+}
+
+// OTPPageHandlers serve a server-rendered HTML form for signing in with an
+// OTP, for clients that are just a browser. It sends and verifies OTPs like
+// the JSON API, but on success starts a browser session, setting the tokens
+// as cookies instead of returning them. Every POST must carry the CSRF
+// cookie's value in its csrf_token field (a double-submit token).
+type OTPPageHandlers struct {
+	auth    *AuthHandlers
+	page    *template.Template
+	cookies *SessionCookies
+	logger  *logrus.Logger
+}
+
+// NewOTPPageHandlers parses the page template at templatePath, or the
+// built-in one when it is empty. cookies must be the SessionCookies auth
+// was created with, so the API accepts the sessions the page starts.
+func NewOTPPageHandlers(auth *AuthHandlers, templatePath string, cookies *SessionCookies, logger *logrus.Logger) (*OTPPageHandlers, error) {
+	var page *template.Template
+	var err error
+	if templatePath != "" {
+		page, err = template.ParseFiles(templatePath)
+	} else {
+		page, err = template.ParseFS(defaultOTPPage, "templates/otp_page.html")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &OTPPageHandlers{
+		auth:    auth,
+		page:    page,
+		cookies: cookies,
+		logger:  logger,
+	}, nil
+}
+
+// Show renders the phone number step, prefilled from the phone query
+// parameter.
+func (h *OTPPageHandlers) Show(w http.ResponseWriter, r *http.Request) {
+	token, err := h.csrfToken(w, r)
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to generate CSRF token")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.render(w, r, http.StatusOK, OTPPageData{Step: OTPPageStepPhone, CSRFToken: token, PhoneNumber: r.URL.Query().Get("phone")})
+}
+
+// Submit handles both forms of the page: the phone step sends an OTP and
+// moves to the OTP step, and the OTP step verifies it.
+func (h *OTPPageHandlers) Submit(w http.ResponseWriter, r *http.Request) {
+	if !middleware.ValidCSRFToken(r, r.PostFormValue("csrf_token")) {
+		// Without a matching token, issue a fresh one with the form.
+		token, err := h.csrfToken(w, r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.render(w, r, http.StatusForbidden, OTPPageData{Step: OTPPageStepPhone, CSRFToken: token, Error: "The form expired. Please try again."})
+		return
+	}
+
+	data := OTPPageData{CSRFToken: r.PostFormValue("csrf_token"), PhoneNumber: strings.TrimSpace(r.PostFormValue("phone_number"))}
+	if r.PostFormValue("step") == OTPPageStepOTP {
+		h.verify(w, r, data)
+		return
+	}
+	h.send(w, r, data)
+}
+
+func (h *OTPPageHandlers) send(w http.ResponseWriter, r *http.Request, data OTPPageData) {
+	result := h.auth.initiateOTP(r.Context(), data.PhoneNumber)
+	if result.resp == nil {
+		// A code that is still valid can be entered as usual.
+		if result.code == apierror.CodeOTPAlreadySent {
+			data.Step = OTPPageStepOTP
+		} else {
+			data.Step = OTPPageStepPhone
+		}
+		data.Error = result.message
+		h.render(w, r, result.code.Status(), data)
+		return
+	}
+
+	data.Step = OTPPageStepOTP
+	data.VerificationNonce = result.resp.VerificationNonce
+	h.render(w, r, http.StatusOK, data)
+}
+
+func (h *OTPPageHandlers) verify(w http.ResponseWriter, r *http.Request, data OTPPageData) {
+	ctx := r.Context()
+	data.Step = OTPPageStepOTP
+	data.VerificationNonce = r.PostFormValue("verification_nonce")
+
+	id, err := h.auth.identifiers.Parse(data.PhoneNumber)
+	if err != nil {
+		code, message := identifierError(id, err)
+		data.Step = OTPPageStepPhone
+		data.Error = message
+		h.render(w, r, code.Status(), data)
+		return
+	}
+	phoneNumber := id.Normalized
+
+	otp := strings.TrimSpace(r.PostFormValue("otp"))
+	if !isValidOTP(otp, h.auth.otpService.Length()) {
+		data.Error = "Enter the code exactly as you received it."
+		h.render(w, r, http.StatusBadRequest, data)
+		return
+	}
+
+	if code, message, _ := h.auth.checkAccountLock(ctx, phoneNumber); code != "" {
+		data.Error = message
+		h.render(w, r, code.Status(), data)
+		return
+	}
+
+	valid, err := h.auth.otpService.VerifyOTP(ctx, phoneNumber, otp, data.VerificationNonce)
+	if err != nil && !errors.Is(err, service.ErrInvalidNonce) {
+		logging.LoggerFromContext(ctx, h.logger).WithError(err).Warn("OTP page verification failed")
+	}
+	if err != nil || !valid {
+		data.Error = "The code is invalid or has expired."
+		h.render(w, r, http.StatusUnauthorized, data)
+		return
+	}
+
+	user, err := h.auth.userRepo.GetOrCreate(ctx, phoneNumber)
+	if err != nil {
+		logging.LoggerFromContext(ctx, h.logger).WithError(err).Error("Failed to get or create user")
+		data.Error = "Signing in failed. Please try again."
+		h.render(w, r, http.StatusInternalServerError, data)
+		return
+	}
+
+	tokenPair, err := h.auth.issueTokenPair(ctx, user.UserID, phoneNumber, time.Now(), "")
+	if err != nil {
+		logging.LoggerFromContext(ctx, h.logger).WithError(err).Error("Failed to issue tokens")
+		data.Error = "Signing in failed. Please try again."
+		h.render(w, r, http.StatusInternalServerError, data)
+		return
+	}
+
+	h.cookies.set(w, r, tokenPair)
+
+	h.auth.events.Publish(ctx, events.Event{Type: events.TypeLogin, UserID: user.UserID, Phone: phoneNumber})
+	h.render(w, r, http.StatusOK, OTPPageData{Step: OTPPageStepDone})
+}
+
+// csrfToken returns the request's CSRF cookie value, setting a new random
+// one if it has none. The cookie is sent to the whole site, and is not
+// HttpOnly, so the session's scripts can echo it on API writes.
+func (h *OTPPageHandlers) csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(middleware.CSRFCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name: middleware.CSRFCookie, Value: token, Path: "/",
+		Secure: h.cookies.secure(r), SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+func (h *OTPPageHandlers) render(w http.ResponseWriter, r *http.Request, status int, data OTPPageData) {
+	data.Action = r.URL.Path
+	data.OTPLength = h.auth.otpService.Length()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := h.page.Execute(w, data); err != nil {
+		logging.LoggerFromContext(r.Context(), h.logger).WithError(err).Error("Failed to render OTP page")
+	}
+}
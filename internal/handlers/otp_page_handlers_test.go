@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/qcom/qcom/internal/config"
+	"github.com/qcom/qcom/internal/middleware"
+)
+
+func withOTPPage(cfg *config.Config) {
+	cfg.Server.OTPPage = true
+}
+
+// browser sends requests to a testEnv with the cookies it was set, like a
+// browser on the service's origin.
+type browser struct {
+	env *testEnv
+	jar *cookiejar.Jar
+}
+
+var browserOrigin = &url.URL{Scheme: "http", Host: "example.com", Path: "/"}
+
+func newBrowser(env *testEnv) *browser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		env.t.Fatalf("cookiejar.New: %v", err)
+	}
+	return &browser{env: env, jar: jar}
+}
+
+func (b *browser) send(req *http.Request) *httptest.ResponseRecorder {
+	for _, cookie := range b.jar.Cookies(browserOrigin) {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	b.env.router.ServeHTTP(rec, req)
+	b.jar.SetCookies(browserOrigin, rec.Result().Cookies())
+	return rec
+}
+
+// post submits a form of the OTP page.
+func (b *browser) post(form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/auth/otp", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.send(req)
+}
+
+// api sends an API request authenticated only by the browser's cookies,
+// with csrfToken in X-CSRF-Token unless it is empty.
+func (b *browser) api(method, path, csrfToken string, body interface{}) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			b.env.t.Fatalf("encoding request body: %v", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if csrfToken != "" {
+		req.Header.Set(middleware.CSRFHeader, csrfToken)
+	}
+	return b.send(req)
+}
+
+func (b *browser) cookie(name string) string {
+	for _, cookie := range b.jar.Cookies(browserOrigin) {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// signIn goes through the OTP page for phoneNumber and returns the CSRF
+// token of the session.
+func (b *browser) signIn(phoneNumber string) string {
+	b.env.t.Helper()
+	rec := b.send(httptest.NewRequest(http.MethodGet, "/auth/otp", nil))
+	if rec.Code != http.StatusOK {
+		b.env.t.Fatalf("GET /auth/otp status = %d", rec.Code)
+	}
+	csrfToken := b.cookie(middleware.CSRFCookie)
+
+	rec = b.post(url.Values{"csrf_token": {csrfToken}, "step": {OTPPageStepPhone}, "phone_number": {phoneNumber}})
+	if rec.Code != http.StatusOK {
+		b.env.t.Fatalf("phone step status = %d: %s", rec.Code, rec.Body)
+	}
+	rec = b.post(url.Values{
+		"csrf_token":         {csrfToken},
+		"step":               {OTPPageStepOTP},
+		"phone_number":       {phoneNumber},
+		"verification_nonce": {hiddenField(b.env.t, rec, "verification_nonce")},
+		"otp":                {b.env.sender.last(phoneNumber)},
+	})
+	if rec.Code != http.StatusOK {
+		b.env.t.Fatalf("OTP step status = %d: %s", rec.Code, rec.Body)
+	}
+	return csrfToken
+}
+
+// hiddenField returns the value of the hidden input name on a rendered page.
+func hiddenField(t testing.TB, rec *httptest.ResponseRecorder, name string) string {
+	t.Helper()
+	match := regexp.MustCompile(`name="` + name + `" value="([^"]*)"`).FindStringSubmatch(rec.Body.String())
+	if match == nil {
+		t.Fatalf("page has no %s field: %s", name, rec.Body)
+	}
+	return html.UnescapeString(match[1])
+}
+
+func TestOTPPageRendersPhoneStep(t *testing.T) {
+	env := newTestEnv(t, withOTPPage)
+	b := newBrowser(env)
+
+	rec := b.send(httptest.NewRequest(http.MethodGet, "/auth/otp?phone=%2B15551234567", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if rec.Header().Get("Content-Security-Policy") == "" {
+		t.Error("page served without a Content-Security-Policy")
+	}
+
+	var csrf *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == middleware.CSRFCookie {
+			csrf = cookie
+		}
+	}
+	if csrf == nil || csrf.Value == "" {
+		t.Fatal("no CSRF cookie set")
+	}
+	if csrf.Path != "/" || csrf.HttpOnly {
+		t.Errorf("CSRF cookie has path %q and HttpOnly %v, want it readable on the whole site", csrf.Path, csrf.HttpOnly)
+	}
+	if got := hiddenField(t, rec, "csrf_token"); got != csrf.Value {
+		t.Errorf("form csrf_token = %q, want the cookie's %q", got, csrf.Value)
+	}
+	if !strings.Contains(rec.Body.String(), `value="&#43;15551234567"`) {
+		t.Errorf("phone number not prefilled: %s", rec.Body)
+	}
+}
+
+func TestOTPPageRejectsMissingCSRFToken(t *testing.T) {
+	env := newTestEnv(t, withOTPPage)
+	b := newBrowser(env)
+	b.send(httptest.NewRequest(http.MethodGet, "/auth/otp", nil))
+
+	rec := b.post(url.Values{"csrf_token": {"forged"}, "step": {OTPPageStepPhone}, "phone_number": {testPhone}})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", rec.Code)
+	}
+	if otp := env.sender.last(testPhone); otp != "" {
+		t.Error("an OTP was sent for a post without the CSRF token")
+	}
+}
+
+func TestOTPPageSignIn(t *testing.T) {
+	env := newTestEnv(t, withOTPPage)
+	b := newBrowser(env)
+	b.signIn(testPhone)
+
+	for _, name := range []string{middleware.AccessTokenCookie, middleware.RefreshTokenCookie} {
+		if b.cookie(name) == "" {
+			t.Errorf("no %s cookie after signing in", name)
+		}
+	}
+
+	rec := b.api(http.MethodGet, "/api/v1/me", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /me with the session cookie: %d %s", rec.Code, rec.Body)
+	}
+	var me struct {
+		PhoneNumber string `json:"phone_number"`
+	}
+	decodeBody(t, rec, &me)
+	if me.PhoneNumber != testPhone {
+		t.Errorf("GET /me phone number = %q, want %q", me.PhoneNumber, testPhone)
+	}
+}
+
+func TestSessionCookieWritesRequireCSRFToken(t *testing.T) {
+	env := newTestEnv(t, withOTPPage)
+	b := newBrowser(env)
+	csrfToken := b.signIn(testPhone)
+
+	update := UpdateMeRequest{Name: aws.String("Ada")}
+	for _, token := range []string{"", "forged"} {
+		rec := b.api(http.MethodPatch, "/api/v1/me", token, update)
+		if rec.Code != http.StatusForbidden || errorCode(t, rec) != "INVALID_CSRF_TOKEN" {
+			t.Errorf("PATCH /me with CSRF token %q: %d %s, want INVALID_CSRF_TOKEN", token, rec.Code, rec.Body)
+		}
+	}
+
+	rec := b.api(http.MethodPatch, "/api/v1/me", csrfToken, update)
+	if rec.Code != http.StatusOK {
+		t.Errorf("PATCH /me with the CSRF token: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestSessionCookieRefresh(t *testing.T) {
+	env := newTestEnv(t, withOTPPage)
+	b := newBrowser(env)
+	csrfToken := b.signIn(testPhone)
+	oldRefresh := b.cookie(middleware.RefreshTokenCookie)
+
+	rec := b.api(http.MethodPost, "/api/v1/auth/refresh", "", nil)
+	if rec.Code != http.StatusForbidden || errorCode(t, rec) != "INVALID_CSRF_TOKEN" {
+		t.Fatalf("refresh without the CSRF token: %d %s, want INVALID_CSRF_TOKEN", rec.Code, rec.Body)
+	}
+
+	rec = b.api(http.MethodPost, "/api/v1/auth/refresh", csrfToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh with the session cookie: %d %s", rec.Code, rec.Body)
+	}
+	var resp RefreshTokenResponse
+	decodeBody(t, rec, &resp)
+	if resp.AccessToken != "" || resp.RefreshToken != "" {
+		t.Error("refresh of a browser session returned its tokens")
+	}
+	if resp.ExpiresIn <= 0 {
+		t.Errorf("expires_in = %d, want the new access token's lifetime", resp.ExpiresIn)
+	}
+	if b.cookie(middleware.RefreshTokenCookie) == oldRefresh {
+		t.Error("refresh cookie not rotated")
+	}
+
+	if rec := b.api(http.MethodGet, "/api/v1/me", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /me with the refreshed cookie: %d %s", rec.Code, rec.Body)
+	}
+	if rec := env.refreshWith(oldRefresh); errorCode(t, rec) != "TOKEN_REVOKED" {
+		t.Errorf("refresh with the rotated cookie's token: %d %s, want TOKEN_REVOKED", rec.Code, rec.Body)
+	}
+}
+
+func TestSessionCookieLogout(t *testing.T) {
+	env := newTestEnv(t, withOTPPage)
+	b := newBrowser(env)
+	csrfToken := b.signIn(testPhone)
+	refreshToken := b.cookie(middleware.RefreshTokenCookie)
+
+	if rec := b.api(http.MethodPost, "/api/v1/auth/logout", "", nil); errorCode(t, rec) != "INVALID_CSRF_TOKEN" {
+		t.Fatalf("logout without the CSRF token: %d %s, want INVALID_CSRF_TOKEN", rec.Code, rec.Body)
+	}
+	if rec := b.api(http.MethodPost, "/api/v1/auth/logout", csrfToken, nil); rec.Code != http.StatusOK {
+		t.Fatalf("logout with the session cookie: %d %s", rec.Code, rec.Body)
+	}
+
+	for _, name := range []string{middleware.AccessTokenCookie, middleware.RefreshTokenCookie} {
+		if b.cookie(name) != "" {
+			t.Errorf("%s cookie kept after logging out", name)
+		}
+	}
+	if rec := env.refreshWith(refreshToken); errorCode(t, rec) != "TOKEN_REVOKED" {
+		t.Errorf("refresh with the logged-out session's token: %d %s, want TOKEN_REVOKED", rec.Code, rec.Body)
+	}
+}
+
+func TestSessionCookiesIgnoredWithoutOTPPage(t *testing.T) {
+	env := newTestEnv(t)
+	session := env.signIn(testPhone)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/me", nil)
+	req.AddCookie(&http.Cookie{Name: middleware.AccessTokenCookie, Value: session.AccessToken})
+	rec := httptest.NewRecorder()
+	env.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /me with only a session cookie: %d, want 401", rec.Code)
+	}
+}
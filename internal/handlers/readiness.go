@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Readiness backs the /ready endpoint. Unlike /health, which only says the
+// process is up, it reports 503 until SetReady is called, so load balancers
+// hold traffic back until startup work such as connection warm-up is done.
+type Readiness struct {
+	ready atomic.Bool
+}
+
+func (rd *Readiness) SetReady() {
+	rd.ready.Store(true)
+}
+
+func (rd *Readiness) Ready() bool {
+	return rd.ready.Load()
+}
+
+func (rd *Readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !rd.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("NOT READY"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	readiness := &Readiness{}
+
+	rec := httptest.NewRecorder()
+	readiness.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/ready before SetReady = %d, want 503", rec.Code)
+	}
+
+	readiness.SetReady()
+	rec = httptest.NewRecorder()
+	readiness.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusOK || !readiness.Ready() {
+		t.Errorf("/ready after SetReady = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"net/netip"
+
+	"github.com/qcom/qcom/internal/middleware"
+	"github.com/qcom/qcom/internal/models"
+)
+
+// SessionCookies configures browser sessions, which keep their tokens in
+// HttpOnly cookies instead of handing them to scripts. The OTP page starts
+// them; refresh and logout accept the refresh token cookie in place of
+// refresh_token in the body. A nil *SessionCookies disables them.
+type SessionCookies struct {
+	TrustedProxies []netip.Prefix
+	// ForceSecure sets the Secure flag as by FORCE_SECURE_COOKIES.
+	ForceSecure bool
+}
+
+func (c *SessionCookies) secure(r *http.Request) bool {
+	return middleware.SecureCookies(r, c.TrustedProxies, c.ForceSecure)
+}
+
+// refreshToken returns the refresh token cookie of r, or "" if it has none
+// or sessions are disabled.
+func (c *SessionCookies) refreshToken(r *http.Request) string {
+	if c == nil {
+		return ""
+	}
+	cookie, err := r.Cookie(middleware.RefreshTokenCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// set stores tokenPair in the token cookies, each expiring with its token.
+func (c *SessionCookies) set(w http.ResponseWriter, r *http.Request, tokenPair *models.TokenPair) {
+	secure := c.secure(r)
+	http.SetCookie(w, &http.Cookie{
+		Name: middleware.AccessTokenCookie, Value: tokenPair.AccessToken, Path: "/",
+		MaxAge: int(tokenPair.ExpiresIn), HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name: middleware.RefreshTokenCookie, Value: tokenPair.RefreshToken, Path: "/",
+		MaxAge: int(tokenPair.RefreshExpiresIn), HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clear deletes the token cookies.
+func (c *SessionCookies) clear(w http.ResponseWriter, r *http.Request) {
+	secure := c.secure(r)
+	for _, name := range []string{middleware.AccessTokenCookie, middleware.RefreshTokenCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name: name, Path: "/", MaxAge: -1, HttpOnly: true, Secure: secure, SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
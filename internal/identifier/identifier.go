@@ -0,0 +1,117 @@
+package identifier
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/qcom/qcom/internal/email"
+	"github.com/qcom/qcom/internal/phone"
+)
+
+// Kind is the type of an identifier a user signs in with.
+type Kind string
+
+const (
+	KindPhone    Kind = "phone"
+	KindEmail    Kind = "email"
+	KindUsername Kind = "username"
+)
+
+// Kinds are all the kinds Detect can return.
+var Kinds = []Kind{KindPhone, KindEmail, KindUsername}
+
+var (
+	// ErrUnsupportedKind is returned by Parse for a kind of identifier the
+	// Router was not configured to accept.
+	ErrUnsupportedKind = errors.New("identifier kind is not supported")
+
+	// ErrNotDeliverable is returned by Parse for an accepted kind that no
+	// delivery channel can send an OTP to.
+	ErrNotDeliverable = errors.New("identifier kind has no OTP delivery channel")
+
+	// ErrInvalidUsername is returned by Parse for input that is neither a
+	// phone number nor an email address and not a valid username either.
+	ErrInvalidUsername = errors.New("invalid username")
+)
+
+// usernamePattern is a letter followed by 2 to 31 letters, digits, "_",
+// "." or "-".
+var usernamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]{2,31}$`)
+
+// Identifier is user input recognised as a phone number, email address or
+// username. Normalized is the form it is stored and looked up under, and
+// DeliveryChannel the channel OTPs for it are sent through.
+type Identifier struct {
+	Kind            Kind
+	Normalized      string
+	DeliveryChannel string
+}
+
+// Detect returns the kind of identifier input looks like, without
+// validating it: an email address contains "@", a phone number starts with
+// "+", "(" or a digit, and anything else is a username. Empty input is
+// taken for a phone number, the only kind accepted before kinds existed.
+func Detect(input string) Kind {
+	input = strings.TrimSpace(input)
+	switch {
+	case strings.Contains(input, "@"):
+		return KindEmail
+	case input == "" || strings.ContainsRune("+(0123456789", rune(input[0])):
+		return KindPhone
+	default:
+		return KindUsername
+	}
+}
+
+// Router validates and normalizes identifiers of the kinds it accepts and
+// routes each to its delivery channel.
+type Router struct {
+	kinds    []Kind
+	channels map[Kind]string
+	email    email.Policy
+}
+
+// NewRouter creates a Router accepting kinds. channels maps each kind that
+// OTPs can be delivered to to its channel; a kind without one is accepted
+// but cannot be sent an OTP.
+func NewRouter(kinds []Kind, channels map[Kind]string, emailPolicy email.Policy) *Router {
+	return &Router{kinds: kinds, channels: channels, email: emailPolicy}
+}
+
+// Parse detects the kind of input and validates and normalizes it. It
+// returns ErrUnsupportedKind or ErrNotDeliverable, wrapped with the kind,
+// for identifiers the Router cannot send an OTP to, and otherwise the
+// validation error of the kind: phone.ErrInvalid, phone.ErrHasExtension,
+// email.ErrInvalid or ErrInvalidUsername.
+func (r *Router) Parse(input string) (Identifier, error) {
+	kind := Detect(input)
+	if !slices.Contains(r.kinds, kind) {
+		return Identifier{Kind: kind}, fmt.Errorf("%w: %s", ErrUnsupportedKind, kind)
+	}
+
+	var normalized string
+	var err error
+	switch kind {
+	case KindPhone:
+		normalized, err = phone.Parse(input)
+	case KindEmail:
+		normalized, err = r.email.NormalizeEmail(input)
+	case KindUsername:
+		normalized = strings.ToLower(strings.TrimSpace(input))
+		if !usernamePattern.MatchString(normalized) {
+			err = ErrInvalidUsername
+		}
+	}
+	if err != nil {
+		return Identifier{Kind: kind}, err
+	}
+
+	channel := r.channels[kind]
+	if channel == "" {
+		return Identifier{Kind: kind, Normalized: normalized}, fmt.Errorf("%w: %s", ErrNotDeliverable, kind)
+	}
+	return Identifier{Kind: kind, Normalized: normalized, DeliveryChannel: channel}, nil
+}
@@ -0,0 +1,67 @@
+package identifier
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qcom/qcom/internal/email"
+	"github.com/qcom/qcom/internal/phone"
+)
+
+func TestDetect(t *testing.T) {
+	tests := map[string]Kind{
+		"+15551234567":     KindPhone,
+		"(555) 123-4567":   KindPhone,
+		"5551234567":       KindPhone,
+		"":                 KindPhone,
+		"ada@example.com":  KindEmail,
+		" ada@example.com": KindEmail,
+		"ada_lovelace":     KindUsername,
+	}
+	for input, want := range tests {
+		if got := Detect(input); got != want {
+			t.Errorf("Detect(%q) = %s, want %s", input, got, want)
+		}
+	}
+}
+
+func TestRouterParse(t *testing.T) {
+	router := NewRouter([]Kind{KindPhone, KindEmail, KindUsername}, map[Kind]string{
+		KindPhone: "sms",
+		KindEmail: "email",
+	}, email.Policy{})
+
+	tests := []struct {
+		input string
+		want  Identifier
+		err   error
+	}{
+		{"+1 (555) 123-4567", Identifier{KindPhone, "+15551234567", "sms"}, nil},
+		{" Ada@Example.COM ", Identifier{KindEmail, "Ada@example.com", "email"}, nil},
+		{"Ada_L", Identifier{KindUsername, "ada_l", ""}, ErrNotDeliverable},
+		{"+0555123", Identifier{Kind: KindPhone}, phone.ErrInvalid},
+		{"ada@localhost", Identifier{Kind: KindEmail}, email.ErrInvalid},
+		{"a!", Identifier{Kind: KindUsername}, ErrInvalidUsername},
+	}
+	for _, tt := range tests {
+		got, err := router.Parse(tt.input)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v, %v", tt.input, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// Kinds the router was not configured for are refused before validation.
+func TestRouterParseUnsupportedKind(t *testing.T) {
+	router := NewRouter([]Kind{KindPhone}, map[Kind]string{KindPhone: "sms"}, email.Policy{})
+
+	for input, kind := range map[string]Kind{"ada@example.com": KindEmail, "ada@": KindEmail, "ada_l": KindUsername} {
+		got, err := router.Parse(input)
+		if !errors.Is(err, ErrUnsupportedKind) || got.Kind != kind {
+			t.Errorf("Parse(%q) = %+v, %v, want ErrUnsupportedKind for a %s", input, got, err, kind)
+		}
+	}
+	if got, err := router.Parse("+15551234567"); err != nil || got.DeliveryChannel != "sms" {
+		t.Errorf("Parse of a phone number = %+v, %v, want it routed to sms", got, err)
+	}
+}
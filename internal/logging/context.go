@@ -0,0 +1,24 @@
+package logging
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying entry, so that code handling the
+// request logs with the same correlation fields.
+func WithLogger(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, entry)
+}
+
+// LoggerFromContext returns the request-scoped logger stored in ctx, or base
+// when ctx carries none (e.g. during startup or in background work).
+func LoggerFromContext(ctx context.Context, base *logrus.Logger) *logrus.Entry {
+	if entry, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(base)
+}
@@ -0,0 +1,24 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLoggerFromContext(t *testing.T) {
+	base := logrus.New()
+	base.SetOutput(io.Discard)
+
+	if entry := LoggerFromContext(context.Background(), base); entry.Logger != base || len(entry.Data) != 0 {
+		t.Errorf("LoggerFromContext without a logger = %+v, want a bare entry of base", entry)
+	}
+
+	scoped := base.WithField("request_id", "abc")
+	ctx := WithLogger(context.Background(), scoped)
+	if entry := LoggerFromContext(ctx, base); entry != scoped {
+		t.Errorf("LoggerFromContext = %+v, want the request's entry", entry)
+	}
+}
@@ -0,0 +1,18 @@
+package logging
+
+import "strings"
+
+// LogPhone masks the middle digits of a phone number so it can be written to
+// logs without exposing the full number, e.g. "+254712345789" -> "+2547****789".
+func LogPhone(phone string) string {
+	const keepPrefix, keepSuffix = 5, 3
+
+	if len(phone) <= keepPrefix+keepSuffix {
+		if len(phone) <= 2 {
+			return strings.Repeat("*", len(phone))
+		}
+		return strings.Repeat("*", len(phone)-2) + phone[len(phone)-2:]
+	}
+
+	return phone[:keepPrefix] + "****" + phone[len(phone)-keepSuffix:]
+}
@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLogPhone(t *testing.T) {
+	tests := []struct {
+		phone string
+		want  string
+	}{
+		{"+254712345789", "+2547****789"},
+		{"+15551234567", "+1555****567"},
+		{"+123456789", "+1234****789"},
+		{"+1234567", "******67"},
+		{"+1", "**"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := LogPhone(tt.phone); got != tt.want {
+			t.Errorf("LogPhone(%q) = %q, want %q", tt.phone, got, tt.want)
+		}
+	}
+}
+
+// However short the number, the masked form never gives away more than its
+// first five and last three characters.
+func TestLogPhoneHidesMiddleDigits(t *testing.T) {
+	for n := 0; n <= 16; n++ {
+		phone := "+" + strings.Repeat("7", n)
+		masked := LogPhone(phone)
+		if masked == phone {
+			t.Errorf("LogPhone(%q) left the number unmasked", phone)
+		}
+		if strings.Count(masked, "7") > 7 {
+			t.Errorf("LogPhone(%q) = %q, which keeps more than 7 digits", phone, masked)
+		}
+	}
+}
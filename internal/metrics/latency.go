@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Backends whose recent latencies are kept for LatencySnapshot.
+const (
+	BackendDynamoDB  = "dynamodb"
+	BackendOTPVerify = "otp_verify"
+)
+
+// Recent latencies are the last latencyWindowSize observations of a backend
+// that are at most latencyWindowAge old, so the percentiles follow current
+// conditions rather than the whole uptime, as the histograms do.
+const (
+	latencyWindowSize = 1024
+	latencyWindowAge  = 5 * time.Minute
+)
+
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// latencyWindow is a ring buffer of the most recent samples.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []latencySample
+	next    int
+}
+
+func (w *latencyWindow) add(at time.Time, d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, latencySample{at, d})
+		return
+	}
+	w.samples[w.next] = latencySample{at, d}
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// recent returns the durations observed since cutoff, sorted.
+func (w *latencyWindow) recent(cutoff time.Time) []time.Duration {
+	w.mu.Lock()
+	durations := make([]time.Duration, 0, len(w.samples))
+	for _, s := range w.samples {
+		if !s.at.Before(cutoff) {
+			durations = append(durations, s.duration)
+		}
+	}
+	w.mu.Unlock()
+
+	slices.Sort(durations)
+	return durations
+}
+
+var latencyWindows = map[string]*latencyWindow{
+	BackendDynamoDB:  {},
+	BackendOTPVerify: {},
+}
+
+// LatencyPercentiles summarizes a backend's recent latencies in
+// milliseconds. The percentiles are zero when Count is.
+type LatencyPercentiles struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+// LatencySnapshot returns the percentiles of each backend's recent
+// latencies. It sorts at most latencyWindowSize samples per backend, so it
+// is cheap enough to poll.
+func LatencySnapshot() map[string]LatencyPercentiles {
+	return latencySnapshot(time.Now())
+}
+
+func latencySnapshot(now time.Time) map[string]LatencyPercentiles {
+	snapshot := make(map[string]LatencyPercentiles, len(latencyWindows))
+	for backend, window := range latencyWindows {
+		durations := window.recent(now.Add(-latencyWindowAge))
+		snapshot[backend] = LatencyPercentiles{
+			Count: len(durations),
+			P50:   percentile(durations, 50),
+			P95:   percentile(durations, 95),
+			P99:   percentile(durations, 99),
+		}
+	}
+	return snapshot
+}
+
+// percentile returns the nearest-rank percentile p of sorted, in
+// milliseconds.
+func percentile(sorted []time.Duration, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return float64(sorted[max(rank, 1)-1]) / float64(time.Millisecond)
+}
+
+func observeLatency(backend string, d time.Duration) {
+	latencyWindows[backend].add(time.Now(), d)
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+// useFreshLatencyWindows replaces the latency windows with empty ones for
+// the rest of the test.
+func useFreshLatencyWindows(t *testing.T) {
+	saved := latencyWindows
+	latencyWindows = map[string]*latencyWindow{BackendDynamoDB: {}, BackendOTPVerify: {}}
+	t.Cleanup(func() { latencyWindows = saved })
+}
+
+func TestLatencySnapshot(t *testing.T) {
+	useFreshLatencyWindows(t)
+	now := time.Now()
+
+	// 1ms to 100ms in a scrambled order, and slow samples too old to count.
+	for i := 0; i < 100; i++ {
+		latencyWindows[BackendDynamoDB].add(now.Add(-time.Minute), time.Duration((i*37)%100+1)*time.Millisecond)
+	}
+	for i := 0; i < 50; i++ {
+		latencyWindows[BackendDynamoDB].add(now.Add(-latencyWindowAge-time.Second), 10*time.Second)
+	}
+
+	snapshot := latencySnapshot(now)
+	want := LatencyPercentiles{Count: 100, P50: 50, P95: 95, P99: 99}
+	if got := snapshot[BackendDynamoDB]; got != want {
+		t.Errorf("dynamodb latencies = %+v, want %+v", got, want)
+	}
+	if got := snapshot[BackendOTPVerify]; got != (LatencyPercentiles{}) {
+		t.Errorf("otp_verify latencies without samples = %+v, want zeros", got)
+	}
+}
+
+// Only the latest latencyWindowSize samples are kept.
+func TestLatencyWindowWraps(t *testing.T) {
+	useFreshLatencyWindows(t)
+	now := time.Now()
+	for i := 0; i < 2*latencyWindowSize; i++ {
+		latencyWindows[BackendOTPVerify].add(now, time.Duration(i)*time.Millisecond)
+	}
+
+	got := latencySnapshot(now)[BackendOTPVerify]
+	if got.Count != latencyWindowSize || got.P50 != float64(latencyWindowSize+latencyWindowSize/2-1) || got.P99 >= float64(2*latencyWindowSize) {
+		t.Errorf("latencies after wrapping = %+v, want the latest %d samples", got, latencyWindowSize)
+	}
+}
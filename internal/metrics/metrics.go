@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Label values are fixed sets; never label by phone number or token ID.
+const (
+	OTPResultSuccess = "success"
+	OTPResultInvalid = "invalid"
+	OTPResultExpired = "expired"
+	OTPResultLocked  = "locked"
+
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+)
+
+var (
+	otpVerifyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "otp_verify_total",
+		Help: "OTP verification attempts by result.",
+	}, []string{"result"})
+
+	otpVerifyDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "otp_verify_duration_seconds",
+		Help:    "Latency of OTP verification.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	tokensIssuedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tokens_issued_total",
+		Help: "Tokens issued by type.",
+	}, []string{"type"})
+
+	refreshTokenStoreDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "refresh_token_dynamodb_duration_seconds",
+		Help:    "Latency of refresh token DynamoDB operations.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	dynamoDBOpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dynamodb_operation_duration_seconds",
+		Help:    "Latency of DynamoDB operations, retries included, by API operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+)
+
+// ObserveOTPVerify records the result and latency of an OTP verification
+// that started at start.
+func ObserveOTPVerify(result string, start time.Time) {
+	d := time.Since(start)
+	otpVerifyTotal.WithLabelValues(result).Inc()
+	otpVerifyDuration.Observe(d.Seconds())
+	observeLatency(BackendOTPVerify, d)
+}
+
+// TokenIssued counts a single issued token of the given type.
+func TokenIssued(tokenType string) {
+	tokensIssuedTotal.WithLabelValues(tokenType).Inc()
+}
+
+// ObserveRefreshTokenOp records the latency of a refresh token repository
+// operation that started at start. Intended for use with defer.
+func ObserveRefreshTokenOp(operation string, start time.Time) {
+	refreshTokenStoreDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// ObserveDynamoDBOp records the latency of a DynamoDB API operation, such as
+// GetItem.
+func ObserveDynamoDBOp(operation string, d time.Duration) {
+	dynamoDBOpDuration.WithLabelValues(operation).Observe(d.Seconds())
+	observeLatency(BackendDynamoDB, d)
+}
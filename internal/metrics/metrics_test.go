@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counterValue returns the value of the counter name with the label
+// name=value, or 0 if it has not been incremented yet.
+func counterValue(t *testing.T, name, label, value string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() == label && pair.GetValue() == value {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestObserveOTPVerify(t *testing.T) {
+	before := counterValue(t, "otp_verify_total", "result", OTPResultLocked)
+	ObserveOTPVerify(OTPResultLocked, time.Now())
+	ObserveOTPVerify(OTPResultLocked, time.Now())
+
+	if got := counterValue(t, "otp_verify_total", "result", OTPResultLocked); got != before+2 {
+		t.Errorf("otp_verify_total{result=locked} = %v, want %v", got, before+2)
+	}
+}
+
+func TestTokenIssued(t *testing.T) {
+	before := counterValue(t, "tokens_issued_total", "type", TokenTypeRefresh)
+	TokenIssued(TokenTypeRefresh)
+
+	if got := counterValue(t, "tokens_issued_total", "type", TokenTypeRefresh); got != before+1 {
+		t.Errorf("tokens_issued_total{type=refresh} = %v, want %v", got, before+1)
+	}
+}
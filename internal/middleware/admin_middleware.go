@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/netip"
+
+	"github.com/qcom/qcom/internal/apierror"
+)
+
+// RequireAdminKey only lets through requests carrying the configured admin
+// API key in the X-Admin-Key header.
+func RequireAdminKey(apiKey string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			provided := r.Header.Get("X-Admin-Key")
+			if provided == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(apiKey)) != 1 {
+				apierror.Write(w, r, apierror.CodeForbidden, "Admin access denied")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RestrictNetworks only lets through requests whose client IP, as resolved
+// by ClientIP through the trusted proxies, is in allowed (when it is not
+// empty) and not in blocked. Other requests get 403.
+func RestrictNetworks(allowed, blocked, trusted []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, err := netip.ParseAddr(ClientIP(r, trusted))
+			if err != nil || inPrefixes(client, blocked) || (len(allowed) > 0 && !inPrefixes(client, allowed)) {
+				apierror.Write(w, r, apierror.CodeForbidden, "Access denied from this network")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestRestrictNetworks(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	allowed := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("10.0.0.0/8")}
+	blocked := []netip.Prefix{netip.MustParsePrefix("192.0.2.66/32")}
+	tests := []struct {
+		name       string
+		allowed    []netip.Prefix
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{"allowed client", allowed, "192.0.2.7:1234", "", http.StatusNoContent},
+		{"client outside the allowlist", allowed, "203.0.113.7:1234", "", http.StatusForbidden},
+		{"blocked client inside the allowlist", allowed, "192.0.2.66:1234", "", http.StatusForbidden},
+		{"allowed client behind a trusted proxy", allowed, "10.0.0.5:1234", "192.0.2.7", http.StatusNoContent},
+		{"outside client behind a trusted proxy", allowed, "10.0.0.5:1234", "203.0.113.7", http.StatusForbidden},
+		{"untrusted peer spoofing an allowed client", allowed, "203.0.113.7:1234", "192.0.2.7", http.StatusForbidden},
+		{"untrusted peer spoofing past the blocklist", nil, "192.0.2.66:1234", "198.51.100.1", http.StatusForbidden},
+		{"any client without an allowlist", nil, "203.0.113.7:1234", "", http.StatusNoContent},
+		{"unparsable remote address", allowed, "@unix", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/admin/audit", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			rec := httptest.NewRecorder()
+			RestrictNetworks(tt.allowed, blocked, trusted)(okHandler).ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -2,67 +2,267 @@ package middleware
 
 import (
 	"context"
+	"crypto/subtle"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/qcom/qcom/internal/apierror"
+	"github.com/qcom/qcom/internal/logging"
 	"github.com/qcom/qcom/internal/service"
 	"github.com/sirupsen/logrus"
 )
 
+// Cookies of a browser session, set by the OTP page. The tokens are
+// HttpOnly; the CSRF cookie is not, so the session's scripts can echo it in
+// CSRFHeader.
+const (
+	AccessTokenCookie  = "qcom_access_token"
+	RefreshTokenCookie = "qcom_refresh_token"
+	CSRFCookie         = "qcom_csrf"
+	CSRFHeader         = "X-CSRF-Token"
+)
+
 type AuthMiddleware struct {
-	jwtService *service.JWTService
-	logger     *logrus.Logger
+	jwtService        *service.JWTService
+	revocationService *service.TokenRevocationService
+	// sessionCookies accepts the access token from AccessTokenCookie when
+	// a request has no Authorization header.
+	sessionCookies bool
+	logger         *logrus.Logger
 }
 
-func NewAuthMiddleware(jwtService *service.JWTService, logger *logrus.Logger) *AuthMiddleware {
+func NewAuthMiddleware(jwtService *service.JWTService, revocationService *service.TokenRevocationService, sessionCookies bool, logger *logrus.Logger) *AuthMiddleware {
 	return &AuthMiddleware{
-		jwtService: jwtService,
-		logger:     logger,
+		jwtService:        jwtService,
+		revocationService: revocationService,
+		sessionCookies:    sessionCookies,
+		logger:            logger,
 	}
 }
 
 func (m *AuthMiddleware) RequireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			m.respondUnauthorized(w, "Missing authorization header")
+		tokenString, ok := m.bearerToken(w, r)
+		if !ok {
 			return
 		}
 
-		// Extract token from "Bearer <token>"
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			m.respondUnauthorized(w, "Invalid authorization header format")
+		m.serveAuthenticated(w, r, next, tokenString, false, false)
+	})
+}
+
+// RequireGuestAuth is RequireAuth for the routes guests use, which accept
+// only guest tokens. Every other authenticated route refuses them.
+func (m *AuthMiddleware) RequireGuestAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString, ok := m.bearerToken(w, r)
+		if !ok {
 			return
 		}
 
-		tokenString := parts[1]
+		m.serveAuthenticated(w, r, next, tokenString, false, true)
+	})
+}
 
-		// Verify token
-		claims, err := m.jwtService.VerifyToken(tokenString)
-		if err != nil {
-			m.logger.WithError(err).Debug("Token verification failed")
-			m.respondUnauthorized(w, "Invalid or expired token")
+// RequireLogoutAuth is RequireAuth for the logout route. It also accepts an
+// access token that has already been logged out, so logging out twice
+// succeeds. Tokens revoked by an epoch are still rejected.
+func (m *AuthMiddleware) RequireLogoutAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString, ok := m.bearerToken(w, r)
+		if !ok {
 			return
 		}
 
-		// Check token type
-		if claims.Type != "access" {
-			m.respondUnauthorized(w, "Invalid token type")
+		m.serveAuthenticated(w, r, next, tokenString, true, false)
+	})
+}
+
+// RequireRecentAuth rejects requests whose access token is based on an OTP
+// verification more than maxAge ago, or whose token does not record one,
+// with REAUTH_REQUIRED. It must run after RequireAuth.
+func (m *AuthMiddleware) RequireRecentAuth(maxAge time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value("claims").(*service.Claims)
+			if !ok {
+				m.respondUnauthorized(w, r, "Invalid token")
+				return
+			}
+
+			authTime := claims.AuthenticatedAt()
+			if authTime.IsZero() || time.Since(authTime) > maxAge {
+				apierror.Write(w, r, apierror.CodeReauthRequired, "Verify an OTP again to continue")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WebSocketAuthProtocol is the subprotocol a browser WebSocket client offers
+// alongside its access token, e.g.
+//
+//	new WebSocket(url, ["qcom.bearer", accessToken])
+//
+// since browsers cannot set an Authorization header on the handshake.
+const WebSocketAuthProtocol = "qcom.bearer"
+
+// RequireWebSocketAuth is RequireAuth for routes that also accept WebSocket
+// upgrades. On an upgrade request offering WebSocketAuthProtocol, the access
+// token is taken from the entry following it in Sec-WebSocket-Protocol
+// instead of the Authorization header. The token is then removed from the
+// request's offered subprotocols, so it is never echoed back, and
+// WebSocketAuthProtocol is set as the accepted subprotocol on the response.
+// Other requests are authenticated exactly as by RequireAuth.
+func (m *AuthMiddleware) RequireWebSocketAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) || r.Header.Get("Authorization") != "" {
+			m.RequireAuth(next).ServeHTTP(w, r)
+			return
+		}
+
+		var protocols []string
+		for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+			for _, protocol := range strings.Split(value, ",") {
+				protocols = append(protocols, strings.TrimSpace(protocol))
+			}
+		}
+
+		i := slices.Index(protocols, WebSocketAuthProtocol)
+		if i < 0 || i+1 >= len(protocols) {
+			m.respondUnauthorized(w, r, "Missing access token in Sec-WebSocket-Protocol")
 			return
 		}
+		tokenString := protocols[i+1]
 
-		// Add claims to context
-		ctx := context.WithValue(r.Context(), "claims", claims)
-		ctx = context.WithValue(ctx, "phone", claims.Phone)
-		ctx = context.WithValue(ctx, "user_id", claims.Subject)
+		r = r.Clone(r.Context())
+		r.Header.Set("Sec-WebSocket-Protocol", strings.Join(slices.Delete(protocols, i+1, i+2), ", "))
+		w.Header().Set("Sec-WebSocket-Protocol", WebSocketAuthProtocol)
 
-		next.ServeHTTP(w, r.WithContext(ctx))
+		m.serveAuthenticated(w, r, next, tokenString, false, false)
 	})
 }
 
-func (m *AuthMiddleware) respondUnauthorized(w http.ResponseWriter, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusUnauthorized)
-	w.Write([]byte(`{"error":{"code":"UNAUTHORIZED","message":"` + message + `"}}`))
+// isWebSocketUpgrade reports whether r is a WebSocket opening handshake.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bearerToken extracts the token from the Authorization header, or with
+// session cookies accepted, from AccessTokenCookie. It responds with an
+// error and returns false if there is none, or if a write authenticated by
+// the cookie fails the CSRF check.
+func (m *AuthMiddleware) bearerToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		cookie, err := r.Cookie(AccessTokenCookie)
+		if !m.sessionCookies || err != nil || cookie.Value == "" {
+			m.respondUnauthorized(w, r, "Missing authorization header")
+			return "", false
+		}
+		if !isSafeMethod(r.Method) && !ValidCSRFToken(r, r.Header.Get(CSRFHeader)) {
+			apierror.Write(w, r, apierror.CodeInvalidCSRFToken, "Missing or invalid CSRF token")
+			return "", false
+		}
+		return cookie.Value, true
+	}
+
+	// Extract token from "Bearer <token>"
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		m.respondUnauthorized(w, r, "Invalid authorization header format")
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+// ValidCSRFToken reports whether token matches r's CSRFCookie. Another site
+// can make a browser send the cookie but cannot read it, so only the
+// session's own pages can echo it.
+func ValidCSRFToken(r *http.Request, token string) bool {
+	cookie, err := r.Cookie(CSRFCookie)
+	return err == nil && cookie.Value != "" && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) == 1
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// serveAuthenticated verifies an access token and calls next with its claims
+// in the context. With allowRevokedJTI set, a token revoked individually,
+// rather than by an epoch, is accepted. guest selects whether only guest
+// tokens or only user tokens are accepted.
+func (m *AuthMiddleware) serveAuthenticated(w http.ResponseWriter, r *http.Request, next http.Handler, tokenString string, allowRevokedJTI, guest bool) {
+	// Verify token
+	claims, err := m.jwtService.VerifyToken(tokenString)
+	if err != nil {
+		m.logger.WithError(err).Debug("Token verification failed")
+		m.respondUnauthorized(w, r, "Invalid or expired token")
+		return
+	}
+
+	// Check token type
+	if claims.Type != "access" {
+		m.respondUnauthorized(w, r, "Invalid token type")
+		return
+	}
+
+	// Exchanged tokens are minted for other services
+	if len(claims.Audience) > 0 {
+		m.respondUnauthorized(w, r, "Invalid token audience")
+		return
+	}
+
+	if claims.Guest != guest {
+		if claims.Guest {
+			apierror.Write(w, r, apierror.CodeForbidden, "Guest sessions cannot use this route; upgrade to an account first")
+		} else {
+			apierror.Write(w, r, apierror.CodeForbidden, "Only guest sessions can use this route")
+		}
+		return
+	}
+
+	// Revocation is checked last, as the only step that reads from storage.
+	// Tokens are refused if it cannot be read, so a logged-out token never
+	// gets through.
+	isRevoked := m.revocationService.IsRevoked
+	if allowRevokedJTI {
+		isRevoked = m.revocationService.IsRevokedByEpoch
+	}
+	revoked, err := isRevoked(r.Context(), claims)
+	if err != nil {
+		logging.LoggerFromContext(r.Context(), m.logger).WithError(err).Error("Failed to check token revocation")
+		apierror.Write(w, r, apierror.CodeServiceUnavailable, "Token revocation could not be checked; retry shortly")
+		return
+	}
+	if revoked {
+		apierror.Write(w, r, apierror.CodeTokenRevoked, "Token has been revoked")
+		return
+	}
+
+	// Add claims to context
+	ctx := context.WithValue(r.Context(), "claims", claims)
+	ctx = context.WithValue(ctx, "phone", claims.Phone)
+	ctx = context.WithValue(ctx, "user_id", claims.Subject)
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (m *AuthMiddleware) respondUnauthorized(w http.ResponseWriter, r *http.Request, message string) {
+	apierror.Write(w, r, apierror.CodeUnauthorized, message)
 }
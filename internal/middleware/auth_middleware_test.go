@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qcom/qcom/internal/config"
+	"github.com/qcom/qcom/internal/dynamotest"
+	"github.com/qcom/qcom/internal/repository"
+	"github.com/qcom/qcom/internal/service"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// newTestAuthMiddleware returns an AuthMiddleware, the JWT service whose
+// tokens it accepts and the revocation service it checks them against.
+func newTestAuthMiddleware(t *testing.T) (*AuthMiddleware, *service.JWTService, *service.TokenRevocationService) {
+	t.Helper()
+	db := dynamotest.New(t)
+	db.CreateTable("tokens", "PK", "SK")
+	return authMiddlewareOn(t, db, db.Table("tokens"))
+}
+
+// authMiddlewareOn is newTestAuthMiddleware with revocations stored in
+// tableName, which need not exist.
+func authMiddlewareOn(t *testing.T, db *dynamotest.DB, tableName string) (*AuthMiddleware, *service.JWTService, *service.TokenRevocationService) {
+	t.Helper()
+	revocationRepo := repository.NewTokenRevocationRepository(db.Client(), tableName, repository.KeySchema{PK: "PK", SK: "SK"}, testLogger())
+	revocationService := service.NewTokenRevocationService(revocationRepo, testLogger())
+
+	jwtService, err := service.NewJWTService(&config.JWTConfig{
+		SecretKey:    "test-secret-key-of-at-least-32-bytes",
+		AccessExpiry: 15 * time.Minute,
+		IssuedAtSkew: 5 * time.Second,
+	}, testLogger())
+	if err != nil {
+		t.Fatalf("NewJWTService: %v", err)
+	}
+	return NewAuthMiddleware(jwtService, revocationService, false, testLogger()), jwtService, revocationService
+}
+
+// serveWithToken serves a request bearing accessToken through handler and
+// returns the response.
+func serveWithToken(handler http.Handler, accessToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/me", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// responseCode returns the error code of an API error response.
+func responseCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding error response: %v", err)
+	}
+	return body.Error.Code
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+})
+
+func TestRequireAuthRejectsLoggedOutToken(t *testing.T) {
+	auth, jwtService, revocationService := newTestAuthMiddleware(t)
+	tokens, err := jwtService.GenerateAccessTokenOnly("user-1", "+15551234567", time.Now())
+	if err != nil {
+		t.Fatalf("GenerateAccessTokenOnly: %v", err)
+	}
+	handler := auth.RequireAuth(okHandler)
+
+	if rec := serveWithToken(handler, tokens.AccessToken); rec.Code != http.StatusNoContent {
+		t.Fatalf("request before logout: %d %s", rec.Code, rec.Body)
+	}
+
+	claims, err := jwtService.VerifyToken(tokens.AccessToken)
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+	if err := revocationService.Revoke(context.Background(), claims); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+
+	rec := serveWithToken(handler, tokens.AccessToken)
+	if rec.Code != http.StatusUnauthorized || responseCode(t, rec) != "TOKEN_REVOKED" {
+		t.Errorf("request after logout: %d, want 401 TOKEN_REVOKED", rec.Code)
+	}
+	// Logging out again is still allowed.
+	if rec := serveWithToken(auth.RequireLogoutAuth(okHandler), tokens.AccessToken); rec.Code != http.StatusNoContent {
+		t.Errorf("logout request after logout: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRequireAuthFailsClosedWithoutRevocationStore(t *testing.T) {
+	db := dynamotest.New(t)
+	// The revocation table is never created, so every check fails.
+	auth, jwtService, _ := authMiddlewareOn(t, db, db.Table("tokens"))
+	tokens, err := jwtService.GenerateAccessTokenOnly("user-1", "+15551234567", time.Now())
+	if err != nil {
+		t.Fatalf("GenerateAccessTokenOnly: %v", err)
+	}
+
+	for name, handler := range map[string]http.Handler{
+		"RequireAuth":       auth.RequireAuth(okHandler),
+		"RequireLogoutAuth": auth.RequireLogoutAuth(okHandler),
+	} {
+		rec := serveWithToken(handler, tokens.AccessToken)
+		if rec.Code != http.StatusServiceUnavailable || responseCode(t, rec) != "SERVICE_UNAVAILABLE" {
+			t.Errorf("%s with revocations unreadable: %d, want 503 SERVICE_UNAVAILABLE", name, rec.Code)
+		}
+	}
+}
+
+// webSocketAccept is the Sec-WebSocket-Accept value for key (RFC 6455).
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// upgradeHandler completes a WebSocket handshake by taking over the
+// connection, reporting the authenticated user and the subprotocols the
+// client was left offering.
+func upgradeHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := r.Context().Value("claims").(*service.Claims)
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\n")
+	fmt.Fprintf(buf, "Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(buf, "Sec-WebSocket-Accept: %s\r\n", webSocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+	fmt.Fprintf(buf, "Sec-WebSocket-Protocol: %s\r\n", w.Header().Get("Sec-WebSocket-Protocol"))
+	fmt.Fprintf(buf, "X-Subject: %s\r\nX-Offered: %s\r\n\r\n", claims.Subject, r.Header.Get("Sec-WebSocket-Protocol"))
+	buf.Flush()
+}
+
+// handshake sends a WebSocket opening handshake offering protocols to url
+// and returns the response.
+func handshake(t *testing.T, url, protocols string) *http.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	req, _ := http.NewRequest(http.MethodGet, url+"/api/v1/events", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Protocol", protocols)
+	req.Header.Set("Accept-Encoding", "gzip")
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("writing handshake: %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("reading handshake response: %v", err)
+	}
+	return resp
+}
+
+func TestRequireWebSocketAuthHandshake(t *testing.T) {
+	auth, jwtService, _ := newTestAuthMiddleware(t)
+	tokens, err := jwtService.GenerateAccessTokenOnly("user-1", "+15551234567", time.Now())
+	if err != nil {
+		t.Fatalf("GenerateAccessTokenOnly: %v", err)
+	}
+
+	// The response writer is wrapped by every middleware of the server's
+	// chain, each of which must let the handler take over the connection.
+	var handler http.Handler = auth.RequireWebSocketAuth(http.HandlerFunc(upgradeHandler))
+	handler = JSONCase(true)(handler)
+	handler = CompressionMiddleware(0)(handler)
+	handler = LoggingMiddleware(testLogger(), nil)(handler)
+	handler = TracingMiddleware(handler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp := handshake(t, server.URL, "chat, "+WebSocketAuthProtocol+", "+tokens.AccessToken)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != webSocketAccept("dGhlIHNhbXBsZSBub25jZQ==") {
+		t.Errorf("Sec-WebSocket-Accept = %q", got)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != WebSocketAuthProtocol {
+		t.Errorf("accepted subprotocol = %q, want %q", got, WebSocketAuthProtocol)
+	}
+	if got := resp.Header.Get("X-Subject"); got != "user-1" {
+		t.Errorf("handler saw subject %q, want user-1", got)
+	}
+	if got := resp.Header.Get("X-Offered"); strings.Contains(got, tokens.AccessToken) || got != "chat, "+WebSocketAuthProtocol {
+		t.Errorf("handler saw offered subprotocols %q, want the token removed", got)
+	}
+}
+
+func TestRequireWebSocketAuthRejects(t *testing.T) {
+	auth, _, _ := newTestAuthMiddleware(t)
+	server := httptest.NewServer(auth.RequireWebSocketAuth(http.HandlerFunc(upgradeHandler)))
+	defer server.Close()
+
+	for name, protocols := range map[string]string{
+		"no token":      WebSocketAuthProtocol,
+		"invalid token": WebSocketAuthProtocol + ", not-a-token",
+		"no protocol":   "chat",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if resp := handshake(t, server.URL, protocols); resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("status = %d, want 401", resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIP returns the address of the client that sent r. X-Forwarded-For is
+// only honoured when the immediate peer is a trusted proxy; the chain is then
+// walked from the right, skipping trusted hops, and the first untrusted
+// address is the client. Anything left of it could have been forged by the
+// client, so it is never used.
+func ClientIP(r *http.Request, trusted []netip.Prefix) string {
+	peer := remoteAddr(r)
+	if !peer.IsValid() {
+		return r.RemoteAddr
+	}
+	if !inPrefixes(peer, trusted) {
+		return peer.String()
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = hop.Unmap()
+		if !inPrefixes(client, trusted) {
+			break
+		}
+	}
+	return client.String()
+}
+
+func remoteAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// inPrefixes reports whether addr is in any of prefixes.
+func inPrefixes(addr netip.Addr, prefixes []netip.Prefix) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"untrusted peer forging the header", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"one trusted proxy", "10.0.0.5:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy chain", "10.0.0.5:1234", []string{"198.51.100.1, 10.0.0.9"}, "198.51.100.1"},
+		{"forged entries left of the client", "10.0.0.5:1234", []string{"192.0.2.66, 198.51.100.1"}, "198.51.100.1"},
+		{"chain across header lines", "10.0.0.5:1234", []string{"198.51.100.1", "10.0.0.9"}, "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.5:1234", nil, "10.0.0.5"},
+		{"garbage hop", "10.0.0.5:1234", []string{"198.51.100.1, not-an-ip"}, "10.0.0.5"},
+		{"IPv4-mapped peer", "[::ffff:10.0.0.5]:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"IPv6 proxy", "[fd00::1]:1234", []string{"2001:db8::7"}, "2001:db8::7"},
+		{"unparsable remote address", "@unix", nil, "@unix"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := ClientIP(r, trusted); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressionMiddleware(t *testing.T) {
+	large := strings.Repeat("a", 100)
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		status         int
+		body           string
+		encoding       string
+		gzip           bool
+	}{
+		{"large", "gzip, deflate", http.StatusOK, large, "", true},
+		{"small", "gzip", http.StatusOK, "small", "", false},
+		{"not accepted", "deflate", http.StatusOK, large, "", false},
+		{"refused", "gzip;q=0", http.StatusOK, large, "", false},
+		{"wildcard", "*", http.StatusOK, large, "", true},
+		{"error status", "gzip", http.StatusBadRequest, large, "", true},
+		{"already encoded", "gzip", http.StatusOK, large, "br", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := CompressionMiddleware(64)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.WriteHeader(tt.status)
+				// Written in pieces, to cross minSize part way.
+				io.WriteString(w, tt.body[:len(tt.body)/2])
+				io.WriteString(w, tt.body[len(tt.body)/2:])
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d", rec.Code, tt.status)
+			}
+			if vary := rec.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Accept-Encoding" {
+				t.Errorf("Vary = %v, want Accept-Encoding", vary)
+			}
+			body := rec.Body.String()
+			if tt.gzip {
+				if rec.Header().Get("Content-Encoding") != "gzip" {
+					t.Fatalf("Content-Encoding = %q, want gzip", rec.Header().Get("Content-Encoding"))
+				}
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader: %v", err)
+				}
+				decoded, err := io.ReadAll(gz)
+				if err != nil {
+					t.Fatalf("reading gzip body: %v", err)
+				}
+				body = string(decoded)
+			} else if rec.Header().Get("Content-Encoding") != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", rec.Header().Get("Content-Encoding"), tt.encoding)
+			}
+			if body != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+// A response with no body is passed through uncompressed.
+func TestCompressionMiddlewareNoContent(t *testing.T) {
+	handler := CompressionMiddleware(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() != 0 {
+		t.Errorf("response = %d, encoding %q, %d bytes, want an empty 204", rec.Code, rec.Header().Get("Content-Encoding"), rec.Body.Len())
+	}
+}
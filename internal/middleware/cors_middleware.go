@@ -1,19 +1,35 @@
 package middleware
 
-import "net/http"
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
 
-func CORSMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Max-Age", "3600")
+// NewCORSMiddleware allows cross-origin requests from any origin. Browsers
+// may cache preflight responses for maxAge, and may let scripts read the
+// exposeHeaders response headers.
+func NewCORSMiddleware(maxAge time.Duration, exposeHeaders []string) func(http.Handler) http.Handler {
+	maxAgeSeconds := strconv.Itoa(int(maxAge.Seconds()))
+	expose := strings.Join(exposeHeaders, ", ")
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-OTP-Status-Token, If-Match, X-JSON-Case, X-Service-Key")
+			w.Header().Set("Access-Control-Max-Age", maxAgeSeconds)
+			if expose != "" {
+				w.Header().Set("Access-Control-Expose-Headers", expose)
+			}
 
-		next.ServeHTTP(w, r)
-	})
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
 }
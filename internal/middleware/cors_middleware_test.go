@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	cors := NewCORSMiddleware(10*time.Minute, []string{"X-Request-ID", "Retry-After"})
+
+	for _, method := range []string{http.MethodOptions, http.MethodGet} {
+		rec := httptest.NewRecorder()
+		cors(okHandler).ServeHTTP(rec, httptest.NewRequest(method, "/api/v1/me", nil))
+
+		if got := rec.Header().Get("Access-Control-Max-Age"); got != "600" {
+			t.Errorf("%s: Access-Control-Max-Age = %q, want 600", method, got)
+		}
+		if got := rec.Header().Get("Access-Control-Expose-Headers"); got != "X-Request-ID, Retry-After" {
+			t.Errorf("%s: Access-Control-Expose-Headers = %q, want the configured headers", method, got)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	cors(okHandler).ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, "/api/v1/me", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("preflight status = %d, want 200 without calling the handler", rec.Code)
+	}
+}
+
+func TestCORSMiddlewareNoExposedHeaders(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewCORSMiddleware(0, nil)(okHandler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/me", nil))
+
+	if _, ok := rec.Header()["Access-Control-Expose-Headers"]; ok {
+		t.Error("Access-Control-Expose-Headers set with no headers configured")
+	}
+	if got := rec.Header().Get("Access-Control-Max-Age"); got != "0" {
+		t.Errorf("Access-Control-Max-Age = %q, want 0", got)
+	}
+}
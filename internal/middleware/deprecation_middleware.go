@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/qcom/qcom/internal/config"
+)
+
+// Deprecation advertises the deprecation of the routes in routes, keyed by
+// path template, on their responses: a Deprecation header (RFC 9745), a
+// Sunset header (RFC 8594) when the removal date is known, and a Link to the
+// migration docs. It must be installed on the router so the matched route is
+// known.
+func Deprecation(routes map[string]config.RouteDeprecation) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := mux.CurrentRoute(r); route != nil {
+				template, err := route.GetPathTemplate()
+				if deprecation, ok := routes[template]; err == nil && ok {
+					setDeprecationHeaders(w.Header(), deprecation)
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func setDeprecationHeaders(h http.Header, deprecation config.RouteDeprecation) {
+	h.Set("Deprecation", fmt.Sprintf("@%d", deprecation.DeprecatedAt.Unix()))
+	if !deprecation.Sunset.IsZero() {
+		h.Set("Sunset", deprecation.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if deprecation.Link != "" {
+		h.Add("Link", fmt.Sprintf(`<%s>; rel="deprecation"; type="text/html"`, deprecation.Link))
+	}
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/qcom/qcom/internal/config"
+)
+
+func TestDeprecation(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(Deprecation(map[string]config.RouteDeprecation{
+		"/api/v1/users/{id}": {
+			DeprecatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			Sunset:       time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC),
+			Link:         "https://example.com/migrate",
+		},
+		"/api/v1/legacy": {DeprecatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}))
+	for _, path := range []string{"/api/v1/users/{id}", "/api/v1/legacy", "/api/v1/me"} {
+		router.Handle(path, okHandler)
+	}
+
+	tests := []struct {
+		path                      string
+		deprecation, sunset, link string
+	}{
+		{"/api/v1/users/42", "@1767225600", "Wed, 01 Jul 2026 00:00:00 GMT", `<https://example.com/migrate>; rel="deprecation"; type="text/html"`},
+		{"/api/v1/legacy", "@1767225600", "", ""},
+		{"/api/v1/me", "", "", ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		h := rec.Header()
+		if h.Get("Deprecation") != tt.deprecation || h.Get("Sunset") != tt.sunset || h.Get("Link") != tt.link {
+			t.Errorf("%s: Deprecation %q, Sunset %q, Link %q, want %q, %q, %q",
+				tt.path, h.Get("Deprecation"), h.Get("Sunset"), h.Get("Link"), tt.deprecation, tt.sunset, tt.link)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/qcom/qcom/internal/apierror"
+)
+
+// JSONCaseHeader lets a request override the configured response field
+// naming with "snake" or "camel".
+const JSONCaseHeader = "X-JSON-Case"
+
+// JSONCase lets clients use camelCase JSON field names. Request bodies with
+// camelCase keys are rewritten to the snake_case the handlers decode, and
+// responses are rewritten to camelCase when camel is true or the request's
+// X-JSON-Case header asks for it. Only keys change, never values. A body
+// whose keys are already snake_case is passed through untouched, so request
+// signatures over it still verify. Request bodies are read into memory, up
+// to maxBufferedBodySize. A response the handler flushes is streamed from
+// then on with its keys as written, since a partial document cannot be
+// rewritten. WebSocket handshakes are passed through, since their
+// connection is taken over rather than answered.
+func JSONCase(camel bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", JSONCaseHeader)
+
+			if r.Body != nil && isJSON(r.Header.Get("Content-Type")) {
+				body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBufferedBodySize))
+				r.Body.Close()
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					apierror.Write(w, r, apierror.CodeRequestTooLarge, "Request body too large")
+					return
+				}
+				if err != nil {
+					apierror.Write(w, r, apierror.CodeInvalidRequest, "Failed to read request body")
+					return
+				}
+				if rewritten, ok := rewriteKeys(body, camelToSnake); ok {
+					body = rewritten
+					r.ContentLength = int64(len(body))
+					r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+
+			if isWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			switch strings.ToLower(r.Header.Get(JSONCaseHeader)) {
+			case "camel":
+			case "snake":
+				next.ServeHTTP(w, r)
+				return
+			default:
+				if !camel {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			cw := &caseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(cw, r)
+			cw.finish()
+		})
+	}
+}
+
+// caseWriter buffers a response so its JSON keys can be rewritten, until
+// the handler flushes it.
+type caseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	buf        bytes.Buffer
+	// streaming is set once the handler has flushed; writes then go
+	// straight to ResponseWriter.
+	streaming bool
+}
+
+func (cw *caseWriter) WriteHeader(code int) {
+	if !cw.streaming {
+		cw.statusCode = code
+	}
+}
+
+func (cw *caseWriter) Write(p []byte) (int, error) {
+	if cw.streaming {
+		return cw.ResponseWriter.Write(p)
+	}
+	return cw.buf.Write(p)
+}
+
+// Flush sends what has been buffered, unchanged, and stops buffering.
+func (cw *caseWriter) Flush() {
+	if !cw.streaming {
+		cw.streaming = true
+		cw.ResponseWriter.WriteHeader(cw.statusCode)
+		cw.ResponseWriter.Write(cw.buf.Bytes())
+		cw.buf.Reset()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *caseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// finish writes the buffered response, rewritten if it is JSON, unless it
+// has been streamed.
+func (cw *caseWriter) finish() {
+	if cw.streaming {
+		return
+	}
+	body := cw.buf.Bytes()
+	if isJSON(cw.Header().Get("Content-Type")) {
+		if rewritten, ok := rewriteKeys(body, snakeToCamel); ok {
+			body = rewritten
+			cw.Header().Del("Content-Length")
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.statusCode)
+	cw.ResponseWriter.Write(body)
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// rewriteKeys renames every object key in the JSON document body with
+// rename. It reports false, leaving body to be used as-is, if body is not
+// JSON or no key changed.
+func rewriteKeys(body []byte, rename func(string) string) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, false
+	}
+
+	changed := false
+	doc = renameKeys(doc, rename, &changed)
+	if !changed {
+		return nil, false
+	}
+
+	rewritten, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false
+	}
+	if bytes.HasSuffix(body, []byte("\n")) {
+		rewritten = append(rewritten, '\n')
+	}
+	return rewritten, true
+}
+
+func renameKeys(v interface{}, rename func(string) string, changed *bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			newKey := rename(key)
+			if newKey != key {
+				*changed = true
+			}
+			renamed[newKey] = renameKeys(value, rename, changed)
+		}
+		return renamed
+	case []interface{}:
+		for i, value := range v {
+			v[i] = renameKeys(value, rename, changed)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// snakeToCamel turns access_token into accessToken.
+func snakeToCamel(key string) string {
+	if !strings.Contains(key, "_") {
+		return key
+	}
+	parts := strings.Split(key, "_")
+	var b strings.Builder
+	b.WriteString(parts[0])
+	for _, part := range parts[1:] {
+		if part == "" {
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+// camelToSnake turns accessToken into access_token, and treats a run of
+// capitals as one word: userID becomes user_id.
+func camelToSnake(key string) string {
+	if strings.IndexFunc(key, unicode.IsUpper) < 0 {
+		return key
+	}
+	runes := []rune(key)
+	var b strings.Builder
+	for i, c := range runes {
+		if unicode.IsUpper(c) {
+			if i > 0 && (!unicode.IsUpper(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) && runes[i-1] != '_' {
+				b.WriteByte('_')
+			}
+			c = unicode.ToLower(c)
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONCaseRewritesKeys(t *testing.T) {
+	handler := JSONCase(true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"refresh_token":"x"}` {
+			t.Errorf("handler read body %s, want snake_case keys", body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"y"}`))
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"refreshToken":"x"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Body.String(); got != `{"accessToken":"y"}` {
+		t.Errorf("response = %s, want camelCase keys", got)
+	}
+}
+
+func TestJSONCaseBodyTooLarge(t *testing.T) {
+	handler := JSONCase(false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler called with an oversized body")
+	}))
+
+	body := `{"name":"` + strings.Repeat("a", maxBufferedBodySize) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", rec.Code)
+	}
+	var resp struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Error.Code != "REQUEST_TOO_LARGE" {
+		t.Errorf("response = %s, want REQUEST_TOO_LARGE", rec.Body)
+	}
+}
+
+func TestJSONCaseStreamsFlushedResponses(t *testing.T) {
+	received := make(chan struct{})
+	handler := JSONCase(true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"first_page":[1]`))
+		http.NewResponseController(w).Flush()
+
+		// The rest is only written once the client has the first part.
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Error("client did not receive the flushed part before the response ended")
+		}
+		w.Write([]byte(`,"second_page":[2]}` + "\n"))
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	first := make([]byte, len(`{"first_page":[1]`))
+	if _, err := io.ReadFull(reader, first); err != nil {
+		t.Fatalf("reading the flushed part: %v", err)
+	}
+	close(received)
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading the rest: %v", err)
+	}
+
+	// A streamed document cannot be rewritten, so its keys are as written.
+	if got := string(first) + string(rest); got != `{"first_page":[1],"second_page":[2]}`+"\n" {
+		t.Errorf("response = %s, want it unchanged", got)
+	}
+}
@@ -1,27 +1,55 @@
 package middleware
 
 import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
 	"net/http"
+	"net/netip"
 	"time"
 
+	"github.com/qcom/qcom/internal/logging"
 	"github.com/sirupsen/logrus"
 )
 
-func LoggingMiddleware(logger *logrus.Logger) func(http.Handler) http.Handler {
+// RequestIDHeader carries the request ID. A well-formed ID sent by the
+// client or an upstream proxy is kept; otherwise a new one is generated.
+// The ID is echoed on the response.
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 64
+
+// LoggingMiddleware attaches a request-scoped logger carrying the request ID,
+// method, path and client IP to the request context, and logs each request
+// once it completes.
+func LoggingMiddleware(logger *logrus.Logger, trustedProxies []netip.Prefix) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 
+			requestID := r.Header.Get(RequestIDHeader)
+			if !isValidRequestID(requestID) {
+				requestID = newRequestID()
+			}
+			w.Header().Set(RequestIDHeader, requestID)
+
+			entry := logger.WithFields(logrus.Fields{
+				"request_id": requestID,
+				"method":     r.Method,
+				"scheme":     Scheme(r, trustedProxies),
+				"path":       r.URL.Path,
+				"client_ip":  ClientIP(r, trustedProxies),
+			})
+
 			// Create a response writer wrapper to capture status code
 			wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 
-			next.ServeHTTP(wrapped, r)
+			next.ServeHTTP(wrapped, r.WithContext(logging.WithLogger(r.Context(), entry)))
 
 			duration := time.Since(start)
 
-			logger.WithFields(logrus.Fields{
-				"method":      r.Method,
-				"path":        r.URL.Path,
+			entry.WithFields(logrus.Fields{
 				"status":      wrapped.statusCode,
 				"duration":    duration,
 				"remote_addr": r.RemoteAddr,
@@ -30,6 +58,30 @@ func LoggingMiddleware(logger *logrus.Logger) func(http.Handler) http.Handler {
 	}
 }
 
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// isValidRequestID accepts short IDs made of characters that are safe to
+// write to logs and headers unescaped.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
@@ -39,3 +91,24 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Flush passes through to the underlying writer, so streamed responses are
+// not held back.
+func (rw *responseWriter) Flush() {
+	http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Hijack hands the connection to a WebSocket handler, recording the
+// response as 101 Switching Protocols.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil {
+		rw.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qcom/qcom/internal/logging"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestLoggingMiddlewareRequestID(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	var handlerFields logrus.Fields
+	handler := LoggingMiddleware(logger, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerFields = logging.LoggerFromContext(r.Context(), logger).Data
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	for _, tc := range []struct {
+		sent string
+		keep bool
+	}{
+		{"", false},
+		{"req-1.a_B", true},
+		{"bad id\n", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	} {
+		hook.Reset()
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/me", nil)
+		if tc.sent != "" {
+			r.Header.Set(RequestIDHeader, tc.sent)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		id := rec.Header().Get(RequestIDHeader)
+		if tc.keep && id != tc.sent || !tc.keep && (id == tc.sent || !isValidRequestID(id)) {
+			t.Errorf("request ID %q became %q", tc.sent, id)
+		}
+		if handlerFields["request_id"] != id || handlerFields["path"] != "/api/v1/me" {
+			t.Errorf("handler logged with %v, want the request ID and path", handlerFields)
+		}
+		entry := hook.LastEntry()
+		if entry == nil || entry.Data["request_id"] != id || entry.Data["status"] != http.StatusTeapot {
+			t.Errorf("request logged as %+v, want its ID and status", entry)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/qcom/qcom/internal/apierror"
+	"github.com/qcom/qcom/internal/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// maintenanceStateTTL is how long an instance trusts its copy of the
+// maintenance flag before reading it again, and so how long a toggle takes
+// to reach every instance.
+const maintenanceStateTTL = 5 * time.Second
+
+// Maintenance holds the maintenance flag shared by every instance through
+// DynamoDB. It can be flipped at runtime, e.g. from an admin endpoint, and
+// only affects requests that arrive afterwards. Until it is first set, the
+// configured default applies.
+type Maintenance struct {
+	repo       *repository.MaintenanceRepository
+	retryAfter time.Duration
+	exempt     []string
+	logger     *logrus.Logger
+
+	mu        sync.Mutex
+	enabled   bool
+	fetchedAt time.Time
+}
+
+// NewMaintenance returns a Maintenance whose flag defaults to enabled. While
+// enabled, requests to any path other than the exempt ones are rejected
+// with a Retry-After of retryAfter.
+func NewMaintenance(repo *repository.MaintenanceRepository, enabled bool, retryAfter time.Duration, logger *logrus.Logger, exempt ...string) *Maintenance {
+	return &Maintenance{
+		repo:       repo,
+		retryAfter: retryAfter,
+		exempt:     exempt,
+		logger:     logger,
+		enabled:    enabled,
+	}
+}
+
+// Enabled reports whether maintenance is enabled, reading the flag from
+// DynamoDB when the copy held is older than maintenanceStateTTL or fresh is
+// set. If the read fails, the last known state is returned with the error.
+func (m *Maintenance) Enabled(ctx context.Context, fresh bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !fresh && !m.fetchedAt.IsZero() && time.Since(m.fetchedAt) < maintenanceStateTTL {
+		return m.enabled, nil
+	}
+
+	// A failed read is not retried until the TTL is up either, so an
+	// outage does not add a failing read to every request.
+	m.fetchedAt = time.Now()
+	enabled, ok, err := m.repo.Get(ctx)
+	if err != nil {
+		return m.enabled, err
+	}
+	if ok {
+		m.enabled = enabled
+	}
+	return m.enabled, nil
+}
+
+// SetEnabled turns maintenance on or off for every instance.
+func (m *Maintenance) SetEnabled(ctx context.Context, enabled bool) error {
+	if err := m.repo.Set(ctx, enabled); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.enabled, m.fetchedAt = enabled, time.Now()
+	m.mu.Unlock()
+	return nil
+}
+
+// Middleware responds 503 MAINTENANCE while maintenance is enabled. If the
+// flag cannot be read, the last known state applies.
+func (m *Maintenance) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(m.exempt, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		enabled, err := m.Enabled(r.Context(), false)
+		if err != nil {
+			m.logger.WithError(err).Error("Failed to read maintenance flag")
+		}
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(m.retryAfter.Seconds())))
+		apierror.Write(w, r, apierror.CodeMaintenance, "Service is down for maintenance")
+	})
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qcom/qcom/internal/dynamotest"
+	"github.com/qcom/qcom/internal/repository"
+)
+
+// maintenanceOn returns a Maintenance storing its flag in db's main table,
+// standing in for one server instance.
+func maintenanceOn(db *dynamotest.DB, enabled bool) *Maintenance {
+	repo := repository.NewMaintenanceRepository(db.Client(), db.Table("main"), repository.KeySchema{PK: "PK", SK: "SK"}, testLogger())
+	return NewMaintenance(repo, enabled, time.Minute, testLogger(), "/health")
+}
+
+func serveMaintenance(m *Maintenance, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	m.Middleware(okHandler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestMaintenanceDefaultsToConfig(t *testing.T) {
+	db := dynamotest.New(t)
+	db.CreateTable("main", "PK", "SK")
+
+	rec := serveMaintenance(maintenanceOn(db, true), "/api/v1/me")
+	if rec.Code != http.StatusServiceUnavailable || responseCode(t, rec) != "MAINTENANCE" {
+		t.Errorf("request while starting in maintenance = %d, want 503 MAINTENANCE", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("Retry-After = %q, want 60", rec.Header().Get("Retry-After"))
+	}
+	if rec := serveMaintenance(maintenanceOn(db, true), "/health"); rec.Code != http.StatusNoContent {
+		t.Errorf("exempt path during maintenance = %d, want 204", rec.Code)
+	}
+	if rec := serveMaintenance(maintenanceOn(db, false), "/api/v1/me"); rec.Code != http.StatusNoContent {
+		t.Errorf("request without maintenance = %d, want 204", rec.Code)
+	}
+}
+
+func TestMaintenanceToggleReachesOtherInstances(t *testing.T) {
+	db := dynamotest.New(t)
+	db.CreateTable("main", "PK", "SK")
+	toggled, other := maintenanceOn(db, false), maintenanceOn(db, true)
+	ctx := context.Background()
+
+	if err := toggled.SetEnabled(ctx, true); err != nil {
+		t.Fatalf("SetEnabled: %v", err)
+	}
+	if enabled, err := other.Enabled(ctx, false); !enabled || err != nil {
+		t.Errorf("Enabled on another instance = %v, %v, want true", enabled, err)
+	}
+
+	// The stored flag overrides the configured default.
+	if err := toggled.SetEnabled(ctx, false); err != nil {
+		t.Fatalf("SetEnabled: %v", err)
+	}
+	if enabled, err := other.Enabled(ctx, true); enabled || err != nil {
+		t.Errorf("Enabled on an instance started in maintenance = %v, %v, want false", enabled, err)
+	}
+	if rec := serveMaintenance(maintenanceOn(db, true), "/api/v1/me"); rec.Code != http.StatusNoContent {
+		t.Errorf("request after maintenance was turned off = %d, want 204", rec.Code)
+	}
+}
+
+func TestMaintenanceKeepsLastStateWhenUnreadable(t *testing.T) {
+	db := dynamotest.New(t)
+	// The main table does not exist, so the flag cannot be read.
+	m := maintenanceOn(db, true)
+
+	if enabled, err := m.Enabled(context.Background(), true); !enabled || err == nil {
+		t.Errorf("Enabled without a table = %v, %v, want the configured true and an error", enabled, err)
+	}
+	if rec := serveMaintenance(m, "/api/v1/me"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("request with the flag unreadable = %d, want 503", rec.Code)
+	}
+}
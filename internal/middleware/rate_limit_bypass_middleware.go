@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/netip"
+
+	"github.com/qcom/qcom/internal/service"
+)
+
+// ServiceKeyHeader carries an allowlisted service's API key.
+const ServiceKeyHeader = "X-Service-Key"
+
+// RateLimitBypass exempts internal services from the per-phone rate limits.
+// A request qualifies with one of keys in the X-Service-Key header, or when
+// its client IP, as resolved by ClientIP through the trusted proxies, is in
+// cidrs. Requests that don't qualify, including ones with a wrong key, are
+// passed on unchanged and limited as usual.
+func RateLimitBypass(keys []string, cidrs, trusted []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if caller := bypassCaller(r, keys, cidrs, trusted); caller != "" {
+				r = r.WithContext(service.WithRateLimitBypass(r.Context(), caller))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bypassCaller names the allowlist entry r matches, or returns "" when it
+// matches none. Keys are identified by position so they never reach logs.
+func bypassCaller(r *http.Request, keys []string, cidrs, trusted []netip.Prefix) string {
+	if provided := r.Header.Get(ServiceKeyHeader); provided != "" {
+		for i, key := range keys {
+			if subtle.ConstantTimeCompare([]byte(provided), []byte(key)) == 1 {
+				return fmt.Sprintf("key#%d", i+1)
+			}
+		}
+	}
+
+	client, err := netip.ParseAddr(ClientIP(r, trusted))
+	if err != nil {
+		return ""
+	}
+	for _, prefix := range cidrs {
+		if prefix.Contains(client) {
+			return "cidr:" + prefix.String()
+		}
+	}
+	return ""
+}
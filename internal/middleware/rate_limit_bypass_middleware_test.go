@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestBypassCaller(t *testing.T) {
+	keys := []string{"service-key-1", "service-key-2"}
+	cidrs := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name       string
+		key        string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"second key", "service-key-2", "203.0.113.7:1234", "", "key#2"},
+		{"wrong key", "service-key-3", "203.0.113.7:1234", "", ""},
+		{"allowlisted network", "", "192.0.2.7:1234", "", "cidr:192.0.2.0/24"},
+		{"wrong key from an allowlisted network", "guess", "192.0.2.7:1234", "", "cidr:192.0.2.0/24"},
+		{"allowlisted client behind a trusted proxy", "", "10.0.0.5:1234", "192.0.2.7", "cidr:192.0.2.0/24"},
+		{"untrusted peer spoofing an allowlisted client", "", "203.0.113.7:1234", "192.0.2.7", ""},
+		{"normal caller", "", "203.0.113.7:1234", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/auth/initiate-otp", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.key != "" {
+				r.Header.Set(ServiceKeyHeader, tt.key)
+			}
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := bypassCaller(r, keys, cidrs, trusted); got != tt.want {
+				t.Errorf("bypassCaller = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Scheme returns the scheme ("http" or "https") the client used to reach the
+// service. Behind a TLS-terminating proxy the connection is plain HTTP, so
+// X-Forwarded-Proto is consulted, but only when the immediate peer is a
+// trusted proxy; otherwise a client could claim https over plain HTTP.
+func Scheme(r *http.Request, trusted []netip.Prefix) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	if peer := remoteAddr(r); peer.IsValid() && inPrefixes(peer, trusted) {
+		// A chain of proxies may each append a value; the first is the
+		// one facing the client.
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if strings.EqualFold(strings.TrimSpace(proto), "https") {
+			return "https"
+		}
+	}
+	return "http"
+}
+
+// SecureCookies reports whether cookies set in response to r should carry
+// the Secure flag. force sets it regardless of how the request arrived, for
+// deployments whose proxies don't send X-Forwarded-Proto.
+func SecureCookies(r *http.Request, trusted []netip.Prefix, force bool) bool {
+	return force || Scheme(r, trusted) == "https"
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestScheme(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		proto      string
+		tls        bool
+		want       string
+	}{
+		{"direct HTTP", "203.0.113.7:1234", "", false, "http"},
+		{"direct TLS", "203.0.113.7:1234", "", true, "https"},
+		{"proxied HTTPS", "10.0.0.5:1234", "https", false, "https"},
+		{"proxied HTTPS, proxy chain", "10.0.0.5:1234", "https, http", false, "https"},
+		{"proxied HTTP", "10.0.0.5:1234", "http", false, "http"},
+		{"untrusted peer claiming HTTPS", "203.0.113.7:1234", "https", false, "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if got := Scheme(r, trusted); got != tt.want {
+				t.Errorf("Scheme = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecureCookies(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.7:1234"
+
+	if SecureCookies(r, nil, false) {
+		t.Error("SecureCookies over direct HTTP = true, want false")
+	}
+	if !SecureCookies(r, nil, true) {
+		t.Error("SecureCookies with force = false, want true")
+	}
+}
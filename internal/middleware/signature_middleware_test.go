@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSigningSecret = "signing-secret"
+
+// signedHandler returns SignatureMiddleware around a handler that echoes
+// the body it receives.
+func signedHandler() http.Handler {
+	return SignatureMiddleware(testSigningSecret, 5*time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+}
+
+func signedRequest(method, target, body string, at time.Time) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, ComputeSignature(testSigningSecret, method, req.URL.RequestURI(), timestamp, []byte(body)))
+	return req
+}
+
+func TestSignatureMiddlewareValid(t *testing.T) {
+	rec := httptest.NewRecorder()
+	signedHandler().ServeHTTP(rec, signedRequest(http.MethodPost, "/admin/purge?phone=x", `{"a":1}`, time.Now()))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if rec.Body.String() != `{"a":1}` {
+		t.Errorf("handler read body %q, want the signed body", rec.Body)
+	}
+}
+
+func TestSignatureMiddlewareRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*http.Request) *http.Request
+		status int
+	}{
+		{"tampered body", func(r *http.Request) *http.Request {
+			r.Body = io.NopCloser(strings.NewReader(`{"a":2}`))
+			return r
+		}, http.StatusUnauthorized},
+		{"tampered query", func(r *http.Request) *http.Request {
+			r.URL.RawQuery = "phone=y"
+			return r
+		}, http.StatusUnauthorized},
+		{"wrong method", func(r *http.Request) *http.Request {
+			r.Method = http.MethodDelete
+			return r
+		}, http.StatusUnauthorized},
+		{"missing signature", func(r *http.Request) *http.Request {
+			r.Header.Del(SignatureHeader)
+			return r
+		}, http.StatusUnauthorized},
+		{"expired timestamp", func(*http.Request) *http.Request {
+			return signedRequest(http.MethodPost, "/admin/purge?phone=x", `{"a":1}`, time.Now().Add(-6*time.Minute))
+		}, http.StatusUnauthorized},
+		{"future timestamp", func(*http.Request) *http.Request {
+			return signedRequest(http.MethodPost, "/admin/purge?phone=x", `{"a":1}`, time.Now().Add(6*time.Minute))
+		}, http.StatusUnauthorized},
+		{"oversized body", func(*http.Request) *http.Request {
+			return signedRequest(http.MethodPost, "/admin/purge?phone=x", strings.Repeat("a", maxBufferedBodySize+1), time.Now())
+		}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.modify(signedRequest(http.MethodPost, "/admin/purge?phone=x", `{"a":1}`, time.Now()))
+			rec := httptest.NewRecorder()
+			signedHandler().ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
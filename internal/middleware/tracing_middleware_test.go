@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qcom/qcom/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider that records every ended span for
+// the duration of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+	return recorder
+}
+
+func TestTracingMiddlewareSpanHierarchy(t *testing.T) {
+	recorder := recordSpans(t)
+
+	handler := TracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := tracing.StartDynamoDBSpan(r.Context(), "GetItem", "otps")
+		span.End()
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentID = "00f067aa0ba902b7"
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	db, server := spans[0], spans[1]
+
+	if server.Name() != "GET /health" || server.SpanKind() != trace.SpanKindServer {
+		t.Errorf("server span = %q (%v), want server span \"GET /health\"", server.Name(), server.SpanKind())
+	}
+	if got := server.SpanContext().TraceID().String(); got != traceID {
+		t.Errorf("server span trace ID = %s, want the incoming %s", got, traceID)
+	}
+	if got := server.Parent().SpanID().String(); got != parentID || !server.Parent().IsRemote() {
+		t.Errorf("server span parent = %s (remote %v), want remote %s", got, server.Parent().IsRemote(), parentID)
+	}
+
+	if db.Name() != "DynamoDB.GetItem" || db.SpanKind() != trace.SpanKindClient {
+		t.Errorf("handler span = %q (%v), want client span \"DynamoDB.GetItem\"", db.Name(), db.SpanKind())
+	}
+	if db.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("DynamoDB span parent = %s, want the server span %s", db.Parent().SpanID(), server.SpanContext().SpanID())
+	}
+
+	var status int64
+	for _, attr := range server.Attributes() {
+		if attr.Key == "http.response.status_code" {
+			status = attr.Value.AsInt64()
+		}
+	}
+	if status != http.StatusTeapot {
+		t.Errorf("http.response.status_code = %d, want %d", status, http.StatusTeapot)
+	}
+}
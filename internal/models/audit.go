@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+type AuditEvent struct {
+	Phone     string    `json:"phone"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AuditFilter struct {
+	EventType string
+	From      time.Time
+	To        time.Time
+	Limit     int
+	Cursor    string
+}
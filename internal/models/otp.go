@@ -8,4 +8,14 @@ type OTPData struct {
 	Attempts  int       `json:"attempts"`
 	CreatedAt time.Time `json:"created_at"`
 	ExpiresAt time.Time `json:"expires_at"`
+	// FirstCreatedAt is when the first of a run of resent OTPs, which
+	// carry their attempts over, was created. OTPs stored before it was
+	// recorded have none.
+	FirstCreatedAt time.Time `json:"first_created_at,omitempty"`
+	// Nonce must accompany verification when nonces are required; it is
+	// consumed with the OTP.
+	Nonce string `json:"nonce,omitempty"`
+	// PepperVersion identifies the pepper mixed into OTPHash. OTPs stored
+	// before it was recorded have none.
+	PepperVersion string `json:"pepper_version,omitempty"`
 }
@@ -0,0 +1,22 @@
+package models
+
+// Page is the envelope of every paginated list response. NextCursor is
+// opaque and URL-safe; it is passed back as the cursor parameter to get the
+// following page, and is empty on the last one.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	Count      int    `json:"count"`
+}
+
+// NewPage returns a page of items. Items is never null in JSON.
+func NewPage[T any](items []T, nextCursor string) *Page[T] {
+	if items == nil {
+		items = []T{}
+	}
+	return &Page[T]{
+		Items:      items,
+		NextCursor: nextCursor,
+		Count:      len(items),
+	}
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPageEnvelope(t *testing.T) {
+	tests := []struct {
+		name string
+		page *Page[string]
+		want string
+	}{
+		{"items and cursor", NewPage([]string{"a", "b"}, "next"), `{"items":["a","b"],"next_cursor":"next","count":2}`},
+		{"last page", NewPage([]string{"a"}, ""), `{"items":["a"],"count":1}`},
+		{"no items", NewPage[string](nil, ""), `{"items":[],"count":0}`},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.page)
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", tt.name, err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: page = %s, want %s", tt.name, data, tt.want)
+		}
+	}
+}
@@ -4,9 +4,12 @@ import "time"
 
 type TokenPair struct {
 	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 	TokenType    string `json:"token_type"`
 	ExpiresIn    int64  `json:"expires_in"`
+	// RefreshExpiresIn is the refresh token's remaining lifetime in
+	// seconds, matching the expiry it is stored with.
+	RefreshExpiresIn int64 `json:"refresh_expires_in,omitempty"`
 }
 
 type RefreshTokenData struct {
@@ -17,4 +20,28 @@ type RefreshTokenData struct {
 	CreatedAt time.Time `json:"created_at"`
 	ExpiresAt time.Time `json:"expires_at"`
 	Revoked   bool      `json:"revoked"`
+	// RefreshCount is how many rotations led to this token since the
+	// family was issued at login.
+	RefreshCount int `json:"refresh_count"`
+	// PushToken is the push notification token of the device the session
+	// was signed in on, if it sent one.
+	PushToken string `json:"push_token,omitempty"`
+}
+
+// RefreshTokenReplacement identifies the refresh token issued when another
+// was rotated, kept briefly so a retried rotation can be told from reuse.
+// It holds no tokens; a retry is answered with newly issued ones.
+type RefreshTokenReplacement struct {
+	JTI       string    `json:"jti"`
+	FamilyID  string    `json:"family_id"`
+	RotatedAt time.Time `json:"rotated_at"`
+}
+
+// TokenRevocation is the stored state that can revoke an otherwise valid
+// token: the epochs of its phone number and of all tokens, and whether its
+// JTI has been revoked individually.
+type TokenRevocation struct {
+	UserEpoch   time.Time
+	GlobalEpoch time.Time
+	Revoked     bool
 }
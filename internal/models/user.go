@@ -5,10 +5,17 @@ import (
 )
 
 type User struct {
+	// UserID is a stable identifier used as the JWT subject. Unlike the
+	// phone number it never changes.
+	UserID      string    `json:"user_id" dynamodbav:"user_id"`
 	PhoneNumber string    `json:"phone_number" dynamodbav:"phone_number"`
 	Name        string    `json:"name,omitempty" dynamodbav:"name,omitempty"`
 	CreatedAt   time.Time `json:"created_at" dynamodbav:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at" dynamodbav:"updated_at"`
+	// Version is incremented by every update, which only succeeds if the
+	// stored version is still the one read. Users created before versioning
+	// have version 0 until their first update.
+	Version int64 `json:"version" dynamodbav:"version"`
 }
 
 func (u *User) GetPK() string {
@@ -0,0 +1,100 @@
+package phone
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ErrInvalid is returned by Parse for a number that is not valid E.164
+	// once formatting is removed.
+	ErrInvalid = errors.New("invalid phone number")
+
+	// ErrHasExtension is returned by Parse for an otherwise valid number
+	// that has an extension, since SMS cannot be delivered to one.
+	ErrHasExtension = errors.New("phone number has an extension")
+)
+
+var e164Pattern = regexp.MustCompile(`^\+[1-9]\d{1,14}$`)
+
+// extensionPattern matches a trailing extension in the usual notations:
+// "ext. 89", "extension 89", "x89", "#89", ",89" and RFC 3966 ";ext=89".
+var extensionPattern = regexp.MustCompile(`(?i)^(.*?)\s*(?:;\s*ext\s*=|,|#|ext(?:ension)?\.?|x)\s*\d+$`)
+
+// formatting is removed from numbers by Normalize.
+var formatting = strings.NewReplacer(" ", "", "\t", "", "-", "", ".", "", "(", "", ")", "", "/", "")
+
+// Normalize removes whitespace and the separators commonly used to format
+// numbers, such as in "+1 (555) 123-4567", and ensures the number starts
+// with "+".
+func Normalize(phoneNumber string) string {
+	phoneNumber = formatting.Replace(strings.TrimSpace(phoneNumber))
+	if !strings.HasPrefix(phoneNumber, "+") {
+		phoneNumber = "+" + phoneNumber
+	}
+	return phoneNumber
+}
+
+// Parse normalizes and validates user input. It returns ErrHasExtension,
+// rather than ErrInvalid, for a valid number followed by an extension, so
+// callers can tell the user why it was refused.
+func Parse(input string) (string, error) {
+	phoneNumber := Normalize(input)
+	if IsValid(phoneNumber) {
+		return phoneNumber, nil
+	}
+
+	if m := extensionPattern.FindStringSubmatch(strings.TrimSpace(input)); m != nil && IsValid(Normalize(m[1])) {
+		return "", ErrHasExtension
+	}
+	return "", ErrInvalid
+}
+
+// IsValid reports whether phoneNumber is in E.164 format:
+// +[country code][number], at most 15 digits after the +.
+func IsValid(phoneNumber string) bool {
+	return e164Pattern.MatchString(phoneNumber)
+}
+
+// CountryCode returns the ITU calling code of an E.164 number without the
+// leading "+", e.g. "254" for "+254712345678". Calling codes are prefix-free,
+// so at most one of the 1-, 2- and 3-digit prefixes can match.
+func CountryCode(phoneNumber string) (string, bool) {
+	digits := strings.TrimPrefix(phoneNumber, "+")
+	for n := 1; n <= 3 && n <= len(digits); n++ {
+		if callingCodes[digits[:n]] {
+			return digits[:n], true
+		}
+	}
+	return "", false
+}
+
+var callingCodes = func() map[string]bool {
+	codes := strings.Fields(`
+		1 7
+		20 27 30 31 32 33 34 36 39 40 41 43 44 45 46 47 48 49
+		51 52 53 54 55 56 57 58 60 61 62 63 64 65 66 81 82 84 86
+		90 91 92 93 94 95 98
+		211 212 213 216 218 220 221 222 223 224 225 226 227 228 229
+		230 231 232 233 234 235 236 237 238 239 240 241 242 243 244
+		245 246 247 248 249 250 251 252 253 254 255 256 257 258 260
+		261 262 263 264 265 266 267 268 269 290 291 297 298 299
+		350 351 352 353 354 355 356 357 358 359 370 371 372 373 374
+		375 376 377 378 379 380 381 382 383 385 386 387 389
+		420 421 423
+		500 501 502 503 504 505 506 507 508 509
+		590 591 592 593 594 595 596 597 598 599
+		670 672 673 674 675 676 677 678 679 680 681 682 683 685 686
+		687 688 689 690 691 692
+		800 808 850 852 853 855 856 870 878 880 881 882 883 886 888
+		960 961 962 963 964 965 966 967 968 970 971 972 973 974 975
+		976 977 979 992 993 994 995 996 998
+	`)
+
+	m := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		m[code] = true
+	}
+	return m
+}()
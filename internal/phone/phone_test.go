@@ -0,0 +1,136 @@
+package phone
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// trickyNumbers seeds the fuzz targets with inputs that have tripped up
+// phone number validators: lookalike digits, invisible and bidi characters,
+// embedded nulls and newlines, extensions and overlong numbers.
+var trickyNumbers = []string{
+	"+15551234567",
+	"+1 (555) 123-4567",
+	"15551234567",
+	"+254712345678",
+	"+1555123456789012",
+	"+" + strings.Repeat("1", 15),
+	"+" + strings.Repeat("1", 16),
+	strings.Repeat("9", 1000),
+	"+",
+	"",
+	" ",
+	"+0123456789",
+	"++15551234567",
+	"+1555\x001234567",
+	"+15551234567\x00",
+	"+15551234567\n",
+	"+15551234567\n+15557654321",
+	"+١٥٥٥١٢٣٤٥٦٧",
+	"+１５５５１２３４５６７",
+	"+1555​1234567",
+	"‮+15551234567",
+	"+1555 1234567",
+	"+15551234567 ext. 89",
+	"+15551234567;ext=89",
+	"+15551234567 x" + strings.Repeat("9", 1000),
+	"+15551234567#",
+	"\xff\xfe+15551234567",
+}
+
+func FuzzIsValidPhoneNumber(f *testing.F) {
+	for _, seed := range trickyNumbers {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		if !IsValid(input) {
+			return
+		}
+		digits, ok := strings.CutPrefix(input, "+")
+		if !ok || len(digits) < 2 || len(digits) > 15 || digits[0] == '0' {
+			t.Fatalf("IsValid(%q) = true for a number outside E.164", input)
+		}
+		for i := 0; i < len(digits); i++ {
+			if digits[i] < '0' || digits[i] > '9' {
+				t.Fatalf("IsValid(%q) = true with non-digit byte %q", input, digits[i])
+			}
+		}
+	})
+}
+
+func FuzzNormalizePhone(f *testing.F) {
+	for _, seed := range trickyNumbers {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		if normalized := Normalize(input); !strings.HasPrefix(normalized, "+") {
+			t.Fatalf("Normalize(%q) = %q, want a leading +", input, normalized)
+		}
+
+		number, err := Parse(input)
+		if err != nil {
+			if number != "" {
+				t.Fatalf("Parse(%q) returned %q along with %v", input, number, err)
+			}
+			return
+		}
+		if !IsValid(number) {
+			t.Fatalf("Parse(%q) = %q, which is not valid E.164", input, number)
+		}
+		if again, err := Parse(number); err != nil || again != number {
+			t.Fatalf("Parse(%q) = %q, %v, want the number unchanged", number, again, err)
+		}
+	})
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		err   error
+	}{
+		{"+15551234567", "+15551234567", nil},
+		{"+1 (555) 123-4567", "+15551234567", nil},
+		{"+1-555-123-4567", "+15551234567", nil},
+		{"+1.555.123.4567", "+15551234567", nil},
+		{" 15551234567 ", "+15551234567", nil},
+		{"+1-555-123-4567 ext. 89", "", ErrHasExtension},
+		{"+15551234567 extension 89", "", ErrHasExtension},
+		{"+15551234567 EXT 89", "", ErrHasExtension},
+		{"+15551234567x89", "", ErrHasExtension},
+		{"+15551234567 #89", "", ErrHasExtension},
+		{"+15551234567,89", "", ErrHasExtension},
+		{"+15551234567;ext=89", "", ErrHasExtension},
+		{"+0555123 ext. 89", "", ErrInvalid},
+		{"+15551234567 ext.", "", ErrInvalid},
+		{"not a number", "", ErrInvalid},
+		{"", "", ErrInvalid},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.input)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("Parse(%q) = %q, %v, want %q, %v", tt.input, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestCountryCode(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string
+		known  bool
+	}{
+		{"+15551234567", "1", true},
+		{"+447700900123", "44", true},
+		{"+254712345678", "254", true},
+		{"+79991234567", "7", true},
+		{"+2801234567", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got, known := CountryCode(tt.number); got != tt.want || known != tt.known {
+			t.Errorf("CountryCode(%q) = %q, %v, want %q, %v", tt.number, got, known, tt.want, tt.known)
+		}
+	}
+}
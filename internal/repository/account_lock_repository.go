@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// AccountLockRepository stores account lockouts and the refresh token reuse
+// detections that lead to them, both per phone number.
+type AccountLockRepository struct {
+	client    *dynamodb.Client
+	tableName string
+	keys      KeySchema
+	logger    *logrus.Logger
+}
+
+func NewAccountLockRepository(client *dynamodb.Client, tableName string, keys KeySchema, logger *logrus.Logger) *AccountLockRepository {
+	return &AccountLockRepository{
+		client:    client,
+		tableName: tableName,
+		keys:      keys,
+		logger:    logger,
+	}
+}
+
+// RecordReuse counts a refresh token reuse detection for phoneNumber and
+// returns how many there have been in the current window. Windows are
+// consecutive intervals of the given length, so the count restarts at each
+// window boundary.
+func (r *AccountLockRepository) RecordReuse(ctx context.Context, phoneNumber string, window time.Duration) (int, error) {
+	now := time.Now()
+	start := now.Truncate(window)
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "UpdateItem", r.tableName)
+	result, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(r.tableName),
+		Key:                      r.keys.key(fmt.Sprintf("REUSE_DETECTIONS#%s", phoneNumber), strconv.FormatInt(start.Unix(), 10)),
+		UpdateExpression:         aws.String("ADD Detections :one SET #ttl = :ttl"),
+		ExpressionAttributeNames: map[string]string{"#ttl": "TTL"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":ttl": &types.AttributeValueMemberN{Value: strconv.FormatInt(start.Add(window).Unix(), 10)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to record refresh token reuse: %w", err)
+	}
+
+	detections, ok := result.Attributes["Detections"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("failed to read reuse detections")
+	}
+	count, err := strconv.Atoi(detections.Value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse reuse detections: %w", err)
+	}
+	return count, nil
+}
+
+// Lock locks phoneNumber's account until until, or until it is unlocked
+// when until is zero.
+func (r *AccountLockRepository) Lock(ctx context.Context, phoneNumber string, until time.Time) error {
+	attrs := map[string]types.AttributeValue{
+		"LockedAt": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+	}
+	if !until.IsZero() {
+		attrs["LockedUntil"] = &types.AttributeValueMemberS{Value: until.Format(time.RFC3339)}
+		attrs["TTL"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(until.Unix(), 10)}
+	}
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "PutItem", r.tableName)
+	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item:      r.keys.item(fmt.Sprintf("ACCOUNT_LOCK#%s", phoneNumber), "METADATA", attrs),
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return fmt.Errorf("failed to lock account: %w", err)
+	}
+	return nil
+}
+
+// Get reports whether phoneNumber's account is locked and until when; the
+// time is zero for a lock that lasts until it is unlocked. DynamoDB deletes
+// expired items only eventually, so expiry is checked here.
+func (r *AccountLockRepository) Get(ctx context.Context, phoneNumber string) (bool, time.Time, error) {
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "GetItem", r.tableName)
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       r.keys.key(fmt.Sprintf("ACCOUNT_LOCK#%s", phoneNumber), "METADATA"),
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("failed to get account lock: %w", err)
+	}
+	if result.Item == nil {
+		return false, time.Time{}, nil
+	}
+
+	lockedUntil, ok := result.Item["LockedUntil"].(*types.AttributeValueMemberS)
+	if !ok {
+		return true, time.Time{}, nil
+	}
+	until, err := time.Parse(time.RFC3339, lockedUntil.Value)
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("malformed account lock: %w", err)
+	}
+	return time.Now().Before(until), until, nil
+}
+
+// Unlock removes any lock on phoneNumber's account. It is idempotent.
+func (r *AccountLockRepository) Unlock(ctx context.Context, phoneNumber string) error {
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "DeleteItem", r.tableName)
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       r.keys.key(fmt.Sprintf("ACCOUNT_LOCK#%s", phoneNumber), "METADATA"),
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return fmt.Errorf("failed to unlock account: %w", err)
+	}
+	return nil
+}
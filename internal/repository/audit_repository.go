@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/models"
+	"github.com/qcom/qcom/internal/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// auditRetention is how long audit entries are kept before TTL expiry
+	auditRetention = 90 * 24 * time.Hour
+
+	// auditTimeFormat is fixed-width so that sort keys order chronologically
+	auditTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+	DefaultAuditPageSize = 25
+	MaxAuditPageSize     = 100
+)
+
+type AuditRepository struct {
+	client    *dynamodb.Client
+	tableName string
+	keys      KeySchema
+	logger    *logrus.Logger
+}
+
+func NewAuditRepository(client *dynamodb.Client, tableName string, keys KeySchema, logger *logrus.Logger) *AuditRepository {
+	return &AuditRepository{
+		client:    client,
+		tableName: tableName,
+		keys:      keys,
+		logger:    logger,
+	}
+}
+
+// Query returns audit events for a phone number, newest first, narrowed by
+// the filter's time range and event type.
+func (r *AuditRepository) Query(ctx context.Context, phoneNumber string, filter models.AuditFilter) (*models.Page[models.AuditEvent], error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultAuditPageSize
+	}
+	if limit > MaxAuditPageSize {
+		limit = MaxAuditPageSize
+	}
+
+	from := "0"
+	if !filter.From.IsZero() {
+		from = filter.From.UTC().Format(auditTimeFormat)
+	}
+	to := "~"
+	if !filter.To.IsZero() {
+		// "~" sorts after "#", so events at exactly To are included
+		to = filter.To.UTC().Format(auditTimeFormat) + "~"
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(r.tableName),
+		KeyConditionExpression: aws.String("#pk = :pk AND #sk BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]string{
+			"#pk": r.keys.PK,
+			"#sk": r.keys.SK,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":   &types.AttributeValueMemberS{Value: fmt.Sprintf("AUDIT#%s", phoneNumber)},
+			":from": &types.AttributeValueMemberS{Value: from},
+			":to":   &types.AttributeValueMemberS{Value: to},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(int32(limit)),
+	}
+
+	if filter.EventType != "" {
+		input.FilterExpression = aws.String("Event = :event")
+		input.ExpressionAttributeValues[":event"] = &types.AttributeValueMemberS{Value: filter.EventType}
+	}
+
+	if filter.Cursor != "" {
+		startKey, err := decodeAuditCursor(r.keys, filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		input.ExclusiveStartKey = startKey
+	}
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "Query", r.tableName)
+	result, err := r.client.Query(ctx, input)
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		r.logger.WithError(err).Error("Failed to query audit events from DynamoDB")
+		return nil, fmt.Errorf("failed to query audit events: %w", err)
+	}
+
+	var events []models.AuditEvent
+	for _, item := range result.Items {
+		var event models.AuditEvent
+		if err := attributevalue.UnmarshalMap(item, &event); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal audit event: %w", err)
+		}
+		events = append(events, event)
+	}
+
+	var nextCursor string
+	if len(result.LastEvaluatedKey) > 0 {
+		nextCursor = encodeAuditCursor(r.keys, result.LastEvaluatedKey)
+	}
+
+	return models.NewPage(events, nextCursor), nil
+}
+
+func auditItem(keys KeySchema, phoneNumber, event string, at time.Time) map[string]types.AttributeValue {
+	pk := fmt.Sprintf("AUDIT#%s", phoneNumber)
+	sk := fmt.Sprintf("%s#%s", at.UTC().Format(auditTimeFormat), event)
+
+	return keys.item(pk, sk, map[string]types.AttributeValue{
+		"Event":     &types.AttributeValueMemberS{Value: event},
+		"Phone":     &types.AttributeValueMemberS{Value: phoneNumber},
+		"CreatedAt": &types.AttributeValueMemberS{Value: at.Format(time.RFC3339)},
+		"TTL":       &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", at.Add(auditRetention).Unix())},
+	})
+}
+
+// Cursors always store the key values under "PK" and "SK", whatever the
+// table's key attributes are called.
+func encodeAuditCursor(keys KeySchema, key map[string]types.AttributeValue) string {
+	cursor := map[string]string{}
+	for name, attr := range map[string]string{"PK": keys.PK, "SK": keys.SK} {
+		if value, ok := key[attr].(*types.AttributeValueMemberS); ok {
+			cursor[name] = value.Value
+		}
+	}
+
+	return encodeCursor(cursor)
+}
+
+func decodeAuditCursor(keys KeySchema, cursor string) (map[string]types.AttributeValue, error) {
+	var values map[string]string
+	if err := decodeCursor(cursor, &values); err != nil {
+		return nil, err
+	}
+	if values["PK"] == "" || values["SK"] == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	return keys.key(values["PK"], values["SK"]), nil
+}
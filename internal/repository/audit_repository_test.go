@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/qcom/qcom/internal/models"
+)
+
+// auditEvents are written a minute apart, oldest first, starting at
+// auditStart.
+var (
+	auditStart  = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	auditEvents = []string{"otp_generated", "otp_verified", "otp_generated", "otp_generated", "otp_verified"}
+)
+
+func newTestAuditRepository(t *testing.T) *AuditRepository {
+	t.Helper()
+	_, db := newTestOTPRepository(t)
+	for i, event := range auditEvents {
+		_, err := db.Client().PutItem(context.Background(), &dynamodb.PutItemInput{
+			TableName: aws.String(db.Table("audit")),
+			Item:      auditItem(testKeys, "+15551234567", event, auditStart.Add(time.Duration(i)*time.Minute)),
+		})
+		if err != nil {
+			t.Fatalf("PutItem: %v", err)
+		}
+	}
+	_, err := db.Client().PutItem(context.Background(), &dynamodb.PutItemInput{
+		TableName: aws.String(db.Table("audit")),
+		Item:      auditItem(testKeys, "+15557654321", "otp_generated", auditStart),
+	})
+	if err != nil {
+		t.Fatalf("PutItem: %v", err)
+	}
+	return NewAuditRepository(db.Client(), db.Table("audit"), testKeys, testLogger())
+}
+
+// minutes returns how many minutes after auditStart each event was written.
+func minutes(events []models.AuditEvent) []int {
+	offsets := make([]int, len(events))
+	for i, event := range events {
+		offsets[i] = int(event.CreatedAt.Sub(auditStart) / time.Minute)
+	}
+	return offsets
+}
+
+func TestAuditQuery(t *testing.T) {
+	repo := newTestAuditRepository(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		filter models.AuditFilter
+		want   []int
+	}{
+		{"all, newest first", models.AuditFilter{}, []int{4, 3, 2, 1, 0}},
+		{"event type", models.AuditFilter{EventType: "otp_verified"}, []int{4, 1}},
+		{"from", models.AuditFilter{From: auditStart.Add(3 * time.Minute)}, []int{4, 3}},
+		{"to, inclusive", models.AuditFilter{To: auditStart.Add(time.Minute)}, []int{1, 0}},
+		{"range and type", models.AuditFilter{From: auditStart.Add(time.Minute), To: auditStart.Add(3 * time.Minute), EventType: "otp_generated"}, []int{3, 2}},
+	}
+	for _, tt := range tests {
+		page, err := repo.Query(ctx, "+15551234567", tt.filter)
+		if err != nil {
+			t.Fatalf("%s: Query: %v", tt.name, err)
+		}
+		if got := minutes(page.Items); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: events at minutes %v, want %v", tt.name, got, tt.want)
+		}
+		for _, event := range page.Items {
+			if event.Phone != "+15551234567" {
+				t.Errorf("%s: returned an event of %s", tt.name, event.Phone)
+			}
+		}
+	}
+}
+
+// Following the cursor visits every event once, in order.
+func TestAuditQueryPages(t *testing.T) {
+	repo := newTestAuditRepository(t)
+	ctx := context.Background()
+
+	var got []int
+	filter := models.AuditFilter{Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > len(auditEvents) {
+			t.Fatal("cursor never ran out")
+		}
+		page, err := repo.Query(ctx, "+15551234567", filter)
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		if page.Count > 2 || page.Count != len(page.Items) {
+			t.Fatalf("page has count %d and %d items, want at most 2", page.Count, len(page.Items))
+		}
+		got = append(got, minutes(page.Items)...)
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+	if want := []int{4, 3, 2, 1, 0}; !slices.Equal(got, want) {
+		t.Errorf("paged through events at minutes %v, want %v", got, want)
+	}
+}
+
+func TestAuditQueryInvalidCursor(t *testing.T) {
+	repo := newTestAuditRepository(t)
+
+	for _, cursor := range []string{"not base64!", "bm90IGpzb24", encodeCursor(map[string]string{"PK": "AUDIT#+15551234567"})} {
+		_, err := repo.Query(context.Background(), "+15551234567", models.AuditFilter{Cursor: cursor})
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("Query with cursor %q = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// encodeCursor turns a repository's pagination state into an opaque,
+// URL-safe cursor.
+func encodeCursor(state interface{}) string {
+	data, _ := json.Marshal(state)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reverses encodeCursor, returning ErrInvalidCursor for
+// anything it did not produce.
+func decodeCursor(cursor string, state interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
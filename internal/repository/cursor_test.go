@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	type state struct {
+		PK, SK string
+	}
+	want := state{PK: "AUDIT#+15551234567", SK: "2026-01-02T03:04:05Z/+?&="}
+
+	cursor := encodeCursor(want)
+	if url.QueryEscape(cursor) != cursor {
+		t.Errorf("cursor %q is not URL-safe", cursor)
+	}
+	var got state
+	if err := decodeCursor(cursor, &got); err != nil || got != want {
+		t.Errorf("decodeCursor = %+v, %v, want %+v", got, err, want)
+	}
+
+	for _, bad := range []string{"not base64!", "bm90IGpzb24", ""} {
+		if err := decodeCursor(bad, &got); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("decodeCursor(%q) = %v, want ErrInvalidCursor", bad, err)
+		}
+	}
+}
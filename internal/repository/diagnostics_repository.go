@@ -0,0 +1,139 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/models"
+	"github.com/qcom/qcom/internal/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultDiagnosticPageSize = 25
+	MaxDiagnosticPageSize     = 100
+)
+
+// ErrUnknownQuery is returned by Run for a query name that is not defined.
+var ErrUnknownQuery = errors.New("unknown diagnostic query")
+
+// diagnosticQuery is a PartiQL SELECT on a single partition. Only the key
+// value is supplied by the caller, and always as a statement parameter.
+type diagnosticQuery struct {
+	// param is the request parameter carrying the key value.
+	param      string
+	table      string
+	pkPrefix   string
+	projection string
+}
+
+// DiagnosticsRepository runs a fixed set of named read-only queries for
+// admin investigations. Each one looks up a single partition, so it runs
+// as a Query rather than a Scan. Projections leave out OTP hashes, nonces
+// and user names.
+type DiagnosticsRepository struct {
+	client  *dynamodb.Client
+	keys    KeySchema
+	queries map[string]diagnosticQuery
+	logger  *logrus.Logger
+}
+
+func NewDiagnosticsRepository(client *dynamodb.Client, usersTable, tokensTable, otpTable string, keys KeySchema, logger *logrus.Logger) *DiagnosticsRepository {
+	return &DiagnosticsRepository{
+		client: client,
+		keys:   keys,
+		queries: map[string]diagnosticQuery{
+			"user":          {param: "phone", table: usersTable, pkPrefix: "USER!", projection: `"user_id", "created_at", "updated_at"`},
+			"otp":           {param: "phone", table: otpTable, pkPrefix: "OTP#", projection: `"Phone", "Attempts", "CreatedAt", "ExpiresAt"`},
+			"refresh_token": {param: "jti", table: tokensTable, pkPrefix: "REFRESH_TOKEN#", projection: "*"},
+			"token_family":  {param: "family_id", table: tokensTable, pkPrefix: "TOKEN_FAMILY#", projection: "*"},
+			"user_tokens":   {param: "user_id", table: tokensTable, pkPrefix: "USER_TOKENS#", projection: "*"},
+
+			"user_push_tokens": {param: "user_id", table: tokensTable, pkPrefix: "USER_PUSH_TOKENS#", projection: "*"},
+		},
+		logger: logger,
+	}
+}
+
+// QueryNames returns the names of the defined queries, sorted.
+func (r *DiagnosticsRepository) QueryNames() []string {
+	names := make([]string, 0, len(r.queries))
+	for name := range r.queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// QueryParam returns the request parameter holding the key value for the
+// named query.
+func (r *DiagnosticsRepository) QueryParam(name string) (string, bool) {
+	q, ok := r.queries[name]
+	return q.param, ok
+}
+
+// Run executes the named query for value. limit is clamped to
+// MaxDiagnosticPageSize, and cursor is a previous page's NextCursor.
+func (r *DiagnosticsRepository) Run(ctx context.Context, name, value string, limit int, cursor string) (*models.Page[map[string]interface{}], error) {
+	q, ok := r.queries[name]
+	if !ok {
+		return nil, ErrUnknownQuery
+	}
+
+	if limit <= 0 {
+		limit = DefaultDiagnosticPageSize
+	}
+	if limit > MaxDiagnosticPageSize {
+		limit = MaxDiagnosticPageSize
+	}
+
+	input := &dynamodb.ExecuteStatementInput{
+		Statement: aws.String(fmt.Sprintf(`SELECT %s FROM "%s" WHERE "%s" = ?`, q.projection, q.table, r.keys.PK)),
+		Parameters: []types.AttributeValue{
+			&types.AttributeValueMemberS{Value: q.pkPrefix + value},
+		},
+		Limit: aws.Int32(int32(limit)),
+	}
+	if cursor != "" {
+		var state diagnosticCursor
+		if err := decodeCursor(cursor, &state); err != nil || state.NextToken == "" {
+			return nil, ErrInvalidCursor
+		}
+		input.NextToken = aws.String(state.NextToken)
+	}
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "ExecuteStatement", q.table)
+	result, err := r.client.ExecuteStatement(ctx, input)
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to run diagnostic query %s: %w", name, err)
+	}
+
+	var items []map[string]interface{}
+	for _, item := range result.Items {
+		var decoded map[string]interface{}
+		if err := attributevalue.UnmarshalMap(item, &decoded); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal diagnostic query result: %w", err)
+		}
+		items = append(items, decoded)
+	}
+
+	var nextCursor string
+	if result.NextToken != nil {
+		nextCursor = encodeCursor(diagnosticCursor{NextToken: *result.NextToken})
+	}
+
+	return models.NewPage(items, nextCursor), nil
+}
+
+// diagnosticCursor wraps a PartiQL NextToken, which is not URL-safe.
+type diagnosticCursor struct {
+	NextToken string `json:"t"`
+}
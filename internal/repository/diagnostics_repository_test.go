@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/qcom/qcom/internal/dynamotest"
+	"github.com/qcom/qcom/internal/models"
+)
+
+// newTestDiagnosticsRepository stores a user, an OTP and a family of
+// refresh tokens for +15551234567 and returns a repository over them.
+func newTestDiagnosticsRepository(t *testing.T) *DiagnosticsRepository {
+	t.Helper()
+	db := dynamotest.New(t)
+	for _, table := range []string{"users", "tokens", "otps", "audit"} {
+		db.CreateTable(table, testKeys.PK, testKeys.SK)
+	}
+	ctx := context.Background()
+
+	users := NewUserRepository(db.Client(), db.Table("users"), testKeys, true, 3, nil, testLogger())
+	if err := users.Create(ctx, &models.User{UserID: "user-1", PhoneNumber: "+15551234567", Name: "Ada"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	otps := NewOTPRepository(db.Client(), db.Table("otps"), db.Table("audit"), testKeys, testLogger())
+	if err := otps.Store(ctx, "+15551234567", testOTP("+15551234567")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	tokens := NewRefreshTokenRepository(db.Client(), db.Table("tokens"), testKeys, testLogger())
+	storeFamily(t, tokens, "family-a", 5)
+
+	return NewDiagnosticsRepository(db.Client(), db.Table("users"), db.Table("tokens"), db.Table("otps"), testKeys, testLogger())
+}
+
+func TestDiagnosticQueries(t *testing.T) {
+	repo := newTestDiagnosticsRepository(t)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name, value string
+		want        int
+		hidden      string
+	}{
+		{"user", "+15551234567", 1, "name"},
+		{"otp", "+15551234567", 1, "OTPHash"},
+		{"refresh_token", "family-a-002", 1, ""},
+		{"token_family", "family-a", 5, ""},
+		{"user_tokens", "user-1", 5, ""},
+		{"user", "+15557654321", 0, ""},
+	} {
+		page, err := repo.Run(ctx, tc.name, tc.value, 0, "")
+		if err != nil {
+			t.Fatalf("Run(%s, %s): %v", tc.name, tc.value, err)
+		}
+		if len(page.Items) != tc.want {
+			t.Errorf("Run(%s, %s) returned %d items, want %d", tc.name, tc.value, len(page.Items), tc.want)
+		}
+		for _, item := range page.Items {
+			if _, ok := item[tc.hidden]; ok {
+				t.Errorf("Run(%s) returned %s", tc.name, tc.hidden)
+			}
+		}
+	}
+}
+
+// Following the cursor visits each item once.
+func TestDiagnosticQueryPages(t *testing.T) {
+	repo := newTestDiagnosticsRepository(t)
+
+	seen := map[string]bool{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("cursor never ran out")
+		}
+		page, err := repo.Run(context.Background(), "token_family", "family-a", 2, cursor)
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		if len(page.Items) > 2 {
+			t.Fatalf("page has %d items, want at most 2", len(page.Items))
+		}
+		for _, item := range page.Items {
+			jti := fmt.Sprint(item["JTI"])
+			if seen[jti] {
+				t.Errorf("%s returned twice", jti)
+			}
+			seen[jti] = true
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 5 {
+		t.Errorf("paged through %d members, want 5", len(seen))
+	}
+}
+
+func TestDiagnosticQueryUnknown(t *testing.T) {
+	repo := NewDiagnosticsRepository(nil, "users", "tokens", "otps", testKeys, testLogger())
+
+	if _, err := repo.Run(context.Background(), "DELETE FROM users", "", 0, ""); !errors.Is(err, ErrUnknownQuery) {
+		t.Errorf("Run of an unknown query = %v, want ErrUnknownQuery", err)
+	}
+	if _, err := repo.Run(context.Background(), "user", "+15551234567", 0, "not base64!"); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Run with a malformed cursor = %v, want ErrInvalidCursor", err)
+	}
+	if _, ok := repo.QueryParam("scan"); ok {
+		t.Error("QueryParam found an undefined query")
+	}
+	if names := repo.QueryNames(); len(names) == 0 || names[0] > names[len(names)-1] {
+		t.Errorf("QueryNames = %v, want the defined queries sorted", names)
+	}
+}
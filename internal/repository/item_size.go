@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// maxItemSize is DynamoDB's limit on the size of an item.
+const maxItemSize = 400 * 1024
+
+// ErrItemTooLarge is returned, before anything is sent to DynamoDB, for a
+// write that would exceed its item size limit.
+var ErrItemTooLarge = errors.New("item exceeds the DynamoDB item size limit")
+
+// checkItemSize returns ErrItemTooLarge if attrs are larger than an item
+// may be. For an update, attrs are only the attributes being set, so a
+// passing check does not guarantee the whole item fits.
+func checkItemSize(attrs map[string]types.AttributeValue) error {
+	if size := itemSize(attrs); size > maxItemSize {
+		return fmt.Errorf("%w: %d bytes", ErrItemTooLarge, size)
+	}
+	return nil
+}
+
+// itemSize estimates the size DynamoDB counts for attrs: the length of each
+// attribute name plus the size of its value. Numbers are counted at their
+// string length, which is never less than DynamoDB's count.
+func itemSize(attrs map[string]types.AttributeValue) int {
+	size := 0
+	for name, value := range attrs {
+		size += len(name) + attributeSize(value)
+	}
+	return size
+}
+
+func attributeSize(value types.AttributeValue) int {
+	switch v := value.(type) {
+	case *types.AttributeValueMemberS:
+		return len(v.Value)
+	case *types.AttributeValueMemberN:
+		return len(v.Value)
+	case *types.AttributeValueMemberB:
+		return len(v.Value)
+	case *types.AttributeValueMemberBOOL, *types.AttributeValueMemberNULL:
+		return 1
+	case *types.AttributeValueMemberSS:
+		size := 0
+		for _, s := range v.Value {
+			size += len(s)
+		}
+		return size
+	case *types.AttributeValueMemberNS:
+		size := 0
+		for _, n := range v.Value {
+			size += len(n)
+		}
+		return size
+	case *types.AttributeValueMemberBS:
+		size := 0
+		for _, b := range v.Value {
+			size += len(b)
+		}
+		return size
+	case *types.AttributeValueMemberL:
+		// Lists and maps cost 3 bytes, plus 1 per element.
+		size := 3
+		for _, element := range v.Value {
+			size += 1 + attributeSize(element)
+		}
+		return size
+	case *types.AttributeValueMemberM:
+		return 3 + len(v.Value) + itemSize(v.Value)
+	default:
+		return 0
+	}
+}
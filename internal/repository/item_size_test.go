@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/models"
+)
+
+func TestItemSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs map[string]types.AttributeValue
+		want  int
+	}{
+		{"string", map[string]types.AttributeValue{"name": &types.AttributeValueMemberS{Value: "Ada"}}, 4 + 3},
+		{"number", map[string]types.AttributeValue{"TTL": &types.AttributeValueMemberN{Value: "1767225600"}}, 3 + 10},
+		{"bool", map[string]types.AttributeValue{"Revoked": &types.AttributeValueMemberBOOL{Value: true}}, 7 + 1},
+		{"string set", map[string]types.AttributeValue{"SS": &types.AttributeValueMemberSS{Value: []string{"ab", "cde"}}}, 2 + 5},
+		{"list", map[string]types.AttributeValue{"L": &types.AttributeValueMemberL{Value: []types.AttributeValue{
+			&types.AttributeValueMemberS{Value: "ab"},
+			&types.AttributeValueMemberN{Value: "1"},
+		}}}, 1 + 3 + (1 + 2) + (1 + 1)},
+		{"map", map[string]types.AttributeValue{"M": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"k": &types.AttributeValueMemberS{Value: "v"},
+		}}}, 1 + 3 + 1 + (1 + 1)},
+	}
+	for _, tt := range tests {
+		if got := itemSize(tt.attrs); got != tt.want {
+			t.Errorf("%s: itemSize = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// oversizedName fills a user record past the item size limit on its own.
+var oversizedName = strings.Repeat("a", maxItemSize)
+
+func TestCreateRejectsOversizedUser(t *testing.T) {
+	repo, db := newTestUserRepository(t)
+	ctx := context.Background()
+
+	err := repo.Create(ctx, &models.User{PhoneNumber: "+15551234567", Name: oversizedName})
+	if !errors.Is(err, ErrItemTooLarge) {
+		t.Fatalf("Create with an oversized name = %v, want ErrItemTooLarge", err)
+	}
+	if n := db.Len("users"); n != 0 {
+		t.Errorf("users table has %d items after the refused write, want 0", n)
+	}
+}
+
+func TestUpdateRejectsOversizedName(t *testing.T) {
+	repo, _ := newTestUserRepository(t)
+	ctx := context.Background()
+
+	user := &models.User{PhoneNumber: "+15551234567", Name: "Ada"}
+	if err := repo.Create(ctx, user); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	user.Name = oversizedName
+	if err := repo.Update(ctx, user); !errors.Is(err, ErrItemTooLarge) {
+		t.Fatalf("Update with an oversized name = %v, want ErrItemTooLarge", err)
+	}
+	stored, err := repo.GetByPhoneNumber(ctx, "+15551234567")
+	if err != nil || stored.Name != "Ada" || stored.Version != 1 {
+		t.Errorf("stored user after the refused update = %+v, %v, want it unchanged", stored, err)
+	}
+}
+
+// An oversized item in a transaction refuses the whole transaction.
+func TestTransactWriteRejectsOversizedItem(t *testing.T) {
+	repo, db := newTestOTPRepository(t)
+	ctx := context.Background()
+
+	otp := testOTP("+15551234567")
+	otp.OTPHash = strings.Repeat("h", maxItemSize)
+	if err := repo.StoreWithAudit(ctx, "+15551234567", otp, "OTP_ISSUED"); !errors.Is(err, ErrItemTooLarge) {
+		t.Fatalf("StoreWithAudit with an oversized OTP = %v, want ErrItemTooLarge", err)
+	}
+	if n := db.Len("otps") + db.Len("audit"); n != 0 {
+		t.Errorf("%d items written by the refused transaction, want 0", n)
+	}
+}
@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// KeySchema names the partition and sort key attributes of the table, so
+// the service can reuse an existing table whose keys aren't called PK/SK.
+type KeySchema struct {
+	PK string
+	SK string
+}
+
+// key returns the primary key with the given partition and sort key values.
+func (k KeySchema) key(pk, sk string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		k.PK: &types.AttributeValueMemberS{Value: pk},
+		k.SK: &types.AttributeValueMemberS{Value: sk},
+	}
+}
+
+// item adds the primary key attributes to attrs and returns it.
+func (k KeySchema) item(pk, sk string, attrs map[string]types.AttributeValue) map[string]types.AttributeValue {
+	attrs[k.PK] = &types.AttributeValueMemberS{Value: pk}
+	attrs[k.SK] = &types.AttributeValueMemberS{Value: sk}
+	return attrs
+}
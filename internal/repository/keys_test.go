@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/qcom/qcom/internal/dynamotest"
+	"github.com/qcom/qcom/internal/models"
+)
+
+// The repositories work on a table whose keys aren't called PK and SK.
+func TestCustomKeySchema(t *testing.T) {
+	keys := KeySchema{PK: "id", SK: "kind"}
+	db := dynamotest.New(t)
+	db.CreateTable("main", keys.PK, keys.SK)
+	client, table := db.Client(), db.Table("main")
+	ctx := context.Background()
+
+	users := NewUserRepository(client, table, keys, true, 3, nil, testLogger())
+	if err := users.Create(ctx, &models.User{PhoneNumber: "+15551234567", Name: "Ada"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if user, err := users.GetByPhoneNumber(ctx, "+15551234567"); err != nil || user == nil || user.Name != "Ada" {
+		t.Errorf("GetByPhoneNumber = %v, %v, want Ada", user, err)
+	}
+
+	otps := NewOTPRepository(client, table, table, keys, testLogger())
+	if err := otps.StoreWithAudit(ctx, "+15551234567", testOTP("+15551234567"), "OTP_ISSUED"); err != nil {
+		t.Fatalf("StoreWithAudit: %v", err)
+	}
+	if otp, err := otps.Get(ctx, "+15551234567"); err != nil || otp.OTPHash != "hash" {
+		t.Errorf("Get = %v, %v, want the stored OTP", otp, err)
+	}
+
+	tokens := NewRefreshTokenRepository(client, table, keys, testLogger())
+	jtis := storeFamily(t, tokens, "family-a", 2)
+	if family, err := tokens.GetByFamilyID(ctx, "family-a"); err != nil || len(family) != len(jtis) {
+		t.Errorf("GetByFamilyID = %v, %v, want %d tokens", family, err, len(jtis))
+	}
+}
@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/qcom/qcom/internal/metrics"
+)
+
+// WithLatencyMetrics records the latency of every DynamoDB operation,
+// retries included, with metrics.ObserveDynamoDBOp. It runs after the SDK's
+// own initialize steps, which put the operation name in the context.
+func WithLatencyMetrics() func(*dynamodb.Options) {
+	return func(o *dynamodb.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("LatencyMetrics", func(
+				ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+			) (middleware.InitializeOutput, middleware.Metadata, error) {
+				start := time.Now()
+				out, metadata, err := next.HandleInitialize(ctx, in)
+				metrics.ObserveDynamoDBOp(awsmiddleware.GetOperationName(ctx), time.Since(start))
+				return out, metadata, err
+			}), middleware.After)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// MaintenanceRepository stores the maintenance flag shared by every
+// instance.
+type MaintenanceRepository struct {
+	client    *dynamodb.Client
+	tableName string
+	keys      KeySchema
+	logger    *logrus.Logger
+}
+
+func NewMaintenanceRepository(client *dynamodb.Client, tableName string, keys KeySchema, logger *logrus.Logger) *MaintenanceRepository {
+	return &MaintenanceRepository{
+		client:    client,
+		tableName: tableName,
+		keys:      keys,
+		logger:    logger,
+	}
+}
+
+// Get returns the stored maintenance flag. ok is false if it has never been
+// set.
+func (r *MaintenanceRepository) Get(ctx context.Context) (enabled, ok bool, err error) {
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "GetItem", r.tableName)
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(r.tableName),
+		Key:            r.keys.key("MAINTENANCE", "STATE"),
+		ConsistentRead: aws.Bool(true),
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return false, false, fmt.Errorf("failed to get maintenance flag: %w", err)
+	}
+	if result.Item == nil {
+		return false, false, nil
+	}
+
+	attr, ok := result.Item["Enabled"].(*types.AttributeValueMemberBOOL)
+	if !ok {
+		return false, false, fmt.Errorf("malformed maintenance flag")
+	}
+	return attr.Value, true, nil
+}
+
+// Set stores the maintenance flag.
+func (r *MaintenanceRepository) Set(ctx context.Context, enabled bool) error {
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "PutItem", r.tableName)
+	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item: r.keys.item("MAINTENANCE", "STATE", map[string]types.AttributeValue{
+			"Enabled":   &types.AttributeValueMemberBOOL{Value: enabled},
+			"UpdatedAt": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+		}),
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return fmt.Errorf("failed to store maintenance flag: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/tracing"
+)
+
+// ErrPepperStateChanged is returned by SwapPepperState when the stored state
+// no longer has the expected current version, or its previous version is
+// still accepted.
+var ErrPepperStateChanged = errors.New("OTP pepper state changed")
+
+// PepperState records which OTP pepper every instance hashes new OTPs with,
+// and which one it replaced. Only pepper versions are stored, never the
+// peppers themselves.
+type PepperState struct {
+	CurrentVersion  string
+	PreviousVersion string
+	// PreviousUntil is when OTPs hashed with PreviousVersion stop being
+	// accepted.
+	PreviousUntil time.Time
+}
+
+// GetPepperState returns the stored pepper state, or nil if the pepper has
+// never been rotated.
+func (r *OTPRepository) GetPepperState(ctx context.Context) (*PepperState, error) {
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "GetItem", r.tableName)
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(r.tableName),
+		Key:            r.keys.key("OTP_PEPPER", "STATE"),
+		ConsistentRead: aws.Bool(true),
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get OTP pepper state: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	current, ok := result.Item["CurrentVersion"].(*types.AttributeValueMemberS)
+	if !ok {
+		return nil, fmt.Errorf("malformed OTP pepper state: no current version")
+	}
+	state := &PepperState{CurrentVersion: current.Value}
+	if previous, ok := result.Item["PreviousVersion"].(*types.AttributeValueMemberS); ok {
+		state.PreviousVersion = previous.Value
+	}
+	if until, ok := result.Item["PreviousUntil"].(*types.AttributeValueMemberN); ok {
+		seconds, err := strconv.ParseInt(until.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed OTP pepper state: %w", err)
+		}
+		state.PreviousUntil = time.Unix(seconds, 0)
+	}
+	return state, nil
+}
+
+// SwapPepperState replaces the stored pepper state with state, provided its
+// current version is from and the version before that is no longer
+// accepted; with no state stored, from is taken to be current. Otherwise it
+// returns ErrPepperStateChanged, so of two concurrent rotations only one
+// takes effect.
+func (r *OTPRepository) SwapPepperState(ctx context.Context, from string, state PepperState) error {
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "PutItem", r.tableName)
+	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item: r.keys.item("OTP_PEPPER", "STATE", map[string]types.AttributeValue{
+			"CurrentVersion":  &types.AttributeValueMemberS{Value: state.CurrentVersion},
+			"PreviousVersion": &types.AttributeValueMemberS{Value: state.PreviousVersion},
+			"PreviousUntil":   &types.AttributeValueMemberN{Value: strconv.FormatInt(state.PreviousUntil.Unix(), 10)},
+		}),
+		ConditionExpression:      aws.String("attribute_not_exists(#pk) OR (CurrentVersion = :from AND PreviousUntil <= :now)"),
+		ExpressionAttributeNames: map[string]string{"#pk": r.keys.PK},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":from": &types.AttributeValueMemberS{Value: from},
+			":now":  &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return ErrPepperStateChanged
+		}
+		return fmt.Errorf("failed to store OTP pepper state: %w", err)
+	}
+	return nil
+}
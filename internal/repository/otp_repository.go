@@ -2,76 +2,131 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/qcom/qcom/internal/logging"
 	"github.com/qcom/qcom/internal/models"
+	"github.com/qcom/qcom/internal/tracing"
 	"github.com/sirupsen/logrus"
 )
 
+// ErrOTPNotFound is returned by Get when no OTP is stored for the number.
+var ErrOTPNotFound = errors.New("OTP not found or expired")
+
+// ErrNonceMismatch is returned by DeleteWithNonce when the stored OTP has a
+// different nonce or is already gone.
+var ErrNonceMismatch = errors.New("OTP nonce mismatch")
+
+// ErrOTPMismatch is returned by ConsumeIfMatches when the stored OTP exists
+// but could not be consumed, along with the stored OTP.
+var ErrOTPMismatch = errors.New("OTP does not match")
+
+// ErrOTPLocked is returned by IncrementAttempts once the OTP has used all of
+// its attempts.
+var ErrOTPLocked = errors.New("OTP attempts exhausted")
+
 type OTPRepository struct {
 	client    *dynamodb.Client
 	tableName string
-	logger    *logrus.Logger
+	keys      KeySchema
+	// auditTableName is where StoreWithAudit writes its audit entry.
+	auditTableName string
+	logger         *logrus.Logger
 }
 
-func NewOTPRepository(client *dynamodb.Client, tableName string, logger *logrus.Logger) *OTPRepository {
+func NewOTPRepository(client *dynamodb.Client, tableName, auditTableName string, keys KeySchema, logger *logrus.Logger) *OTPRepository {
 	return &OTPRepository{
-		client:    client,
-		tableName: tableName,
-		logger:    logger,
+		client:         client,
+		tableName:      tableName,
+		keys:           keys,
+		auditTableName: auditTableName,
+		logger:         logger,
 	}
 }
 
 // Store stores OTP data in DynamoDB with TTL
 func (r *OTPRepository) Store(ctx context.Context, phoneNumber string, otpData models.OTPData) error {
-	// Calculate TTL (expiration time in Unix seconds)
-	ttl := otpData.ExpiresAt.Unix()
-
-	item := map[string]types.AttributeValue{
-		"PK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("OTP#%s", phoneNumber)},
-		"SK":        &types.AttributeValueMemberS{Value: "METADATA"},
-		"OTPHash":   &types.AttributeValueMemberS{Value: otpData.OTPHash},
-		"Phone":     &types.AttributeValueMemberS{Value: otpData.Phone},
-		"Attempts":  &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", otpData.Attempts)},
-		"CreatedAt": &types.AttributeValueMemberS{Value: otpData.CreatedAt.Format(time.RFC3339)},
-		"ExpiresAt": &types.AttributeValueMemberS{Value: otpData.ExpiresAt.Format(time.RFC3339)},
-		"TTL":       &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", ttl)},
-	}
+	item := otpItem(r.keys, phoneNumber, otpData)
 
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "PutItem", r.tableName)
 	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
 		TableName: aws.String(r.tableName),
 		Item:      item,
 	})
+	tracing.EndSpan(span, err)
 
 	if err != nil {
-		r.logger.WithError(err).Error("Failed to store OTP in DynamoDB")
+		r.logger.WithError(err).WithField("phone", logging.LogPhone(phoneNumber)).Error("Failed to store OTP in DynamoDB")
 		return fmt.Errorf("failed to store OTP: %w", err)
 	}
 
 	return nil
 }
 
+// StoreWithAudit stores OTP data together with an audit entry for event in a
+// single transaction, so the OTP is never stored without its audit record.
+func (r *OTPRepository) StoreWithAudit(ctx context.Context, phoneNumber string, otpData models.OTPData, event string) error {
+	err := transactWrite(ctx, r.client,
+		types.Put{TableName: aws.String(r.tableName), Item: otpItem(r.keys, phoneNumber, otpData)},
+		types.Put{TableName: aws.String(r.auditTableName), Item: auditItem(r.keys, phoneNumber, event, time.Now())},
+	)
+	if err != nil {
+		r.logger.WithError(err).WithField("phone", logging.LogPhone(phoneNumber)).Error("Failed to store OTP with audit entry")
+		return fmt.Errorf("failed to store OTP: %w", err)
+	}
+
+	return nil
+}
+
+func otpItem(keys KeySchema, phoneNumber string, otpData models.OTPData) map[string]types.AttributeValue {
+	// Calculate TTL (expiration time in Unix seconds)
+	ttl := otpData.ExpiresAt.Unix()
+
+	attrs := map[string]types.AttributeValue{
+		"OTPHash":   &types.AttributeValueMemberS{Value: otpData.OTPHash},
+		"Phone":     &types.AttributeValueMemberS{Value: otpData.Phone},
+		"Attempts":  &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", otpData.Attempts)},
+		"CreatedAt": &types.AttributeValueMemberS{Value: otpData.CreatedAt.Format(time.RFC3339)},
+		// In UTC, so ConsumeIfMatches can compare it as a string.
+		"ExpiresAt": &types.AttributeValueMemberS{Value: otpData.ExpiresAt.UTC().Format(time.RFC3339)},
+		"TTL":       &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", ttl)},
+	}
+	if !otpData.FirstCreatedAt.IsZero() {
+		attrs["FirstCreatedAt"] = &types.AttributeValueMemberS{Value: otpData.FirstCreatedAt.Format(time.RFC3339)}
+	}
+	if otpData.PepperVersion != "" {
+		attrs["PepperVersion"] = &types.AttributeValueMemberS{Value: otpData.PepperVersion}
+	}
+	if otpData.Nonce != "" {
+		attrs["Nonce"] = &types.AttributeValueMemberS{Value: otpData.Nonce}
+	}
+
+	return keys.item(fmt.Sprintf("OTP#%s", phoneNumber), "METADATA", attrs)
+}
+
 // Get retrieves OTP data from DynamoDB
 func (r *OTPRepository) Get(ctx context.Context, phoneNumber string) (*models.OTPData, error) {
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "GetItem", r.tableName)
 	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(r.tableName),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("OTP#%s", phoneNumber)},
-			"SK": &types.AttributeValueMemberS{Value: "METADATA"},
-		},
+		Key:       r.keys.key(fmt.Sprintf("OTP#%s", phoneNumber), "METADATA"),
 	})
+	tracing.EndSpan(span, err)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to get OTP: %w", err)
 	}
 
 	if result.Item == nil {
-		return nil, fmt.Errorf("OTP not found or expired")
+		return nil, ErrOTPNotFound
 	}
 
 	var otpData models.OTPData
@@ -82,42 +137,202 @@ func (r *OTPRepository) Get(ctx context.Context, phoneNumber string) (*models.OT
 	return &otpData, nil
 }
 
-// Delete removes OTP data from DynamoDB
-func (r *OTPRepository) Delete(ctx context.Context, phoneNumber string) error {
+// IncrementAttempts atomically increments the attempt counter on the stored
+// OTP and returns the new count. Concurrent callers each see a distinct
+// count, so the attempt limit cannot be bypassed by racing guesses. Once the
+// count reaches maxAttempts the update is refused with ErrOTPLocked, so the
+// counter never runs past the limit.
+func (r *OTPRepository) IncrementAttempts(ctx context.Context, phoneNumber string, maxAttempts int) (int, error) {
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "UpdateItem", r.tableName)
+	result, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(r.tableName),
+		Key:                      r.keys.key(fmt.Sprintf("OTP#%s", phoneNumber), "METADATA"),
+		UpdateExpression:         aws.String("ADD Attempts :one"),
+		ConditionExpression:      aws.String("attribute_exists(#pk) AND (attribute_not_exists(Attempts) OR Attempts < :max)"),
+		ExpressionAttributeNames: map[string]string{"#pk": r.keys.PK},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":max": &types.AttributeValueMemberN{Value: strconv.Itoa(maxAttempts)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+		// Tells a locked OTP apart from a missing one.
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			if conditionFailed.Item != nil {
+				return 0, ErrOTPLocked
+			}
+			return 0, ErrOTPNotFound
+		}
+		return 0, fmt.Errorf("failed to increment OTP attempts: %w", err)
+	}
+
+	attempts, ok := result.Attributes["Attempts"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("failed to read OTP attempts")
+	}
+
+	count, err := strconv.Atoi(attempts.Value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse OTP attempts: %w", err)
+	}
+
+	return count, nil
+}
+
+// ConsumeIfMatches deletes the OTP stored for phoneNumber in a single
+// conditional write, provided its hash is hash, it has not expired, it has
+// attempts left and, when nonce is not empty, its nonce is nonce. Only a
+// deterministic hash, such as the HMAC one, can be matched this way.
+//
+// When the condition fails it returns ErrOTPNotFound, or ErrOTPMismatch with
+// the stored OTP, which the caller should then verify as usual.
+func (r *OTPRepository) ConsumeIfMatches(ctx context.Context, phoneNumber, hash, nonce string, maxAttempts int) (*models.OTPData, error) {
+	// Expiry is checked against ExpiresAt, as VerifyOTP's own check is.
+	// Both sides are RFC 3339 in UTC, so they order as strings.
+	condition := "OTPHash = :hash AND ExpiresAt > :now AND (attribute_not_exists(Attempts) OR Attempts < :max)"
+	values := map[string]types.AttributeValue{
+		":hash": &types.AttributeValueMemberS{Value: hash},
+		":now":  &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		":max":  &types.AttributeValueMemberN{Value: strconv.Itoa(maxAttempts)},
+	}
+	if nonce != "" {
+		condition += " AND Nonce = :nonce"
+		values[":nonce"] = &types.AttributeValueMemberS{Value: nonce}
+	}
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "DeleteItem", r.tableName)
 	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                           aws.String(r.tableName),
+		Key:                                 r.keys.key(fmt.Sprintf("OTP#%s", phoneNumber), "METADATA"),
+		ConditionExpression:                 aws.String(condition),
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if !errors.As(err, &conditionFailed) {
+			return nil, fmt.Errorf("failed to consume OTP: %w", err)
+		}
+		if conditionFailed.Item == nil {
+			return nil, ErrOTPNotFound
+		}
+		var otpData models.OTPData
+		if err := attributevalue.UnmarshalMap(conditionFailed.Item, &otpData); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal OTP data: %w", err)
+		}
+		return &otpData, ErrOTPMismatch
+	}
+
+	return nil, nil
+}
+
+// AcquireGenerationLock takes the lock held for phoneNumber while an OTP is
+// generated and sent, and returns the token that releases it. It returns ""
+// when another caller holds the lock. The lock lapses after ttl, so a holder
+// that crashes blocks the number for at most that long; DynamoDB's TTL
+// deletion is too slow for this, so expiry is checked in the condition.
+func (r *OTPRepository) AcquireGenerationLock(ctx context.Context, phoneNumber string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	token := uuid.New().String()
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "PutItem", r.tableName)
+	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
 		TableName: aws.String(r.tableName),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("OTP#%s", phoneNumber)},
-			"SK": &types.AttributeValueMemberS{Value: "METADATA"},
+		Item: r.keys.item(fmt.Sprintf("OTP_LOCK#%s", phoneNumber), "METADATA", map[string]types.AttributeValue{
+			"Owner":       &types.AttributeValueMemberS{Value: token},
+			"ExpiresAtMs": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(ttl).UnixMilli(), 10)},
+			"TTL":         &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(ttl).Unix()+1, 10)},
+		}),
+		ConditionExpression:      aws.String("attribute_not_exists(#pk) OR ExpiresAtMs < :now"),
+		ExpressionAttributeNames: map[string]string{"#pk": r.keys.PK},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixMilli(), 10)},
 		},
 	})
+	tracing.EndSpan(span, err)
 
 	if err != nil {
-		return fmt.Errorf("failed to delete OTP: %w", err)
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to acquire OTP generation lock: %w", err)
 	}
 
-	return nil
+	return token, nil
 }
 
-// StoreTestOTP stores plain OTP for testing purposes
-func (r *OTPRepository) StoreTestOTP(ctx context.Context, phoneNumber, otp string, expiresAt time.Time) error {
-	ttl := expiresAt.Unix()
+// ReleaseGenerationLock releases a lock taken by AcquireGenerationLock. It
+// does nothing if the lock has since lapsed and been taken by another
+// caller.
+func (r *OTPRepository) ReleaseGenerationLock(ctx context.Context, phoneNumber, token string) error {
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "DeleteItem", r.tableName)
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                aws.String(r.tableName),
+		Key:                      r.keys.key(fmt.Sprintf("OTP_LOCK#%s", phoneNumber), "METADATA"),
+		ConditionExpression:      aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{"#owner": "Owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: token},
+		},
+	})
+	tracing.EndSpan(span, err)
 
-	item := map[string]types.AttributeValue{
-		"PK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("OTP_TEST#%s", phoneNumber)},
-		"SK":        &types.AttributeValueMemberS{Value: "METADATA"},
-		"OTP":       &types.AttributeValueMemberS{Value: otp},
-		"ExpiresAt": &types.AttributeValueMemberS{Value: expiresAt.Format(time.RFC3339)},
-		"TTL":       &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", ttl)},
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return nil
+		}
+		return fmt.Errorf("failed to release OTP generation lock: %w", err)
 	}
 
-	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
+	return nil
+}
+
+// Delete removes OTP data from DynamoDB
+func (r *OTPRepository) Delete(ctx context.Context, phoneNumber string) error {
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "DeleteItem", r.tableName)
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
 		TableName: aws.String(r.tableName),
-		Item:      item,
+		Key:       r.keys.key(fmt.Sprintf("OTP#%s", phoneNumber), "METADATA"),
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return fmt.Errorf("failed to delete OTP: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteWithNonce deletes the OTP only if it still carries nonce, consuming
+// the nonce. Of several concurrent callers with the same nonce, exactly one
+// succeeds; the others get ErrNonceMismatch.
+func (r *OTPRepository) DeleteWithNonce(ctx context.Context, phoneNumber, nonce string) error {
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "DeleteItem", r.tableName)
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(r.tableName),
+		Key:                 r.keys.key(fmt.Sprintf("OTP#%s", phoneNumber), "METADATA"),
+		ConditionExpression: aws.String("Nonce = :nonce"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":nonce": &types.AttributeValueMemberS{Value: nonce},
+		},
 	})
+	tracing.EndSpan(span, err)
 
 	if err != nil {
-		return fmt.Errorf("failed to store test OTP: %w", err)
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return ErrNonceMismatch
+		}
+		return fmt.Errorf("failed to delete OTP: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIncrementAttemptsLocksAtMax(t *testing.T) {
+	repo, _ := newTestOTPRepository(t)
+	ctx := context.Background()
+	if err := repo.Store(ctx, "+15551234567", testOTP("+15551234567")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	for want := 1; want <= 3; want++ {
+		got, err := repo.IncrementAttempts(ctx, "+15551234567", 3)
+		if err != nil || got != want {
+			t.Fatalf("IncrementAttempts = %d, %v, want %d", got, err, want)
+		}
+	}
+	if _, err := repo.IncrementAttempts(ctx, "+15551234567", 3); !errors.Is(err, ErrOTPLocked) {
+		t.Fatalf("IncrementAttempts past the limit = %v, want ErrOTPLocked", err)
+	}
+
+	// The refused attempt is not counted.
+	otpData, err := repo.Get(ctx, "+15551234567")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if otpData.Attempts != 3 {
+		t.Errorf("Attempts = %d after lockout, want 3", otpData.Attempts)
+	}
+}
+
+func TestIncrementAttemptsMissingOTP(t *testing.T) {
+	repo, db := newTestOTPRepository(t)
+
+	_, err := repo.IncrementAttempts(context.Background(), "+15551234567", 3)
+	if !errors.Is(err, ErrOTPNotFound) {
+		t.Fatalf("IncrementAttempts without an OTP = %v, want ErrOTPNotFound", err)
+	}
+	if n := db.Len("otps"); n != 0 {
+		t.Errorf("OTP table has %d items, want 0: the increment created one", n)
+	}
+}
+
+func TestIncrementAttemptsConcurrent(t *testing.T) {
+	repo, _ := newTestOTPRepository(t)
+	ctx := context.Background()
+	if err := repo.Store(ctx, "+15551234567", testOTP("+15551234567")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	const callers, maxAttempts = 20, 5
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		counts = map[int]int{}
+		locked int
+	)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := repo.IncrementAttempts(ctx, "+15551234567", maxAttempts)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, ErrOTPLocked):
+				locked++
+			case err != nil:
+				t.Errorf("IncrementAttempts: %v", err)
+			default:
+				counts[n]++
+			}
+		}()
+	}
+	wg.Wait()
+
+	for n := 1; n <= maxAttempts; n++ {
+		if counts[n] != 1 {
+			t.Errorf("count %d was returned %d times, want once", n, counts[n])
+		}
+	}
+	if len(counts) != maxAttempts || locked != callers-maxAttempts {
+		t.Errorf("%d distinct counts and %d lockouts, want %d and %d", len(counts), locked, maxAttempts, callers-maxAttempts)
+	}
+}
+
+func TestConsumeIfMatchesChecksExpiresAt(t *testing.T) {
+	repo, _ := newTestOTPRepository(t)
+	ctx := context.Background()
+	// Ahead of UTC, so a local-time ExpiresAt would sort after now even
+	// once expired.
+	zone := time.FixedZone("UTC+14", 14*60*60)
+
+	expired := testOTP("+15551234567")
+	expired.ExpiresAt = time.Now().Add(-time.Second).In(zone)
+	if err := repo.Store(ctx, "+15551234567", expired); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if otpData, err := repo.ConsumeIfMatches(ctx, "+15551234567", "hash", "", 3); !errors.Is(err, ErrOTPMismatch) || otpData == nil {
+		t.Errorf("ConsumeIfMatches of an expired OTP = %v, %v, want ErrOTPMismatch with the OTP", otpData, err)
+	}
+
+	pending := testOTP("+15557654321")
+	pending.ExpiresAt = pending.ExpiresAt.In(zone)
+	if err := repo.Store(ctx, "+15557654321", pending); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if _, err := repo.ConsumeIfMatches(ctx, "+15557654321", "hash", "", 3); err != nil {
+		t.Errorf("ConsumeIfMatches of a pending OTP = %v, want nil", err)
+	}
+	if _, err := repo.Get(ctx, "+15557654321"); !errors.Is(err, ErrOTPNotFound) {
+		t.Errorf("Get after ConsumeIfMatches = %v, want ErrOTPNotFound", err)
+	}
+}
+
+func TestGenerationLock(t *testing.T) {
+	repo, _ := newTestOTPRepository(t)
+	ctx := context.Background()
+
+	token, err := repo.AcquireGenerationLock(ctx, "+15551234567", time.Minute)
+	if err != nil || token == "" {
+		t.Fatalf("AcquireGenerationLock = %q, %v, want the lock", token, err)
+	}
+	if other, err := repo.AcquireGenerationLock(ctx, "+15551234567", time.Minute); err != nil || other != "" {
+		t.Fatalf("AcquireGenerationLock while held = %q, %v, want \"\"", other, err)
+	}
+	if other, err := repo.AcquireGenerationLock(ctx, "+15557654321", time.Minute); err != nil || other == "" {
+		t.Errorf("AcquireGenerationLock of another number = %q, %v, want the lock", other, err)
+	}
+
+	// Releasing with someone else's token leaves the lock held.
+	if err := repo.ReleaseGenerationLock(ctx, "+15551234567", "not-the-owner"); err != nil {
+		t.Fatalf("ReleaseGenerationLock: %v", err)
+	}
+	if other, _ := repo.AcquireGenerationLock(ctx, "+15551234567", time.Minute); other != "" {
+		t.Fatal("a release by another caller freed the lock")
+	}
+
+	if err := repo.ReleaseGenerationLock(ctx, "+15551234567", token); err != nil {
+		t.Fatalf("ReleaseGenerationLock: %v", err)
+	}
+	if again, err := repo.AcquireGenerationLock(ctx, "+15551234567", time.Minute); err != nil || again == "" {
+		t.Errorf("AcquireGenerationLock after release = %q, %v, want the lock", again, err)
+	}
+}
+
+// A lock whose holder never released it can be taken once it lapses.
+func TestGenerationLockLapses(t *testing.T) {
+	repo, _ := newTestOTPRepository(t)
+	ctx := context.Background()
+
+	if _, err := repo.AcquireGenerationLock(ctx, "+15551234567", 10*time.Millisecond); err != nil {
+		t.Fatalf("AcquireGenerationLock: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if token, err := repo.AcquireGenerationLock(ctx, "+15551234567", time.Minute); err != nil || token == "" {
+		t.Errorf("AcquireGenerationLock of a lapsed lock = %q, %v, want the lock", token, err)
+	}
+}
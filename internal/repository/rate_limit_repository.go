@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// maxBucketRetries bounds how often Take retries after losing a race with
+// another instance updating the same bucket.
+const maxBucketRetries = 5
+
+// RateLimitRepository stores token buckets in DynamoDB so that every server
+// instance draws from the same buckets.
+type RateLimitRepository struct {
+	client    *dynamodb.Client
+	tableName string
+	keys      KeySchema
+	logger    *logrus.Logger
+}
+
+func NewRateLimitRepository(client *dynamodb.Client, tableName string, keys KeySchema, logger *logrus.Logger) *RateLimitRepository {
+	return &RateLimitRepository{
+		client:    client,
+		tableName: tableName,
+		keys:      keys,
+		logger:    logger,
+	}
+}
+
+// Take removes one token from the bucket named name, which refills at
+// ratePerMinute tokens per minute up to burst. It reports false when the
+// bucket is empty. Updates are conditional on the bucket's version, so
+// concurrent takers never spend the same token twice; a taker that keeps
+// losing races is treated as finding the bucket empty.
+func (r *RateLimitRepository) Take(ctx context.Context, name string, ratePerMinute, burst int) (bool, error) {
+	pk := fmt.Sprintf("RATE_LIMIT#%s", name)
+
+	for attempt := 0; attempt < maxBucketRetries; attempt++ {
+		spanCtx, span := tracing.StartDynamoDBSpan(ctx, "GetItem", r.tableName)
+		result, err := r.client.GetItem(spanCtx, &dynamodb.GetItemInput{
+			TableName:      aws.String(r.tableName),
+			Key:            r.keys.key(pk, "BUCKET"),
+			ConsistentRead: aws.Bool(true),
+		})
+		tracing.EndSpan(span, err)
+
+		if err != nil {
+			return false, fmt.Errorf("failed to get rate limit bucket: %w", err)
+		}
+
+		now := time.Now()
+		tokens := float64(burst)
+		version := 0
+		if result.Item != nil {
+			tokens, version = bucketState(result.Item, now, ratePerMinute, burst)
+		}
+
+		if tokens < 1 {
+			return false, nil
+		}
+
+		input := &dynamodb.PutItemInput{
+			TableName: aws.String(r.tableName),
+			Item: r.keys.item(pk, "BUCKET", map[string]types.AttributeValue{
+				"Tokens":    &types.AttributeValueMemberN{Value: strconv.FormatFloat(tokens-1, 'f', -1, 64)},
+				"UpdatedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixMilli(), 10)},
+				"Version":   &types.AttributeValueMemberN{Value: strconv.Itoa(version + 1)},
+			}),
+		}
+		if result.Item == nil {
+			input.ConditionExpression = aws.String("attribute_not_exists(#pk)")
+			input.ExpressionAttributeNames = map[string]string{"#pk": r.keys.PK}
+		} else {
+			input.ConditionExpression = aws.String("Version = :version")
+			input.ExpressionAttributeValues = map[string]types.AttributeValue{
+				":version": &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+			}
+		}
+
+		spanCtx, span = tracing.StartDynamoDBSpan(ctx, "PutItem", r.tableName)
+		_, err = r.client.PutItem(spanCtx, input)
+		tracing.EndSpan(span, err)
+
+		if err == nil {
+			return true, nil
+		}
+
+		var conditionFailed *types.ConditionalCheckFailedException
+		if !errors.As(err, &conditionFailed) {
+			return false, fmt.Errorf("failed to update rate limit bucket: %w", err)
+		}
+	}
+
+	r.logger.WithField("bucket", name).Warn("Gave up taking from contended rate limit bucket")
+	return false, nil
+}
+
+// bucketState returns the bucket's tokens after refilling for the time
+// since its last update, and its version.
+func bucketState(item map[string]types.AttributeValue, now time.Time, ratePerMinute, burst int) (float64, int) {
+	var tokens float64
+	var updatedAt int64
+	var version int
+
+	if v, ok := item["Tokens"].(*types.AttributeValueMemberN); ok {
+		tokens, _ = strconv.ParseFloat(v.Value, 64)
+	}
+	if v, ok := item["UpdatedAt"].(*types.AttributeValueMemberN); ok {
+		updatedAt, _ = strconv.ParseInt(v.Value, 10, 64)
+	}
+	if v, ok := item["Version"].(*types.AttributeValueMemberN); ok {
+		version, _ = strconv.Atoi(v.Value)
+	}
+
+	elapsed := now.Sub(time.UnixMilli(updatedAt))
+	if elapsed > 0 {
+		tokens += elapsed.Minutes() * float64(ratePerMinute)
+	}
+	return min(tokens, float64(burst)), version
+}
+
+// Reset deletes the bucket named name, so it starts full again. It is
+// idempotent.
+func (r *RateLimitRepository) Reset(ctx context.Context, name string) error {
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "DeleteItem", r.tableName)
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       r.keys.key(fmt.Sprintf("RATE_LIMIT#%s", name), "BUCKET"),
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return fmt.Errorf("failed to reset rate limit bucket: %w", err)
+	}
+	return nil
+}
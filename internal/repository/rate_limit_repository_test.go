@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/dynamotest"
+)
+
+func newTestRateLimitRepository(t *testing.T) *RateLimitRepository {
+	t.Helper()
+	db := dynamotest.New(t)
+	db.CreateTable("rate_limits", testKeys.PK, testKeys.SK)
+	return NewRateLimitRepository(db.Client(), db.Table("rate_limits"), testKeys, testLogger())
+}
+
+func TestTakeEmptiesBucket(t *testing.T) {
+	repo := newTestRateLimitRepository(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if ok, err := repo.Take(ctx, "test", 1, 3); !ok || err != nil {
+			t.Fatalf("Take %d = %v, %v, want a token", i+1, ok, err)
+		}
+	}
+	if ok, err := repo.Take(ctx, "test", 1, 3); ok || err != nil {
+		t.Fatalf("Take from an empty bucket = %v, %v, want false", ok, err)
+	}
+	if ok, _ := repo.Take(ctx, "other", 1, 3); !ok {
+		t.Error("Take from another bucket found it empty")
+	}
+
+	if err := repo.Reset(ctx, "test"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if ok, err := repo.Take(ctx, "test", 1, 3); !ok || err != nil {
+		t.Errorf("Take after Reset = %v, %v, want a token", ok, err)
+	}
+}
+
+// Concurrent takers never spend more tokens than the bucket holds.
+func TestTakeConcurrent(t *testing.T) {
+	repo := newTestRateLimitRepository(t)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := repo.Take(context.Background(), "test", 1, 5)
+			if err != nil {
+				t.Errorf("Take: %v", err)
+			}
+			if ok {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if taken == 0 || taken > 5 {
+		t.Errorf("%d takers got a token from a bucket of 5", taken)
+	}
+}
+
+func TestBucketStateRefills(t *testing.T) {
+	// UpdatedAt is stored in milliseconds.
+	now := time.UnixMilli(time.Now().UnixMilli())
+	item := func(tokens float64, updated time.Time) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			"Tokens":    &types.AttributeValueMemberN{Value: strconv.FormatFloat(tokens, 'f', -1, 64)},
+			"UpdatedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(updated.UnixMilli(), 10)},
+			"Version":   &types.AttributeValueMemberN{Value: "7"},
+		}
+	}
+
+	for _, tc := range []struct {
+		tokens  float64
+		updated time.Time
+		want    float64
+	}{
+		{0, now, 0},
+		{0, now.Add(-30 * time.Second), 1},
+		{1, now.Add(-time.Minute), 3},
+		{2, now.Add(-time.Hour), 10},
+		{4, now.Add(time.Minute), 4},
+	} {
+		tokens, version := bucketState(item(tc.tokens, tc.updated), now, 2, 10)
+		if tokens != tc.want || version != 7 {
+			t.Errorf("bucketState(%v tokens, %v ago) = %v, version %d, want %v, version 7", tc.tokens, now.Sub(tc.updated), tokens, version, tc.want)
+		}
+	}
+}
@@ -2,39 +2,47 @@ package repository
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/metrics"
 	"github.com/qcom/qcom/internal/models"
+	"github.com/qcom/qcom/internal/tracing"
 	"github.com/sirupsen/logrus"
 )
 
 type RefreshTokenRepository struct {
 	client    *dynamodb.Client
 	tableName string
+	keys      KeySchema
 	logger    *logrus.Logger
 }
 
-func NewRefreshTokenRepository(client *dynamodb.Client, tableName string, logger *logrus.Logger) *RefreshTokenRepository {
+func NewRefreshTokenRepository(client *dynamodb.Client, tableName string, keys KeySchema, logger *logrus.Logger) *RefreshTokenRepository {
 	return &RefreshTokenRepository{
 		client:    client,
 		tableName: tableName,
+		keys:      keys,
 		logger:    logger,
 	}
 }
 
 // Store stores refresh token in DynamoDB with TTL
 func (r *RefreshTokenRepository) Store(ctx context.Context, tokenData models.RefreshTokenData) error {
+	defer metrics.ObserveRefreshTokenOp("Store", time.Now())
+
 	// Calculate TTL (expiration time in Unix seconds)
 	ttl := tokenData.ExpiresAt.Unix()
 
-	item := map[string]types.AttributeValue{
-		"PK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("REFRESH_TOKEN#%s", tokenData.JTI)},
-		"SK":        &types.AttributeValueMemberS{Value: "METADATA"},
+	item := r.keys.item(fmt.Sprintf("REFRESH_TOKEN#%s", tokenData.JTI), "METADATA", map[string]types.AttributeValue{
 		"JTI":       &types.AttributeValueMemberS{Value: tokenData.JTI},
 		"UserID":    &types.AttributeValueMemberS{Value: tokenData.UserID},
 		"Phone":     &types.AttributeValueMemberS{Value: tokenData.Phone},
@@ -43,13 +51,25 @@ func (r *RefreshTokenRepository) Store(ctx context.Context, tokenData models.Ref
 		"CreatedAt": &types.AttributeValueMemberS{Value: tokenData.CreatedAt.Format(time.RFC3339)},
 		"ExpiresAt": &types.AttributeValueMemberS{Value: tokenData.ExpiresAt.Format(time.RFC3339)},
 		"TTL":       &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", ttl)},
-	}
 
-	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(r.tableName),
-		Item:      item,
+		"RefreshCount": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", tokenData.RefreshCount)},
 	})
+	if tokenData.PushToken != "" {
+		item["PushToken"] = &types.AttributeValueMemberS{Value: tokenData.PushToken}
+	}
 
+	// The token and its index entries are written together so that
+	// RevokeFamily and RevokeUser can always find every token.
+	items := []map[string]types.AttributeValue{item, familyMemberItem(r.keys, tokenData.FamilyID, tokenData.JTI, ttl)}
+	if tokenData.UserID != "" {
+		items = append(items, userTokenItem(r.keys, tokenData.UserID, tokenData.JTI, ttl, tokenData.Revoked))
+	}
+	// Revoking a token rewrites it, which must not point the device back at
+	// a session it has since replaced.
+	if tokenData.UserID != "" && tokenData.PushToken != "" && !tokenData.Revoked {
+		items = append(items, userPushTokenItem(r.keys, tokenData, ttl))
+	}
+	err := transactPut(ctx, r.client, r.tableName, items...)
 	if err != nil {
 		r.logger.WithError(err).Error("Failed to store refresh token in DynamoDB")
 		return fmt.Errorf("failed to store refresh token: %w", err)
@@ -60,13 +80,14 @@ func (r *RefreshTokenRepository) Store(ctx context.Context, tokenData models.Ref
 
 // Get retrieves refresh token from DynamoDB
 func (r *RefreshTokenRepository) Get(ctx context.Context, jti string) (*models.RefreshTokenData, error) {
+	defer metrics.ObserveRefreshTokenOp("Get", time.Now())
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "GetItem", r.tableName)
 	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(r.tableName),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("REFRESH_TOKEN#%s", jti)},
-			"SK": &types.AttributeValueMemberS{Value: "METADATA"},
-		},
+		Key:       r.keys.key(fmt.Sprintf("REFRESH_TOKEN#%s", jti), "METADATA"),
 	})
+	tracing.EndSpan(span, err)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to get refresh token: %w", err)
@@ -86,13 +107,14 @@ func (r *RefreshTokenRepository) Get(ctx context.Context, jti string) (*models.R
 
 // Delete removes refresh token from DynamoDB
 func (r *RefreshTokenRepository) Delete(ctx context.Context, jti string) error {
+	defer metrics.ObserveRefreshTokenOp("Delete", time.Now())
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "DeleteItem", r.tableName)
 	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
 		TableName: aws.String(r.tableName),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("REFRESH_TOKEN#%s", jti)},
-			"SK": &types.AttributeValueMemberS{Value: "METADATA"},
-		},
+		Key:       r.keys.key(fmt.Sprintf("REFRESH_TOKEN#%s", jti), "METADATA"),
 	})
+	tracing.EndSpan(span, err)
 
 	if err != nil {
 		return fmt.Errorf("failed to delete refresh token: %w", err)
@@ -103,13 +125,14 @@ func (r *RefreshTokenRepository) Delete(ctx context.Context, jti string) error {
 
 // IsRevoked checks if a token is revoked by checking for revoked marker
 func (r *RefreshTokenRepository) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	defer metrics.ObserveRefreshTokenOp("IsRevoked", time.Now())
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "GetItem", r.tableName)
 	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(r.tableName),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: fmt.Sprintf("REVOKED_TOKEN#%s", jti)},
-			"SK": &types.AttributeValueMemberS{Value: "METADATA"},
-		},
+		Key:       r.keys.key(fmt.Sprintf("REVOKED_TOKEN#%s", jti), "METADATA"),
 	})
+	tracing.EndSpan(span, err)
 
 	if err != nil {
 		return false, err
@@ -120,19 +143,21 @@ func (r *RefreshTokenRepository) IsRevoked(ctx context.Context, jti string) (boo
 
 // MarkRevoked marks a token as revoked with TTL
 func (r *RefreshTokenRepository) MarkRevoked(ctx context.Context, jti string, expiresAt time.Time) error {
+	defer metrics.ObserveRefreshTokenOp("MarkRevoked", time.Now())
+
 	ttl := expiresAt.Unix()
 
-	item := map[string]types.AttributeValue{
-		"PK":        &types.AttributeValueMemberS{Value: fmt.Sprintf("REVOKED_TOKEN#%s", jti)},
-		"SK":        &types.AttributeValueMemberS{Value: "METADATA"},
+	item := r.keys.item(fmt.Sprintf("REVOKED_TOKEN#%s", jti), "METADATA", map[string]types.AttributeValue{
 		"RevokedAt": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
 		"TTL":       &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", ttl)},
-	}
+	})
 
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "PutItem", r.tableName)
 	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
 		TableName: aws.String(r.tableName),
 		Item:      item,
 	})
+	tracing.EndSpan(span, err)
 
 	if err != nil {
 		return fmt.Errorf("failed to mark token as revoked: %w", err)
@@ -141,27 +166,292 @@ func (r *RefreshTokenRepository) MarkRevoked(ctx context.Context, jti string, ex
 	return nil
 }
 
-// GetByFamilyID retrieves all tokens for a given family ID
+// StoreReplacement records which refresh token replaced the refresh token
+// jti, until ttl.
+func (r *RefreshTokenRepository) StoreReplacement(ctx context.Context, jti string, replacement models.RefreshTokenReplacement, ttl time.Time) error {
+	defer metrics.ObserveRefreshTokenOp("StoreReplacement", time.Now())
+
+	item := r.keys.item(fmt.Sprintf("REFRESH_REPLACEMENT#%s", jti), "METADATA", map[string]types.AttributeValue{
+		"JTI":       &types.AttributeValueMemberS{Value: replacement.JTI},
+		"FamilyID":  &types.AttributeValueMemberS{Value: replacement.FamilyID},
+		"RotatedAt": &types.AttributeValueMemberS{Value: replacement.RotatedAt.Format(time.RFC3339Nano)},
+		"TTL":       &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", ttl.Unix())},
+	})
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "PutItem", r.tableName)
+	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item:      item,
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return fmt.Errorf("failed to store refresh token replacement: %w", err)
+	}
+
+	return nil
+}
+
+// GetReplacement returns the refresh token that replaced the refresh token
+// jti, or nil if none is recorded.
+func (r *RefreshTokenRepository) GetReplacement(ctx context.Context, jti string) (*models.RefreshTokenReplacement, error) {
+	defer metrics.ObserveRefreshTokenOp("GetReplacement", time.Now())
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "GetItem", r.tableName)
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(r.tableName),
+		Key:            r.keys.key(fmt.Sprintf("REFRESH_REPLACEMENT#%s", jti), "METADATA"),
+		ConsistentRead: aws.Bool(true),
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refresh token replacement: %w", err)
+	}
+
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var replacement models.RefreshTokenReplacement
+	if err := attributevalue.UnmarshalMap(result.Item, &replacement); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal refresh token replacement: %w", err)
+	}
+
+	return &replacement, nil
+}
+
+// GetByFamilyID retrieves all tokens for a given family ID using the family
+// index, which costs one Query plus batched reads instead of a table scan
 func (r *RefreshTokenRepository) GetByFamilyID(ctx context.Context, familyID string) ([]models.RefreshTokenData, error) {
-	// Query using GSI (if you create one) or scan with filter
-	// For simplicity, using scan with filter expression
-	result, err := r.client.Scan(ctx, &dynamodb.ScanInput{
-		TableName:        aws.String(r.tableName),
-		FilterExpression: aws.String("begins_with(PK, :pk_prefix) AND FamilyID = :family_id"),
+	defer metrics.ObserveRefreshTokenOp("GetByFamilyID", time.Now())
+
+	return r.getByIndex(ctx, fmt.Sprintf("TOKEN_FAMILY#%s", familyID))
+}
+
+// GetByUserID retrieves all of a user's tokens using the user index.
+func (r *RefreshTokenRepository) GetByUserID(ctx context.Context, userID string) ([]models.RefreshTokenData, error) {
+	defer metrics.ObserveRefreshTokenOp("GetByUserID", time.Now())
+
+	return r.getByIndex(ctx, fmt.Sprintf("USER_TOKENS#%s", userID))
+}
+
+// CountActiveByUserID counts the user's unexpired, unrevoked tokens with a
+// single COUNT query on the user index, without reading the tokens. A user
+// with no index entries has a count of 0.
+func (r *RefreshTokenRepository) CountActiveByUserID(ctx context.Context, userID string) (int, error) {
+	defer metrics.ObserveRefreshTokenOp("CountActiveByUserID", time.Now())
+
+	indexPK := fmt.Sprintf("USER_TOKENS#%s", userID)
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:              aws.String(r.tableName),
+		KeyConditionExpression: aws.String("#pk = :pk"),
+		// DynamoDB deletes expired entries only eventually, so expiry is
+		// checked here. Entries written before the index carried Revoked
+		// count as active.
+		FilterExpression: aws.String("#ttl > :now AND (attribute_not_exists(#revoked) OR #revoked = :false)"),
+		ExpressionAttributeNames: map[string]string{
+			"#pk":      r.keys.PK,
+			"#ttl":     "TTL",
+			"#revoked": "Revoked",
+		},
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":pk_prefix": &types.AttributeValueMemberS{Value: "REFRESH_TOKEN#"},
-			":family_id": &types.AttributeValueMemberS{Value: familyID},
+			":pk":    &types.AttributeValueMemberS{Value: indexPK},
+			":now":   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", time.Now().Unix())},
+			":false": &types.AttributeValueMemberBOOL{Value: false},
 		},
+		Select: types.SelectCount,
 	})
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to query tokens by family ID: %w", err)
+	// A COUNT query still pages at 1 MB of scanned entries, which only a
+	// user with thousands of tokens reaches.
+	count := 0
+	for paginator.HasMorePages() {
+		ctx, span := tracing.StartDynamoDBSpan(ctx, "Query", r.tableName)
+		page, err := paginator.NextPage(ctx)
+		tracing.EndSpan(span, err)
+
+		if err != nil {
+			return 0, fmt.Errorf("failed to count token index %s: %w", indexPK, err)
+		}
+		count += int(page.Count)
+	}
+
+	return count, nil
+}
+
+// getByIndex reads the tokens listed under an index partition, whose items
+// each carry the JTI of one token. Tokens are returned oldest first, each
+// JTI at most once.
+func (r *RefreshTokenRepository) getByIndex(ctx context.Context, indexPK string) ([]models.RefreshTokenData, error) {
+	var keys []map[string]types.AttributeValue
+	seen := make(map[string]bool)
+
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:                aws.String(r.tableName),
+		KeyConditionExpression:   aws.String("#pk = :pk"),
+		ExpressionAttributeNames: map[string]string{"#pk": r.keys.PK},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: indexPK},
+		},
+		ProjectionExpression: aws.String("JTI"),
+	})
+
+	for paginator.HasMorePages() {
+		ctx, span := tracing.StartDynamoDBSpan(ctx, "Query", r.tableName)
+		page, err := paginator.NextPage(ctx)
+		tracing.EndSpan(span, err)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to query token index %s: %w", indexPK, err)
+		}
+
+		for _, member := range page.Items {
+			jti, ok := member["JTI"].(*types.AttributeValueMemberS)
+			// BatchGetItem rejects requests with duplicate keys.
+			if !ok || seen[jti.Value] {
+				continue
+			}
+			seen[jti.Value] = true
+			keys = append(keys, r.keys.key(fmt.Sprintf("REFRESH_TOKEN#%s", jti.Value), "METADATA"))
+		}
 	}
 
 	var tokens []models.RefreshTokenData
-	if err := attributevalue.UnmarshalListOfMaps(result.Items, &tokens); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal tokens: %w", err)
+	for start := 0; start < len(keys); start += maxBatchGetItems {
+		end := min(start+maxBatchGetItems, len(keys))
+
+		items, err := r.batchGet(ctx, keys[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		var batch []models.RefreshTokenData
+		if err := attributevalue.UnmarshalListOfMaps(items, &batch); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal tokens: %w", err)
+		}
+		tokens = append(tokens, batch...)
 	}
 
+	// BatchGetItem returns items in no particular order.
+	slices.SortFunc(tokens, func(a, b models.RefreshTokenData) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.JTI, b.JTI)
+	})
+
 	return tokens, nil
 }
+
+// BackfillFamilyIndex creates family and user index entries for refresh
+// tokens stored before those indexes existed. It pages through the table
+// with Scan, so it is meant to be run once rather than on the request path.
+func (r *RefreshTokenRepository) BackfillFamilyIndex(ctx context.Context) (int, error) {
+	paginator := dynamodb.NewScanPaginator(r.client, &dynamodb.ScanInput{
+		TableName:                aws.String(r.tableName),
+		FilterExpression:         aws.String("begins_with(#pk, :pk_prefix)"),
+		ExpressionAttributeNames: map[string]string{"#pk": r.keys.PK},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk_prefix": &types.AttributeValueMemberS{Value: "REFRESH_TOKEN#"},
+		},
+	})
+
+	count := 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return count, fmt.Errorf("failed to scan refresh tokens: %w", err)
+		}
+
+		var tokens []models.RefreshTokenData
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &tokens); err != nil {
+			return count, fmt.Errorf("failed to unmarshal tokens: %w", err)
+		}
+
+		for _, token := range tokens {
+			var entries []map[string]types.AttributeValue
+			if token.FamilyID != "" {
+				entries = append(entries, familyMemberItem(r.keys, token.FamilyID, token.JTI, token.ExpiresAt.Unix()))
+			}
+			if token.UserID != "" {
+				entries = append(entries, userTokenItem(r.keys, token.UserID, token.JTI, token.ExpiresAt.Unix(), token.Revoked))
+			}
+			if len(entries) == 0 {
+				continue
+			}
+
+			for _, entry := range entries {
+				_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
+					TableName: aws.String(r.tableName),
+					Item:      entry,
+				})
+				if err != nil {
+					return count, fmt.Errorf("failed to write token index entry: %w", err)
+				}
+			}
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// maxBatchGetItems is the DynamoDB limit on keys per BatchGetItem request
+const maxBatchGetItems = 100
+
+func (r *RefreshTokenRepository) batchGet(ctx context.Context, keys []map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+
+	request := map[string]types.KeysAndAttributes{
+		r.tableName: {Keys: keys},
+	}
+	for len(request) > 0 {
+		ctx, span := tracing.StartDynamoDBSpan(ctx, "BatchGetItem", r.tableName)
+		result, err := r.client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: request,
+		})
+		tracing.EndSpan(span, err)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to batch get refresh tokens: %w", err)
+		}
+
+		items = append(items, result.Responses[r.tableName]...)
+		request = result.UnprocessedKeys
+	}
+
+	return items, nil
+}
+
+func familyMemberItem(keys KeySchema, familyID, jti string, ttl int64) map[string]types.AttributeValue {
+	return keys.item(fmt.Sprintf("TOKEN_FAMILY#%s", familyID), jti, map[string]types.AttributeValue{
+		"JTI": &types.AttributeValueMemberS{Value: jti},
+		"TTL": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", ttl)},
+	})
+}
+
+// userPushTokenItem is a user's push token index entry, keyed by a hash of
+// the token so that a device signing in again replaces its entry with the
+// new session.
+func userPushTokenItem(keys KeySchema, tokenData models.RefreshTokenData, ttl int64) map[string]types.AttributeValue {
+	sum := sha256.Sum256([]byte(tokenData.PushToken))
+	return keys.item(fmt.Sprintf("USER_PUSH_TOKENS#%s", tokenData.UserID), hex.EncodeToString(sum[:]), map[string]types.AttributeValue{
+		"PushToken": &types.AttributeValueMemberS{Value: tokenData.PushToken},
+		"JTI":       &types.AttributeValueMemberS{Value: tokenData.JTI},
+		"FamilyID":  &types.AttributeValueMemberS{Value: tokenData.FamilyID},
+		"UpdatedAt": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+		"TTL":       &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", ttl)},
+	})
+}
+
+// userTokenItem is a user index entry. It repeats the token's Revoked flag,
+// which Store rewrites on revocation, so active tokens can be counted from
+// the index alone.
+func userTokenItem(keys KeySchema, userID, jti string, ttl int64, revoked bool) map[string]types.AttributeValue {
+	return keys.item(fmt.Sprintf("USER_TOKENS#%s", userID), jti, map[string]types.AttributeValue{
+		"JTI":     &types.AttributeValueMemberS{Value: jti},
+		"Revoked": &types.AttributeValueMemberBOOL{Value: revoked},
+		"TTL":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", ttl)},
+	})
+}
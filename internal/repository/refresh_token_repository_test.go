@@ -0,0 +1,196 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/dynamotest"
+	"github.com/qcom/qcom/internal/models"
+)
+
+func newTestRefreshTokenRepository(t testing.TB) (*RefreshTokenRepository, *dynamotest.DB) {
+	t.Helper()
+	db := dynamotest.New(t)
+	db.CreateTable("tokens", testKeys.PK, testKeys.SK)
+	return NewRefreshTokenRepository(db.Client(), db.Table("tokens"), testKeys, testLogger()), db
+}
+
+// storeFamily stores n refresh tokens in familyID, created a second apart,
+// and returns their JTIs oldest first.
+func storeFamily(t testing.TB, repo *RefreshTokenRepository, familyID string, n int) []string {
+	t.Helper()
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	jtis := make([]string, n)
+	for i := range jtis {
+		jtis[i] = fmt.Sprintf("%s-%03d", familyID, i)
+		err := repo.Store(context.Background(), models.RefreshTokenData{
+			JTI:       jtis[i],
+			UserID:    "user-1",
+			Phone:     "+15551234567",
+			FamilyID:  familyID,
+			CreatedAt: created.Add(time.Duration(i) * time.Second),
+			ExpiresAt: created.Add(24 * time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	return jtis
+}
+
+// A family larger than one BatchGetItem request is read in full, and only
+// that family is read.
+func TestGetByFamilyID(t *testing.T) {
+	repo, _ := newTestRefreshTokenRepository(t)
+	want := storeFamily(t, repo, "family-a", maxBatchGetItems+20)
+	storeFamily(t, repo, "family-b", 3)
+
+	tokens, err := repo.GetByFamilyID(context.Background(), "family-a")
+	if err != nil {
+		t.Fatalf("GetByFamilyID: %v", err)
+	}
+	if len(tokens) != len(want) {
+		t.Fatalf("GetByFamilyID returned %d tokens, want %d", len(tokens), len(want))
+	}
+	for i, token := range tokens {
+		if token.JTI != want[i] || token.FamilyID != "family-a" {
+			t.Fatalf("token %d = %s of %s, want %s of family-a", i, token.JTI, token.FamilyID, want[i])
+		}
+	}
+}
+
+// Tokens come back oldest first whatever their JTIs, and a JTI listed under
+// the family twice is returned once.
+func TestGetByFamilyIDSortsAndDedupes(t *testing.T) {
+	repo, db := newTestRefreshTokenRepository(t)
+	ctx := context.Background()
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i, jti := range []string{"c", "a", "b"} {
+		err := repo.Store(ctx, models.RefreshTokenData{
+			JTI:       jti,
+			UserID:    "user-1",
+			FamilyID:  "family-a",
+			CreatedAt: created.Add(time.Duration(i) * time.Second),
+			ExpiresAt: created.Add(24 * time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	_, err := db.Client().PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(db.Table("tokens")),
+		Item: testKeys.item("TOKEN_FAMILY#family-a", "duplicate-of-a", map[string]types.AttributeValue{
+			"JTI": &types.AttributeValueMemberS{Value: "a"},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("PutItem: %v", err)
+	}
+
+	tokens, err := repo.GetByFamilyID(ctx, "family-a")
+	if err != nil {
+		t.Fatalf("GetByFamilyID: %v", err)
+	}
+	var got []string
+	for _, token := range tokens {
+		got = append(got, token.JTI)
+	}
+	if want := []string{"c", "a", "b"}; !slices.Equal(got, want) {
+		t.Errorf("GetByFamilyID returned %v, want %v", got, want)
+	}
+}
+
+func TestGetByFamilyIDUnknownFamily(t *testing.T) {
+	repo, _ := newTestRefreshTokenRepository(t)
+
+	tokens, err := repo.GetByFamilyID(context.Background(), "no-such-family")
+	if err != nil || len(tokens) != 0 {
+		t.Errorf("GetByFamilyID of an unknown family = %v, %v, want no tokens", tokens, err)
+	}
+}
+
+// Tokens stored before the family index existed are found once it has been
+// backfilled.
+func TestBackfillFamilyIndex(t *testing.T) {
+	repo, db := newTestRefreshTokenRepository(t)
+	ctx := context.Background()
+	expires := time.Now().Add(time.Hour)
+
+	_, err := db.Client().PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(db.Table("tokens")),
+		Item: testKeys.item("REFRESH_TOKEN#legacy", "METADATA", map[string]types.AttributeValue{
+			"JTI":       &types.AttributeValueMemberS{Value: "legacy"},
+			"UserID":    &types.AttributeValueMemberS{Value: "user-1"},
+			"FamilyID":  &types.AttributeValueMemberS{Value: "family-a"},
+			"CreatedAt": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+			"ExpiresAt": &types.AttributeValueMemberS{Value: expires.Format(time.RFC3339)},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("PutItem: %v", err)
+	}
+	if tokens, _ := repo.GetByFamilyID(ctx, "family-a"); len(tokens) != 0 {
+		t.Fatalf("GetByFamilyID before the backfill found %d tokens", len(tokens))
+	}
+
+	if count, err := repo.BackfillFamilyIndex(ctx); err != nil || count != 1 {
+		t.Fatalf("BackfillFamilyIndex = %d, %v, want 1", count, err)
+	}
+	if tokens, err := repo.GetByFamilyID(ctx, "family-a"); err != nil || len(tokens) != 1 || tokens[0].JTI != "legacy" {
+		t.Errorf("GetByFamilyID after the backfill = %v, %v, want the legacy token", tokens, err)
+	}
+	if tokens, err := repo.GetByUserID(ctx, "user-1"); err != nil || len(tokens) != 1 {
+		t.Errorf("GetByUserID after the backfill = %v, %v, want the legacy token", tokens, err)
+	}
+}
+
+// Only the user's unexpired, unrevoked tokens are counted.
+func TestCountActiveByUserID(t *testing.T) {
+	repo, _ := newTestRefreshTokenRepository(t)
+	ctx := context.Background()
+	storeFamily(t, repo, "family-a", 3)
+
+	now := time.Now()
+	for _, token := range []models.RefreshTokenData{
+		{JTI: "expired", ExpiresAt: now.Add(-time.Minute)},
+		{JTI: "revoked", ExpiresAt: now.Add(time.Hour), Revoked: true},
+	} {
+		token.UserID = "user-1"
+		token.FamilyID = "family-b"
+		token.CreatedAt = now.Add(-time.Hour)
+		if err := repo.Store(ctx, token); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	if count, err := repo.CountActiveByUserID(ctx, "user-1"); err != nil || count != 3 {
+		t.Errorf("CountActiveByUserID = %d, %v, want 3", count, err)
+	}
+	if count, err := repo.CountActiveByUserID(ctx, "no-such-user"); err != nil || count != 0 {
+		t.Errorf("CountActiveByUserID of an unknown user = %d, %v, want 0", count, err)
+	}
+}
+
+// BenchmarkGetByFamilyID reads a family from a table that also holds many
+// other families, which the family index lets it skip.
+func BenchmarkGetByFamilyID(b *testing.B) {
+	repo, _ := newTestRefreshTokenRepository(b)
+	for i := 0; i < 20; i++ {
+		storeFamily(b, repo, fmt.Sprintf("other-%02d", i), 10)
+	}
+	storeFamily(b, repo, "family-a", 10)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := repo.GetByFamilyID(ctx, "family-a"); err != nil {
+			b.Fatalf("GetByFamilyID: %v", err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/smithy-go/middleware"
+)
+
+var errStopped = errors.New("stopped before sending")
+
+// deadlineClient returns a client with WithDefaultTimeout(timeout) whose
+// operations record the deadline they would be sent with, if any, and stop
+// there.
+func deadlineClient(timeout time.Duration, deadline *time.Time, ok *bool) *dynamodb.Client {
+	capture := func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CaptureDeadline", func(
+			ctx context.Context, _ middleware.InitializeInput, _ middleware.InitializeHandler,
+		) (middleware.InitializeOutput, middleware.Metadata, error) {
+			*deadline, *ok = ctx.Deadline()
+			return middleware.InitializeOutput{}, middleware.Metadata{}, errStopped
+		}), middleware.After)
+	}
+	return dynamodb.New(dynamodb.Options{Region: "us-east-1"}, WithDefaultTimeout(timeout), func(o *dynamodb.Options) {
+		o.APIOptions = append(o.APIOptions, capture)
+	})
+}
+
+func TestWithDefaultTimeout(t *testing.T) {
+	var deadline time.Time
+	var ok bool
+	client := deadlineClient(time.Minute, &deadline, &ok)
+	get := func(ctx context.Context) {
+		t.Helper()
+		_, err := client.GetItem(ctx, &dynamodb.GetItemInput{TableName: aws.String("table"), Key: testKeys.key("PK", "SK")})
+		if !errors.Is(err, errStopped) {
+			t.Fatalf("GetItem = %v, want it stopped before sending", err)
+		}
+	}
+
+	get(context.Background())
+	if until := time.Until(deadline); !ok || until <= 0 || until > time.Minute {
+		t.Errorf("deadline without a parent deadline = %v, %v, want a minute from now", deadline, ok)
+	}
+
+	for _, parent := range []time.Duration{time.Second, time.Hour} {
+		ctx, cancel := context.WithTimeout(context.Background(), parent)
+		want, _ := ctx.Deadline()
+		get(ctx)
+		cancel()
+		if !ok || !deadline.Equal(want) {
+			t.Errorf("deadline with a parent deadline %v away = %v, want the parent's %v", parent, deadline, want)
+		}
+	}
+}
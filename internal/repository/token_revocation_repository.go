@@ -0,0 +1,176 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/models"
+	"github.com/qcom/qcom/internal/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// globalEpochScope is the scope of the epoch that applies to every token.
+// Phone numbers start with '+', so it cannot collide with a user's scope.
+const globalEpochScope = "GLOBAL"
+
+// TokenRevocationRepository stores what revokes tokens besides their
+// expiry. Token epochs invalidate every token issued at or before them,
+// without each one having to be tracked; there is one per phone number and
+// one for all tokens. Individual tokens are revoked with the same
+// REVOKED_TOKEN markers the RefreshTokenRepository writes.
+type TokenRevocationRepository struct {
+	client    *dynamodb.Client
+	tableName string
+	keys      KeySchema
+	logger    *logrus.Logger
+}
+
+func NewTokenRevocationRepository(client *dynamodb.Client, tableName string, keys KeySchema, logger *logrus.Logger) *TokenRevocationRepository {
+	return &TokenRevocationRepository{
+		client:    client,
+		tableName: tableName,
+		keys:      keys,
+		logger:    logger,
+	}
+}
+
+// Get returns, in one read, the epoch of phoneNumber, the global epoch and
+// whether jti has been revoked. An epoch that was never set is the zero
+// time.
+func (r *TokenRevocationRepository) Get(ctx context.Context, phoneNumber, jti string) (*models.TokenRevocation, error) {
+	revokedPK := fmt.Sprintf("REVOKED_TOKEN#%s", jti)
+	request := map[string]types.KeysAndAttributes{
+		r.tableName: {Keys: []map[string]types.AttributeValue{
+			r.epochKey(phoneNumber),
+			r.epochKey(globalEpochScope),
+			r.keys.key(revokedPK, "METADATA"),
+		}},
+	}
+
+	state := &models.TokenRevocation{}
+	for len(request) > 0 {
+		spanCtx, span := tracing.StartDynamoDBSpan(ctx, "BatchGetItem", r.tableName)
+		result, err := r.client.BatchGetItem(spanCtx, &dynamodb.BatchGetItemInput{
+			RequestItems: request,
+		})
+		tracing.EndSpan(span, err)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to get token revocation state: %w", err)
+		}
+
+		for _, item := range result.Responses[r.tableName] {
+			if pk, ok := item[r.keys.PK].(*types.AttributeValueMemberS); ok && pk.Value == revokedPK {
+				state.Revoked = true
+				continue
+			}
+
+			scope, _ := item["Scope"].(*types.AttributeValueMemberS)
+			epoch, err := epochFromItem(item)
+			if scope == nil || err != nil {
+				return nil, fmt.Errorf("malformed token epoch item")
+			}
+			if scope.Value == globalEpochScope {
+				state.GlobalEpoch = epoch
+			} else {
+				state.UserEpoch = epoch
+			}
+		}
+		request = result.UnprocessedKeys
+	}
+
+	return state, nil
+}
+
+// Revoke marks the token jti as revoked until it expires at expiresAt. It
+// is idempotent.
+func (r *TokenRevocationRepository) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	item := r.keys.item(fmt.Sprintf("REVOKED_TOKEN#%s", jti), "METADATA", map[string]types.AttributeValue{
+		"RevokedAt": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+		"TTL":       &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expiresAt.Unix())},
+	})
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "PutItem", r.tableName)
+	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item:      item,
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	return nil
+}
+
+// AdvanceUser sets the epoch of phoneNumber to epoch, unless it is already
+// later. It returns the epoch in effect afterwards.
+func (r *TokenRevocationRepository) AdvanceUser(ctx context.Context, phoneNumber string, epoch time.Time) (time.Time, error) {
+	return r.advance(ctx, phoneNumber, epoch)
+}
+
+// AdvanceGlobal is AdvanceUser for the epoch that applies to every token.
+func (r *TokenRevocationRepository) AdvanceGlobal(ctx context.Context, epoch time.Time) (time.Time, error) {
+	return r.advance(ctx, globalEpochScope, epoch)
+}
+
+// advance only ever moves an epoch forward, so a stale or repeated request
+// cannot make revoked tokens valid again.
+func (r *TokenRevocationRepository) advance(ctx context.Context, scope string, epoch time.Time) (time.Time, error) {
+	// Seconds with millisecond decimals, so epochs stored in whole seconds
+	// still compare and parse.
+	epochValue := strconv.FormatFloat(float64(epoch.UnixMilli())/1000, 'f', 3, 64)
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "UpdateItem", r.tableName)
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(r.tableName),
+		Key:                 r.epochKey(scope),
+		UpdateExpression:    aws.String("SET #scope = :scope, #epoch = :epoch, UpdatedAt = :now"),
+		ConditionExpression: aws.String("attribute_not_exists(#epoch) OR #epoch < :epoch"),
+		ExpressionAttributeNames: map[string]string{
+			"#scope": "Scope",
+			"#epoch": "Epoch",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":scope": &types.AttributeValueMemberS{Value: scope},
+			":epoch": &types.AttributeValueMemberN{Value: epochValue},
+			":now":   &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return epochFromItem(conditionFailed.Item)
+		}
+		return time.Time{}, fmt.Errorf("failed to advance token epoch: %w", err)
+	}
+
+	return time.UnixMilli(epoch.UnixMilli()), nil
+}
+
+func (r *TokenRevocationRepository) epochKey(scope string) map[string]types.AttributeValue {
+	return r.keys.key(fmt.Sprintf("TOKEN_EPOCH#%s", scope), "METADATA")
+}
+
+func epochFromItem(item map[string]types.AttributeValue) (time.Time, error) {
+	attr, ok := item["Epoch"].(*types.AttributeValueMemberN)
+	if !ok {
+		return time.Time{}, fmt.Errorf("token epoch item has no Epoch")
+	}
+	seconds, err := strconv.ParseFloat(attr.Value, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid token epoch: %w", err)
+	}
+	return time.UnixMilli(int64(math.Round(seconds * 1000))), nil
+}
@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/tracing"
+)
+
+// ErrTransactionCanceled is returned when DynamoDB rejects a transaction, in
+// which case none of its writes were applied.
+var ErrTransactionCanceled = errors.New("transaction canceled")
+
+// transactPut writes all items to the table in a single TransactWriteItems
+// call, so either every item is stored or none are.
+func transactPut(ctx context.Context, client *dynamodb.Client, tableName string, items ...map[string]types.AttributeValue) error {
+	puts := make([]types.Put, 0, len(items))
+	for _, item := range items {
+		puts = append(puts, types.Put{
+			TableName: aws.String(tableName),
+			Item:      item,
+		})
+	}
+
+	return transactWrite(ctx, client, puts...)
+}
+
+// transactWrite applies puts, which may target different tables, in a single
+// TransactWriteItems call.
+func transactWrite(ctx context.Context, client *dynamodb.Client, puts ...types.Put) error {
+	transactItems := make([]types.TransactWriteItem, 0, len(puts))
+	var tableNames []string
+	for i := range puts {
+		if err := checkItemSize(puts[i].Item); err != nil {
+			return err
+		}
+		transactItems = append(transactItems, types.TransactWriteItem{Put: &puts[i]})
+		if name := aws.ToString(puts[i].TableName); !slices.Contains(tableNames, name) {
+			tableNames = append(tableNames, name)
+		}
+	}
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "TransactWriteItems", strings.Join(tableNames, ","))
+	_, err := client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: transactItems,
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) {
+			var reasons []string
+			for _, reason := range canceled.CancellationReasons {
+				reasons = append(reasons, aws.ToString(reason.Code))
+			}
+			return fmt.Errorf("%w: %s", ErrTransactionCanceled, strings.Join(reasons, ", "))
+		}
+		return fmt.Errorf("failed to write transaction: %w", err)
+	}
+
+	return nil
+}
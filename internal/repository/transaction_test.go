@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/qcom/qcom/internal/dynamotest"
+	"github.com/qcom/qcom/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+var testKeys = KeySchema{PK: "PK", SK: "SK"}
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func newTestOTPRepository(t *testing.T) (*OTPRepository, *dynamotest.DB) {
+	t.Helper()
+	db := dynamotest.New(t)
+	db.CreateTable("otps", testKeys.PK, testKeys.SK)
+	db.CreateTable("audit", testKeys.PK, testKeys.SK)
+	return NewOTPRepository(db.Client(), db.Table("otps"), db.Table("audit"), testKeys, testLogger()), db
+}
+
+func testOTP(phone string) models.OTPData {
+	now := time.Now()
+	return models.OTPData{
+		OTPHash:   "hash",
+		Phone:     phone,
+		CreatedAt: now,
+		ExpiresAt: now.Add(5 * time.Minute),
+	}
+}
+
+func TestStoreWithAuditWritesBoth(t *testing.T) {
+	repo, db := newTestOTPRepository(t)
+	ctx := context.Background()
+
+	if err := repo.StoreWithAudit(ctx, "+15551234567", testOTP("+15551234567"), "OTP_ISSUED"); err != nil {
+		t.Fatalf("StoreWithAudit: %v", err)
+	}
+
+	if _, err := repo.Get(ctx, "+15551234567"); err != nil {
+		t.Errorf("Get after StoreWithAudit: %v", err)
+	}
+	if n := db.Len("audit"); n != 1 {
+		t.Errorf("audit table has %d items, want 1", n)
+	}
+}
+
+func TestStoreWithAuditFailedWritesNeither(t *testing.T) {
+	db := dynamotest.New(t)
+	db.CreateTable("otps", testKeys.PK, testKeys.SK)
+	// The audit table is never created, so the audit entry, the second
+	// write, fails; the OTP put would already have been applied if the
+	// writes were not atomic.
+	repo := NewOTPRepository(db.Client(), db.Table("otps"), db.Table("audit"), testKeys, testLogger())
+	ctx := context.Background()
+
+	if err := repo.StoreWithAudit(ctx, "+15551234567", testOTP("+15551234567"), "OTP_ISSUED"); err == nil {
+		t.Fatal("StoreWithAudit succeeded without an audit table")
+	}
+
+	if _, err := repo.Get(ctx, "+15551234567"); !errors.Is(err, ErrOTPNotFound) {
+		t.Errorf("Get after failed transaction = %v, want ErrOTPNotFound", err)
+	}
+	if n := db.Len("otps"); n != 0 {
+		t.Errorf("OTP table has %d items after failed transaction, want 0", n)
+	}
+}
@@ -2,6 +2,7 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -9,39 +10,74 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/qcom/qcom/internal/fieldcrypt"
+	"github.com/qcom/qcom/internal/logging"
 	"github.com/qcom/qcom/internal/models"
+	"github.com/qcom/qcom/internal/tracing"
 	"github.com/sirupsen/logrus"
 )
 
+var ErrUserExists = errors.New("user already exists")
+
+// ErrVersionConflict is returned by Update when the user was modified since
+// it was read.
+var ErrVersionConflict = errors.New("user was modified concurrently")
+
+// ErrCreateRetriesExhausted is returned by GetOrCreate when every create
+// attempt lost to a user that was deleted again before it could be read.
+var ErrCreateRetriesExhausted = errors.New("user create retries exhausted")
+
 type UserRepository struct {
-	client    *dynamodb.Client
-	tableName string
-	logger    *logrus.Logger
+	client         *dynamodb.Client
+	tableName      string
+	keys           KeySchema
+	consistentRead bool
+	createRetries  int
+	cipher         *fieldcrypt.Cipher
+	logger         *logrus.Logger
 }
 
-func NewUserRepository(client *dynamodb.Client, tableName string, logger *logrus.Logger) *UserRepository {
+// NewUserRepository creates the repository. With a non-nil cipher, the
+// user's name is encrypted at rest; names stored in plaintext earlier are
+// still read. createRetries bounds how many more times GetOrCreate tries to
+// create a user after a failed create finds nothing to read back.
+func NewUserRepository(client *dynamodb.Client, tableName string, keys KeySchema, consistentRead bool, createRetries int, cipher *fieldcrypt.Cipher, logger *logrus.Logger) *UserRepository {
 	return &UserRepository{
-		client:    client,
-		tableName: tableName,
-		logger:    logger,
+		client:         client,
+		tableName:      tableName,
+		keys:           keys,
+		consistentRead: consistentRead,
+		createRetries:  createRetries,
+		cipher:         cipher,
+		logger:         logger,
 	}
 }
 
+// nameAAD binds an encrypted name to its user record.
+func nameAAD(user *models.User) string {
+	return user.GetPK() + "#name"
+}
+
 func (r *UserRepository) GetByPhoneNumber(ctx context.Context, phoneNumber string) (*models.User, error) {
+	return r.getByPhoneNumber(ctx, phoneNumber, r.consistentRead)
+}
+
+func (r *UserRepository) getByPhoneNumber(ctx context.Context, phoneNumber string, consistentRead bool) (*models.User, error) {
 	user := &models.User{PhoneNumber: phoneNumber}
 	pk := user.GetPK()
 	sk := user.GetSK()
 
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "GetItem", r.tableName)
 	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(r.tableName),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: pk},
-			"SK": &types.AttributeValueMemberS{Value: sk},
-		},
+		TableName:      aws.String(r.tableName),
+		Key:            r.keys.key(pk, sk),
+		ConsistentRead: aws.Bool(consistentRead),
 	})
+	tracing.EndSpan(span, err)
 
 	if err != nil {
-		r.logger.WithError(err).Error("Failed to get user from DynamoDB")
+		r.logger.WithError(err).WithField("phone", logging.LogPhone(phoneNumber)).Error("Failed to get user from DynamoDB")
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
@@ -56,13 +92,19 @@ func (r *UserRepository) GetByPhoneNumber(ctx context.Context, phoneNumber strin
 	}
 
 	// Set PK and SK from the item
-	if pkAttr, ok := result.Item["PK"].(*types.AttributeValueMemberS); ok {
+	if pkAttr, ok := result.Item[r.keys.PK].(*types.AttributeValueMemberS); ok {
 		// Extract phone number from PK (USER!<phoneNumber>)
 		if len(pkAttr.Value) > 5 {
 			dbUser.PhoneNumber = pkAttr.Value[5:] // Remove "USER!" prefix
 		}
 	}
 
+	dbUser.Name, err = r.cipher.Decrypt(dbUser.Name, nameAAD(&dbUser))
+	if err != nil {
+		r.logger.WithError(err).WithField("phone", logging.LogPhone(phoneNumber)).Error("Failed to decrypt user name")
+		return nil, fmt.Errorf("failed to decrypt user name: %w", err)
+	}
+
 	return &dbUser, nil
 }
 
@@ -70,90 +112,228 @@ func (r *UserRepository) Create(ctx context.Context, user *models.User) error {
 	now := time.Now()
 	user.CreatedAt = now
 	user.UpdatedAt = now
+	user.Version = 1
+	if user.UserID == "" {
+		user.UserID = uuid.New().String()
+	}
 
 	pk := user.GetPK()
 	sk := user.GetSK()
 
-	item, err := attributevalue.MarshalMap(user)
+	// Marshal a copy so the caller's user keeps the plaintext name.
+	stored := *user
+	name, err := r.cipher.Encrypt(user.Name, nameAAD(user))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt user name: %w", err)
+	}
+	stored.Name = name
+
+	item, err := attributevalue.MarshalMap(stored)
 	if err != nil {
 		r.logger.WithError(err).Error("Failed to marshal user for DynamoDB")
 		return fmt.Errorf("failed to marshal user: %w", err)
 	}
 
 	// Add PK and SK
-	item["PK"] = &types.AttributeValueMemberS{Value: pk}
-	item["SK"] = &types.AttributeValueMemberS{Value: sk}
+	item = r.keys.item(pk, sk, item)
+	if err := checkItemSize(item); err != nil {
+		return err
+	}
 
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "PutItem", r.tableName)
 	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName:           aws.String(r.tableName),
-		Item:                item,
-		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+		TableName:                aws.String(r.tableName),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#pk)"),
+		ExpressionAttributeNames: map[string]string{"#pk": r.keys.PK},
 	})
+	tracing.EndSpan(span, err)
 
 	if err != nil {
-		if _, ok := err.(*types.ConditionalCheckFailedException); ok {
-			return fmt.Errorf("user already exists")
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return ErrUserExists
 		}
-		r.logger.WithError(err).Error("Failed to create user in DynamoDB")
+		r.logger.WithError(err).WithField("phone", logging.LogPhone(user.PhoneNumber)).Error("Failed to create user in DynamoDB")
 		return fmt.Errorf("failed to create user: %w", err)
 	}
 
 	return nil
 }
 
+// Update writes user's name if the stored user still has user.Version, and
+// returns ErrVersionConflict otherwise. On success user.Version is the new
+// version.
 func (r *UserRepository) Update(ctx context.Context, user *models.User) error {
-	user.UpdatedAt = time.Now()
+	updatedAt := time.Now()
 
 	pk := user.GetPK()
 	sk := user.GetSK()
 
-	updateExpression := "SET #name = :name, updated_at = :updated_at"
+	name, err := r.cipher.Encrypt(user.Name, nameAAD(user))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt user name: %w", err)
+	}
+
+	updateExpression := "SET #name = :name, updated_at = :updated_at, #version = :next_version"
 	expressionAttributeNames := map[string]string{
-		"#name": "name",
+		"#name":    "name",
+		"#version": "version",
 	}
 	expressionAttributeValues := map[string]types.AttributeValue{
-		":name":       &types.AttributeValueMemberS{Value: user.Name},
-		":updated_at": &types.AttributeValueMemberS{Value: user.UpdatedAt.Format(time.RFC3339)},
+		":name":         &types.AttributeValueMemberS{Value: name},
+		":updated_at":   &types.AttributeValueMemberS{Value: updatedAt.Format(time.RFC3339)},
+		":next_version": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", user.Version+1)},
+	}
+	if err := checkItemSize(map[string]types.AttributeValue{"name": expressionAttributeValues[":name"]}); err != nil {
+		return err
 	}
 
-	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
-		TableName: aws.String(r.tableName),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: pk},
-			"SK": &types.AttributeValueMemberS{Value: sk},
-		},
+	// Users written before versioning have no version attribute.
+	conditionExpression := "#version = :version"
+	if user.Version == 0 {
+		conditionExpression = "attribute_exists(#pk) AND attribute_not_exists(#version)"
+		expressionAttributeNames["#pk"] = r.keys.PK
+	} else {
+		expressionAttributeValues[":version"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", user.Version)}
+	}
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "UpdateItem", r.tableName)
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.tableName),
+		Key:                       r.keys.key(pk, sk),
 		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String(conditionExpression),
 		ExpressionAttributeNames:  expressionAttributeNames,
 		ExpressionAttributeValues: expressionAttributeValues,
 	})
+	tracing.EndSpan(span, err)
 
 	if err != nil {
-		r.logger.WithError(err).Error("Failed to update user in DynamoDB")
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return ErrVersionConflict
+		}
+		r.logger.WithError(err).WithField("phone", logging.LogPhone(user.PhoneNumber)).Error("Failed to update user in DynamoDB")
 		return fmt.Errorf("failed to update user: %w", err)
 	}
 
+	user.UpdatedAt = updatedAt
+	user.Version++
 	return nil
 }
 
 func (r *UserRepository) GetOrCreate(ctx context.Context, phoneNumber string) (*models.User, error) {
-	user, err := r.GetByPhoneNumber(ctx, phoneNumber)
+	user, _, err := r.GetOrCreateWithName(ctx, phoneNumber, "")
+	return user, err
+}
+
+// GetOrCreateWithName is GetOrCreate, but a newly created user is written
+// with name in the same PutItem. Existing users are returned unchanged;
+// created reports which case applied.
+func (r *UserRepository) GetOrCreateWithName(ctx context.Context, phoneNumber, name string) (user *models.User, created bool, err error) {
+	user, err = r.GetByPhoneNumber(ctx, phoneNumber)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	if user != nil {
-		return user, nil
+		if user.UserID == "" {
+			user, err = r.assignUserID(ctx, user)
+		}
+		return user, false, err
 	}
 
-	// User doesn't exist, create new one
-	newUser := &models.User{
-		PhoneNumber: phoneNumber,
-		Name:        "", // Will be set later
+	for attempt := 0; attempt <= r.createRetries; attempt++ {
+		newUser := &models.User{
+			PhoneNumber: phoneNumber,
+			Name:        name,
+		}
+
+		err := r.Create(ctx, newUser)
+		if err == nil {
+			return newUser, true, nil
+		}
+		if !errors.Is(err, ErrUserExists) {
+			return nil, false, err
+		}
+
+		// A concurrent request created the user after our read missed it,
+		// so read it back with a strongly consistent read.
+		user, err = r.getByPhoneNumber(ctx, phoneNumber, true)
+		if err != nil || user != nil {
+			return user, false, err
+		}
+
+		// The user the create collided with was deleted before the read,
+		// so the condition failure was transient: try creating it again.
+		r.logger.WithFields(logrus.Fields{
+			"phone":   logging.LogPhone(phoneNumber),
+			"attempt": attempt + 1,
+		}).Warn("User vanished after conditional create failed, retrying")
 	}
 
-	if err := r.Create(ctx, newUser); err != nil {
-		return nil, err
+	return nil, false, ErrCreateRetriesExhausted
+}
+
+// assignUserID gives a user created before stable user IDs existed a UserID.
+// If a concurrent request assigned one first, that ID is kept.
+func (r *UserRepository) assignUserID(ctx context.Context, user *models.User) (*models.User, error) {
+	userID := uuid.New().String()
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "UpdateItem", r.tableName)
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(r.tableName),
+		Key:                 r.keys.key(user.GetPK(), user.GetSK()),
+		UpdateExpression:    aws.String("SET user_id = :user_id"),
+		ConditionExpression: aws.String("attribute_not_exists(user_id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user_id": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	tracing.EndSpan(span, err)
+
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return r.getByPhoneNumber(ctx, user.PhoneNumber, true)
+		}
+		r.logger.WithError(err).WithField("phone", logging.LogPhone(user.PhoneNumber)).Error("Failed to assign user ID in DynamoDB")
+		return nil, fmt.Errorf("failed to assign user ID: %w", err)
+	}
+
+	user.UserID = userID
+	return user, nil
+}
+
+// SelfTest creates, reads back and deletes a throwaway user, catching
+// unreachable tables, missing permissions, a wrong key schema and unusable
+// encryption keys. Its phone number is not E.164, so it can never collide
+// with a real user.
+func (r *UserRepository) SelfTest(ctx context.Context) error {
+	user := &models.User{PhoneNumber: "self-test-" + uuid.NewString(), Name: "Self Test"}
+	if err := r.Create(ctx, user); err != nil {
+		return err
 	}
 
-	return newUser, nil
+	got, getErr := r.getByPhoneNumber(ctx, user.PhoneNumber, true)
+
+	ctx, span := tracing.StartDynamoDBSpan(ctx, "DeleteItem", r.tableName)
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       r.keys.key(user.GetPK(), user.GetSK()),
+	})
+	tracing.EndSpan(span, err)
+
+	switch {
+	case getErr != nil:
+		return getErr
+	case got == nil:
+		return errors.New("created user not found")
+	case got.UserID != user.UserID || got.Name != user.Name:
+		return errors.New("user read back differs from the one written")
+	case err != nil:
+		return fmt.Errorf("failed to delete self-test user: %w", err)
+	}
+	return nil
 }
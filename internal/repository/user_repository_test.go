@@ -0,0 +1,346 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/qcom/qcom/internal/dynamotest"
+	"github.com/qcom/qcom/internal/fieldcrypt"
+	"github.com/qcom/qcom/internal/models"
+)
+
+func newTestUserRepository(t *testing.T) (*UserRepository, *dynamotest.DB) {
+	t.Helper()
+	db := dynamotest.New(t)
+	db.CreateTable("users", testKeys.PK, testKeys.SK)
+	return NewUserRepository(db.Client(), db.Table("users"), testKeys, true, 3, nil, testLogger()), db
+}
+
+func TestUpdateIncrementsVersion(t *testing.T) {
+	repo, _ := newTestUserRepository(t)
+	ctx := context.Background()
+
+	user := &models.User{PhoneNumber: "+15551234567", Name: "Ada"}
+	if err := repo.Create(ctx, user); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if user.Version != 1 {
+		t.Fatalf("created user has version %d, want 1", user.Version)
+	}
+
+	user.Name = "Ada L."
+	if err := repo.Update(ctx, user); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if user.Version != 2 {
+		t.Errorf("updated user has version %d, want 2", user.Version)
+	}
+
+	stored, err := repo.GetByPhoneNumber(ctx, "+15551234567")
+	if err != nil {
+		t.Fatalf("GetByPhoneNumber: %v", err)
+	}
+	if stored.Name != "Ada L." || stored.Version != 2 {
+		t.Errorf("stored user = %q version %d, want %q version 2", stored.Name, stored.Version, "Ada L.")
+	}
+}
+
+func TestUpdateStaleVersionConflicts(t *testing.T) {
+	repo, _ := newTestUserRepository(t)
+	ctx := context.Background()
+
+	if err := repo.Create(ctx, &models.User{PhoneNumber: "+15551234567", Name: "Ada"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// Two writers read the same version.
+	first, err := repo.GetByPhoneNumber(ctx, "+15551234567")
+	if err != nil {
+		t.Fatalf("GetByPhoneNumber: %v", err)
+	}
+	second := *first
+
+	first.Name = "First"
+	if err := repo.Update(ctx, first); err != nil {
+		t.Fatalf("first Update: %v", err)
+	}
+	second.Name = "Second"
+	if err := repo.Update(ctx, &second); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("stale Update = %v, want ErrVersionConflict", err)
+	}
+
+	stored, err := repo.GetByPhoneNumber(ctx, "+15551234567")
+	if err != nil {
+		t.Fatalf("GetByPhoneNumber: %v", err)
+	}
+	if stored.Name != "First" {
+		t.Errorf("stored name = %q after a conflicting update, want %q", stored.Name, "First")
+	}
+}
+
+func TestUpdateUnversionedUser(t *testing.T) {
+	repo, db := newTestUserRepository(t)
+	ctx := context.Background()
+
+	// A user written before versioning.
+	user := &models.User{UserID: "user-1", PhoneNumber: "+15551234567", Name: "Ada"}
+	_, err := db.Client().PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(db.Table("users")),
+		Item: testKeys.item(user.GetPK(), user.GetSK(), map[string]types.AttributeValue{
+			"user_id":      &types.AttributeValueMemberS{Value: user.UserID},
+			"phone_number": &types.AttributeValueMemberS{Value: user.PhoneNumber},
+			"name":         &types.AttributeValueMemberS{Value: user.Name},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("PutItem: %v", err)
+	}
+
+	stale := *user
+	user.Name = "Ada L."
+	if err := repo.Update(ctx, user); err != nil {
+		t.Fatalf("Update of an unversioned user: %v", err)
+	}
+	if user.Version != 1 {
+		t.Errorf("updated user has version %d, want 1", user.Version)
+	}
+	if err := repo.Update(ctx, &stale); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("stale Update of a formerly unversioned user = %v, want ErrVersionConflict", err)
+	}
+
+	missing := &models.User{UserID: "user-2", PhoneNumber: "+15557654321"}
+	if err := repo.Update(ctx, missing); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Update of a missing user = %v, want ErrVersionConflict", err)
+	}
+}
+
+// staleReads makes eventually consistent GetItem calls return nothing, as
+// a read from a replica the latest write has not reached yet would.
+func staleReads(o *dynamodb.Options) {
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("StaleReads", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			if get, ok := in.Parameters.(*dynamodb.GetItemInput); ok && !aws.ToBool(get.ConsistentRead) {
+				return middleware.InitializeOutput{Result: &dynamodb.GetItemOutput{}}, middleware.Metadata{}, nil
+			}
+			return next.HandleInitialize(ctx, in)
+		}), middleware.Before)
+	})
+}
+
+// A user created by another request is returned, not created again, even
+// when the first read misses it.
+func TestGetOrCreateAfterStaleRead(t *testing.T) {
+	repo, db := newTestUserRepository(t)
+	ctx := context.Background()
+	existing := &models.User{PhoneNumber: "+15551234567", Name: "Ada"}
+	if err := repo.Create(ctx, existing); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	stale := NewUserRepository(db.Client(staleReads), db.Table("users"), testKeys, false, 3, nil, testLogger())
+	user, created, err := stale.GetOrCreateWithName(ctx, "+15551234567", "Grace")
+	if err != nil {
+		t.Fatalf("GetOrCreateWithName: %v", err)
+	}
+	if created || user.UserID != existing.UserID || user.Name != "Ada" {
+		t.Errorf("GetOrCreateWithName = %s %q, created %v, want the existing user %s %q", user.UserID, user.Name, created, existing.UserID, "Ada")
+	}
+}
+
+// With strongly consistent reads the first read already sees the user.
+func TestStronglyConsistentUserReads(t *testing.T) {
+	repo, db := newTestUserRepository(t)
+	ctx := context.Background()
+	if err := repo.Create(ctx, &models.User{PhoneNumber: "+15551234567"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	eventual := NewUserRepository(db.Client(staleReads), db.Table("users"), testKeys, false, 3, nil, testLogger())
+	if user, err := eventual.GetByPhoneNumber(ctx, "+15551234567"); err != nil || user != nil {
+		t.Fatalf("eventually consistent GetByPhoneNumber = %v, %v, want a stale miss", user, err)
+	}
+	consistent := NewUserRepository(db.Client(staleReads), db.Table("users"), testKeys, true, 3, nil, testLogger())
+	if user, err := consistent.GetByPhoneNumber(ctx, "+15551234567"); err != nil || user == nil {
+		t.Errorf("strongly consistent GetByPhoneNumber = %v, %v, want the user", user, err)
+	}
+}
+
+func TestCreateExistingUser(t *testing.T) {
+	repo, _ := newTestUserRepository(t)
+	ctx := context.Background()
+	if err := repo.Create(ctx, &models.User{PhoneNumber: "+15551234567"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := repo.Create(ctx, &models.User{PhoneNumber: "+15551234567"}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("second Create = %v, want ErrUserExists", err)
+	}
+}
+
+// Concurrent first sign-ins of a number end up with one user between them.
+func TestGetOrCreateRace(t *testing.T) {
+	repo, _ := newTestUserRepository(t)
+	ctx := context.Background()
+
+	const callers = 8
+	var wg sync.WaitGroup
+	users := make([]*models.User, callers)
+	created := make([]bool, callers)
+	errs := make([]error, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			users[i], created[i], errs[i] = repo.GetOrCreateWithName(ctx, "+15551234567", "")
+		}()
+	}
+	wg.Wait()
+
+	creators := 0
+	for i := range callers {
+		if errs[i] != nil {
+			t.Fatalf("GetOrCreateWithName: %v", errs[i])
+		}
+		if users[i].UserID != users[0].UserID {
+			t.Errorf("callers got users %s and %s", users[0].UserID, users[i].UserID)
+		}
+		if created[i] {
+			creators++
+		}
+	}
+	if creators != 1 {
+		t.Errorf("%d callers report creating the user, want 1", creators)
+	}
+}
+
+// failingCreates makes the first n conditional PutItem calls fail with err
+// without writing, and counts every call in attempts.
+func failingCreates(n int, err error, attempts *int) func(*dynamodb.Options) {
+	return func(o *dynamodb.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("FailingCreates", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				if put, ok := in.Parameters.(*dynamodb.PutItemInput); ok && put.ConditionExpression != nil {
+					*attempts++
+					if *attempts <= n {
+						return middleware.InitializeOutput{}, middleware.Metadata{}, err
+					}
+				}
+				return next.HandleInitialize(ctx, in)
+			}), middleware.Before)
+		})
+	}
+}
+
+// A create that collides with a user deleted before the re-read is retried.
+func TestGetOrCreateRetriesVanishedUser(t *testing.T) {
+	_, db := newTestUserRepository(t)
+	attempts := 0
+	conditionFailed := &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	repo := NewUserRepository(db.Client(failingCreates(2, conditionFailed, &attempts)), db.Table("users"), testKeys, true, 2, nil, testLogger())
+
+	user, created, err := repo.GetOrCreateWithName(context.Background(), "+15551234567", "Ada")
+	if err != nil || !created || user.Name != "Ada" {
+		t.Fatalf("GetOrCreateWithName = %+v, %v, %v, want the user created on the last retry", user, created, err)
+	}
+	if attempts != 3 {
+		t.Errorf("%d create attempts, want 3", attempts)
+	}
+	if stored, err := repo.GetByPhoneNumber(context.Background(), "+15551234567"); err != nil || stored == nil || stored.UserID != user.UserID {
+		t.Errorf("stored user = %+v, %v, want %s", stored, err, user.UserID)
+	}
+}
+
+func TestGetOrCreateRetriesExhausted(t *testing.T) {
+	_, db := newTestUserRepository(t)
+	attempts := 0
+	conditionFailed := &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	repo := NewUserRepository(db.Client(failingCreates(10, conditionFailed, &attempts)), db.Table("users"), testKeys, true, 2, nil, testLogger())
+
+	if _, _, err := repo.GetOrCreateWithName(context.Background(), "+15551234567", ""); !errors.Is(err, ErrCreateRetriesExhausted) {
+		t.Fatalf("GetOrCreateWithName = %v, want ErrCreateRetriesExhausted", err)
+	}
+	if attempts != 3 {
+		t.Errorf("%d create attempts, want the first and 2 retries", attempts)
+	}
+}
+
+// Only a failed condition is retried.
+func TestGetOrCreateCreateError(t *testing.T) {
+	_, db := newTestUserRepository(t)
+	attempts := 0
+	repo := NewUserRepository(db.Client(failingCreates(10, errStopped, &attempts)), db.Table("users"), testKeys, true, 2, nil, testLogger())
+
+	if _, _, err := repo.GetOrCreateWithName(context.Background(), "+15551234567", ""); !errors.Is(err, errStopped) {
+		t.Fatalf("GetOrCreateWithName = %v, want the create error", err)
+	}
+	if attempts != 1 {
+		t.Errorf("%d create attempts, want 1", attempts)
+	}
+}
+
+// A user stored before stable IDs existed is given one, and keeps it.
+func TestGetOrCreateAssignsUserID(t *testing.T) {
+	repo, db := newTestUserRepository(t)
+	ctx := context.Background()
+
+	user := &models.User{PhoneNumber: "+15551234567"}
+	_, err := db.Client().PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(db.Table("users")),
+		Item: testKeys.item(user.GetPK(), user.GetSK(), map[string]types.AttributeValue{
+			"phone_number": &types.AttributeValueMemberS{Value: user.PhoneNumber},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("PutItem: %v", err)
+	}
+
+	first, err := repo.GetOrCreate(ctx, "+15551234567")
+	if err != nil || first.UserID == "" {
+		t.Fatalf("GetOrCreate = %+v, %v, want a user ID assigned", first, err)
+	}
+	second, err := repo.GetOrCreate(ctx, "+15551234567")
+	if err != nil || second.UserID != first.UserID {
+		t.Errorf("second GetOrCreate = %+v, %v, want user ID %s kept", second, err, first.UserID)
+	}
+}
+
+// With a cipher, names are encrypted in the table and decrypted on read.
+func TestUserNameEncryptedAtRest(t *testing.T) {
+	_, db := newTestUserRepository(t)
+	c, err := fieldcrypt.New(map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}, "k1")
+	if err != nil {
+		t.Fatalf("fieldcrypt.New: %v", err)
+	}
+	repo := NewUserRepository(db.Client(), db.Table("users"), testKeys, true, 3, c, testLogger())
+	ctx := context.Background()
+	if err := repo.Create(ctx, &models.User{PhoneNumber: "+15551234567", Name: "Ada"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	out, err := db.Client().Scan(ctx, &dynamodb.ScanInput{TableName: aws.String(db.Table("users"))})
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	for _, item := range out.Items {
+		for name, value := range item {
+			if s, ok := value.(*types.AttributeValueMemberS); ok && strings.Contains(s.Value, "Ada") {
+				t.Errorf("attribute %s stores the name in plaintext: %q", name, s.Value)
+			}
+		}
+	}
+
+	if user, err := repo.GetByPhoneNumber(ctx, "+15551234567"); err != nil || user.Name != "Ada" {
+		t.Errorf("GetByPhoneNumber = %+v, %v, want the decrypted name", user, err)
+	}
+	plain := NewUserRepository(db.Client(), db.Table("users"), testKeys, true, 3, nil, testLogger())
+	if _, err := plain.GetByPhoneNumber(ctx, "+15551234567"); !errors.Is(err, fieldcrypt.ErrUnknownKey) {
+		t.Errorf("GetByPhoneNumber without the key = %v, want ErrUnknownKey", err)
+	}
+}
@@ -0,0 +1,34 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/qcom/qcom/internal/tracing"
+)
+
+// WarmUp describes each table once, so that credentials are resolved and
+// connections to DynamoDB are open before the first request needs them.
+// Tables listed more than once are only described once.
+func WarmUp(ctx context.Context, client *dynamodb.Client, tables ...string) error {
+	seen := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		if seen[table] {
+			continue
+		}
+		seen[table] = true
+
+		spanCtx, span := tracing.StartDynamoDBSpan(ctx, "DescribeTable", table)
+		_, err := client.DescribeTable(spanCtx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(table),
+		})
+		tracing.EndSpan(span, err)
+
+		if err != nil {
+			return fmt.Errorf("failed to describe table %s: %w", table, err)
+		}
+	}
+	return nil
+}
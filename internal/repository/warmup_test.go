@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/qcom/qcom/internal/dynamotest"
+)
+
+// countDescribes counts the DescribeTable requests of a client.
+func countDescribes(count *int) func(*dynamodb.Options) {
+	return func(o *dynamodb.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CountDescribes", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				if _, ok := in.Parameters.(*dynamodb.DescribeTableInput); ok {
+					*count++
+				}
+				return next.HandleInitialize(ctx, in)
+			}), middleware.After)
+		})
+	}
+}
+
+// Each table is described once, however often it is listed.
+func TestWarmUp(t *testing.T) {
+	db := dynamotest.New(t)
+	db.CreateTable("main", testKeys.PK, testKeys.SK)
+	db.CreateTable("users", testKeys.PK, testKeys.SK)
+
+	describes := 0
+	client := db.Client(countDescribes(&describes))
+	if err := WarmUp(context.Background(), client, db.Table("main"), db.Table("users"), db.Table("main")); err != nil {
+		t.Fatalf("WarmUp: %v", err)
+	}
+	if describes != 2 {
+		t.Errorf("WarmUp described %d tables, want 2", describes)
+	}
+}
+
+func TestWarmUpMissingTable(t *testing.T) {
+	db := dynamotest.New(t)
+	db.CreateTable("main", testKeys.PK, testKeys.SK)
+
+	err := WarmUp(context.Background(), db.Client(), db.Table("main"), db.Table("missing"))
+	if err == nil || !strings.Contains(err.Error(), db.Table("missing")) {
+		t.Errorf("WarmUp with a missing table = %v, want an error naming it", err)
+	}
+}
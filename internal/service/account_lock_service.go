@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/qcom/qcom/internal/logging"
+	"github.com/qcom/qcom/internal/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// AccountLockedError is returned by AccountLockService.Check while an
+// account is locked. Until is zero when only an admin can unlock it.
+type AccountLockedError struct {
+	Until time.Time
+}
+
+func (e *AccountLockedError) Error() string {
+	if e.Until.IsZero() {
+		return "account is locked until unlocked by an admin"
+	}
+	return fmt.Sprintf("account is locked until %s", e.Until.Format(time.RFC3339))
+}
+
+// AccountLockService locks accounts whose refresh tokens keep being reused,
+// a sign that they were stolen: more than threshold reuse detections within
+// a window lock the phone number out of signing in for duration, or until
+// an admin unlocks it when duration is zero.
+type AccountLockService struct {
+	lockRepo  *repository.AccountLockRepository
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	logger    *logrus.Logger
+}
+
+// NewAccountLockService creates the service. A threshold of zero disables
+// lockouts.
+func NewAccountLockService(lockRepo *repository.AccountLockRepository, threshold int, window, duration time.Duration, logger *logrus.Logger) *AccountLockService {
+	return &AccountLockService{
+		lockRepo:  lockRepo,
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		logger:    logger,
+	}
+}
+
+// Enabled reports whether reuse detections can lock accounts.
+func (s *AccountLockService) Enabled() bool {
+	return s.threshold > 0
+}
+
+// RecordReuse counts a refresh token reuse by phoneNumber and locks the
+// account once the threshold is exceeded. It reports whether it locked the
+// account.
+func (s *AccountLockService) RecordReuse(ctx context.Context, phoneNumber string) (bool, error) {
+	if !s.Enabled() {
+		return false, nil
+	}
+
+	detections, err := s.lockRepo.RecordReuse(ctx, phoneNumber, s.window)
+	if err != nil {
+		return false, err
+	}
+	if detections <= s.threshold {
+		return false, nil
+	}
+
+	var until time.Time
+	if s.duration > 0 {
+		until = time.Now().Add(s.duration)
+	}
+	if err := s.lockRepo.Lock(ctx, phoneNumber, until); err != nil {
+		return false, err
+	}
+
+	logging.LoggerFromContext(ctx, s.logger).WithFields(logrus.Fields{
+		"phone":      logging.LogPhone(phoneNumber),
+		"detections": detections,
+	}).Warn("Account locked after repeated refresh token reuse")
+	return true, nil
+}
+
+// Check returns an *AccountLockedError if phoneNumber's account is locked.
+// Lockouts only happen when enabled, so otherwise nothing is read.
+func (s *AccountLockService) Check(ctx context.Context, phoneNumber string) error {
+	if !s.Enabled() {
+		return nil
+	}
+
+	locked, until, err := s.lockRepo.Get(ctx, phoneNumber)
+	if err != nil {
+		return err
+	}
+	if locked {
+		return &AccountLockedError{Until: until}
+	}
+	return nil
+}
+
+// Unlock lifts any lock on phoneNumber's account.
+func (s *AccountLockService) Unlock(ctx context.Context, phoneNumber string) error {
+	return s.lockRepo.Unlock(ctx, phoneNumber)
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qcom/qcom/internal/dynamotest"
+	"github.com/qcom/qcom/internal/repository"
+)
+
+func newTestAccountLockService(t *testing.T, threshold int, window, duration time.Duration) *AccountLockService {
+	t.Helper()
+	db := dynamotest.New(t)
+	db.CreateTable("main", testKeys.PK, testKeys.SK)
+	repo := repository.NewAccountLockRepository(db.Client(), db.Table("main"), testKeys, testLogger())
+	return NewAccountLockService(repo, threshold, window, duration, testLogger())
+}
+
+func TestAccountLockAfterThreshold(t *testing.T) {
+	svc := newTestAccountLockService(t, 2, time.Hour, time.Hour)
+	ctx := context.Background()
+
+	for i := 1; i <= 3; i++ {
+		locked, err := svc.RecordReuse(ctx, testPhone)
+		if err != nil {
+			t.Fatalf("RecordReuse: %v", err)
+		}
+		if want := i > 2; locked != want {
+			t.Fatalf("detection %d locked = %v, want %v", i, locked, want)
+		}
+	}
+
+	var lockErr *AccountLockedError
+	if err := svc.Check(ctx, testPhone); !errors.As(err, &lockErr) {
+		t.Fatalf("Check after the threshold = %v, want an AccountLockedError", err)
+	}
+	if until := time.Until(lockErr.Until); until <= 0 || until > time.Hour {
+		t.Errorf("locked until %v, want within the hour", lockErr.Until)
+	}
+	if err := svc.Check(ctx, otherPhone); err != nil {
+		t.Errorf("Check of another number = %v, want nil", err)
+	}
+
+	if err := svc.Unlock(ctx, testPhone); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := svc.Check(ctx, testPhone); err != nil {
+		t.Errorf("Check after Unlock = %v, want nil", err)
+	}
+}
+
+// Without a duration the lock lasts until an admin lifts it.
+func TestAccountLockUntilUnlocked(t *testing.T) {
+	svc := newTestAccountLockService(t, 1, time.Hour, 0)
+	ctx := context.Background()
+
+	svc.RecordReuse(ctx, testPhone)
+	if locked, err := svc.RecordReuse(ctx, testPhone); err != nil || !locked {
+		t.Fatalf("RecordReuse = %v, %v, want the account locked", locked, err)
+	}
+	var lockErr *AccountLockedError
+	if err := svc.Check(ctx, testPhone); !errors.As(err, &lockErr) || !lockErr.Until.IsZero() {
+		t.Errorf("Check = %v, want a lock without an expiry", err)
+	}
+}
+
+// Detections are counted per window, so ones in an earlier window do not
+// add up to a lockout.
+func TestAccountLockWindow(t *testing.T) {
+	svc := newTestAccountLockService(t, 1, time.Second, time.Hour)
+	ctx := context.Background()
+
+	svc.RecordReuse(ctx, testPhone)
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	if locked, err := svc.RecordReuse(ctx, testPhone); err != nil || locked {
+		t.Errorf("RecordReuse in a new window = %v, %v, want no lock", locked, err)
+	}
+}
+
+func TestAccountLockDisabled(t *testing.T) {
+	svc := newTestAccountLockService(t, 0, time.Hour, time.Hour)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if locked, err := svc.RecordReuse(ctx, testPhone); err != nil || locked {
+			t.Fatalf("RecordReuse with lockouts disabled = %v, %v, want no lock", locked, err)
+		}
+	}
+	if err := svc.Check(ctx, testPhone); err != nil {
+		t.Errorf("Check with lockouts disabled = %v, want nil", err)
+	}
+}
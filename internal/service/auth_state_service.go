@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/qcom/qcom/internal/logging"
+	"github.com/qcom/qcom/internal/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// AuthStateService removes all authentication state held for a phone
+// number, for flows such as account deletion, admin revocation or a phone
+// number change.
+type AuthStateService struct {
+	userRepo            *repository.UserRepository
+	otpRepo             *repository.OTPRepository
+	rateLimitRepo       *repository.RateLimitRepository
+	refreshTokenService *RefreshTokenService
+	revocationService   *TokenRevocationService
+	accountLocks        *AccountLockService
+	logger              *logrus.Logger
+}
+
+func NewAuthStateService(userRepo *repository.UserRepository, otpRepo *repository.OTPRepository, rateLimitRepo *repository.RateLimitRepository, refreshTokenService *RefreshTokenService, revocationService *TokenRevocationService, accountLocks *AccountLockService, logger *logrus.Logger) *AuthStateService {
+	return &AuthStateService{
+		userRepo:            userRepo,
+		otpRepo:             otpRepo,
+		rateLimitRepo:       rateLimitRepo,
+		refreshTokenService: refreshTokenService,
+		revocationService:   revocationService,
+		accountLocks:        accountLocks,
+		logger:              logger,
+	}
+}
+
+// PurgeUser revokes every refresh token of the user behind phoneNumber and,
+// through the number's epoch, every access token issued so far. It deletes
+// any pending OTP, which also clears its attempt counter and resend
+// cooldown, lifts any account lock and resets the OTP status rate limit.
+// The user record itself is kept.
+//
+// It is idempotent: purging a number with no state, or purging twice,
+// succeeds. Every step is attempted even if an earlier one fails, and the
+// failures are returned together.
+func (s *AuthStateService) PurgeUser(ctx context.Context, phoneNumber string) error {
+	var errs []error
+	revoked := 0
+
+	// Tokens issued before stable user IDs existed are indexed under the
+	// phone number.
+	userIDs := []string{phoneNumber}
+	user, err := s.userRepo.GetByPhoneNumber(ctx, phoneNumber)
+	if err != nil {
+		errs = append(errs, err)
+	} else if user != nil && user.UserID != "" && user.UserID != phoneNumber {
+		userIDs = append(userIDs, user.UserID)
+	}
+
+	for _, userID := range userIDs {
+		n, err := s.refreshTokenService.revokeUser(ctx, userID)
+		revoked += n
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if _, err := s.revocationService.RevokeUserBefore(ctx, phoneNumber, time.Now()); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.otpRepo.Delete(ctx, phoneNumber); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.accountLocks.Unlock(ctx, phoneNumber); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.rateLimitRepo.Reset(ctx, otpStatusBucket(phoneNumber)); err != nil {
+		errs = append(errs, err)
+	}
+
+	log := logging.LoggerFromContext(ctx, s.logger).WithFields(logrus.Fields{
+		"phone":          logging.LogPhone(phoneNumber),
+		"tokens_revoked": revoked,
+	})
+	if err := errors.Join(errs...); err != nil {
+		log.WithError(err).Error("Auth state purge incomplete")
+		return fmt.Errorf("purging auth state: %w", err)
+	}
+
+	log.Info("Purged auth state")
+	return nil
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qcom/qcom/internal/repository"
+)
+
+func TestPurgeUserClearsAllAuthState(t *testing.T) {
+	cfg := testOTPConfig()
+	cfg.StatusRatePerMinute = 1
+	otpService, _, db := newTestOTPService(t, cfg)
+	for _, table := range []string{"users", "tokens", "locks"} {
+		db.CreateTable(table, testKeys.PK, testKeys.SK)
+	}
+	client := db.Client()
+	ctx := context.Background()
+
+	userRepo := repository.NewUserRepository(client, db.Table("users"), testKeys, true, 3, nil, testLogger())
+	refreshTokens := NewRefreshTokenService(repository.NewRefreshTokenRepository(client, db.Table("tokens"), testKeys, testLogger()), false, 0, 0, testLogger())
+	revocations := revocationServiceOn(db)
+	lockRepo := repository.NewAccountLockRepository(client, db.Table("locks"), testKeys, testLogger())
+	accountLocks := NewAccountLockService(lockRepo, 3, time.Hour, time.Hour, testLogger())
+	purger := NewAuthStateService(userRepo, otpService.otpRepo, otpService.rateLimitRepo, refreshTokens, revocations, accountLocks, testLogger())
+
+	user, err := userRepo.GetOrCreate(ctx, testPhone)
+	if err != nil {
+		t.Fatalf("GetOrCreate: %v", err)
+	}
+	if err := refreshTokens.Store(ctx, "refresh-1", user.UserID, testPhone, "family-1", time.Now().Add(time.Hour), 0, ""); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	accessToken := testClaims("access-1", time.Now().Add(-time.Minute))
+	if err := lockRepo.Lock(ctx, testPhone, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if _, err := otpService.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	otpService.Status(ctx, testPhone)
+	if _, err := otpService.Status(ctx, testPhone); !errors.Is(err, ErrStatusRateLimited) {
+		t.Fatalf("second Status = %v, want ErrStatusRateLimited", err)
+	}
+
+	if err := purger.PurgeUser(ctx, testPhone); err != nil {
+		t.Fatalf("PurgeUser: %v", err)
+	}
+
+	if revoked, err := refreshTokens.IsRevoked(ctx, "refresh-1"); !revoked || err != nil {
+		t.Errorf("refresh token revoked = %v, %v, want true", revoked, err)
+	}
+	if revoked, err := revocations.IsRevoked(ctx, accessToken); !revoked || err != nil {
+		t.Errorf("access token revoked = %v, %v, want true", revoked, err)
+	}
+	if _, err := otpService.otpRepo.Get(ctx, testPhone); !errors.Is(err, repository.ErrOTPNotFound) {
+		t.Errorf("pending OTP after purge: %v, want ErrOTPNotFound", err)
+	}
+	if err := accountLocks.Check(ctx, testPhone); err != nil {
+		t.Errorf("account lock after purge: %v", err)
+	}
+	if _, err := otpService.Status(ctx, testPhone); err != nil {
+		t.Errorf("Status after purge = %v, want the rate limit reset", err)
+	}
+
+	if err := purger.PurgeUser(ctx, testPhone); err != nil {
+		t.Errorf("second PurgeUser: %v", err)
+	}
+}
+
+func TestPurgeUserReportsFailures(t *testing.T) {
+	otpService, _, db := newTestOTPService(t, testOTPConfig())
+	client := db.Client()
+
+	// None of the users, tokens or locks tables exist, so those steps fail
+	// while the others still run.
+	userRepo := repository.NewUserRepository(client, db.Table("users"), testKeys, true, 3, nil, testLogger())
+	refreshTokens := NewRefreshTokenService(repository.NewRefreshTokenRepository(client, db.Table("tokens"), testKeys, testLogger()), false, 0, 0, testLogger())
+	accountLocks := NewAccountLockService(repository.NewAccountLockRepository(client, db.Table("locks"), testKeys, testLogger()), 3, time.Hour, time.Hour, testLogger())
+	purger := NewAuthStateService(userRepo, otpService.otpRepo, otpService.rateLimitRepo, refreshTokens, revocationServiceOn(db), accountLocks, testLogger())
+
+	ctx := context.Background()
+	if _, err := otpService.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	if err := purger.PurgeUser(ctx, testPhone); err == nil {
+		t.Fatal("PurgeUser succeeded with its tables missing")
+	}
+	if _, err := otpService.otpRepo.Get(ctx, testPhone); !errors.Is(err, repository.ErrOTPNotFound) {
+		t.Errorf("pending OTP after a partial purge: %v, want it deleted anyway", err)
+	}
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWKS is a JSON Web Key Set (RFC 7517) of the public keys tokens may be
+// signed with.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS returns every verification key, so a key added for an upcoming
+// rotation is published before anything is signed with it. It is empty
+// for HS256, whose secrets must not be published.
+func (s *JWTService) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, k := range s.verificationKeys {
+		publicKey, ok := k.key.(*rsa.PublicKey)
+		if !ok {
+			continue
+		}
+		n, e := rsaComponents(publicKey)
+		set.Keys = append(set.Keys, JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: s.signingMethod.Alg(),
+			Kid: k.id,
+			N:   n,
+			E:   e,
+		})
+	}
+	return set
+}
+
+// loadRSAKey reads a PEM RSA key. A public key is accepted only when the key
+// is not needed for signing.
+func loadRSAKey(file string, forSigning bool) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	pemBytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read key: %w", err)
+	}
+
+	var publicKey *rsa.PublicKey
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes)
+	if err == nil {
+		publicKey = &privateKey.PublicKey
+	} else if !forSigning {
+		publicKey, err = jwt.ParseRSAPublicKeyFromPEM(pemBytes)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse key: %w", err)
+	}
+
+	if publicKey.N.BitLen() < 2048 {
+		return nil, nil, fmt.Errorf("key must be at least 2048 bits")
+	}
+	return privateKey, publicKey, nil
+}
+
+// keyThumbprint is the RFC 7638 thumbprint of publicKey, used as its key ID
+// when none is configured.
+func keyThumbprint(publicKey *rsa.PublicKey) string {
+	n, e := rsaComponents(publicKey)
+	sum := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func rsaComponents(publicKey *rsa.PublicKey) (n, e string) {
+	return base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+}
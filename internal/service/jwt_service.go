@@ -3,65 +3,195 @@ package service
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/qcom/qcom/internal/config"
+	"github.com/qcom/qcom/internal/metrics"
 	"github.com/qcom/qcom/internal/models"
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	ErrAudienceNotAllowed = errors.New("audience not allowed")
+	ErrScopeNotAllowed    = errors.New("scope not allowed")
+)
+
+func init() {
+	// Token epochs have a resolution of one millisecond, so iat needs it
+	// too for a token issued just after an epoch to outlive it.
+	jwt.TimePrecision = time.Millisecond
+}
+
 type JWTService struct {
-	secretKey     []byte
-	accessExpiry  time.Duration
-	refreshExpiry time.Duration
-	logger        *logrus.Logger
+	signingMethod jwt.SigningMethod
+	signingKey    interface{}
+	signingKeyID  string
+	// verificationKeys are tried in order; the first is the current key.
+	verificationKeys []verificationKey
+
+	accessExpiry      time.Duration
+	refreshExpiry     time.Duration
+	exchangeAudiences []string
+	exchangeScopes    []string
+	exchangeExpiry    time.Duration
+	guestExpiry       time.Duration
+	issuedAtSkew      time.Duration
+	logger            *logrus.Logger
+}
+
+// verificationKey is a key tokens are accepted from. id is the kid the key
+// signs with, and is empty for HS256 secrets.
+type verificationKey struct {
+	id  string
+	key interface{}
 }
 
 func NewJWTService(cfg *config.JWTConfig, logger *logrus.Logger) (*JWTService, error) {
-	secretKey := []byte(cfg.SecretKey)
-	if len(secretKey) < 32 {
-		return nil, fmt.Errorf("secret key must be at least 32 bytes")
+	s := &JWTService{
+		accessExpiry:      cfg.AccessExpiry,
+		refreshExpiry:     cfg.RefreshExpiry,
+		exchangeAudiences: cfg.ExchangeAudiences,
+		exchangeScopes:    cfg.ExchangeScopes,
+		exchangeExpiry:    cfg.ExchangeExpiry,
+		guestExpiry:       cfg.GuestExpiry,
+		issuedAtSkew:      cfg.IssuedAtSkew,
+		logger:            logger,
 	}
 
-	return &JWTService{
-		secretKey:     secretKey,
-		accessExpiry:  cfg.AccessExpiry,
-		refreshExpiry: cfg.RefreshExpiry,
-		logger:        logger,
-	}, nil
+	switch cfg.Algorithm {
+	case config.JWTAlgorithmRS256:
+		s.signingMethod = jwt.SigningMethodRS256
+
+		keys := cfg.Keys
+		if len(keys) == 0 {
+			keys = []config.JWTKeyConfig{{Role: config.JWTKeyRoleSign, File: cfg.PrivateKeyFile}}
+		}
+		for _, kc := range keys {
+			signing := kc.Role == config.JWTKeyRoleSign
+			privateKey, publicKey, err := loadRSAKey(kc.File, signing)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", kc.ID, err)
+			}
+			key := verificationKey{id: kc.ID, key: publicKey}
+			if key.id == "" {
+				key.id = keyThumbprint(publicKey)
+			}
+
+			if signing {
+				s.signingKey = privateKey
+				s.signingKeyID = key.id
+				s.verificationKeys = slices.Insert(s.verificationKeys, 0, key)
+			} else {
+				s.verificationKeys = append(s.verificationKeys, key)
+			}
+		}
+		if s.signingKey == nil {
+			return nil, fmt.Errorf("no signing key configured")
+		}
+
+	case config.JWTAlgorithmHS256, "":
+		secretKey := []byte(cfg.SecretKey)
+		if len(secretKey) < 32 {
+			return nil, fmt.Errorf("secret key must be at least 32 bytes")
+		}
+		s.signingMethod = jwt.SigningMethodHS256
+		s.signingKey = secretKey
+		s.verificationKeys = []verificationKey{{key: secretKey}}
+
+		if cfg.PreviousSecretKey != "" {
+			previousSecretKey := []byte(cfg.PreviousSecretKey)
+			if len(previousSecretKey) < 32 {
+				return nil, fmt.Errorf("previous secret key must be at least 32 bytes")
+			}
+			s.verificationKeys = append(s.verificationKeys, verificationKey{key: previousSecretKey})
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", cfg.Algorithm)
+	}
+
+	return s, nil
 }
 
+// ACROTP is the acr claim of tokens whose holder authenticated with an OTP.
+const ACROTP = "otp"
+
 type Claims struct {
 	Phone string `json:"phone"`
 	Type  string `json:"type"`
 	JTI   string `json:"jti"`
+	Scope string `json:"scope,omitempty"`
+
+	// AuthTime is when the user last verified an OTP. Refreshed tokens keep
+	// the original time, so it tells how recently the user actually
+	// authenticated. Tokens issued before it existed lack it.
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	ACR      string           `json:"acr,omitempty"`
+
+	// Guest marks an anonymous guest token, whose subject is a guest ID
+	// rather than a user ID and which has no phone number.
+	Guest bool `json:"guest,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func (s *JWTService) GenerateAccessToken(phoneNumber string) (*models.TokenPair, string, error) {
+// ScopeGuest is the only scope of guest tokens.
+const ScopeGuest = "guest"
+
+// Scopes returns the scopes in the token's scope claim.
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// AuthenticatedAt returns AuthTime, or the zero time if the token has none.
+func (c *Claims) AuthenticatedAt() time.Time {
+	if c.AuthTime == nil {
+		return time.Time{}
+	}
+	return c.AuthTime.Time
+}
+
+// authClaims returns the auth_time and acr claims for authTime, or neither
+// if it is unknown.
+func authClaims(authTime time.Time) (*jwt.NumericDate, string) {
+	if authTime.IsZero() {
+		return nil, ""
+	}
+	return jwt.NewNumericDate(authTime), ACROTP
+}
+
+// GenerateAccessToken issues a token pair in a new family. authTime is when
+// the user last verified an OTP.
+func (s *JWTService) GenerateAccessToken(userID, phoneNumber string, authTime time.Time) (*models.TokenPair, string, error) {
 	now := time.Now()
 	accessJTI := uuid.New().String()
 	refreshJTI := uuid.New().String()
 	familyID := uuid.New().String()
+	authTimeClaim, acr := authClaims(authTime)
 
 	// Generate access token
 	accessClaims := &Claims{
 		Phone: phoneNumber,
 		Type:  "access",
 		JTI:   accessJTI,
+		Scope: s.userScope(),
+
+		AuthTime: authTimeClaim,
+		ACR:      acr,
 		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   phoneNumber,
+			Subject:   userID,
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(s.accessExpiry)),
 			ID:        accessJTI,
 		},
 	}
 
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessTokenString, err := accessToken.SignedString(s.secretKey)
+	accessTokenString, err := s.sign(accessClaims)
 	if err != nil {
 		s.logger.WithError(err).Error("Failed to sign access token")
 		return nil, "", fmt.Errorf("failed to sign access token: %w", err)
@@ -72,21 +202,27 @@ func (s *JWTService) GenerateAccessToken(phoneNumber string) (*models.TokenPair,
 		Phone: phoneNumber,
 		Type:  "refresh",
 		JTI:   refreshJTI,
+		Scope: s.userScope(),
+
+		AuthTime: authTimeClaim,
+		ACR:      acr,
 		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   phoneNumber,
+			Subject:   userID,
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(s.refreshExpiry)),
 			ID:        refreshJTI,
 		},
 	}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshTokenString, err := refreshToken.SignedString(s.secretKey)
+	refreshTokenString, err := s.sign(refreshClaims)
 	if err != nil {
 		s.logger.WithError(err).Error("Failed to sign refresh token")
 		return nil, "", fmt.Errorf("failed to sign refresh token: %w", err)
 	}
 
+	metrics.TokenIssued(metrics.TokenTypeAccess)
+	metrics.TokenIssued(metrics.TokenTypeRefresh)
+
 	return &models.TokenPair{
 		AccessToken:  accessTokenString,
 		RefreshToken: refreshTokenString,
@@ -96,15 +232,74 @@ func (s *JWTService) GenerateAccessToken(phoneNumber string) (*models.TokenPair,
 }
 
 func (s *JWTService) VerifyToken(tokenString string) (*Claims, error) {
+	// A token naming a known key is checked against that key only.
+	keys := s.verificationKeys
+	if kid := tokenKeyID(tokenString); kid != "" {
+		for _, k := range s.verificationKeys {
+			if k.id == kid {
+				keys = []verificationKey{k}
+				break
+			}
+		}
+	}
+
+	claims, err := s.parseToken(tokenString, keys[0].key)
+
+	// During rotation, tokens signed with a previous secret or key remain
+	// valid until it is removed from configuration.
+	for _, k := range keys[1:] {
+		if err == nil || !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			break
+		}
+		claims, err = s.parseToken(tokenString, k.key)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	// The parser's leeway would stretch expiry too, so only iat is given
+	// this tolerance.
+	if claims.IssuedAt != nil && claims.IssuedAt.After(time.Now().Add(s.issuedAtSkew)) {
+		return nil, fmt.Errorf("failed to parse token: %w", jwt.ErrTokenUsedBeforeIssued)
+	}
+
+	return claims, nil
+}
+
+// sign signs claims with the current key, naming it in the kid header so
+// verifiers can pick it from the JWKS.
+func (s *JWTService) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.signingMethod, claims)
+	if s.signingKeyID != "" {
+		token.Header["kid"] = s.signingKeyID
+	}
+	return token.SignedString(s.signingKey)
+}
+
+// tokenKeyID returns the kid header of tokenString without verifying it.
+func tokenKeyID(tokenString string) string {
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, &jwt.RegisteredClaims{})
+	if err != nil {
+		return ""
+	}
+	kid, _ := token.Header["kid"].(string)
+	return kid
+}
+
+func (s *JWTService) parseToken(tokenString string, key interface{}) (*Claims, error) {
+	// Require the exact configured algorithm rather than just its family, so
+	// a token can never pick which key type it is verified against.
+	alg := s.signingMethod.Alg()
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		if token.Method.Alg() != alg {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return s.secretKey, nil
-	})
+		return key, nil
+	}, jwt.WithValidMethods([]string{alg}))
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse token: %w", err)
+		return nil, err
 	}
 
 	claims, ok := token.Claims.(*Claims)
@@ -115,7 +310,10 @@ func (s *JWTService) VerifyToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
-func (s *JWTService) RefreshTokens(refreshTokenString string, familyID string) (*models.TokenPair, string, error) {
+// RefreshTokens issues a new token pair for a valid refresh token. userID is
+// passed explicitly so that tokens issued before stable user IDs existed,
+// whose subject is the phone number, are re-issued with the stable ID.
+func (s *JWTService) RefreshTokens(refreshTokenString, userID, familyID string) (*models.TokenPair, string, error) {
 	claims, err := s.VerifyToken(refreshTokenString)
 	if err != nil {
 		return nil, "", fmt.Errorf("invalid refresh token: %w", err)
@@ -126,13 +324,14 @@ func (s *JWTService) RefreshTokens(refreshTokenString string, familyID string) (
 	}
 
 	// Generate new token pair with existing family ID
-	return s.GenerateAccessTokenWithFamily(claims.Phone, familyID)
+	return s.GenerateAccessTokenWithFamily(userID, claims.Phone, familyID, claims.AuthenticatedAt())
 }
 
-func (s *JWTService) GenerateAccessTokenWithFamily(phoneNumber string, familyID string) (*models.TokenPair, string, error) {
+func (s *JWTService) GenerateAccessTokenWithFamily(userID, phoneNumber, familyID string, authTime time.Time) (*models.TokenPair, string, error) {
 	now := time.Now()
 	accessJTI := uuid.New().String()
 	refreshJTI := uuid.New().String()
+	authTimeClaim, acr := authClaims(authTime)
 
 	// Use provided family ID or generate new one
 	if familyID == "" {
@@ -144,16 +343,19 @@ func (s *JWTService) GenerateAccessTokenWithFamily(phoneNumber string, familyID
 		Phone: phoneNumber,
 		Type:  "access",
 		JTI:   accessJTI,
+		Scope: s.userScope(),
+
+		AuthTime: authTimeClaim,
+		ACR:      acr,
 		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   phoneNumber,
+			Subject:   userID,
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(s.accessExpiry)),
 			ID:        accessJTI,
 		},
 	}
 
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessTokenString, err := accessToken.SignedString(s.secretKey)
+	accessTokenString, err := s.sign(accessClaims)
 	if err != nil {
 		s.logger.WithError(err).Error("Failed to sign access token")
 		return nil, "", fmt.Errorf("failed to sign access token: %w", err)
@@ -164,21 +366,27 @@ func (s *JWTService) GenerateAccessTokenWithFamily(phoneNumber string, familyID
 		Phone: phoneNumber,
 		Type:  "refresh",
 		JTI:   refreshJTI,
+		Scope: s.userScope(),
+
+		AuthTime: authTimeClaim,
+		ACR:      acr,
 		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   phoneNumber,
+			Subject:   userID,
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(s.refreshExpiry)),
 			ID:        refreshJTI,
 		},
 	}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshTokenString, err := refreshToken.SignedString(s.secretKey)
+	refreshTokenString, err := s.sign(refreshClaims)
 	if err != nil {
 		s.logger.WithError(err).Error("Failed to sign refresh token")
 		return nil, "", fmt.Errorf("failed to sign refresh token: %w", err)
 	}
 
+	metrics.TokenIssued(metrics.TokenTypeAccess)
+	metrics.TokenIssued(metrics.TokenTypeRefresh)
+
 	return &models.TokenPair{
 		AccessToken:  accessTokenString,
 		RefreshToken: refreshTokenString,
@@ -187,6 +395,161 @@ func (s *JWTService) GenerateAccessTokenWithFamily(phoneNumber string, familyID
 	}, familyID, nil
 }
 
+// GenerateAccessTokenOnly issues an access token without a refresh token, for
+// clients that re-authenticate instead of refreshing.
+func (s *JWTService) GenerateAccessTokenOnly(userID, phoneNumber string, authTime time.Time) (*models.TokenPair, error) {
+	now := time.Now()
+	accessJTI := uuid.New().String()
+	authTimeClaim, acr := authClaims(authTime)
+
+	accessClaims := &Claims{
+		Phone: phoneNumber,
+		Type:  "access",
+		JTI:   accessJTI,
+		Scope: s.userScope(),
+
+		AuthTime: authTimeClaim,
+		ACR:      acr,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.accessExpiry)),
+			ID:        accessJTI,
+		},
+	}
+
+	accessTokenString, err := s.sign(accessClaims)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to sign access token")
+		return nil, fmt.Errorf("failed to sign access token: %w", err)
+	}
+
+	metrics.TokenIssued(metrics.TokenTypeAccess)
+
+	return &models.TokenPair{
+		AccessToken: accessTokenString,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.accessExpiry.Seconds()),
+	}, nil
+}
+
+// GenerateGuestToken issues an access token for a new anonymous guest and
+// returns it with the guest's ID. Guests get no refresh token; a guest who
+// wants to keep their session past its expiry upgrades to an account.
+func (s *JWTService) GenerateGuestToken() (*models.TokenPair, string, error) {
+	now := time.Now()
+	jti := uuid.New().String()
+	guestID := uuid.New().String()
+
+	claims := &Claims{
+		Type:  "access",
+		JTI:   jti,
+		Scope: ScopeGuest,
+		Guest: true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   guestID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.guestExpiry)),
+			ID:        jti,
+		},
+	}
+
+	tokenString, err := s.sign(claims)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to sign guest token")
+		return nil, "", fmt.Errorf("failed to sign guest token: %w", err)
+	}
+
+	metrics.TokenIssued(metrics.TokenTypeAccess)
+
+	return &models.TokenPair{
+		AccessToken: tokenString,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.guestExpiry.Seconds()),
+	}, guestID, nil
+}
+
+// userScope is the scope claim of user tokens: every scope users hold.
+func (s *JWTService) userScope() string {
+	return strings.Join(s.exchangeScopes, " ")
+}
+
+// GenerateExchangedToken mints a short-lived access token for the user of
+// held, the token being exchanged, restricted to the given audiences and to
+// scopes, which held must carry. It is used by token exchange, which leaves
+// the caller's refresh token untouched.
+func (s *JWTService) GenerateExchangedToken(held *Claims, userID string, audiences, scopes []string) (string, int64, error) {
+	if len(audiences) == 0 {
+		return "", 0, ErrAudienceNotAllowed
+	}
+	for _, audience := range audiences {
+		if !slices.Contains(s.exchangeAudiences, audience) {
+			return "", 0, fmt.Errorf("%w: %s", ErrAudienceNotAllowed, audience)
+		}
+	}
+	// A scope no longer configured is refused even if held still carries it.
+	for _, scope := range scopes {
+		if !slices.Contains(held.Scopes(), scope) || !slices.Contains(s.exchangeScopes, scope) {
+			return "", 0, fmt.Errorf("%w: %s", ErrScopeNotAllowed, scope)
+		}
+	}
+
+	now := time.Now()
+	jti := uuid.New().String()
+
+	claims := &Claims{
+		Phone: held.Phone,
+		Type:  "access",
+		JTI:   jti,
+		Scope: strings.Join(scopes, " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
+			Audience:  jwt.ClaimStrings(audiences),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.exchangeExpiry)),
+			ID:        jti,
+		},
+	}
+
+	tokenString, err := s.sign(claims)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to sign exchanged token")
+		return "", 0, fmt.Errorf("failed to sign exchanged token: %w", err)
+	}
+
+	metrics.TokenIssued(metrics.TokenTypeAccess)
+
+	return tokenString, int64(s.exchangeExpiry.Seconds()), nil
+}
+
+// GenerateOTPStatusToken mints a token, valid until expiresAt, that lets the
+// client that initiated an OTP for phoneNumber check its status. Its type
+// keeps it from being accepted anywhere else.
+func (s *JWTService) GenerateOTPStatusToken(phoneNumber string, expiresAt time.Time) (string, error) {
+	now := time.Now()
+	jti := uuid.New().String()
+
+	claims := &Claims{
+		Phone: phoneNumber,
+		Type:  "otp_status",
+		JTI:   jti,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   phoneNumber,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			ID:        jti,
+		},
+	}
+
+	tokenString, err := s.sign(claims)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to sign OTP status token")
+		return "", fmt.Errorf("failed to sign OTP status token: %w", err)
+	}
+
+	return tokenString, nil
+}
+
 func GenerateSecretKey() (string, error) {
 	key := make([]byte, 32) // 256 bits
 	if _, err := rand.Read(key); err != nil {
@@ -0,0 +1,343 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/qcom/qcom/internal/config"
+)
+
+func testJWTConfig() *config.JWTConfig {
+	return &config.JWTConfig{
+		SecretKey:         "test-secret-key-of-at-least-32-bytes",
+		AccessExpiry:      15 * time.Minute,
+		RefreshExpiry:     24 * time.Hour,
+		ExchangeAudiences: []string{"billing", "reports"},
+		ExchangeScopes:    []string{"read"},
+		ExchangeExpiry:    5 * time.Minute,
+		IssuedAtSkew:      5 * time.Second,
+	}
+}
+
+func newTestJWTService(t *testing.T, cfg *config.JWTConfig) *JWTService {
+	t.Helper()
+	svc, err := NewJWTService(cfg, testLogger())
+	if err != nil {
+		t.Fatalf("NewJWTService: %v", err)
+	}
+	return svc
+}
+
+// refreshClaims returns the claims of a refresh token svc issues.
+func refreshClaims(t *testing.T, svc *JWTService) *Claims {
+	t.Helper()
+	pair, _, err := svc.GenerateAccessToken("user-1", testPhone, time.Now())
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	claims, err := svc.VerifyToken(pair.RefreshToken)
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+	return claims
+}
+
+func TestExchangedTokenListsEveryAudience(t *testing.T) {
+	svc := newTestJWTService(t, testJWTConfig())
+
+	token, _, err := svc.GenerateExchangedToken(refreshClaims(t, svc), "user-1", []string{"billing", "reports"}, []string{"read"})
+	if err != nil {
+		t.Fatalf("GenerateExchangedToken: %v", err)
+	}
+	claims, err := svc.VerifyToken(token)
+	if err != nil {
+		t.Fatalf("VerifyToken: %v", err)
+	}
+	if !slices.Equal(claims.Audience, []string{"billing", "reports"}) {
+		t.Errorf("aud = %v, want both audiences", claims.Audience)
+	}
+}
+
+func TestExchangedTokenRefusesUnlistedAudience(t *testing.T) {
+	svc := newTestJWTService(t, testJWTConfig())
+	held := refreshClaims(t, svc)
+
+	for _, audiences := range [][]string{nil, {"admin"}, {"billing", "admin"}} {
+		if _, _, err := svc.GenerateExchangedToken(held, "user-1", audiences, nil); !errors.Is(err, ErrAudienceNotAllowed) {
+			t.Errorf("GenerateExchangedToken(%v) = %v, want ErrAudienceNotAllowed", audiences, err)
+		}
+	}
+}
+
+func TestExchangedTokenScopesMustBeHeld(t *testing.T) {
+	cfg := testJWTConfig()
+	svc := newTestJWTService(t, cfg)
+	held := refreshClaims(t, svc)
+	if !slices.Equal(held.Scopes(), []string{"read"}) {
+		t.Fatalf("refresh token scopes = %v, want the configured ones", held.Scopes())
+	}
+
+	if _, _, err := svc.GenerateExchangedToken(held, "user-1", []string{"billing"}, []string{"read"}); err != nil {
+		t.Errorf("GenerateExchangedToken of a held scope: %v", err)
+	}
+	if _, _, err := svc.GenerateExchangedToken(held, "user-1", []string{"billing"}, []string{"write"}); !errors.Is(err, ErrScopeNotAllowed) {
+		t.Errorf("GenerateExchangedToken of a scope not held = %v, want ErrScopeNotAllowed", err)
+	}
+
+	// Configuring a scope later does not grant it to tokens issued before.
+	cfg.ExchangeScopes = []string{"read", "write"}
+	widened := newTestJWTService(t, cfg)
+	if _, _, err := widened.GenerateExchangedToken(held, "user-1", []string{"billing"}, []string{"write"}); !errors.Is(err, ErrScopeNotAllowed) {
+		t.Errorf("GenerateExchangedToken of a scope configured after issuance = %v, want ErrScopeNotAllowed", err)
+	}
+
+	// Nor does a token keep a scope that is no longer configured.
+	cfg.ExchangeScopes = nil
+	narrowed := newTestJWTService(t, cfg)
+	if _, _, err := narrowed.GenerateExchangedToken(held, "user-1", []string{"billing"}, []string{"read"}); !errors.Is(err, ErrScopeNotAllowed) {
+		t.Errorf("GenerateExchangedToken of a scope no longer configured = %v, want ErrScopeNotAllowed", err)
+	}
+}
+
+// writeRSAKey writes a new 2048-bit RSA private key to a PEM file and
+// returns its path and the key.
+func writeRSAKey(t *testing.T) (string, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "key.pem")
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("writing RSA key: %v", err)
+	}
+	return file, key
+}
+
+// forgedClaims are claims VerifyToken would accept if they were signed with
+// the right algorithm and key.
+func forgedClaims() *Claims {
+	now := time.Now()
+	return &Claims{
+		Phone: testPhone,
+		Type:  "access",
+		JTI:   "forged",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "user-1",
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	}
+}
+
+// A token signed with the HS256 secret under another HMAC algorithm, or not
+// signed at all, is refused.
+func TestVerifyTokenRejectsOtherAlgorithms(t *testing.T) {
+	cfg := testJWTConfig()
+	svc := newTestJWTService(t, cfg)
+
+	for _, method := range []jwt.SigningMethod{jwt.SigningMethodHS384, jwt.SigningMethodHS512} {
+		token, err := jwt.NewWithClaims(method, forgedClaims()).SignedString([]byte(cfg.SecretKey))
+		if err != nil {
+			t.Fatalf("signing with %s: %v", method.Alg(), err)
+		}
+		if _, err := svc.VerifyToken(token); err == nil {
+			t.Errorf("VerifyToken accepted a token signed with %s", method.Alg())
+		}
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodNone, forgedClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("signing with none: %v", err)
+	}
+	if _, err := svc.VerifyToken(token); err == nil {
+		t.Error("VerifyToken accepted an unsigned token")
+	}
+}
+
+// An RS256 verifier must not accept an HS256 token whose secret is the
+// published public key.
+func TestVerifyTokenRejectsAlgorithmConfusion(t *testing.T) {
+	file, key := writeRSAKey(t)
+	cfg := testJWTConfig()
+	cfg.Algorithm = config.JWTAlgorithmRS256
+	cfg.PrivateKeyFile = file
+	svc := newTestJWTService(t, cfg)
+
+	pair, _, err := svc.GenerateAccessToken("user-1", testPhone, time.Now())
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	if _, err := svc.VerifyToken(pair.AccessToken); err != nil {
+		t.Fatalf("VerifyToken of an RS256 token: %v", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("encoding public key: %v", err)
+	}
+	for _, secret := range [][]byte{
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		der,
+		key.PublicKey.N.Bytes(),
+	} {
+		forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, forgedClaims()).SignedString(secret)
+		if err != nil {
+			t.Fatalf("signing with HS256: %v", err)
+		}
+		if _, err := svc.VerifyToken(forged); err == nil {
+			t.Error("VerifyToken accepted an HS256 token keyed with the public key")
+		}
+	}
+}
+
+// Tokens signed with the previous secret are accepted while it is still
+// configured, and new tokens are signed with the current one.
+func TestVerifyTokenWithPreviousSecret(t *testing.T) {
+	oldCfg := testJWTConfig()
+	old := newTestJWTService(t, oldCfg)
+	pair, _, err := old.GenerateAccessToken("user-1", testPhone, time.Now())
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+
+	cfg := testJWTConfig()
+	cfg.SecretKey = "rotated-secret-key-of-at-least-32-bytes"
+	cfg.PreviousSecretKey = oldCfg.SecretKey
+	rotating := newTestJWTService(t, cfg)
+	if _, err := rotating.VerifyToken(pair.AccessToken); err != nil {
+		t.Errorf("VerifyToken of a token signed with the previous secret: %v", err)
+	}
+
+	fresh, _, err := rotating.GenerateAccessToken("user-1", testPhone, time.Now())
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	if _, err := old.VerifyToken(fresh.AccessToken); err == nil {
+		t.Error("a new token verified with the previous secret, want it signed with the current one")
+	}
+
+	cfg.PreviousSecretKey = ""
+	rotated := newTestJWTService(t, cfg)
+	if _, err := rotated.VerifyToken(pair.AccessToken); err == nil {
+		t.Error("VerifyToken accepted a token signed with a secret no longer configured")
+	}
+}
+
+// A token minted by an instance whose clock runs ahead verifies as long as
+// its iat is within IssuedAtSkew of this instance's clock.
+func TestVerifyTokenIssuedAtSkew(t *testing.T) {
+	svc := newTestJWTService(t, testJWTConfig())
+
+	for _, tc := range []struct {
+		ahead time.Duration
+		ok    bool
+	}{
+		{0, true},
+		{3 * time.Second, true},
+		{30 * time.Second, false},
+	} {
+		token, err := svc.sign(testClaims("jti-1", time.Now().Add(tc.ahead)))
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		_, err = svc.VerifyToken(token)
+		if tc.ok && err != nil {
+			t.Errorf("VerifyToken of a token issued %v ahead: %v", tc.ahead, err)
+		}
+		if !tc.ok && !errors.Is(err, jwt.ErrTokenUsedBeforeIssued) {
+			t.Errorf("VerifyToken of a token issued %v ahead = %v, want ErrTokenUsedBeforeIssued", tc.ahead, err)
+		}
+	}
+}
+
+func TestNewJWTServiceRejectsShortPreviousSecret(t *testing.T) {
+	cfg := testJWTConfig()
+	cfg.PreviousSecretKey = "too-short"
+	if _, err := NewJWTService(cfg, testLogger()); err == nil {
+		t.Error("NewJWTService accepted a previous secret shorter than 32 bytes")
+	}
+}
+
+// rotationService is an RS256 service over keys, given as kid:role pairs of
+// the files in files.
+func rotationService(t *testing.T, files map[string]string, keys ...string) *JWTService {
+	t.Helper()
+	cfg := testJWTConfig()
+	cfg.SecretKey = ""
+	cfg.Algorithm = config.JWTAlgorithmRS256
+	for _, key := range keys {
+		id, role, _ := strings.Cut(key, ":")
+		cfg.Keys = append(cfg.Keys, config.JWTKeyConfig{ID: id, Role: role, File: files[id]})
+	}
+	return newTestJWTService(t, cfg)
+}
+
+// Through each phase of a rotation every token signed in the previous phase
+// still verifies, and the JWKS lists each key that may be in use.
+func TestKeyRotationPhases(t *testing.T) {
+	oldFile, _ := writeRSAKey(t)
+	newFile, _ := writeRSAKey(t)
+	files := map[string]string{"old": oldFile, "new": newFile}
+
+	phases := []struct {
+		name   string
+		keys   []string
+		signer string
+	}{
+		{"old signs", []string{"old:sign"}, "old"},
+		{"new published", []string{"old:sign", "new:verify"}, "old"},
+		{"new signs", []string{"new:sign", "old:verify"}, "new"},
+		{"old retired", []string{"new:sign"}, "new"},
+	}
+
+	var previous string
+	for _, phase := range phases {
+		svc := rotationService(t, files, phase.keys...)
+
+		var published []string
+		for _, key := range svc.JWKS().Keys {
+			published = append(published, key.Kid)
+		}
+		if len(published) != len(phase.keys) || published[0] != phase.signer {
+			t.Errorf("%s: JWKS lists %v, want %d keys with %s first", phase.name, published, len(phase.keys), phase.signer)
+		}
+
+		if previous != "" {
+			if _, err := svc.VerifyToken(previous); err != nil {
+				t.Errorf("%s: token from the previous phase: %v", phase.name, err)
+			}
+		}
+
+		pair, _, err := svc.GenerateAccessToken("user-1", testPhone, time.Now())
+		if err != nil {
+			t.Fatalf("%s: GenerateAccessToken: %v", phase.name, err)
+		}
+		if kid := tokenKeyID(pair.AccessToken); kid != phase.signer {
+			t.Errorf("%s: token signed with kid %q, want %q", phase.name, kid, phase.signer)
+		}
+		if _, err := svc.VerifyToken(pair.AccessToken); err != nil {
+			t.Errorf("%s: VerifyToken of its own token: %v", phase.name, err)
+		}
+		previous = pair.AccessToken
+	}
+
+	oldToken, _, err := rotationService(t, files, "old:sign").GenerateAccessToken("user-1", testPhone, time.Now())
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %v", err)
+	}
+	if _, err := rotationService(t, files, "new:sign").VerifyToken(oldToken.AccessToken); err == nil {
+		t.Error("VerifyToken accepted a token signed with a retired key")
+	}
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/qcom/qcom/internal/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Prefixes identifying the algorithm of a stored OTP hash. Argon2id hashes
+// use the PHC string format; bcrypt hashes carry their own "$2a$"/"$2b$"
+// prefix, so hashes written before algorithms were selectable still verify.
+const (
+	argon2idPrefix = "$argon2id$"
+	hmacPrefix     = "$hmac-sha256$"
+	bcryptPrefix   = "$2"
+)
+
+// Argon2id parameters for new hashes (RFC 9106 / OWASP minimums). They are
+// encoded into each hash, so changing them does not break stored OTPs.
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// errMalformedOTPHash is returned when a stored hash has an unknown
+// algorithm marker or cannot be parsed for its marked algorithm.
+var errMalformedOTPHash = errors.New("malformed OTP hash")
+
+// errUnknownPepper is returned when a stored hash was peppered with a
+// pepper this instance no longer, or never did, accept.
+var errUnknownPepper = errors.New("OTP hashed with an unknown pepper")
+
+// hashOTP hashes otp with the configured algorithm, prefixed with its
+// marker, and returns the version of the pepper mixed in.
+func (s *OTPService) hashOTP(ctx context.Context, otp string) (hash, version string, err error) {
+	pepper, version, err := s.peppers.Current(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	secret := peppered(pepper, otp)
+
+	switch s.cfg.HashAlgorithm {
+	case config.OTPHashArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", "", err
+		}
+		key := argon2.IDKey(secret, salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+			argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), version, nil
+	case config.OTPHashHMAC:
+		// pepper already keyed the HMAC; config requires a pepper here.
+		return hmacPrefix + string(secret), version, nil
+	default:
+		hashed, err := bcrypt.GenerateFromPassword(secret, bcrypt.DefaultCost)
+		if err != nil {
+			return "", "", err
+		}
+		return string(hashed), version, nil
+	}
+}
+
+// burnOTPCheck spends about as long as checking otp against a stored hash,
+// for verifications that fail before any hash is checked. Otherwise a fast
+// failure would tell a caller that no OTP is pending for the number.
+func (s *OTPService) burnOTPCheck(ctx context.Context, otp string) {
+	s.hashOTP(ctx, otp)
+}
+
+// checkOTPHash reports whether otp matches encoded, dispatching on the
+// algorithm marker stored with the hash rather than the current setting, and
+// peppering with the pepper of the stored version.
+func (s *OTPService) checkOTPHash(ctx context.Context, encoded, version, otp string) (bool, error) {
+	pepper, ok, err := s.peppers.Lookup(ctx, version)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, fmt.Errorf("%w: version %q", errUnknownPepper, version)
+	}
+	secret := peppered(pepper, otp)
+
+	switch {
+	case strings.HasPrefix(encoded, argon2idPrefix):
+		return checkArgon2id(encoded, secret)
+	case strings.HasPrefix(encoded, hmacPrefix):
+		if pepper == "" {
+			return false, fmt.Errorf("%w: HMAC hash but no pepper configured", errMalformedOTPHash)
+		}
+		want := strings.TrimPrefix(encoded, hmacPrefix)
+		return subtle.ConstantTimeCompare([]byte(want), secret) == 1, nil
+	case strings.HasPrefix(encoded, bcryptPrefix):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), secret)
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("%w: %w", errMalformedOTPHash, err)
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("%w: unknown algorithm", errMalformedOTPHash)
+	}
+}
+
+func checkArgon2id(encoded string, secret []byte) (bool, error) {
+	// "$argon2id$v=19$m=...,t=...,p=...$salt$key" splits into 6 parts.
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("%w: argon2id hash has %d fields", errMalformedOTPHash, len(parts))
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("%w: unsupported argon2 version %q", errMalformedOTPHash, parts[2])
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, fmt.Errorf("%w: argon2id parameters: %w", errMalformedOTPHash, err)
+	}
+	// argon2.IDKey panics on zero iterations or threads.
+	if iterations == 0 || threads == 0 {
+		return false, fmt.Errorf("%w: argon2id parameters %q", errMalformedOTPHash, parts[3])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("%w: argon2id salt: %w", errMalformedOTPHash, err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, fmt.Errorf("%w: argon2id key", errMalformedOTPHash)
+	}
+
+	got := argon2.IDKey(secret, salt, iterations, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// peppered mixes pepper into otp with HMAC-SHA256 so that a leaked hash
+// cannot be brute-forced offline without the server secret. With no pepper
+// the OTP is hashed as-is.
+func peppered(pepper, otp string) []byte {
+	if pepper == "" {
+		return []byte(otp)
+	}
+
+	mac := hmac.New(sha256.New, []byte(pepper))
+	mac.Write([]byte(otp))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/qcom/qcom/internal/config"
+)
+
+func TestOTPHashAlgorithms(t *testing.T) {
+	ctx := context.Background()
+	for algorithm, prefix := range map[string]string{
+		config.OTPHashBcrypt:   bcryptPrefix,
+		config.OTPHashArgon2id: argon2idPrefix,
+		config.OTPHashHMAC:     hmacPrefix,
+	} {
+		cfg := testOTPConfig()
+		cfg.HashAlgorithm = algorithm
+		svc, _, _ := newTestOTPService(t, cfg)
+
+		hash, version, err := svc.hashOTP(ctx, "123456")
+		if err != nil {
+			t.Fatalf("%s: hashOTP: %v", algorithm, err)
+		}
+		if !strings.HasPrefix(hash, prefix) || strings.Contains(hash, "123456") {
+			t.Errorf("%s: hash %q, want a %s hash that hides the OTP", algorithm, hash, prefix)
+		}
+		if ok, err := svc.checkOTPHash(ctx, hash, version, "123456"); !ok || err != nil {
+			t.Errorf("%s: checkOTPHash with the OTP = %v, %v, want true", algorithm, ok, err)
+		}
+		if ok, err := svc.checkOTPHash(ctx, hash, version, "654321"); ok || err != nil {
+			t.Errorf("%s: checkOTPHash with another OTP = %v, %v, want false", algorithm, ok, err)
+		}
+	}
+}
+
+// OTPs hashed before the algorithm changed still verify afterwards.
+func TestOTPHashMigration(t *testing.T) {
+	cfg := testOTPConfig()
+	cfg.HashAlgorithm = config.OTPHashBcrypt
+	old, sender, db := newTestOTPService(t, cfg)
+	ctx := context.Background()
+	if _, err := old.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+
+	migrated := testOTPConfig()
+	migrated.HashAlgorithm = config.OTPHashArgon2id
+	svc, _ := otpServiceOn(db, migrated)
+	if valid, err := svc.VerifyOTP(ctx, testPhone, sender.last(testPhone), ""); !valid || err != nil {
+		t.Errorf("VerifyOTP of a bcrypt OTP after switching to argon2id = %v, %v, want true", valid, err)
+	}
+}
+
+func TestCheckOTPHashMalformed(t *testing.T) {
+	svc, _, _ := newTestOTPService(t, testOTPConfig())
+
+	for _, hash := range []string{
+		"plaintext",
+		"$argon2id$v=19$m=19456,t=2,p=1$c2FsdA",
+		"$argon2id$v=18$m=19456,t=2,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=19456,t=0,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=19456,t=2,p=1$!!!$a2V5",
+		"$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$",
+		"$2a$10$short",
+	} {
+		if _, err := svc.checkOTPHash(context.Background(), hash, "", "123456"); !errors.Is(err, errMalformedOTPHash) {
+			t.Errorf("checkOTPHash(%q) = %v, want errMalformedOTPHash", hash, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/qcom/qcom/internal/config"
+	"github.com/qcom/qcom/internal/repository"
+)
+
+// ErrPepperRotationInProgress is returned by RotatePepper while OTPs hashed
+// with an earlier pepper may still be outstanding.
+var ErrPepperRotationInProgress = errors.New("a previous OTP pepper is still accepted")
+
+// noPepperVersion is the version of OTPs hashed without a pepper.
+const noPepperVersion = "none"
+
+// pepperVersion identifies pepper in stored OTPs without revealing it: the
+// first bytes of an HMAC keyed by the pepper.
+func pepperVersion(pepper string) string {
+	if pepper == "" {
+		return noPepperVersion
+	}
+	mac := hmac.New(sha256.New, []byte(pepper))
+	mac.Write([]byte("otp-pepper-version"))
+	return hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+// pepperStateTTL is how long an instance trusts its copy of the pepper
+// state before reading it again, and so how long after a rotation it may go
+// on hashing new OTPs with the replaced pepper.
+const pepperStateTTL = 10 * time.Second
+
+// pepperRing resolves pepper versions to the peppers in the configuration,
+// following the rotation state shared by every instance through DynamoDB.
+// New OTPs are hashed with the current pepper. The one it replaced keeps
+// verifying until the window set at rotation ends; the configured previous
+// and next peppers always verify, so an instance whose copy of the state is
+// stale still checks OTPs hashed by one that is not.
+type pepperRing struct {
+	otpRepo *repository.OTPRepository
+	// peppers maps the version of each configured pepper to the pepper.
+	peppers map[string]string
+	// initialVersion is the version of the configured pepper, which new
+	// OTPs are hashed with until the first rotation. OTPs stored without a
+	// version were hashed with it too.
+	initialVersion string
+	// alwaysAccepted are the versions of the configured previous and
+	// next peppers.
+	alwaysAccepted []string
+
+	mu        sync.Mutex
+	state     repository.PepperState
+	fetchedAt time.Time
+}
+
+func newPepperRing(otpRepo *repository.OTPRepository, cfg *config.OTPConfig) *pepperRing {
+	r := &pepperRing{
+		otpRepo:        otpRepo,
+		peppers:        map[string]string{pepperVersion(cfg.Pepper): cfg.Pepper},
+		initialVersion: pepperVersion(cfg.Pepper),
+	}
+	for _, pepper := range []string{cfg.PreviousPepper, cfg.NextPepper} {
+		if pepper != "" {
+			r.peppers[pepperVersion(pepper)] = pepper
+			r.alwaysAccepted = append(r.alwaysAccepted, pepperVersion(pepper))
+		}
+	}
+	return r
+}
+
+// load returns the pepper state, read from DynamoDB when the copy held is
+// older than pepperStateTTL or fresh is set.
+func (r *pepperRing) load(ctx context.Context, fresh bool) (repository.PepperState, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !fresh && !r.fetchedAt.IsZero() && time.Since(r.fetchedAt) < pepperStateTTL {
+		return r.state, nil
+	}
+
+	state, err := r.otpRepo.GetPepperState(ctx)
+	if err != nil {
+		return repository.PepperState{}, err
+	}
+	if state == nil {
+		state = &repository.PepperState{CurrentVersion: r.initialVersion}
+	}
+	r.state, r.fetchedAt = *state, time.Now()
+	return r.state, nil
+}
+
+// Current returns the pepper new OTPs are hashed with and its version.
+func (r *pepperRing) Current(ctx context.Context) (pepper, version string, err error) {
+	state, err := r.load(ctx, false)
+	if err != nil {
+		return "", "", err
+	}
+	pepper, ok := r.peppers[state.CurrentVersion]
+	if !ok {
+		return "", "", fmt.Errorf("%w: current version %q is not configured", errUnknownPepper, state.CurrentVersion)
+	}
+	return pepper, state.CurrentVersion, nil
+}
+
+// Lookup returns the pepper with the given version, if it is still accepted.
+func (r *pepperRing) Lookup(ctx context.Context, version string) (string, bool, error) {
+	if version == "" {
+		version = r.initialVersion
+	}
+	pepper, ok := r.peppers[version]
+	if !ok {
+		return "", false, nil
+	}
+	if slices.Contains(r.alwaysAccepted, version) {
+		return pepper, true, nil
+	}
+
+	state, err := r.load(ctx, false)
+	if err != nil {
+		return "", false, err
+	}
+	if version == state.CurrentVersion || (version == state.PreviousVersion && time.Now().Before(state.PreviousUntil)) {
+		return pepper, true, nil
+	}
+	return "", false, nil
+}
+
+// Rotate makes pepper current on every instance. The pepper it replaces
+// keeps verifying for window, long enough for every OTP hashed with it to
+// expire.
+func (r *pepperRing) Rotate(ctx context.Context, pepper string, window time.Duration) (previousUntil time.Time, err error) {
+	version := pepperVersion(pepper)
+	if configured, ok := r.peppers[version]; !ok || configured != pepper {
+		return time.Time{}, ErrInvalidPepper
+	}
+
+	state, err := r.load(ctx, true)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if version == state.CurrentVersion {
+		return time.Time{}, ErrInvalidPepper
+	}
+	now := time.Now()
+	if state.PreviousVersion != "" && now.Before(state.PreviousUntil) {
+		return time.Time{}, ErrPepperRotationInProgress
+	}
+
+	next := repository.PepperState{
+		CurrentVersion:  version,
+		PreviousVersion: state.CurrentVersion,
+		PreviousUntil:   now.Add(window),
+	}
+	err = r.otpRepo.SwapPepperState(ctx, state.CurrentVersion, next)
+	if errors.Is(err, repository.ErrPepperStateChanged) {
+		return time.Time{}, ErrPepperRotationInProgress
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	r.mu.Lock()
+	r.state, r.fetchedAt = next, now
+	r.mu.Unlock()
+	return next.PreviousUntil, nil
+}
+
+// ErrInvalidPepper is returned by RotatePepper for a pepper that is not in
+// the configuration or is already current.
+var ErrInvalidPepper = errors.New("invalid OTP pepper")
+
+// RotatePepper makes pepper, which must be one of the configured peppers,
+// the one new OTPs are hashed with on every instance. OTPs hashed with the
+// pepper it replaces keep verifying until they expire, after which the
+// returned time has passed and another rotation is allowed. Instances pick
+// the rotation up within pepperStateTTL, so the window covers OTPs they hash
+// with the old pepper until then.
+func (s *OTPService) RotatePepper(ctx context.Context, pepper string) (version string, previousUntil time.Time, err error) {
+	if pepper == "" {
+		return "", time.Time{}, ErrInvalidPepper
+	}
+
+	previousUntil, err = s.peppers.Rotate(ctx, pepper, s.cfg.Expiry+pepperStateTTL)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return pepperVersion(pepper), previousUntil, nil
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/qcom/qcom/internal/config"
+	"github.com/qcom/qcom/internal/dynamotest"
+)
+
+func rotatableOTPConfig() *config.OTPConfig {
+	cfg := testOTPConfig()
+	cfg.NextPepper = "new pepper"
+	return cfg
+}
+
+// endPepperWindow ends the window of the last rotation without waiting for
+// OTP expiry.
+func endPepperWindow(t *testing.T, db *dynamotest.DB) {
+	t.Helper()
+	_, err := db.Client().UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(db.Table("otps")),
+		Key:              map[string]types.AttributeValue{"PK": &types.AttributeValueMemberS{Value: "OTP_PEPPER"}, "SK": &types.AttributeValueMemberS{Value: "STATE"}},
+		UpdateExpression: aws.String("SET PreviousUntil = :until"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":until": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("ending the pepper window: %v", err)
+	}
+}
+
+func TestRotatePepperAcrossInstances(t *testing.T) {
+	rotating, rotatingSender, db := newTestOTPService(t, rotatableOTPConfig())
+	other, otherSender := otpServiceOn(db, rotatableOTPConfig())
+	ctx := context.Background()
+
+	if _, err := rotating.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	before := rotatingSender.last(testPhone)
+	// The other instance reads the state now, so it still hashes with the
+	// old pepper right after the rotation.
+	if _, err := other.GenerateOTP(ctx, "+15550002222"); err != nil {
+		t.Fatalf("GenerateOTP on the other instance: %v", err)
+	}
+
+	version, previousUntil, err := rotating.RotatePepper(ctx, "new pepper")
+	if err != nil {
+		t.Fatalf("RotatePepper: %v", err)
+	}
+	if version != pepperVersion("new pepper") {
+		t.Errorf("RotatePepper version = %q, want %q", version, pepperVersion("new pepper"))
+	}
+	if until := time.Until(previousUntil); until < testOTPConfig().Expiry || until > testOTPConfig().Expiry+pepperStateTTL {
+		t.Errorf("previous pepper accepted for %v, want OTP expiry plus the state TTL", until)
+	}
+
+	if _, err := rotating.GenerateOTP(ctx, otherPhone); err != nil {
+		t.Fatalf("GenerateOTP after rotation: %v", err)
+	}
+	if _, err := other.GenerateOTP(ctx, "+15550001111"); err != nil {
+		t.Fatalf("GenerateOTP on the other instance after rotation: %v", err)
+	}
+
+	// Each instance verifies the other's OTPs, old pepper and new.
+	if valid, err := other.VerifyOTP(ctx, testPhone, before, ""); !valid || err != nil {
+		t.Errorf("VerifyOTP of an OTP sent before the rotation = %v, %v, want true", valid, err)
+	}
+	if valid, err := other.VerifyOTP(ctx, otherPhone, rotatingSender.last(otherPhone), ""); !valid || err != nil {
+		t.Errorf("VerifyOTP of an OTP sent with the new pepper = %v, %v, want true", valid, err)
+	}
+	for _, phone := range []string{"+15550002222", "+15550001111"} {
+		if valid, err := rotating.VerifyOTP(ctx, phone, otherSender.last(phone), ""); !valid || err != nil {
+			t.Errorf("VerifyOTP of the other instance's OTP for %s = %v, %v, want true", phone, valid, err)
+		}
+	}
+}
+
+func TestRotatePepperSurvivesRestart(t *testing.T) {
+	svc, _, db := newTestOTPService(t, rotatableOTPConfig())
+	ctx := context.Background()
+
+	if _, _, err := svc.RotatePepper(ctx, "new pepper"); err != nil {
+		t.Fatalf("RotatePepper: %v", err)
+	}
+
+	restarted, _ := otpServiceOn(db, rotatableOTPConfig())
+	if _, err := restarted.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	otpData, err := restarted.otpRepo.Get(ctx, testPhone)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if otpData.PepperVersion != pepperVersion("new pepper") {
+		t.Errorf("OTP hashed with pepper version %q after a restart, want the rotated-to %q", otpData.PepperVersion, pepperVersion("new pepper"))
+	}
+	if _, _, err := restarted.RotatePepper(ctx, "pepper"); !errors.Is(err, ErrPepperRotationInProgress) {
+		t.Errorf("RotatePepper after a restart during the window = %v, want ErrPepperRotationInProgress", err)
+	}
+}
+
+func TestRotatePepperRefused(t *testing.T) {
+	svc, _, db := newTestOTPService(t, rotatableOTPConfig())
+	ctx := context.Background()
+
+	for _, pepper := range []string{"", "pepper", "unconfigured"} {
+		if _, _, err := svc.RotatePepper(ctx, pepper); !errors.Is(err, ErrInvalidPepper) {
+			t.Errorf("RotatePepper(%q) = %v, want ErrInvalidPepper", pepper, err)
+		}
+	}
+	if _, _, err := svc.RotatePepper(ctx, "new pepper"); err != nil {
+		t.Fatalf("RotatePepper: %v", err)
+	}
+
+	other, _ := otpServiceOn(db, rotatableOTPConfig())
+	if _, _, err := other.RotatePepper(ctx, "pepper"); !errors.Is(err, ErrPepperRotationInProgress) {
+		t.Errorf("RotatePepper on another instance during the window = %v, want ErrPepperRotationInProgress", err)
+	}
+}
+
+func TestRotatePepperWindowEnds(t *testing.T) {
+	svc, sender, db := newTestOTPService(t, rotatableOTPConfig())
+	ctx := context.Background()
+
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	if _, _, err := svc.RotatePepper(ctx, "new pepper"); err != nil {
+		t.Fatalf("RotatePepper: %v", err)
+	}
+	endPepperWindow(t, db)
+
+	other, _ := otpServiceOn(db, rotatableOTPConfig())
+	if valid, _ := other.VerifyOTP(ctx, testPhone, sender.last(testPhone), ""); valid {
+		t.Error("VerifyOTP accepted an OTP hashed with a pepper no longer accepted")
+	}
+	if _, _, err := other.RotatePepper(ctx, "pepper"); err != nil {
+		t.Errorf("RotatePepper after the window = %v, want nil", err)
+	}
+}
+
+func TestPreviousPepperFromConfig(t *testing.T) {
+	svc, sender, db := newTestOTPService(t, testOTPConfig())
+	ctx := context.Background()
+
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	otp := sender.last(testPhone)
+
+	// Another instance, already deployed with the next pepper.
+	cfg := testOTPConfig()
+	cfg.Pepper = "new pepper"
+	withoutPrevious, _ := otpServiceOn(db, cfg)
+	if valid, _ := withoutPrevious.VerifyOTP(ctx, testPhone, otp, ""); valid {
+		t.Fatal("VerifyOTP accepted an OTP hashed with an unknown pepper")
+	}
+
+	cfg.PreviousPepper = "pepper"
+	withPrevious, _ := otpServiceOn(db, cfg)
+	if valid, err := withPrevious.VerifyOTP(ctx, testPhone, otp, ""); !valid || err != nil {
+		t.Errorf("VerifyOTP with the old pepper as OTP_PREVIOUS_PEPPER = %v, %v, want true", valid, err)
+	}
+
+	// A configured previous pepper does not hold up rotation.
+	cfg.NextPepper = "third pepper"
+	withNext, _ := otpServiceOn(db, cfg)
+	if _, _, err := withNext.RotatePepper(ctx, "third pepper"); err != nil {
+		t.Errorf("RotatePepper with OTP_PREVIOUS_PEPPER set = %v, want nil", err)
+	}
+}
@@ -3,78 +3,389 @@ package service
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"math/big"
+	"slices"
 	"time"
 
 	"github.com/qcom/qcom/internal/config"
+	"github.com/qcom/qcom/internal/delivery"
+	"github.com/qcom/qcom/internal/logging"
+	"github.com/qcom/qcom/internal/metrics"
 	"github.com/qcom/qcom/internal/models"
+	"github.com/qcom/qcom/internal/phone"
 	"github.com/qcom/qcom/internal/repository"
+	"github.com/qcom/qcom/internal/tracing"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// OTPActiveError is returned by GenerateOTP when the number already has an
+// unexpired OTP and the resend cooldown has not passed.
+type OTPActiveError struct {
+	ExpiresAt time.Time
+	RetryAt   time.Time
+}
+
+func (e *OTPActiveError) Error() string {
+	return fmt.Sprintf("an OTP is still active until %s", e.ExpiresAt.Format(time.RFC3339))
+}
+
+// OTPAttemptsExhaustedError is returned by GenerateOTP when the number's
+// attempts are used up and would carry over to a new OTP, until RetryAt.
+type OTPAttemptsExhaustedError struct {
+	RetryAt time.Time
+}
+
+func (e *OTPAttemptsExhaustedError) Error() string {
+	return fmt.Sprintf("OTP attempts exhausted until %s", e.RetryAt.Format(time.RFC3339))
+}
+
+// ErrServiceBusy is returned by GenerateOTP when the global send budget is
+// exhausted or no concurrent send slot frees up in time.
+var ErrServiceBusy = errors.New("OTP send budget exhausted")
+
+// ErrStatusRateLimited is returned by Status when the phone number's status
+// checks exceed OTPConfig.StatusRatePerMinute.
+var ErrStatusRateLimited = errors.New("too many OTP status checks")
+
+// ErrGenerationInProgress is returned by GenerateOTP when another request is
+// already generating an OTP for the same phone number.
+var ErrGenerationInProgress = errors.New("OTP generation already in progress")
+
+// ErrInvalidNonce is returned by VerifyOTP when verification nonces are
+// required and the nonce is missing, wrong or already used.
+var ErrInvalidNonce = errors.New("invalid verification nonce")
+
+// globalOTPBucket is the rate limit bucket shared by all OTP sends.
+const globalOTPBucket = "OTP_GLOBAL"
+
+// otpStatusBucket is the rate limit bucket of phoneNumber's status checks.
+func otpStatusBucket(phoneNumber string) string {
+	return "OTP_STATUS#" + phoneNumber
+}
+
+// testNumberChannel is reported as the delivery channel of test numbers.
+const testNumberChannel = "none"
+
+// generationLockTTL bounds how long a crashed request can block OTP
+// generation for its phone number. It covers a send that fails over across
+// both delivery channels.
+const generationLockTTL = 30 * time.Second
+
 type OTPService struct {
-	otpRepo *repository.OTPRepository
-	cfg     *config.OTPConfig
-	logger  *logrus.Logger
+	otpRepo       *repository.OTPRepository
+	rateLimitRepo *repository.RateLimitRepository
+	sender        delivery.Sender
+	cfg           *config.OTPConfig
+	peppers       *pepperRing
+	// sendSlots holds a token per OTP being sent, when MaxConcurrentSends
+	// is set.
+	sendSlots chan struct{}
+	logger    *logrus.Logger
 }
 
-func NewOTPService(otpRepo *repository.OTPRepository, cfg *config.OTPConfig, logger *logrus.Logger) *OTPService {
-	return &OTPService{
-		otpRepo: otpRepo,
-		cfg:     cfg,
-		logger:  logger,
+func NewOTPService(otpRepo *repository.OTPRepository, rateLimitRepo *repository.RateLimitRepository, sender delivery.Sender, cfg *config.OTPConfig, logger *logrus.Logger) *OTPService {
+	s := &OTPService{
+		otpRepo:       otpRepo,
+		rateLimitRepo: rateLimitRepo,
+		sender:        sender,
+		cfg:           cfg,
+		peppers:       newPepperRing(otpRepo, cfg),
+		logger:        logger,
+	}
+	if cfg.MaxConcurrentSends > 0 {
+		s.sendSlots = make(chan struct{}, cfg.MaxConcurrentSends)
 	}
+	return s
 }
 
-func (s *OTPService) GenerateOTP(phoneNumber string) (string, error) {
-	// Generate random OTP
-	otp, err := s.generateRandomOTP(s.cfg.Length)
+// OTPDelivery describes where a generated OTP was sent.
+type OTPDelivery struct {
+	// Channel is the delivery channel that succeeded, after any failover.
+	Channel string
+	// Destination is the masked phone number, set only when
+	// OTPConfig.ReturnDestination is enabled.
+	Destination string
+	// ExpiresAt is when the OTP stops being accepted.
+	ExpiresAt time.Time
+	// Nonce must be passed to VerifyOTP; it is only set when
+	// OTPConfig.RequireVerificationNonce is enabled.
+	Nonce string
+	// TestNumber is set when the number is one of OTPConfig.TestNumbers,
+	// whose fixed OTP was stored but not delivered.
+	TestNumber bool
+}
+
+// OTPStatus describes the pending OTP for a phone number, if any.
+type OTPStatus struct {
+	Pending           bool
+	ExpiresIn         time.Duration
+	AttemptsRemaining int
+}
+
+func (s *OTPService) GenerateOTP(ctx context.Context, phoneNumber string) (result *OTPDelivery, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "OTPService.GenerateOTP",
+		trace.WithAttributes(tracing.PhoneAttributes(phoneNumber)...))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	// Serialize generation per number, so concurrent requests can't each
+	// store and send a different code.
+	lockToken, err := s.otpRepo.AcquireGenerationLock(ctx, phoneNumber, generationLockTTL)
+	if err != nil {
+		return nil, err
+	}
+	if lockToken == "" {
+		return nil, ErrGenerationInProgress
+	}
+	defer func() {
+		if err := s.otpRepo.ReleaseGenerationLock(context.WithoutCancel(ctx), phoneNumber, lockToken); err != nil {
+			logging.LoggerFromContext(ctx, s.logger).WithError(err).Warn("Failed to release OTP generation lock")
+		}
+	}()
+
+	attempts, firstCreatedAt, err := s.checkExistingOTP(ctx, phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	// Taken before the global budget, so a request refused here doesn't
+	// use up a send it never makes.
+	release, err := s.acquireSendSlot(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate OTP: %w", err)
+		return nil, err
+	}
+	defer release()
+
+	// Test numbers are never sent anything, so they don't use the send
+	// budget either. Allowlisted callers do: the budget protects the SMS
+	// bill rather than any one number.
+	testOTP, isTestNumber := s.cfg.TestNumbers[phoneNumber]
+
+	if s.cfg.GlobalRatePerMinute > 0 && !isTestNumber {
+		ok, err := s.rateLimitRepo.Take(ctx, globalOTPBucket, s.cfg.GlobalRatePerMinute, s.cfg.GlobalBurst)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			logging.LoggerFromContext(ctx, s.logger).Warn("Global OTP send budget exhausted")
+			return nil, ErrServiceBusy
+		}
+	}
+
+	// Generate random OTP
+	otp := testOTP
+	if !isTestNumber {
+		otp, err = s.generateRandomOTP(s.cfg.Length)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate OTP: %w", err)
+		}
 	}
 
 	// Hash OTP before storing
-	hashedOTP, err := bcrypt.GenerateFromPassword([]byte(otp), bcrypt.DefaultCost)
+	hashedOTP, pepperVersion, err := s.hashOTP(ctx, otp)
 	if err != nil {
-		return "", fmt.Errorf("failed to hash OTP: %w", err)
+		return nil, fmt.Errorf("failed to hash OTP: %w", err)
 	}
 
 	// Store OTP data in DynamoDB
+	now := time.Now()
+	if firstCreatedAt.IsZero() {
+		firstCreatedAt = now
+	}
 	otpData := models.OTPData{
-		OTPHash:   string(hashedOTP),
-		Phone:     phoneNumber,
-		Attempts:  0,
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(s.cfg.Expiry),
+		OTPHash:        hashedOTP,
+		PepperVersion:  pepperVersion,
+		Phone:          phoneNumber,
+		Attempts:       attempts,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(s.cfg.Expiry),
+		FirstCreatedAt: firstCreatedAt,
+	}
+	if s.cfg.RequireVerificationNonce {
+		otpData.Nonce, err = generateNonce()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate verification nonce: %w", err)
+		}
 	}
 
-	ctx := context.Background()
-	if err := s.otpRepo.Store(ctx, phoneNumber, otpData); err != nil {
-		return "", err
+	if err := s.otpRepo.StoreWithAudit(ctx, phoneNumber, otpData, "OTP_ISSUED"); err != nil {
+		return nil, err
 	}
 
-	// Store plain OTP for testing purposes
-	if err := s.otpRepo.StoreTestOTP(ctx, phoneNumber, otp, otpData.ExpiresAt); err != nil {
-		s.logger.WithError(err).Warn("Failed to store test OTP")
+	channel := testNumberChannel
+	if isTestNumber {
+		logging.LoggerFromContext(ctx, s.logger).WithField("phone", logging.LogPhone(phoneNumber)).Info("Test number, OTP not delivered")
+	} else {
+		channel, err = s.sender.Send(ctx, phoneNumber, otp)
+		if err != nil {
+			// Nobody received the code, so it must not stay verifiable.
+			if delErr := s.otpRepo.Delete(context.WithoutCancel(ctx), phoneNumber); delErr != nil {
+				logging.LoggerFromContext(ctx, s.logger).WithError(delErr).Error("Failed to delete undelivered OTP")
+			}
+			return nil, fmt.Errorf("failed to deliver OTP: %w", err)
+		}
+
+		logging.LoggerFromContext(ctx, s.logger).WithFields(logrus.Fields{
+			"phone":   logging.LogPhone(phoneNumber),
+			"channel": channel,
+		}).Info("OTP delivered")
+	}
+
+	result = &OTPDelivery{Channel: channel, ExpiresAt: otpData.ExpiresAt, Nonce: otpData.Nonce, TestNumber: isTestNumber}
+	if s.cfg.ReturnDestination {
+		result.Destination = logging.LogPhone(phoneNumber)
 	}
+	return result, nil
+}
 
-	// Log OTP (for development - remove in production)
-	s.logger.WithFields(logrus.Fields{
-		"phone": phoneNumber,
-		"otp":   otp,
-	}).Info("OTP generated (logged for development)")
+// acquireSendSlot waits up to SendSlotWait for one of the
+// MaxConcurrentSends slots, returning ErrServiceBusy if none frees up. The
+// returned func gives the slot back.
+func (s *OTPService) acquireSendSlot(ctx context.Context) (func(), error) {
+	if s.sendSlots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-s.sendSlots }
 
-	return otp, nil
+	select {
+	case s.sendSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	timer := time.NewTimer(s.cfg.SendSlotWait)
+	defer timer.Stop()
+	select {
+	case s.sendSlots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		logging.LoggerFromContext(ctx, s.logger).Warn("No free OTP send slot")
+		return nil, ErrServiceBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
-func (s *OTPService) VerifyOTP(phoneNumber, otp string) (bool, error) {
-	ctx := context.Background()
+// Status reports whether phoneNumber has a pending OTP without counting an
+// attempt against it.
+func (s *OTPService) Status(ctx context.Context, phoneNumber string) (*OTPStatus, error) {
+	if s.cfg.StatusRatePerMinute > 0 {
+		ok, err := s.rateLimitRepo.Take(ctx, otpStatusBucket(phoneNumber), s.cfg.StatusRatePerMinute, s.cfg.StatusRatePerMinute)
+		if err != nil {
+			return nil, err
+		}
+		if !ok && !s.bypassRateLimit(ctx, "otp_status", phoneNumber) {
+			return nil, ErrStatusRateLimited
+		}
+	}
 
-	// Get OTP data from DynamoDB
 	otpData, err := s.otpRepo.Get(ctx, phoneNumber)
+	if errors.Is(err, repository.ErrOTPNotFound) {
+		return &OTPStatus{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Attempts past MaxAttempts lock the OTP out, as in VerifyOTP.
+	expiresIn := time.Until(otpData.ExpiresAt)
+	if expiresIn <= 0 || otpData.Attempts >= s.cfg.MaxAttempts {
+		return &OTPStatus{}, nil
+	}
+
+	return &OTPStatus{
+		Pending:           true,
+		ExpiresIn:         expiresIn,
+		AttemptsRemaining: s.cfg.MaxAttempts - otpData.Attempts,
+	}, nil
+}
+
+// checkExistingOTP applies the re-initiate policy to any unexpired OTP
+// already stored for phoneNumber. It returns the attempt count the new OTP
+// starts with and the creation time of the first OTP of its run, both
+// carried over from the existing one unless ResetAttemptsOnResend is set.
+// Attempts carry over for Expiry from the first OTP of the run, so resends
+// cannot extend a lockout; while they are used up, no new OTP is issued.
+func (s *OTPService) checkExistingOTP(ctx context.Context, phoneNumber string) (int, time.Time, error) {
+	existing, err := s.otpRepo.Get(ctx, phoneNumber)
+	if errors.Is(err, repository.ErrOTPNotFound) {
+		return 0, time.Time{}, nil
+	}
 	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	now := time.Now()
+	if now.After(existing.ExpiresAt) {
+		return 0, time.Time{}, nil
+	}
+
+	if s.cfg.Reinitiate == config.OTPReinitiateReject {
+		retryAt := existing.CreatedAt.Add(s.cfg.ResendCooldown)
+		if now.Before(retryAt) && !s.bypassRateLimit(ctx, "otp_resend_cooldown", phoneNumber) {
+			return 0, time.Time{}, &OTPActiveError{ExpiresAt: existing.ExpiresAt, RetryAt: retryAt}
+		}
+	}
+
+	attempts, firstCreatedAt := 0, time.Time{}
+	if !s.cfg.ResetAttemptsOnResend {
+		firstCreatedAt = existing.FirstCreatedAt
+		if firstCreatedAt.IsZero() {
+			firstCreatedAt = existing.CreatedAt
+		}
+		carryUntil := firstCreatedAt.Add(s.cfg.Expiry)
+		if now.Before(carryUntil) {
+			if existing.Attempts >= s.cfg.MaxAttempts {
+				return 0, time.Time{}, &OTPAttemptsExhaustedError{RetryAt: carryUntil}
+			}
+			attempts = existing.Attempts
+		} else {
+			firstCreatedAt = time.Time{}
+		}
+	}
+
+	logging.LoggerFromContext(ctx, s.logger).WithFields(logrus.Fields{
+		"phone":      logging.LogPhone(phoneNumber),
+		"expires_in": existing.ExpiresAt.Sub(now).Round(time.Second).String(),
+		"attempts":   attempts,
+	}).Info("Replacing unexpired OTP")
+	return attempts, firstCreatedAt, nil
+}
+
+// VerifyOTP checks otp against the number's pending OTP. nonce is ignored
+// unless OTPConfig.RequireVerificationNonce is enabled.
+func (s *OTPService) VerifyOTP(ctx context.Context, phoneNumber, otp, nonce string) (valid bool, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "OTPService.VerifyOTP",
+		trace.WithAttributes(tracing.PhoneAttributes(phoneNumber)...))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	start := time.Now()
+	result := metrics.OTPResultExpired
+	defer func() { metrics.ObserveOTPVerify(result, start) }()
+
+	// HMAC hashes are deterministic, so a correct code can be checked and
+	// consumed in one conditional write. Anything else falls through to the
+	// usual checks on the OTP the write returns. A missing nonce can't be
+	// matched, so it is left to those checks to reject.
+	var otpData *models.OTPData
+	if s.cfg.HashAlgorithm == config.OTPHashHMAC && (nonce != "" || !s.cfg.RequireVerificationNonce) {
+		var consumed bool
+		otpData, consumed, err = s.consumeIfMatches(ctx, phoneNumber, otp, nonce)
+		if consumed {
+			result = metrics.OTPResultSuccess
+			return true, nil
+		}
+	} else {
+		otpData, err = s.otpRepo.Get(ctx, phoneNumber)
+	}
+	if err != nil {
+		if errors.Is(err, repository.ErrOTPNotFound) {
+			s.burnOTPCheck(ctx, otp)
+		}
 		return false, err
 	}
 
@@ -82,30 +393,121 @@ func (s *OTPService) VerifyOTP(phoneNumber, otp string) (bool, error) {
 	if time.Now().After(otpData.ExpiresAt) {
 		// Delete expired OTP
 		s.otpRepo.Delete(ctx, phoneNumber)
+		s.burnOTPCheck(ctx, otp)
 		return false, fmt.Errorf("OTP expired")
 	}
 
-	// Check attempts
-	if otpData.Attempts >= s.cfg.MaxAttempts {
-		// Delete OTP after max attempts
-		s.otpRepo.Delete(ctx, phoneNumber)
+	// A wrong nonce reveals nothing about the code, so it is rejected
+	// before an attempt is counted.
+	if s.cfg.RequireVerificationNonce && (nonce == "" || subtle.ConstantTimeCompare([]byte(nonce), []byte(otpData.Nonce)) != 1) {
+		result = metrics.OTPResultInvalid
+		return false, ErrInvalidNonce
+	}
+
+	// Count this attempt before comparing. The increment is atomic and
+	// conditional, so concurrent guesses cannot slip past the limit.
+	// Attempts 1..MaxAttempts are compared; any later one is refused and
+	// locks the OTP out.
+	_, err = s.otpRepo.IncrementAttempts(ctx, phoneNumber, s.cfg.MaxAttempts)
+	if errors.Is(err, repository.ErrOTPLocked) {
+		result = metrics.OTPResultLocked
+		// Delete OTP after max attempts, unless it has to stay to carry
+		// the attempt count over to resends.
+		if s.cfg.ResetAttemptsOnResend {
+			s.otpRepo.Delete(ctx, phoneNumber)
+		}
+		s.burnOTPCheck(ctx, otp)
 		return false, fmt.Errorf("maximum attempts exceeded")
 	}
+	if err != nil {
+		return false, err
+	}
 
 	// Verify OTP
-	err = bcrypt.CompareHashAndPassword([]byte(otpData.OTPHash), []byte(otp))
+	match, err := s.checkOTPHash(ctx, otpData.OTPHash, otpData.PepperVersion, otp)
 	if err != nil {
-		// Increment attempts
-		otpData.Attempts++
-		s.otpRepo.Store(ctx, phoneNumber, *otpData)
+		logging.LoggerFromContext(ctx, s.logger).WithError(err).Error("Failed to check stored OTP hash")
+	}
+	if !match {
+		result = metrics.OTPResultInvalid
 		return false, fmt.Errorf("invalid OTP")
 	}
 
-	// OTP verified successfully, delete it
-	s.otpRepo.Delete(ctx, phoneNumber)
+	// OTP verified successfully, delete it. With nonces the delete is
+	// conditional, so of several replays of the same request only one
+	// succeeds.
+	if s.cfg.RequireVerificationNonce {
+		if err := s.otpRepo.DeleteWithNonce(ctx, phoneNumber, nonce); err != nil {
+			result = metrics.OTPResultInvalid
+			if errors.Is(err, repository.ErrNonceMismatch) {
+				return false, ErrInvalidNonce
+			}
+			return false, err
+		}
+	} else {
+		s.otpRepo.Delete(ctx, phoneNumber)
+	}
+	result = metrics.OTPResultSuccess
 	return true, nil
 }
 
+// consumeIfMatches deletes phoneNumber's OTP if otp, hashed with the current
+// pepper, matches it. Otherwise it returns the stored OTP.
+func (s *OTPService) consumeIfMatches(ctx context.Context, phoneNumber, otp, nonce string) (*models.OTPData, bool, error) {
+	hash, _, err := s.hashOTP(ctx, otp)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to hash OTP: %w", err)
+	}
+	if !s.cfg.RequireVerificationNonce {
+		nonce = ""
+	}
+
+	otpData, err := s.otpRepo.ConsumeIfMatches(ctx, phoneNumber, hash, nonce, s.cfg.MaxAttempts)
+	if errors.Is(err, repository.ErrOTPMismatch) {
+		return otpData, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
+
+// CountryAllowed reports whether OTPs may be sent to phoneNumber's country.
+// Numbers with an unrecognised calling code are only allowed when no
+// allowlist is configured.
+func (s *OTPService) CountryAllowed(phoneNumber string) bool {
+	code, known := phone.CountryCode(phoneNumber)
+	if known && slices.Contains(s.cfg.BlockedCountryCodes, code) {
+		return false
+	}
+
+	allowed := s.cfg.AllowedCountryCodes
+	if len(allowed) == 0 || slices.Contains(allowed, "*") {
+		return true
+	}
+
+	return known && slices.Contains(allowed, code)
+}
+
+// Length returns the number of digits in generated OTPs.
+func (s *OTPService) Length() int {
+	return s.cfg.Length
+}
+
+// GenericVerifyErrors reports whether verification failures should all be
+// reported as INVALID_OR_EXPIRED_OTP.
+func (s *OTPService) GenericVerifyErrors() bool {
+	return s.cfg.GenericVerifyErrors
+}
+
+func generateNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 func (s *OTPService) generateRandomOTP(length int) (string, error) {
 	otp := ""
 	for i := 0; i < length; i++ {
@@ -0,0 +1,846 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qcom/qcom/internal/config"
+	"github.com/qcom/qcom/internal/dynamotest"
+	"github.com/qcom/qcom/internal/metrics"
+	"github.com/qcom/qcom/internal/repository"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const (
+	testPhone  = "+15551234567"
+	otherPhone = "+15557654321"
+)
+
+var testKeys = repository.KeySchema{PK: "PK", SK: "SK"}
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// recordingSender remembers the last OTP sent to each number instead of
+// delivering it.
+type recordingSender struct {
+	mu   sync.Mutex
+	otps map[string]string
+}
+
+func (s *recordingSender) Send(_ context.Context, phoneNumber, otp string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.otps == nil {
+		s.otps = map[string]string{}
+	}
+	s.otps[phoneNumber] = otp
+	return "sms", nil
+}
+
+func (s *recordingSender) last(phoneNumber string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.otps[phoneNumber]
+}
+
+func testOTPConfig() *config.OTPConfig {
+	return &config.OTPConfig{
+		Length:        6,
+		Expiry:        5 * time.Minute,
+		MaxAttempts:   3,
+		Pepper:        "pepper",
+		HashAlgorithm: config.OTPHashHMAC,
+		Reinitiate:    config.OTPReinitiateOverwrite,
+	}
+}
+
+// newTestOTPService returns an OTPService backed by an in-memory DynamoDB.
+func newTestOTPService(t *testing.T, cfg *config.OTPConfig) (*OTPService, *recordingSender, *dynamotest.DB) {
+	t.Helper()
+	db := dynamotest.New(t)
+	db.CreateTable("otps", testKeys.PK, testKeys.SK)
+	db.CreateTable("audit", testKeys.PK, testKeys.SK)
+	db.CreateTable("rate_limits", testKeys.PK, testKeys.SK)
+	svc, sender := otpServiceOn(db, cfg)
+	return svc, sender, db
+}
+
+// otpServiceOn returns an OTPService using the tables newTestOTPService
+// created in db, standing in for another server instance.
+func otpServiceOn(db *dynamotest.DB, cfg *config.OTPConfig) (*OTPService, *recordingSender) {
+	client := db.Client()
+	otpRepo := repository.NewOTPRepository(client, db.Table("otps"), db.Table("audit"), testKeys, testLogger())
+	rateLimitRepo := repository.NewRateLimitRepository(client, db.Table("rate_limits"), testKeys, testLogger())
+	sender := &recordingSender{}
+	return NewOTPService(otpRepo, rateLimitRepo, sender, cfg, testLogger()), sender
+}
+
+// recordSpans installs a tracer provider that records every ended span for
+// the duration of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(prev)
+	})
+	return recorder
+}
+
+func TestOTPSpansNestUnderCaller(t *testing.T) {
+	recorder := recordSpans(t)
+	svc, sender, _ := newTestOTPService(t, testOTPConfig())
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "request")
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	if valid, err := svc.VerifyOTP(ctx, testPhone, sender.last(testPhone), ""); !valid || err != nil {
+		t.Fatalf("VerifyOTP = %v, %v, want true", valid, err)
+	}
+	root.End()
+
+	spans := recorder.Ended()
+	byID := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spans {
+		byID[span.SpanContext().SpanID().String()] = span
+	}
+
+	var services, dynamo int
+	for _, span := range spans {
+		parent := byID[span.Parent().SpanID().String()]
+		switch name := span.Name(); {
+		case name == "OTPService.GenerateOTP" || name == "OTPService.VerifyOTP":
+			services++
+			if parent == nil || parent.Name() != "request" {
+				t.Errorf("%s is not a child of the caller's span", name)
+			}
+		case strings.HasPrefix(name, "DynamoDB."):
+			dynamo++
+			if parent == nil || (parent.Name() != "OTPService.GenerateOTP" && parent.Name() != "OTPService.VerifyOTP") {
+				t.Errorf("%s is not a child of an OTPService span", name)
+			}
+		}
+		if span.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("%s is in trace %s, want %s", span.Name(), span.SpanContext().TraceID(), root.SpanContext().TraceID())
+		}
+	}
+	if services != 2 {
+		t.Errorf("recorded %d OTPService spans, want 2", services)
+	}
+	if dynamo == 0 {
+		t.Error("recorded no DynamoDB spans")
+	}
+}
+
+var hashAlgorithms = []string{config.OTPHashBcrypt, config.OTPHashArgon2id, config.OTPHashHMAC}
+
+func TestVerifyOTPWithPepper(t *testing.T) {
+	for _, algorithm := range hashAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			cfg := testOTPConfig()
+			cfg.HashAlgorithm = algorithm
+			svc, sender, db := newTestOTPService(t, cfg)
+			ctx := context.Background()
+
+			if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+				t.Fatalf("GenerateOTP: %v", err)
+			}
+			otp := sender.last(testPhone)
+
+			// Nothing stored may reveal the code without the pepper.
+			out, err := db.Client().Scan(ctx, &dynamodb.ScanInput{TableName: aws.String(db.Table("otps"))})
+			if err != nil {
+				t.Fatalf("Scan: %v", err)
+			}
+			for _, item := range out.Items {
+				for name, av := range item {
+					if s, ok := av.(*types.AttributeValueMemberS); ok && strings.Contains(s.Value, otp) {
+						t.Errorf("stored attribute %s contains the OTP: %q", name, s.Value)
+					}
+				}
+			}
+
+			if valid, err := svc.VerifyOTP(ctx, testPhone, otp, ""); !valid || err != nil {
+				t.Errorf("VerifyOTP with the right pepper = %v, %v, want true", valid, err)
+			}
+		})
+	}
+}
+
+func TestVerifyOTPWrongPepper(t *testing.T) {
+	for _, algorithm := range hashAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			cfg := testOTPConfig()
+			cfg.HashAlgorithm = algorithm
+			svc, sender, db := newTestOTPService(t, cfg)
+			ctx := context.Background()
+
+			if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+				t.Fatalf("GenerateOTP: %v", err)
+			}
+			otp := sender.last(testPhone)
+
+			other := testOTPConfig()
+			other.HashAlgorithm = algorithm
+			other.Pepper = "another pepper"
+			wrong, _ := otpServiceOn(db, other)
+			if valid, _ := wrong.VerifyOTP(ctx, testPhone, otp, ""); valid {
+				t.Error("VerifyOTP with the wrong pepper accepted the OTP")
+			}
+
+			// An OTP stored without a pepper version is checked against the
+			// configured pepper, so the hash itself must not match either.
+			hash, _, err := svc.hashOTP(ctx, otp)
+			if err != nil {
+				t.Fatalf("hashOTP: %v", err)
+			}
+			if match, _ := wrong.checkOTPHash(ctx, hash, "", otp); match {
+				t.Error("hash made with one pepper matched under another")
+			}
+			if match, err := svc.checkOTPHash(ctx, hash, "", otp); !match || err != nil {
+				t.Errorf("checkOTPHash with the right pepper = %v, %v, want true", match, err)
+			}
+		})
+	}
+}
+
+func TestVerifyOTPConcurrentWrongGuessesLockOut(t *testing.T) {
+	cfg := testOTPConfig()
+	// A locked-out OTP is kept, so every guess past the limit is refused
+	// as locked rather than some finding no OTP.
+	cfg.MaxAttempts = 5
+	cfg.ResetAttemptsOnResend = false
+	svc, sender, _ := newTestOTPService(t, cfg)
+	ctx := context.Background()
+
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	otp := sender.last(testPhone)
+	wrong := "000000"
+	if otp == wrong {
+		wrong = "111111"
+	}
+
+	const guesses = 30
+	var (
+		wg              sync.WaitGroup
+		mu              sync.Mutex
+		invalid, locked int
+	)
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			valid, err := svc.VerifyOTP(ctx, testPhone, wrong, "")
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case valid:
+				t.Error("VerifyOTP accepted a wrong code")
+			case err != nil && err.Error() == "invalid OTP":
+				invalid++
+			case err != nil && err.Error() == "maximum attempts exceeded":
+				locked++
+			default:
+				t.Errorf("VerifyOTP: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Exactly MaxAttempts guesses are compared; every other one is refused.
+	if invalid != cfg.MaxAttempts {
+		t.Errorf("%d guesses were compared, want exactly %d", invalid, cfg.MaxAttempts)
+	}
+	if locked != guesses-cfg.MaxAttempts {
+		t.Errorf("%d guesses were refused, want %d", locked, guesses-cfg.MaxAttempts)
+	}
+	if valid, _ := svc.VerifyOTP(ctx, testPhone, otp, ""); valid {
+		t.Error("the right code was accepted after the lockout")
+	}
+}
+
+// medianDuration returns the median time fn takes over n runs.
+func medianDuration(n int, fn func()) time.Duration {
+	durations := make([]time.Duration, n)
+	for i := range durations {
+		start := time.Now()
+		fn()
+		durations[i] = time.Since(start)
+	}
+	slices.Sort(durations)
+	return durations[n/2]
+}
+
+// A verification that fails before any hash is checked must take about as
+// long as a wrong code, or its speed tells whether an OTP is pending.
+func TestVerifyOTPTimingWithoutPendingOTP(t *testing.T) {
+	cfg := testOTPConfig()
+	cfg.HashAlgorithm = config.OTPHashBcrypt
+	cfg.MaxAttempts = 100
+	svc, sender, _ := newTestOTPService(t, cfg)
+	ctx := context.Background()
+
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	wrong := "000000"
+	if sender.last(testPhone) == wrong {
+		wrong = "111111"
+	}
+
+	pending := medianDuration(5, func() {
+		if valid, _ := svc.VerifyOTP(ctx, testPhone, wrong, ""); valid {
+			t.Fatal("VerifyOTP accepted a wrong code")
+		}
+	})
+	none := medianDuration(5, func() {
+		if valid, _ := svc.VerifyOTP(ctx, otherPhone, wrong, ""); valid {
+			t.Fatal("VerifyOTP accepted a code for a number without a pending OTP")
+		}
+	})
+
+	// bcrypt dominates both, so they differ by far less than the hash
+	// they would differ by without burnOTPCheck.
+	if ratio := float64(none) / float64(pending); ratio < 0.5 || ratio > 2 {
+		t.Errorf("no pending OTP took %v, a wrong code %v; want them within 2x", none, pending)
+	}
+}
+
+// Every algorithm, including HMAC's single conditional write, reports a
+// missing OTP the same way, after the same hash check.
+func TestVerifyOTPWithoutPendingOTP(t *testing.T) {
+	for _, algorithm := range hashAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			cfg := testOTPConfig()
+			cfg.HashAlgorithm = algorithm
+			svc, _, _ := newTestOTPService(t, cfg)
+
+			if valid, err := svc.VerifyOTP(context.Background(), testPhone, "123456", ""); valid || !errors.Is(err, repository.ErrOTPNotFound) {
+				t.Errorf("VerifyOTP without a pending OTP = %v, %v, want ErrOTPNotFound", valid, err)
+			}
+		})
+	}
+}
+
+// wrongCode returns a code of the right length that is not otp.
+func wrongCode(otp string) string {
+	if otp == "000000" {
+		return "111111"
+	}
+	return "000000"
+}
+
+func TestResendInterleavedWithWrongGuesses(t *testing.T) {
+	for _, reset := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ResetAttemptsOnResend=%v", reset), func(t *testing.T) {
+			cfg := testOTPConfig()
+			cfg.ResetAttemptsOnResend = reset
+			svc, sender, _ := newTestOTPService(t, cfg)
+			ctx := context.Background()
+
+			first, err := svc.GenerateOTP(ctx, testPhone)
+			if err != nil {
+				t.Fatalf("GenerateOTP: %v", err)
+			}
+			// One wrong guess per OTP, each followed by a resend: with
+			// attempts carried over, the third uses them up.
+			for i := 0; i < cfg.MaxAttempts; i++ {
+				if valid, _ := svc.VerifyOTP(ctx, testPhone, wrongCode(sender.last(testPhone)), ""); valid {
+					t.Fatal("VerifyOTP accepted a wrong code")
+				}
+				_, err := svc.GenerateOTP(ctx, testPhone)
+				var exhausted *OTPAttemptsExhaustedError
+				switch {
+				case reset && err != nil:
+					t.Fatalf("resend %d: %v", i+1, err)
+				case !reset && i < cfg.MaxAttempts-1 && err != nil:
+					t.Fatalf("resend %d with attempts left: %v", i+1, err)
+				case !reset && i == cfg.MaxAttempts-1:
+					if !errors.As(err, &exhausted) {
+						t.Fatalf("resend with attempts used up = %v, want OTPAttemptsExhaustedError", err)
+					}
+					// Resends do not move the end of the lockout.
+					if want := first.ExpiresAt; exhausted.RetryAt.Sub(want).Abs() > time.Second {
+						t.Errorf("lockout ends at %v, want the first OTP's expiry %v", exhausted.RetryAt, want)
+					}
+				}
+			}
+
+			valid, err := svc.VerifyOTP(ctx, testPhone, sender.last(testPhone), "")
+			if reset && (!valid || err != nil) {
+				t.Errorf("VerifyOTP of the latest code with fresh attempts = %v, %v, want true", valid, err)
+			}
+			if !reset && valid {
+				t.Error("VerifyOTP accepted a code after the attempts were used up")
+			}
+		})
+	}
+}
+
+func TestCarriedAttemptsEndWithFirstOTPsExpiry(t *testing.T) {
+	cfg := testOTPConfig()
+	cfg.ResetAttemptsOnResend = false
+	svc, sender, _ := newTestOTPService(t, cfg)
+	ctx := context.Background()
+
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	for i := 0; i < cfg.MaxAttempts; i++ {
+		svc.VerifyOTP(ctx, testPhone, wrongCode(sender.last(testPhone)), "")
+	}
+	var exhausted *OTPAttemptsExhaustedError
+	if _, err := svc.GenerateOTP(ctx, testPhone); !errors.As(err, &exhausted) {
+		t.Fatalf("GenerateOTP with attempts used up = %v, want OTPAttemptsExhaustedError", err)
+	}
+
+	// Age the run past Expiry while the locked OTP itself, as a later
+	// resend would be, is still unexpired.
+	otpData, err := svc.otpRepo.Get(ctx, testPhone)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	otpData.FirstCreatedAt = time.Now().Add(-cfg.Expiry - time.Second)
+	if err := svc.otpRepo.Store(ctx, testPhone, *otpData); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP after the run's window: %v", err)
+	}
+	if valid, err := svc.VerifyOTP(ctx, testPhone, sender.last(testPhone), ""); !valid || err != nil {
+		t.Errorf("VerifyOTP after the run's window = %v, %v, want true", valid, err)
+	}
+}
+
+// failingSender fails every delivery.
+type failingSender struct{}
+
+func (failingSender) Send(context.Context, string, string) (string, error) {
+	return "", errors.New("provider unavailable")
+}
+
+func TestGenerateOTPDeletesUndeliveredOTP(t *testing.T) {
+	svc, _, _ := newTestOTPService(t, testOTPConfig())
+	svc.sender = failingSender{}
+	ctx := context.Background()
+
+	if _, err := svc.GenerateOTP(ctx, testPhone); err == nil {
+		t.Fatal("GenerateOTP succeeded with delivery failing")
+	}
+	if _, err := svc.otpRepo.Get(ctx, testPhone); !errors.Is(err, repository.ErrOTPNotFound) {
+		t.Errorf("OTP after a failed delivery: %v, want ErrOTPNotFound", err)
+	}
+}
+
+func TestGenerateOTPLength(t *testing.T) {
+	for _, length := range []int{config.MinOTPLength, 6, config.MaxOTPLength} {
+		cfg := testOTPConfig()
+		cfg.Length = length
+		svc, sender, _ := newTestOTPService(t, cfg)
+		ctx := context.Background()
+
+		if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+			t.Fatalf("GenerateOTP: %v", err)
+		}
+		otp := sender.last(testPhone)
+		if len(otp) != length || strings.Trim(otp, "0123456789") != "" {
+			t.Errorf("OTP with length %d = %q, want %d digits", length, otp, length)
+		}
+		if valid, err := svc.VerifyOTP(ctx, testPhone, otp, ""); !valid || err != nil {
+			t.Errorf("VerifyOTP of a %d-digit OTP = %v, %v, want true", length, valid, err)
+		}
+	}
+}
+
+// OTP and token metrics are labelled from fixed sets only, never by phone
+// number or token ID, however many numbers sign in.
+func TestMetricsCarryNoPhoneNumbers(t *testing.T) {
+	svc, sender, _ := newTestOTPService(t, testOTPConfig())
+	jwtService := newTestJWTService(t, testJWTConfig())
+	ctx := context.Background()
+
+	for _, phoneNumber := range []string{testPhone, otherPhone} {
+		if _, err := svc.GenerateOTP(ctx, phoneNumber); err != nil {
+			t.Fatalf("GenerateOTP: %v", err)
+		}
+		svc.VerifyOTP(ctx, phoneNumber, wrongCode(sender.last(phoneNumber)), "")
+		if valid, err := svc.VerifyOTP(ctx, phoneNumber, sender.last(phoneNumber), ""); !valid || err != nil {
+			t.Fatalf("VerifyOTP = %v, %v, want true", valid, err)
+		}
+		if _, _, err := jwtService.GenerateAccessToken("user-1", phoneNumber, time.Now()); err != nil {
+			t.Fatalf("GenerateAccessToken: %v", err)
+		}
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	allowed := map[string][]string{
+		"otp_verify_total":    {metrics.OTPResultSuccess, metrics.OTPResultInvalid, metrics.OTPResultExpired, metrics.OTPResultLocked},
+		"tokens_issued_total": {metrics.TokenTypeAccess, metrics.TokenTypeRefresh},
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if strings.Contains(pair.GetValue(), "555") {
+					t.Errorf("%s has label %s=%q, which holds a phone number", family.GetName(), pair.GetName(), pair.GetValue())
+				}
+				if values, ok := allowed[family.GetName()]; ok && !slices.Contains(values, pair.GetValue()) {
+					t.Errorf("%s has label %s=%q, outside its fixed set", family.GetName(), pair.GetName(), pair.GetValue())
+				}
+			}
+		}
+	}
+}
+
+func TestCountryAllowed(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowed, block []string
+		phone          string
+		want           bool
+	}{
+		{"no lists", nil, nil, "+254712345678", true},
+		{"allowlisted", []string{"1", "254"}, nil, "+254712345678", true},
+		{"not allowlisted", []string{"1"}, nil, "+254712345678", false},
+		{"wildcard", []string{"*"}, nil, "+254712345678", true},
+		{"blocked", nil, []string{"254"}, "+254712345678", false},
+		{"blocked beats allowed", []string{"254"}, []string{"254"}, "+254712345678", false},
+		{"blocked beats wildcard", []string{"*"}, []string{"254"}, "+254712345678", false},
+		{"unknown code, no allowlist", nil, []string{"254"}, "+2801234567", true},
+		{"unknown code, allowlist", []string{"1"}, nil, "+2801234567", false},
+	}
+	for _, tt := range tests {
+		cfg := testOTPConfig()
+		cfg.AllowedCountryCodes, cfg.BlockedCountryCodes = tt.allowed, tt.block
+		svc := NewOTPService(nil, nil, nil, cfg, testLogger())
+		if got := svc.CountryAllowed(tt.phone); got != tt.want {
+			t.Errorf("%s: CountryAllowed(%s) = %v, want %v", tt.name, tt.phone, got, tt.want)
+		}
+	}
+}
+
+// Under the reject policy an unexpired OTP keeps working and no new one is
+// sent until the resend cooldown has passed.
+func TestGenerateOTPRejectsReinitiate(t *testing.T) {
+	cfg := testOTPConfig()
+	cfg.Reinitiate = config.OTPReinitiateReject
+	cfg.ResendCooldown = time.Minute
+	svc, sender, _ := newTestOTPService(t, cfg)
+	ctx := context.Background()
+
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	first := sender.last(testPhone)
+
+	_, err := svc.GenerateOTP(ctx, testPhone)
+	var active *OTPActiveError
+	if !errors.As(err, &active) {
+		t.Fatalf("second GenerateOTP = %v, want OTPActiveError", err)
+	}
+	if wait := time.Until(active.RetryAt); wait <= 0 || wait > time.Minute {
+		t.Errorf("RetryAt is %v away, want within the cooldown", wait)
+	}
+	if !active.ExpiresAt.After(active.RetryAt) {
+		t.Errorf("ExpiresAt %v is not after RetryAt %v", active.ExpiresAt, active.RetryAt)
+	}
+	if valid, err := svc.VerifyOTP(ctx, testPhone, first, ""); !valid || err != nil {
+		t.Errorf("VerifyOTP with the first code = %v, %v, want true", valid, err)
+	}
+}
+
+func TestGenerateOTPReinitiateAfterCooldown(t *testing.T) {
+	cfg := testOTPConfig()
+	cfg.Reinitiate = config.OTPReinitiateReject
+	svc, sender, _ := newTestOTPService(t, cfg)
+	ctx := context.Background()
+
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP with no cooldown: %v", err)
+	}
+	if valid, err := svc.VerifyOTP(ctx, testPhone, sender.last(testPhone), ""); !valid || err != nil {
+		t.Errorf("VerifyOTP with the new code = %v, %v, want true", valid, err)
+	}
+}
+
+// Attempt MaxAttempts is still checked; only the one after it is refused.
+func TestVerifyOTPLastAttemptCounts(t *testing.T) {
+	svc, sender, _ := newTestOTPService(t, testOTPConfig())
+	ctx := context.Background()
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	otp := sender.last(testPhone)
+
+	for i := 1; i < testOTPConfig().MaxAttempts; i++ {
+		if valid, _ := svc.VerifyOTP(ctx, testPhone, wrongCode(otp), ""); valid {
+			t.Fatalf("wrong guess %d accepted", i)
+		}
+	}
+	if valid, err := svc.VerifyOTP(ctx, testPhone, otp, ""); !valid || err != nil {
+		t.Errorf("VerifyOTP on the last attempt = %v, %v, want true", valid, err)
+	}
+}
+
+func TestVerifyOTPRefusedAfterMaxAttempts(t *testing.T) {
+	svc, sender, _ := newTestOTPService(t, testOTPConfig())
+	ctx := context.Background()
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	otp := sender.last(testPhone)
+
+	for i := 0; i < testOTPConfig().MaxAttempts; i++ {
+		svc.VerifyOTP(ctx, testPhone, wrongCode(otp), "")
+	}
+	if valid, _ := svc.VerifyOTP(ctx, testPhone, otp, ""); valid {
+		t.Error("the right code was accepted after MaxAttempts wrong guesses")
+	}
+}
+
+// The global send budget is shared by every number and instance, and test
+// numbers don't use it.
+func TestGenerateOTPGlobalBudget(t *testing.T) {
+	cfg := testOTPConfig()
+	cfg.GlobalRatePerMinute = 1
+	cfg.GlobalBurst = 2
+	cfg.TestNumbers = map[string]string{"+15550000001": "123456"}
+	svc, _, db := newTestOTPService(t, cfg)
+	other, _ := otpServiceOn(db, cfg)
+	ctx := context.Background()
+
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	if _, err := other.GenerateOTP(ctx, otherPhone); err != nil {
+		t.Fatalf("GenerateOTP on another instance: %v", err)
+	}
+	if _, err := svc.GenerateOTP(ctx, "+15559876543"); !errors.Is(err, ErrServiceBusy) {
+		t.Errorf("GenerateOTP over the budget = %v, want ErrServiceBusy", err)
+	}
+	if _, err := svc.GenerateOTP(ctx, "+15550000001"); err != nil {
+		t.Errorf("GenerateOTP for a test number over the budget: %v", err)
+	}
+}
+
+func TestGenerateOTPWhileLocked(t *testing.T) {
+	svc, _, _ := newTestOTPService(t, testOTPConfig())
+	ctx := context.Background()
+
+	token, err := svc.otpRepo.AcquireGenerationLock(ctx, testPhone, time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireGenerationLock: %v", err)
+	}
+	if _, err := svc.GenerateOTP(ctx, testPhone); !errors.Is(err, ErrGenerationInProgress) {
+		t.Fatalf("GenerateOTP while locked = %v, want ErrGenerationInProgress", err)
+	}
+
+	if err := svc.otpRepo.ReleaseGenerationLock(ctx, testPhone, token); err != nil {
+		t.Fatalf("ReleaseGenerationLock: %v", err)
+	}
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Errorf("GenerateOTP after release: %v", err)
+	}
+}
+
+// Of concurrent requests for one number, those that run are serialized, so
+// the code stored is the code last sent.
+func TestGenerateOTPConcurrent(t *testing.T) {
+	svc, sender, _ := newTestOTPService(t, testOTPConfig())
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := svc.GenerateOTP(ctx, testPhone)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	generated := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			generated++
+		case !errors.Is(err, ErrGenerationInProgress):
+			t.Errorf("GenerateOTP = %v, want success or ErrGenerationInProgress", err)
+		}
+	}
+	if generated == 0 {
+		t.Fatal("no request generated an OTP")
+	}
+	if valid, err := svc.VerifyOTP(ctx, testPhone, sender.last(testPhone), ""); !valid || err != nil {
+		t.Errorf("VerifyOTP with the last code sent = %v, %v, want true", valid, err)
+	}
+}
+
+// blockingSender holds each delivery until release is closed, announcing
+// it on started.
+type blockingSender struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSender) Send(_ context.Context, _, _ string) (string, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return "sms", nil
+}
+
+func TestGenerateOTPMaxConcurrentSends(t *testing.T) {
+	cfg := testOTPConfig()
+	cfg.MaxConcurrentSends = 2
+	cfg.SendSlotWait = 20 * time.Millisecond
+	svc, _, _ := newTestOTPService(t, cfg)
+	sender := &blockingSender{started: make(chan struct{}), release: make(chan struct{})}
+	svc.sender = sender
+	ctx := context.Background()
+
+	errs := make(chan error, 2)
+	for _, phone := range []string{testPhone, otherPhone} {
+		go func() {
+			_, err := svc.GenerateOTP(ctx, phone)
+			errs <- err
+		}()
+		<-sender.started
+	}
+
+	if _, err := svc.GenerateOTP(ctx, "+15559876543"); !errors.Is(err, ErrServiceBusy) {
+		t.Errorf("GenerateOTP with every send slot taken = %v, want ErrServiceBusy", err)
+	}
+
+	close(sender.release)
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Errorf("GenerateOTP holding a slot: %v", err)
+		}
+	}
+}
+
+// Failed deliveries give their slot back.
+func TestGenerateOTPReleasesSendSlot(t *testing.T) {
+	cfg := testOTPConfig()
+	cfg.MaxConcurrentSends = 1
+	cfg.SendSlotWait = time.Millisecond
+	svc, _, _ := newTestOTPService(t, cfg)
+	svc.sender = failingSender{}
+	ctx := context.Background()
+
+	for range 3 {
+		if _, err := svc.GenerateOTP(ctx, testPhone); err == nil || errors.Is(err, ErrServiceBusy) {
+			t.Fatalf("GenerateOTP with delivery failing = %v, want the delivery error", err)
+		}
+	}
+	svc.sender = &recordingSender{}
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Errorf("GenerateOTP after failed deliveries: %v", err)
+	}
+}
+
+func TestVerifyOTPNonce(t *testing.T) {
+	for _, algorithm := range []string{config.OTPHashHMAC, config.OTPHashBcrypt} {
+		t.Run(algorithm, func(t *testing.T) {
+			cfg := testOTPConfig()
+			cfg.HashAlgorithm = algorithm
+			cfg.RequireVerificationNonce = true
+			svc, sender, _ := newTestOTPService(t, cfg)
+			ctx := context.Background()
+
+			delivery, err := svc.GenerateOTP(ctx, testPhone)
+			if err != nil {
+				t.Fatalf("GenerateOTP: %v", err)
+			}
+			if delivery.Nonce == "" {
+				t.Fatal("GenerateOTP returned no nonce")
+			}
+			code := sender.last(testPhone)
+
+			// Rejected nonces are not counted as attempts at the code.
+			for _, nonce := range []string{"", "wrong", "", "wrong"} {
+				if _, err := svc.VerifyOTP(ctx, testPhone, code, nonce); !errors.Is(err, ErrInvalidNonce) {
+					t.Errorf("VerifyOTP with nonce %q = %v, want ErrInvalidNonce", nonce, err)
+				}
+			}
+			if valid, err := svc.VerifyOTP(ctx, testPhone, code, delivery.Nonce); !valid || err != nil {
+				t.Fatalf("VerifyOTP with the nonce = %v, %v, want true", valid, err)
+			}
+			if valid, _ := svc.VerifyOTP(ctx, testPhone, code, delivery.Nonce); valid {
+				t.Error("a replayed verification succeeded")
+			}
+		})
+	}
+}
+
+// Of concurrent replays of one verification, exactly one succeeds.
+func TestVerifyOTPNonceConcurrentReplays(t *testing.T) {
+	for _, algorithm := range []string{config.OTPHashHMAC, config.OTPHashBcrypt} {
+		t.Run(algorithm, func(t *testing.T) {
+			cfg := testOTPConfig()
+			cfg.HashAlgorithm = algorithm
+			cfg.RequireVerificationNonce = true
+			cfg.MaxAttempts = 10
+			svc, sender, _ := newTestOTPService(t, cfg)
+			ctx := context.Background()
+
+			delivery, err := svc.GenerateOTP(ctx, testPhone)
+			if err != nil {
+				t.Fatalf("GenerateOTP: %v", err)
+			}
+			code := sender.last(testPhone)
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			succeeded := 0
+			for range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if valid, _ := svc.VerifyOTP(ctx, testPhone, code, delivery.Nonce); valid {
+						mu.Lock()
+						succeeded++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if succeeded != 1 {
+				t.Errorf("%d replays succeeded, want 1", succeeded)
+			}
+		})
+	}
+}
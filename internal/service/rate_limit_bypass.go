@@ -0,0 +1,33 @@
+package service
+
+import (
+	"context"
+
+	"github.com/qcom/qcom/internal/logging"
+	"github.com/sirupsen/logrus"
+)
+
+type rateLimitBypassKey struct{}
+
+// WithRateLimitBypass returns a copy of ctx whose requests skip the
+// per-phone limits. caller names the allowlist entry that matched, for the
+// log line written whenever a limit is skipped. The global send budget
+// still applies.
+func WithRateLimitBypass(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, rateLimitBypassKey{}, caller)
+}
+
+// bypassRateLimit reports whether ctx may skip the limit that was just hit,
+// logging it so that allowlisted traffic stays auditable.
+func (s *OTPService) bypassRateLimit(ctx context.Context, limit, phoneNumber string) bool {
+	caller, ok := ctx.Value(rateLimitBypassKey{}).(string)
+	if !ok {
+		return false
+	}
+	logging.LoggerFromContext(ctx, s.logger).WithFields(logrus.Fields{
+		"limit":  limit,
+		"phone":  logging.LogPhone(phoneNumber),
+		"caller": caller,
+	}).Warn("Rate limit bypassed for allowlisted caller")
+	return true
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qcom/qcom/internal/config"
+)
+
+// An allowlisted caller skips the per-number limits that stop a normal
+// caller.
+func TestRateLimitBypass(t *testing.T) {
+	cfg := testOTPConfig()
+	cfg.Reinitiate = config.OTPReinitiateReject
+	cfg.ResendCooldown = time.Minute
+	cfg.StatusRatePerMinute = 1
+	svc, sender, _ := newTestOTPService(t, cfg)
+	normal := context.Background()
+	allowlisted := WithRateLimitBypass(normal, "key#1")
+
+	for _, phone := range []string{testPhone, otherPhone} {
+		if _, err := svc.GenerateOTP(normal, phone); err != nil {
+			t.Fatalf("GenerateOTP: %v", err)
+		}
+		if _, err := svc.Status(normal, phone); err != nil {
+			t.Fatalf("Status: %v", err)
+		}
+	}
+
+	var active *OTPActiveError
+	if _, err := svc.GenerateOTP(normal, testPhone); !errors.As(err, &active) {
+		t.Errorf("GenerateOTP within the cooldown = %v, want OTPActiveError", err)
+	}
+	if _, err := svc.Status(normal, testPhone); !errors.Is(err, ErrStatusRateLimited) {
+		t.Errorf("Status over the limit = %v, want ErrStatusRateLimited", err)
+	}
+
+	first := sender.last(otherPhone)
+	if _, err := svc.GenerateOTP(allowlisted, otherPhone); err != nil {
+		t.Errorf("allowlisted GenerateOTP within the cooldown: %v", err)
+	}
+	if sender.last(otherPhone) == first {
+		t.Error("allowlisted GenerateOTP within the cooldown sent no new OTP")
+	}
+	if _, err := svc.Status(allowlisted, otherPhone); err != nil {
+		t.Errorf("allowlisted Status over the limit: %v", err)
+	}
+}
+
+// The global send budget protects the SMS bill, so allowlisted callers are
+// held to it too.
+func TestRateLimitBypassKeepsGlobalBudget(t *testing.T) {
+	cfg := testOTPConfig()
+	cfg.GlobalRatePerMinute = 1
+	cfg.GlobalBurst = 1
+	svc, _, _ := newTestOTPService(t, cfg)
+	ctx := WithRateLimitBypass(context.Background(), "cidr:10.0.0.0/8")
+
+	if _, err := svc.GenerateOTP(ctx, testPhone); err != nil {
+		t.Fatalf("GenerateOTP: %v", err)
+	}
+	if _, err := svc.GenerateOTP(ctx, otherPhone); !errors.Is(err, ErrServiceBusy) {
+		t.Errorf("allowlisted GenerateOTP over the global budget = %v, want ErrServiceBusy", err)
+	}
+}
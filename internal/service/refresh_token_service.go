@@ -2,28 +2,52 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/qcom/qcom/internal/logging"
 	"github.com/qcom/qcom/internal/models"
 	"github.com/qcom/qcom/internal/repository"
 	"github.com/sirupsen/logrus"
 )
 
+// ErrTokenStorageFailed is returned by Store in strict mode when the refresh
+// token could not be persisted and so must not be handed out.
+var ErrTokenStorageFailed = errors.New("failed to store refresh token")
+
+// ErrRefreshChainExhausted is returned by CheckRefreshChain when a token
+// family has been refreshed the maximum number of times.
+var ErrRefreshChainExhausted = errors.New("refresh chain limit reached")
+
 type RefreshTokenService struct {
-	tokenRepo *repository.RefreshTokenRepository
-	logger    *logrus.Logger
+	tokenRepo        *repository.RefreshTokenRepository
+	lenientStorage   bool
+	reuseGraceWindow time.Duration
+	maxRefreshChain  int
+	logger           *logrus.Logger
 }
 
-func NewRefreshTokenService(tokenRepo *repository.RefreshTokenRepository, logger *logrus.Logger) *RefreshTokenService {
+// NewRefreshTokenService creates the service. With lenientStorage set, Store
+// logs persistence failures instead of returning them, so callers still issue
+// the token even though it can never be revoked. A positive reuseGraceWindow
+// enables RecordReplacement and Replacement, and a positive maxRefreshChain
+// limits how often a family can be refreshed (see CheckRefreshChain).
+func NewRefreshTokenService(tokenRepo *repository.RefreshTokenRepository, lenientStorage bool, reuseGraceWindow time.Duration, maxRefreshChain int, logger *logrus.Logger) *RefreshTokenService {
 	return &RefreshTokenService{
-		tokenRepo: tokenRepo,
-		logger:    logger,
+		tokenRepo:        tokenRepo,
+		lenientStorage:   lenientStorage,
+		reuseGraceWindow: reuseGraceWindow,
+		maxRefreshChain:  maxRefreshChain,
+		logger:           logger,
 	}
 }
 
-func (s *RefreshTokenService) Store(ctx context.Context, jti, userID, phone, familyID string, expiresAt time.Time) error {
+// Store persists a refresh token. refreshCount is 0 for a token issued at
+// login and one more than its predecessor's for a rotated one. pushToken, if
+// not empty, binds the session to the device's push notification token.
+func (s *RefreshTokenService) Store(ctx context.Context, jti, userID, phone, familyID string, expiresAt time.Time, refreshCount int, pushToken string) error {
 	tokenData := models.RefreshTokenData{
 		JTI:       jti,
 		UserID:    userID,
@@ -32,9 +56,19 @@ func (s *RefreshTokenService) Store(ctx context.Context, jti, userID, phone, fam
 		CreatedAt: time.Now(),
 		ExpiresAt: expiresAt,
 		Revoked:   false,
+
+		RefreshCount: refreshCount,
+		PushToken:    pushToken,
 	}
 
-	return s.tokenRepo.Store(ctx, tokenData)
+	if err := s.tokenRepo.Store(ctx, tokenData); err != nil {
+		if s.lenientStorage {
+			logging.LoggerFromContext(ctx, s.logger).WithError(err).WithField("jti", jti).Warn("Failed to store refresh token, issuing it anyway (lenient mode)")
+			return nil
+		}
+		return fmt.Errorf("%w: %w", ErrTokenStorageFailed, err)
+	}
+	return nil
 }
 
 func (s *RefreshTokenService) Get(ctx context.Context, jti string) (*models.RefreshTokenData, error) {
@@ -47,6 +81,11 @@ func (s *RefreshTokenService) Revoke(ctx context.Context, jti string) error {
 		return err
 	}
 
+	return s.revoke(ctx, tokenData)
+}
+
+func (s *RefreshTokenService) revoke(ctx context.Context, tokenData *models.RefreshTokenData) error {
+	jti := tokenData.JTI
 	tokenData.Revoked = true
 	if err := s.tokenRepo.Store(ctx, *tokenData); err != nil {
 		return fmt.Errorf("failed to revoke refresh token: %w", err)
@@ -60,22 +99,161 @@ func (s *RefreshTokenService) Revoke(ctx context.Context, jti string) error {
 	return nil
 }
 
+// CheckRefreshChain returns ErrRefreshChainExhausted, after revoking the
+// whole family, if rotating tokenData would exceed the configured number of
+// refreshes, so the user has to sign in again however recently the family
+// was used.
+func (s *RefreshTokenService) CheckRefreshChain(ctx context.Context, tokenData *models.RefreshTokenData) error {
+	if s.maxRefreshChain <= 0 || tokenData.RefreshCount < s.maxRefreshChain {
+		return nil
+	}
+
+	if err := s.RevokeFamily(ctx, tokenData.FamilyID); err != nil {
+		logging.LoggerFromContext(ctx, s.logger).WithError(err).WithField("family_id", tokenData.FamilyID).Error("Failed to revoke family at refresh chain limit")
+	}
+	return ErrRefreshChainExhausted
+}
+
 func (s *RefreshTokenService) IsRevoked(ctx context.Context, jti string) (bool, error) {
 	return s.tokenRepo.IsRevoked(ctx, jti)
 }
 
+// RecordReplacement remembers, for the reuse grace window, which refresh
+// token replaced the refresh token jti. It does nothing when the window is
+// disabled.
+func (s *RefreshTokenService) RecordReplacement(ctx context.Context, jti string, replacement models.RefreshTokenReplacement) error {
+	if s.reuseGraceWindow <= 0 {
+		return nil
+	}
+	ttl := replacement.RotatedAt.Add(s.reuseGraceWindow + time.Second)
+	return s.tokenRepo.StoreReplacement(ctx, jti, replacement, ttl)
+}
+
+// Replacement returns the refresh token that replaced the rotated refresh
+// token jti, so a client retrying the rotation can be issued tokens again.
+// It returns nil once the grace window has passed, or if the replacement has
+// itself been rotated or revoked, in which case the retry is a real reuse.
+func (s *RefreshTokenService) Replacement(ctx context.Context, jti string) (*models.RefreshTokenReplacement, error) {
+	if s.reuseGraceWindow <= 0 {
+		return nil, nil
+	}
+
+	replacement, err := s.tokenRepo.GetReplacement(ctx, jti)
+	if err != nil || replacement == nil {
+		return nil, err
+	}
+	// DynamoDB deletes expired items only eventually.
+	if time.Since(replacement.RotatedAt) > s.reuseGraceWindow {
+		return nil, nil
+	}
+
+	revoked, err := s.tokenRepo.IsRevoked(ctx, replacement.JTI)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, nil
+	}
+	return replacement, nil
+}
+
 func (s *RefreshTokenService) RevokeFamily(ctx context.Context, familyID string) error {
 	tokens, err := s.tokenRepo.GetByFamilyID(ctx, familyID)
 	if err != nil {
 		return err
 	}
 
+	if _, _, err := s.revokeAll(ctx, tokens); err != nil {
+		return fmt.Errorf("revoking token family %s: %w", familyID, err)
+	}
+	return nil
+}
+
+// CountActiveSessions returns how many of the user's refresh tokens are
+// neither expired nor revoked. Rotation revokes the token it replaces, so
+// this is the number of signed-in sessions.
+func (s *RefreshTokenService) CountActiveSessions(ctx context.Context, userID string) (int, error) {
+	return s.tokenRepo.CountActiveByUserID(ctx, userID)
+}
+
+// ActiveSessions returns the user's refresh tokens that are neither expired
+// nor revoked, oldest first.
+func (s *RefreshTokenService) ActiveSessions(ctx context.Context, userID string) ([]models.RefreshTokenData, error) {
+	tokens, err := s.tokenRepo.GetByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	active := tokens[:0]
 	for _, token := range tokens {
-		if err := s.Revoke(ctx, token.JTI); err != nil {
-			s.logger.WithError(err).WithField("jti", token.JTI).Error("Failed to revoke token in family")
+		if !token.Revoked && token.ExpiresAt.After(now) {
+			active = append(active, token)
+		}
+	}
+	return active, nil
+}
+
+// RevokeUser revokes every refresh token issued to userID, across all of
+// their sessions. Unlike RevokeFamily it fails if any token could not be
+// revoked, so callers can rely on none of them working afterwards.
+func (s *RefreshTokenService) RevokeUser(ctx context.Context, userID string) error {
+	_, err := s.revokeUser(ctx, userID)
+	return err
+}
+
+// revokeUser implements RevokeUser and also returns how many tokens it
+// revoked.
+func (s *RefreshTokenService) revokeUser(ctx context.Context, userID string) (int, error) {
+	tokens, err := s.tokenRepo.GetByUserID(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked, failed, err := s.revokeAll(ctx, tokens)
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d tokens could not be revoked", failed)
+	}
+	if err != nil {
+		return revoked, fmt.Errorf("revoking tokens of user %s: %w", userID, err)
+	}
+	return revoked, nil
+}
+
+// revokeAll revokes the tokens that are not revoked yet. A token that fails
+// to revoke is logged and skipped; revokeAll returns how many tokens were
+// revoked and how many were skipped.
+func (s *RefreshTokenService) revokeAll(ctx context.Context, tokens []models.RefreshTokenData) (revoked, failed int, err error) {
+	for i := range tokens {
+		// Stop if the caller went away; tokens not yet revoked are picked
+		// up again by the next call.
+		if err := ctx.Err(); err != nil {
+			return revoked, failed, err
+		}
+
+		token := &tokens[i]
+		if token.Revoked {
+			continue
 		}
+		if err := s.revoke(ctx, token); err != nil {
+			logging.LoggerFromContext(ctx, s.logger).WithError(err).WithField("jti", token.JTI).Error("Failed to revoke token")
+			failed++
+			continue
+		}
+		revoked++
+	}
+
+	return revoked, failed, nil
+}
+
+// BackfillFamilyIndex indexes refresh tokens issued before family and user
+// index entries were written, so RevokeFamily and RevokeUser can find them.
+func (s *RefreshTokenService) BackfillFamilyIndex(ctx context.Context) error {
+	count, err := s.tokenRepo.BackfillFamilyIndex(ctx)
+	if err != nil {
+		return err
 	}
 
+	logging.LoggerFromContext(ctx, s.logger).WithField("count", count).Info("Backfilled refresh token family index")
 	return nil
 }
 
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/qcom/qcom/internal/dynamotest"
+	"github.com/qcom/qcom/internal/repository"
+)
+
+// newTestRefreshTokenService returns a RefreshTokenService on the tokens
+// table of an in-memory DynamoDB.
+func newTestRefreshTokenService(t *testing.T) (*RefreshTokenService, *dynamotest.DB) {
+	t.Helper()
+	db := dynamotest.New(t)
+	db.CreateTable("tokens", testKeys.PK, testKeys.SK)
+	repo := repository.NewRefreshTokenRepository(db.Client(), db.Table("tokens"), testKeys, testLogger())
+	return NewRefreshTokenService(repo, false, 0, 0, testLogger()), db
+}
+
+// storeTokens stores n refresh tokens of userID in familyID and returns
+// their JTIs.
+func storeTokens(t *testing.T, svc *RefreshTokenService, userID, familyID string, n int) []string {
+	t.Helper()
+	jtis := make([]string, n)
+	for i := range jtis {
+		jtis[i] = fmt.Sprintf("%s-%d", familyID, i)
+		if err := svc.Store(context.Background(), jtis[i], userID, testPhone, familyID, time.Now().Add(time.Hour), i, ""); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	return jtis
+}
+
+func TestRevokeFamily(t *testing.T) {
+	svc, _ := newTestRefreshTokenService(t)
+	ctx := context.Background()
+	family := storeTokens(t, svc, "user-1", "family-a", 3)
+	other := storeTokens(t, svc, "user-1", "family-b", 2)
+
+	if err := svc.RevokeFamily(ctx, "family-a"); err != nil {
+		t.Fatalf("RevokeFamily: %v", err)
+	}
+	for _, jti := range family {
+		if revoked, err := svc.IsRevoked(ctx, jti); !revoked || err != nil {
+			t.Errorf("IsRevoked(%s) = %v, %v, want true", jti, revoked, err)
+		}
+	}
+	for _, jti := range other {
+		if revoked, err := svc.IsRevoked(ctx, jti); revoked || err != nil {
+			t.Errorf("IsRevoked(%s) of another family = %v, %v, want false", jti, revoked, err)
+		}
+	}
+	if n, err := svc.CountActiveSessions(ctx, "user-1"); err != nil || n != len(other) {
+		t.Errorf("CountActiveSessions = %d, %v, want %d", n, err, len(other))
+	}
+}
+
+// cancelAfterWrites calls cancel once n write requests have completed.
+func cancelAfterWrites(n int, cancel context.CancelFunc) func(*dynamodb.Options) {
+	writes := 0
+	return func(o *dynamodb.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CancelAfterWrites", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				out, metadata, err := next.HandleInitialize(ctx, in)
+				switch in.Parameters.(type) {
+				case *dynamodb.GetItemInput, *dynamodb.QueryInput, *dynamodb.BatchGetItemInput:
+				default:
+					if writes++; writes == n {
+						cancel()
+					}
+				}
+				return out, metadata, err
+			}), middleware.After)
+		})
+	}
+}
+
+// A canceled RevokeFamily stops part way, and a later call revokes the
+// rest.
+func TestRevokeFamilyStopsWhenCanceled(t *testing.T) {
+	svc, db := newTestRefreshTokenService(t)
+	jtis := storeTokens(t, svc, "user-1", "family-a", 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	repo := repository.NewRefreshTokenRepository(db.Client(cancelAfterWrites(4, cancel)), db.Table("tokens"), testKeys, testLogger())
+	canceled := NewRefreshTokenService(repo, false, 0, 0, testLogger())
+	if err := canceled.RevokeFamily(ctx, "family-a"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("RevokeFamily = %v, want context.Canceled", err)
+	}
+
+	revoked := func() int {
+		n := 0
+		for _, jti := range jtis {
+			if ok, err := svc.IsRevoked(context.Background(), jti); err != nil {
+				t.Fatalf("IsRevoked: %v", err)
+			} else if ok {
+				n++
+			}
+		}
+		return n
+	}
+	if n := revoked(); n == 0 || n == len(jtis) {
+		t.Fatalf("%d of %d tokens revoked before the cancellation took effect, want some", n, len(jtis))
+	}
+
+	if err := svc.RevokeFamily(context.Background(), "family-a"); err != nil {
+		t.Fatalf("second RevokeFamily: %v", err)
+	}
+	if n := revoked(); n != len(jtis) {
+		t.Errorf("%d of %d tokens revoked after the second call", n, len(jtis))
+	}
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// StartupCheck is one step of the startup self-test.
+type StartupCheck struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// RunStartupChecks runs every check, logging each one's outcome, and returns
+// the failures joined, or nil if all passed.
+func RunStartupChecks(ctx context.Context, checks []StartupCheck, logger *logrus.Logger) error {
+	var errs []error
+	for _, check := range checks {
+		start := time.Now()
+		err := check.Run(ctx)
+		entry := logger.WithFields(logrus.Fields{
+			"check":       check.Name,
+			"duration_ms": time.Since(start).Milliseconds(),
+		})
+		if err != nil {
+			entry.WithError(err).Error("Startup self-test check failed")
+			errs = append(errs, fmt.Errorf("%s: %w", check.Name, err))
+			continue
+		}
+		entry.Info("Startup self-test check passed")
+	}
+	return errors.Join(errs...)
+}
+
+// SelfTest signs an access token for a placeholder user and verifies it,
+// catching unusable signing keys or secrets.
+func (s *JWTService) SelfTest(context.Context) error {
+	tokenPair, err := s.GenerateAccessTokenOnly("self-test", "+10000000000", time.Now())
+	if err != nil {
+		return err
+	}
+	claims, err := s.VerifyToken(tokenPair.AccessToken)
+	if err != nil {
+		return fmt.Errorf("failed to verify a freshly signed token: %w", err)
+	}
+	if claims.Subject != "self-test" || claims.Type != "access" {
+		return fmt.Errorf("verified token has subject %q and type %q", claims.Subject, claims.Type)
+	}
+	return nil
+}
+
+// SelfTest hashes a random OTP with the configured algorithm and pepper and
+// checks that it verifies and that a different OTP does not.
+func (s *OTPService) SelfTest(ctx context.Context) error {
+	otp, err := s.generateRandomOTP(s.cfg.Length)
+	if err != nil {
+		return fmt.Errorf("failed to generate OTP: %w", err)
+	}
+	hash, version, err := s.hashOTP(ctx, otp)
+	if err != nil {
+		return fmt.Errorf("failed to hash OTP: %w", err)
+	}
+
+	valid, err := s.checkOTPHash(ctx, hash, version, otp)
+	if err != nil {
+		return fmt.Errorf("failed to check OTP hash: %w", err)
+	}
+	if !valid {
+		return errors.New("OTP does not verify against its own hash")
+	}
+
+	wrong := []byte(otp)
+	wrong[0] = '0' + (wrong[0]-'0'+1)%10
+	if valid, _ := s.checkOTPHash(ctx, hash, version, string(wrong)); valid {
+		return errors.New("a different OTP verifies against the hash")
+	}
+	return nil
+}
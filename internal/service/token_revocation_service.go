@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/qcom/qcom/internal/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// TokenRevocationService decides whether a verified token has been revoked.
+// Single tokens are revoked by JTI, e.g. on logout. Tokens are also revoked
+// in bulk by epoch: every token issued at or before the epoch of its phone
+// number, or the global epoch, is rejected. Nothing is stored per token for
+// epochs, so invalidating all of a user's tokens, or every token after a key
+// compromise, is a single write.
+type TokenRevocationService struct {
+	revocationRepo *repository.TokenRevocationRepository
+	logger         *logrus.Logger
+}
+
+func NewTokenRevocationService(revocationRepo *repository.TokenRevocationRepository, logger *logrus.Logger) *TokenRevocationService {
+	return &TokenRevocationService{
+		revocationRepo: revocationRepo,
+		logger:         logger,
+	}
+}
+
+// IsRevoked reports whether the token behind claims has been revoked, by its
+// JTI or by an epoch. Epochs have a resolution of one millisecond, so tokens
+// issued in the same millisecond as the epoch are revoked too.
+func (s *TokenRevocationService) IsRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	return s.isRevoked(ctx, claims, true)
+}
+
+// IsRevokedByEpoch is IsRevoked ignoring revocation of the single token.
+func (s *TokenRevocationService) IsRevokedByEpoch(ctx context.Context, claims *Claims) (bool, error) {
+	return s.isRevoked(ctx, claims, false)
+}
+
+func (s *TokenRevocationService) isRevoked(ctx context.Context, claims *Claims, checkJTI bool) (bool, error) {
+	state, err := s.revocationRepo.Get(ctx, claims.Phone, claims.JTI)
+	if err != nil {
+		return false, err
+	}
+	if checkJTI && state.Revoked {
+		return true, nil
+	}
+
+	epoch := state.UserEpoch
+	if state.GlobalEpoch.After(epoch) {
+		epoch = state.GlobalEpoch
+	}
+	if epoch.IsZero() {
+		return false, nil
+	}
+
+	return claims.IssuedAt == nil || !claims.IssuedAt.After(epoch), nil
+}
+
+// Revoke revokes the single token behind claims until it expires. Revoking
+// a token twice is harmless.
+func (s *TokenRevocationService) Revoke(ctx context.Context, claims *Claims) error {
+	return s.revocationRepo.Revoke(ctx, claims.JTI, claims.ExpiresAt.Time)
+}
+
+// RevokeUserBefore revokes every token of phoneNumber issued at or before
+// t. Epochs only move forward; the epoch in effect afterwards is returned.
+func (s *TokenRevocationService) RevokeUserBefore(ctx context.Context, phoneNumber string, t time.Time) (time.Time, error) {
+	return s.revocationRepo.AdvanceUser(ctx, phoneNumber, t)
+}
+
+// RevokeAllBefore revokes every token issued at or before t, for all users.
+func (s *TokenRevocationService) RevokeAllBefore(ctx context.Context, t time.Time) (time.Time, error) {
+	return s.revocationRepo.AdvanceGlobal(ctx, t)
+}
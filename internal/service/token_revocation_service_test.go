@@ -0,0 +1,204 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/qcom/qcom/internal/dynamotest"
+	"github.com/qcom/qcom/internal/repository"
+)
+
+// revocationServiceOn returns a TokenRevocationService on the tokens table
+// of db, standing in for one server instance.
+func revocationServiceOn(db *dynamotest.DB) *TokenRevocationService {
+	repo := repository.NewTokenRevocationRepository(db.Client(), db.Table("tokens"), testKeys, testLogger())
+	return NewTokenRevocationService(repo, testLogger())
+}
+
+func testClaims(jti string, issuedAt time.Time) *Claims {
+	return &Claims{
+		Phone: testPhone,
+		Type:  "access",
+		JTI:   jti,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(15 * time.Minute)),
+		},
+	}
+}
+
+// A revocation through one instance must be seen by every other instance
+// on its next check, even one that has already checked the token.
+func TestRevocationSeenByOtherInstances(t *testing.T) {
+	db := dynamotest.New(t)
+	db.CreateTable("tokens", testKeys.PK, testKeys.SK)
+	served, other := revocationServiceOn(db), revocationServiceOn(db)
+	ctx := context.Background()
+
+	claims := testClaims("jti-1", time.Now().Add(-time.Minute))
+	if revoked, err := other.IsRevoked(ctx, claims); revoked || err != nil {
+		t.Fatalf("IsRevoked before logout = %v, %v, want false", revoked, err)
+	}
+
+	if err := served.Revoke(ctx, claims); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if revoked, err := other.IsRevoked(ctx, claims); !revoked || err != nil {
+		t.Errorf("IsRevoked on another instance = %v, %v, want true", revoked, err)
+	}
+	if revoked, err := other.IsRevokedByEpoch(ctx, claims); revoked || err != nil {
+		t.Errorf("IsRevokedByEpoch of a token revoked by JTI = %v, %v, want false", revoked, err)
+	}
+	if revoked, err := other.IsRevoked(ctx, testClaims("jti-2", time.Now().Add(-time.Minute))); revoked || err != nil {
+		t.Errorf("IsRevoked of an unrelated token = %v, %v, want false", revoked, err)
+	}
+}
+
+func TestRevokeUserBeforeSeenByOtherInstances(t *testing.T) {
+	db := dynamotest.New(t)
+	db.CreateTable("tokens", testKeys.PK, testKeys.SK)
+	served, other := revocationServiceOn(db), revocationServiceOn(db)
+	ctx := context.Background()
+
+	now := time.Now()
+	before := testClaims("jti-1", now.Add(-time.Minute))
+	after := testClaims("jti-2", now.Add(time.Minute))
+	if revoked, err := other.IsRevoked(ctx, before); revoked || err != nil {
+		t.Fatalf("IsRevoked before revoking the user = %v, %v, want false", revoked, err)
+	}
+
+	if _, err := served.RevokeUserBefore(ctx, testPhone, now); err != nil {
+		t.Fatalf("RevokeUserBefore: %v", err)
+	}
+	if revoked, err := other.IsRevoked(ctx, before); !revoked || err != nil {
+		t.Errorf("IsRevoked of an earlier token on another instance = %v, %v, want true", revoked, err)
+	}
+	if revoked, err := other.IsRevoked(ctx, after); revoked || err != nil {
+		t.Errorf("IsRevoked of a later token = %v, %v, want false", revoked, err)
+	}
+}
+
+// A token issued a millisecond after the epoch outlives it, so rotating
+// sessions can issue new tokens right away.
+func TestEpochMillisecondResolution(t *testing.T) {
+	db := dynamotest.New(t)
+	db.CreateTable("tokens", testKeys.PK, testKeys.SK)
+	svc := revocationServiceOn(db)
+	ctx := context.Background()
+
+	epoch, err := svc.RevokeUserBefore(ctx, testPhone, time.Now())
+	if err != nil {
+		t.Fatalf("RevokeUserBefore: %v", err)
+	}
+	if revoked, err := svc.IsRevoked(ctx, testClaims("jti-1", epoch)); !revoked || err != nil {
+		t.Errorf("IsRevoked of a token issued at the epoch = %v, %v, want true", revoked, err)
+	}
+	if revoked, err := svc.IsRevoked(ctx, testClaims("jti-2", epoch.Add(time.Millisecond))); revoked || err != nil {
+		t.Errorf("IsRevoked of a token issued a millisecond later = %v, %v, want false", revoked, err)
+	}
+}
+
+// Epochs stored in whole seconds, before they had millisecond resolution,
+// still apply.
+func TestEpochInWholeSeconds(t *testing.T) {
+	db := dynamotest.New(t)
+	db.CreateTable("tokens", testKeys.PK, testKeys.SK)
+	svc := revocationServiceOn(db)
+	ctx := context.Background()
+
+	epoch := time.Now().Truncate(time.Second)
+	_, err := db.Client().PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(db.Table("tokens")),
+		Item: map[string]types.AttributeValue{
+			"PK":    &types.AttributeValueMemberS{Value: "TOKEN_EPOCH#" + testPhone},
+			"SK":    &types.AttributeValueMemberS{Value: "METADATA"},
+			"Scope": &types.AttributeValueMemberS{Value: testPhone},
+			"Epoch": &types.AttributeValueMemberN{Value: strconv.FormatInt(epoch.Unix(), 10)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("PutItem: %v", err)
+	}
+
+	if revoked, err := svc.IsRevoked(ctx, testClaims("jti-1", epoch)); !revoked || err != nil {
+		t.Errorf("IsRevoked of a token issued at the epoch = %v, %v, want true", revoked, err)
+	}
+	if revoked, err := svc.IsRevoked(ctx, testClaims("jti-2", epoch.Add(time.Millisecond))); revoked || err != nil {
+		t.Errorf("IsRevoked of a token issued a millisecond later = %v, %v, want false", revoked, err)
+	}
+	if got, err := svc.RevokeUserBefore(ctx, testPhone, epoch.Add(1500*time.Millisecond)); err != nil || !got.Equal(epoch.Add(1500*time.Millisecond)) {
+		t.Errorf("RevokeUserBefore past a whole-second epoch = %v, %v, want it advanced", got, err)
+	}
+}
+
+// otherPhoneClaims is testClaims for a token of another user.
+func otherPhoneClaims(jti string, issuedAt time.Time) *Claims {
+	claims := testClaims(jti, issuedAt)
+	claims.Phone = otherPhone
+	return claims
+}
+
+func TestRevokeAllBefore(t *testing.T) {
+	db := dynamotest.New(t)
+	db.CreateTable("tokens", testKeys.PK, testKeys.SK)
+	served, other := revocationServiceOn(db), revocationServiceOn(db)
+	ctx := context.Background()
+
+	now := time.Now()
+	if _, err := served.RevokeAllBefore(ctx, now); err != nil {
+		t.Fatalf("RevokeAllBefore: %v", err)
+	}
+	for _, claims := range []*Claims{testClaims("jti-1", now.Add(-time.Minute)), otherPhoneClaims("jti-2", now.Add(-time.Minute))} {
+		if revoked, err := other.IsRevokedByEpoch(ctx, claims); !revoked || err != nil {
+			t.Errorf("IsRevokedByEpoch of an earlier token of %s = %v, %v, want true", claims.Phone, revoked, err)
+		}
+	}
+	if revoked, err := other.IsRevoked(ctx, testClaims("jti-3", now.Add(time.Minute))); revoked || err != nil {
+		t.Errorf("IsRevoked of a later token = %v, %v, want false", revoked, err)
+	}
+}
+
+// The later of the user and global epochs applies, and neither moves back.
+func TestUserAndGlobalEpochs(t *testing.T) {
+	db := dynamotest.New(t)
+	db.CreateTable("tokens", testKeys.PK, testKeys.SK)
+	svc := revocationServiceOn(db)
+	ctx := context.Background()
+
+	now := time.Now().Truncate(time.Millisecond)
+	userEpoch, globalEpoch := now.Add(-time.Minute), now.Add(-2*time.Minute)
+	if _, err := svc.RevokeUserBefore(ctx, testPhone, userEpoch); err != nil {
+		t.Fatalf("RevokeUserBefore: %v", err)
+	}
+	if _, err := svc.RevokeAllBefore(ctx, globalEpoch); err != nil {
+		t.Fatalf("RevokeAllBefore: %v", err)
+	}
+
+	for _, tc := range []struct {
+		claims *Claims
+		want   bool
+	}{
+		{testClaims("a", globalEpoch.Add(-time.Second)), true},
+		{testClaims("b", userEpoch.Add(-time.Second)), true},
+		{testClaims("c", userEpoch.Add(time.Second)), false},
+		{otherPhoneClaims("d", globalEpoch.Add(-time.Second)), true},
+		{otherPhoneClaims("e", userEpoch.Add(-time.Second)), false},
+	} {
+		if revoked, err := svc.IsRevoked(ctx, tc.claims); revoked != tc.want || err != nil {
+			t.Errorf("IsRevoked of %s's token issued %v before now = %v, %v, want %v", tc.claims.Phone, now.Sub(tc.claims.IssuedAt.Time), revoked, err, tc.want)
+		}
+	}
+
+	if got, err := svc.RevokeUserBefore(ctx, testPhone, userEpoch.Add(-time.Hour)); err != nil || !got.Equal(userEpoch) {
+		t.Errorf("RevokeUserBefore an earlier time = %v, %v, want the epoch kept at %v", got, err, userEpoch)
+	}
+	if got, err := svc.RevokeAllBefore(ctx, globalEpoch.Add(-time.Hour)); err != nil || !got.Equal(globalEpoch) {
+		t.Errorf("RevokeAllBefore an earlier time = %v, %v, want the epoch kept at %v", got, err, globalEpoch)
+	}
+}
@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/qcom/qcom/internal/config"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/qcom/qcom"
+
+// phoneHashKey keys the phone number digests recorded on spans. It is set
+// by Init; without one no phone attribute is recorded.
+var phoneHashKey []byte
+
+// Init installs the global tracer provider and W3C trace context propagator.
+// When no OTLP endpoint is configured the global no-op provider is kept, so
+// spans cost nothing. The returned function flushes and stops the exporter.
+func Init(ctx context.Context, cfg *config.TracingConfig, logger *logrus.Logger) (func(context.Context) error, error) {
+	phoneHashKey = []byte(cfg.PhoneHashKey)
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if cfg.OTLPEndpoint == "" {
+		logger.Info("Tracing disabled (no OTLP endpoint configured)")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.OTLPEndpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	logger.WithField("endpoint", cfg.OTLPEndpoint).Info("Tracing enabled")
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the service-wide tracer from the global provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// StartDynamoDBSpan starts a client span for a single DynamoDB API call.
+func StartDynamoDBSpan(ctx context.Context, operation, tableName string) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, "DynamoDB."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemDynamoDB,
+			semconv.DBOperation(operation),
+			semconv.AWSDynamoDBTableNames(tableName),
+		),
+	)
+}
+
+// PhoneAttributes returns a span attribute carrying an HMAC of the phone
+// number keyed by TracingConfig.PhoneHashKey, so traces can be correlated
+// without exposing the number. Phone numbers are few enough that an unkeyed
+// digest is reversed by trying them all, so with no key it returns none.
+func PhoneAttributes(phoneNumber string) []attribute.KeyValue {
+	if len(phoneHashKey) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, phoneHashKey)
+	mac.Write([]byte(phoneNumber))
+	return []attribute.KeyValue{attribute.String("phone.hash", hex.EncodeToString(mac.Sum(nil)[:8]))}
+}
+
+// EndSpan records err on the span, if any, and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,42 @@
+package tracing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPhoneAttributesKeyed(t *testing.T) {
+	phoneHashKey = []byte("secret")
+	t.Cleanup(func() { phoneHashKey = nil })
+
+	attrs := PhoneAttributes("+15551234567")
+	if len(attrs) != 1 {
+		t.Fatalf("PhoneAttributes returned %d attributes, want 1", len(attrs))
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("+15551234567"))
+	want := hex.EncodeToString(mac.Sum(nil)[:8])
+	if got := attrs[0].Value.AsString(); got != want {
+		t.Errorf("phone.hash = %q, want %q", got, want)
+	}
+
+	unkeyed := sha256.Sum256([]byte("+15551234567"))
+	if attrs[0].Value.AsString() == hex.EncodeToString(unkeyed[:8]) {
+		t.Error("phone.hash is an unkeyed digest of the number")
+	}
+
+	phoneHashKey = []byte("other")
+	if got := PhoneAttributes("+15551234567")[0].Value.AsString(); got == want {
+		t.Error("phone.hash does not depend on the key")
+	}
+}
+
+func TestPhoneAttributesWithoutKey(t *testing.T) {
+	phoneHashKey = nil
+	if attrs := PhoneAttributes("+15551234567"); len(attrs) != 0 {
+		t.Errorf("PhoneAttributes without a key = %v, want none", attrs)
+	}
+}
@@ -0,0 +1,30 @@
+package version
+
+import (
+	"encoding/json"
+	"runtime"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	prev := Version
+	Version = "v1.2.0"
+	t.Cleanup(func() { Version = prev })
+
+	info := Get()
+	if info.Version != "v1.2.0" || info.Commit != Commit || info.GoVersion != runtime.Version() {
+		t.Errorf("Get = %+v, want the linked version and the running Go version", info)
+	}
+
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var fields map[string]string
+	json.Unmarshal(encoded, &fields)
+	for _, key := range []string{"version", "commit", "build_time", "go_version"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("JSON %s has no %q", encoded, key)
+		}
+	}
+}
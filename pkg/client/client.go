@@ -0,0 +1,232 @@
+// Package client is a typed Go client for the QCom authentication API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qcom/qcom/internal/apierror"
+)
+
+// Code is a machine-readable error code from the API error catalog.
+type Code = apierror.Code
+
+// APIError is returned for any non-2xx response from the API.
+type APIError struct {
+	Status  int
+	Code    Code
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("qcom: %s (%d): %s", e.Code, e.Status, e.Message)
+}
+
+// IsCode reports whether err is an APIError with the given code.
+func IsCode(err error, code Code) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+type Config struct {
+	BaseURL string
+	Timeout time.Duration
+
+	// HTTPClient overrides the default client. Timeout is ignored when set.
+	HTTPClient *http.Client
+}
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+}
+
+func NewClient(cfg Config) *Client {
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		timeout := cfg.Timeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		httpClient = &http.Client{Timeout: timeout}
+	}
+
+	return &Client{
+		baseURL:    strings.TrimRight(cfg.BaseURL, "/"),
+		httpClient: httpClient,
+	}
+}
+
+type User struct {
+	UserID      string `json:"user_id"`
+	PhoneNumber string `json:"phone_number"`
+	Name        string `json:"name,omitempty"`
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	User         *User  `json:"user,omitempty"`
+}
+
+type MeResponse struct {
+	PhoneNumber    string    `json:"phone_number"`
+	Name           string    `json:"name"`
+	CreatedAt      time.Time `json:"created_at"`
+	ActiveSessions int       `json:"active_sessions"`
+}
+
+// SetTokens sets the token pair used for authenticated calls.
+func (c *Client) SetTokens(accessToken, refreshToken string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.accessToken = accessToken
+	c.refreshToken = refreshToken
+}
+
+// Tokens returns the current token pair.
+func (c *Client) Tokens() (accessToken, refreshToken string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.accessToken, c.refreshToken
+}
+
+func (c *Client) InitiateOTP(ctx context.Context, phoneNumber string) error {
+	body := map[string]string{"phone_number": phoneNumber}
+	return c.do(ctx, http.MethodPost, "/api/v1/auth/initiate-otp", "", body, nil)
+}
+
+// VerifyOTP exchanges an OTP for tokens and stores them on the client.
+func (c *Client) VerifyOTP(ctx context.Context, phoneNumber, otp string) (*TokenResponse, error) {
+	body := map[string]string{"phone_number": phoneNumber, "otp": otp}
+
+	var resp TokenResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/auth/verify-otp", "", body, &resp); err != nil {
+		return nil, err
+	}
+
+	c.SetTokens(resp.AccessToken, resp.RefreshToken)
+	return &resp, nil
+}
+
+// Refresh rotates the stored refresh token and stores the new pair.
+func (c *Client) Refresh(ctx context.Context) (*TokenResponse, error) {
+	_, refreshToken := c.Tokens()
+	body := map[string]string{"refresh_token": refreshToken}
+
+	var resp TokenResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/auth/refresh", "", body, &resp); err != nil {
+		return nil, err
+	}
+
+	c.SetTokens(resp.AccessToken, resp.RefreshToken)
+	return &resp, nil
+}
+
+// Logout revokes the stored access and refresh tokens and clears them.
+func (c *Client) Logout(ctx context.Context) error {
+	_, refreshToken := c.Tokens()
+	body := map[string]string{"refresh_token": refreshToken}
+
+	if err := c.doAuthenticated(ctx, http.MethodPost, "/api/v1/auth/logout", body, nil); err != nil {
+		return err
+	}
+
+	c.SetTokens("", "")
+	return nil
+}
+
+func (c *Client) Me(ctx context.Context) (*MeResponse, error) {
+	var resp MeResponse
+	if err := c.doAuthenticated(ctx, http.MethodGet, "/api/v1/me", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// doAuthenticated performs an authenticated call, refreshing the token pair
+// and retrying once if the access token is rejected.
+func (c *Client) doAuthenticated(ctx context.Context, method, path string, body, out interface{}) error {
+	accessToken, refreshToken := c.Tokens()
+
+	err := c.do(ctx, method, path, accessToken, body, out)
+	if refreshToken == "" || !IsCode(err, apierror.CodeUnauthorized) {
+		return err
+	}
+
+	if _, refreshErr := c.Refresh(ctx); refreshErr != nil {
+		return err
+	}
+
+	accessToken, _ = c.Tokens()
+	return c.do(ctx, method, path, accessToken, body, out)
+}
+
+func (c *Client) do(ctx context.Context, method, path, accessToken string, body, out interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, &reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Servers running with PROBLEM_DETAILS send RFC 7807 bodies, which
+		// carry the code as a top-level extension member.
+		var errResp struct {
+			apierror.Response
+			Code   Code   `json:"code"`
+			Detail string `json:"detail"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+
+		apiErr := &APIError{
+			Status:  resp.StatusCode,
+			Code:    errResp.Error.Code,
+			Message: errResp.Error.Message,
+		}
+		if apiErr.Code == "" {
+			apiErr.Code = errResp.Code
+			apiErr.Message = errResp.Detail
+		}
+		return apiErr
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+
+	return nil
+}
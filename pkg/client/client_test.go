@@ -0,0 +1,138 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qcom/qcom/internal/apierror"
+)
+
+// fakeAPI serves the routes the client calls. It accepts the access token
+// "access-2" only, so a client holding "access-1" has to refresh first.
+func fakeAPI(t *testing.T) (*httptest.Server, *int) {
+	t.Helper()
+	refreshes := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/auth/verify-otp", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["otp"] != "123456" {
+			apierror.Write(w, r, apierror.CodeInvalidOTP, "Invalid or expired OTP")
+			return
+		}
+		json.NewEncoder(w).Encode(TokenResponse{AccessToken: "access-1", RefreshToken: "refresh-1", TokenType: "Bearer"})
+	})
+	mux.HandleFunc("POST /api/v1/auth/refresh", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["refresh_token"] != "refresh-1" {
+			apierror.Write(w, r, apierror.CodeInvalidToken, "Invalid refresh token")
+			return
+		}
+		refreshes++
+		json.NewEncoder(w).Encode(TokenResponse{AccessToken: "access-2", RefreshToken: "refresh-2", TokenType: "Bearer"})
+	})
+	mux.HandleFunc("GET /api/v1/me", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-2" {
+			apierror.Write(w, r, apierror.CodeUnauthorized, "Invalid or expired token")
+			return
+		}
+		json.NewEncoder(w).Encode(MeResponse{PhoneNumber: "+15551234567", ActiveSessions: 1})
+	})
+	mux.HandleFunc("POST /api/v1/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &refreshes
+}
+
+func TestVerifyOTPStoresTokens(t *testing.T) {
+	server, _ := fakeAPI(t)
+	c := NewClient(Config{BaseURL: server.URL + "/"})
+
+	resp, err := c.VerifyOTP(context.Background(), "+15551234567", "123456")
+	if err != nil {
+		t.Fatalf("VerifyOTP: %v", err)
+	}
+	access, refresh := c.Tokens()
+	if access != resp.AccessToken || refresh != resp.RefreshToken || access == "" {
+		t.Errorf("Tokens() = %q, %q, want the pair VerifyOTP returned", access, refresh)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	server, _ := fakeAPI(t)
+	c := NewClient(Config{BaseURL: server.URL})
+
+	_, err := c.VerifyOTP(context.Background(), "+15551234567", "000000")
+	if !IsCode(err, apierror.CodeInvalidOTP) {
+		t.Fatalf("VerifyOTP with a wrong OTP = %v, want INVALID_OTP", err)
+	}
+	if apiErr := err.(*APIError); apiErr.Status != http.StatusUnauthorized || apiErr.Message == "" {
+		t.Errorf("APIError = %+v, want status 401 and a message", apiErr)
+	}
+}
+
+func TestAPIErrorFromProblemDetails(t *testing.T) {
+	apierror.UseProblemDetails(true)
+	t.Cleanup(func() { apierror.UseProblemDetails(false) })
+	server, _ := fakeAPI(t)
+	c := NewClient(Config{BaseURL: server.URL})
+
+	_, err := c.VerifyOTP(context.Background(), "+15551234567", "000000")
+	if !IsCode(err, apierror.CodeInvalidOTP) {
+		t.Fatalf("VerifyOTP with a wrong OTP = %v, want INVALID_OTP", err)
+	}
+	if apiErr := err.(*APIError); apiErr.Message == "" {
+		t.Errorf("APIError = %+v, want the problem's detail as its message", apiErr)
+	}
+}
+
+// A rejected access token is refreshed and the call retried once.
+func TestAuthenticatedCallRefreshes(t *testing.T) {
+	server, refreshes := fakeAPI(t)
+	c := NewClient(Config{BaseURL: server.URL})
+	c.SetTokens("access-1", "refresh-1")
+
+	me, err := c.Me(context.Background())
+	if err != nil {
+		t.Fatalf("Me: %v", err)
+	}
+	if me.PhoneNumber != "+15551234567" {
+		t.Errorf("Me = %+v", me)
+	}
+	if *refreshes != 1 {
+		t.Errorf("refreshed %d times, want 1", *refreshes)
+	}
+	if access, refresh := c.Tokens(); access != "access-2" || refresh != "refresh-2" {
+		t.Errorf("Tokens() = %q, %q, want the refreshed pair", access, refresh)
+	}
+}
+
+// When the refresh fails too, the original error is returned.
+func TestAuthenticatedCallRefreshFails(t *testing.T) {
+	server, _ := fakeAPI(t)
+	c := NewClient(Config{BaseURL: server.URL})
+	c.SetTokens("access-1", "stale")
+
+	if _, err := c.Me(context.Background()); !IsCode(err, apierror.CodeUnauthorized) {
+		t.Errorf("Me with a stale refresh token = %v, want UNAUTHORIZED", err)
+	}
+}
+
+func TestLogoutClearsTokens(t *testing.T) {
+	server, _ := fakeAPI(t)
+	c := NewClient(Config{BaseURL: server.URL})
+	c.SetTokens("access-2", "refresh-2")
+
+	if err := c.Logout(context.Background()); err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+	if access, refresh := c.Tokens(); access != "" || refresh != "" {
+		t.Errorf("Tokens() after Logout = %q, %q, want none", access, refresh)
+	}
+}